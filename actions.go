@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/minio/pkg/env"
+)
+
+var (
+	// enforcementWebhookURL is where the webhook action POSTs the violations to as JSON
+	enforcementWebhookURL       = env.Get("ENFORCEMENT_WEBHOOK_URL", "")
+	enforcementWebhookAuthToken = env.Get("ENFORCEMENT_WEBHOOK_AUTH_TOKEN", "")
+
+	enforcementWebhookClient = &http.Client{Timeout: 5 * time.Second}
+
+	// enforcementActions are the actions taken by name
+	enforcementActions = map[string]EnforcementAction{
+		"reject":  rejectAction{},
+		"notify":  notifyAction{},
+		"tag":     tagAction{},
+		"delete":  deleteAction{},
+		"webhook": webhookAction{},
+	}
+
+	// defaultPolicy is the policy of the users without one of their own; by ENFORCEMENT_ACTIONS,
+	// or else by ENFORCEMENT_MODE
+	defaultPolicy enforcementPolicy
+	// userPolicies are the policies of the users configured by ENFORCEMENT_USER_ACTIONS
+	userPolicies map[string]enforcementPolicy
+)
+
+// EnforcementAction is a consequence of an update going over the limit of the user
+type EnforcementAction interface {
+	// Rejects returns true if the update is rejected instead of recorded in the quota
+	Rejects() bool
+	// Apply takes the action on the violation; the error, if any, answers the update
+	Apply(ctx context.Context, v *violation) error
+}
+
+// violation represents an update going over the limit of the user
+type violation struct {
+	event notification.Event
+	qe    *quotaEvent
+	// recorded is true if the update was recorded in the quota nevertheless
+	recorded bool
+	// actions are the names of the actions taken
+	actions []string
+}
+
+// enforcementPolicy is the list of the actions taken on a violation, in order
+type enforcementPolicy struct {
+	names   []string
+	actions []EnforcementAction
+}
+
+// rejects returns true if any of the actions rejects the update
+func (p enforcementPolicy) rejects() bool {
+	for _, action := range p.actions {
+		if action.Rejects() {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePolicy parses the comma separated action names
+func parsePolicy(value string) (policy enforcementPolicy, err error) {
+	for _, name := range parseList(value) {
+		action, ok := enforcementActions[name]
+		if !ok {
+			return policy, fmt.Errorf("unknown enforcement action '%v'", name)
+		}
+		if name == "webhook" && enforcementWebhookURL == "" {
+			return policy, errors.New("ENFORCEMENT_WEBHOOK_URL env is not set for the webhook action")
+		}
+		policy.names = append(policy.names, name)
+		policy.actions = append(policy.actions, action)
+	}
+	if len(policy.actions) == 0 {
+		return policy, errors.New("no enforcement actions")
+	}
+	return policy, nil
+}
+
+// loadEnforcementPolicies reads the default policy, the ';' separated USER=ACTIONS policies
+// of the users and the MONITOR_USERS, by their canonical names
+func loadEnforcementPolicies() (err error) {
+	monitorUsers = nil
+	for _, user := range parseList(env.Get("MONITOR_USERS", "")) {
+		monitorUsers = append(monitorUsers, canonicalUser(user))
+	}
+	value := env.Get("ENFORCEMENT_ACTIONS", "")
+	if value == "" {
+		switch enforcementMode {
+		case enforcementModeMonitor:
+			value = "notify"
+		case enforcementModeTag:
+			value = "tag"
+		case enforcementModeDelete:
+			value = "delete"
+		default:
+			value = "reject"
+		}
+	}
+	if defaultPolicy, err = parsePolicy(value); err != nil {
+		return fmt.Errorf("invalid ENFORCEMENT_ACTIONS %v; %v", value, err)
+	}
+	userPolicies = map[string]enforcementPolicy{}
+	for _, entry := range strings.Split(env.Get("ENFORCEMENT_USER_ACTIONS", ""), ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		user, actions, ok := strings.Cut(entry, "=")
+		if !ok || user == "" {
+			return fmt.Errorf("invalid ENFORCEMENT_USER_ACTIONS entry %v", entry)
+		}
+		policy, err := parsePolicy(actions)
+		if err != nil {
+			return fmt.Errorf("invalid ENFORCEMENT_USER_ACTIONS entry %v; %v", entry, err)
+		}
+		userPolicies[canonicalUser(user)] = policy
+	}
+	return nil
+}
+
+// policyOf returns the enforcement policy of the user; the users of MONITOR_USERS are only notified
+func policyOf(user string) enforcementPolicy {
+	if policy, ok := userPolicies[user]; ok {
+		return policy
+	}
+	for _, monitorUser := range monitorUsers {
+		if monitorUser == user {
+			return enforcementPolicy{names: []string{"notify"}, actions: []EnforcementAction{notifyAction{}}}
+		}
+	}
+	return defaultPolicy
+}
+
+// enforce takes the actions of the policy of the user on the update going over the limit
+func enforce(ctx context.Context, event notification.Event, qe *quotaEvent, err error) error {
+	policy := policyOf(qe.User)
+	v := &violation{
+		event:    event,
+		qe:       qe,
+		recorded: errors.Is(err, errOverLimitMonitored),
+		actions:  policy.names,
+	}
+	var answer error
+	for _, action := range policy.actions {
+		if err := action.Apply(ctx, v); err != nil && answer == nil {
+			answer = err
+		}
+	}
+	switch {
+	case v.recorded:
+		countEvent("over_limit")
+		return nil
+	case errors.Is(answer, errOverLimitDeleted):
+		countEvent("deleted")
+	default:
+		countEvent("rejected")
+	}
+	if answer != nil {
+		return answer
+	}
+	return fmt.Errorf("unable to update quota; %w", err)
+}
+
+// rejectAction rejects the update
+type rejectAction struct{}
+
+func (rejectAction) Rejects() bool { return true }
+
+func (rejectAction) Apply(ctx context.Context, v *violation) error { return nil }
+
+// notifyAction sends an over_limit alert
+type notifyAction struct{}
+
+func (notifyAction) Rejects() bool { return false }
+
+func (notifyAction) Apply(ctx context.Context, v *violation) error {
+	outcome := "rejected"
+	if v.recorded {
+		outcome = "recorded"
+	}
+	logf(ctx, "WARNING", "", "user '%v' went over the limit with '%v'; %v", v.qe.User, v.qe.Path, outcome)
+	sendAlert(ctx, alert{
+		Type:    "over_limit",
+		User:    v.qe.User,
+		Message: fmt.Sprintf("user %v went over the limit with %v; %v", v.qe.User, v.qe.Path, outcome),
+	})
+	return nil
+}
+
+// tagAction tags the object with OVER_LIMIT_TAG on the site it was uploaded to
+type tagAction struct{}
+
+func (tagAction) Rejects() bool { return false }
+
+func (tagAction) Apply(ctx context.Context, v *violation) error {
+	tagOverLimit(ctx, v.event, v.qe)
+	return nil
+}
+
+// deleteAction rejects the update and deletes the object on all the sites
+type deleteAction struct{}
+
+func (deleteAction) Rejects() bool { return true }
+
+func (deleteAction) Apply(ctx context.Context, v *violation) error {
+	return deleteOverLimit(ctx, v.qe)
+}
+
+// webhookAction POSTs the violation to ENFORCEMENT_WEBHOOK_URL
+type webhookAction struct{}
+
+// violationNotice represents the violation POSTed by the webhook action
+type violationNotice struct {
+	User     string    `json:"user"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Site     string    `json:"site,omitempty"`
+	Recorded bool      `json:"recorded"`
+	Actions  []string  `json:"actions"`
+	Time     time.Time `json:"time"`
+}
+
+func (webhookAction) Rejects() bool { return false }
+
+func (webhookAction) Apply(ctx context.Context, v *violation) error {
+	notice := violationNotice{
+		User:     v.qe.User,
+		Path:     v.qe.Path,
+		Size:     v.qe.Size,
+		Site:     eventOrigin(v.event),
+		Recorded: v.recorded,
+		Actions:  v.actions,
+		Time:     time.Now().UTC(),
+	}
+	if err := postJSON(ctx, enforcementWebhookClient, enforcementWebhookURL, enforcementWebhookAuthToken, notice); err != nil {
+		// the violation is already enforced by the other actions
+		logf(ctx, "WARNING", "", "unable to POST the violation of user '%v' to the enforcement webhook; %v", v.qe.User, err)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// GET /admin/status
+//
+// - Probes the configured sites for reachability and latency
+// - Returns the uptime, version, configured buckets and the results of the last refresh/purge/sync runs
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getStatus(ctx))
+}
+
+// GET /ready
+//
+//   - Returns the readiness of each site; ready, initializing (unreachable on startup and being
+//     connected in the background) or quarantined
+//   - Returns 503 until at least one site is ready
+//   - Names the replica in the X-Quota-Server-Node header, for its peers
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	states := make(map[string]string, len(sites))
+	ready := false
+	for _, site := range sites {
+		switch {
+		case site.InitError() != nil:
+			states[site.name] = "initializing"
+		case site.Quarantined():
+			states[site.name] = "quarantined"
+		default:
+			states[site.name] = "ready"
+			ready = true
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if nodeName != "" {
+		w.Header().Set(nodeHeader, nodeName)
+	}
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(states)
+}
+
+// GET /admin/jobs
+//
+// - Returns the progress of the running and the last refresh jobs on each site
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs.get())
+}
+
+// POST /admin/sites/{name}/reconnect
+//
+// - Rebuilds the s3 client of the site, re-resolving DNS and reloading the certificates
+// - Re-validates the existence of the buckets on the site
+func reconnectHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	name := mux.Vars(r)["name"]
+	site := findSite(name)
+	if site == nil {
+		http.Error(w, fmt.Sprintf("site %v is not configured", name), http.StatusNotFound)
+		return
+	}
+	if err := site.connect(ctx); err != nil {
+		logf(ctx, "ERROR", name, "unable to reconnect; %v", err)
+		http.Error(w, fmt.Sprintf("unable to reconnect to site %v; %v", name, err), http.StatusInternalServerError)
+		return
+	}
+	logf(ctx, "LOG", name, "reconnected to %v", site.Client().EndpointURL().Host)
+}
+
+// DELETE /admin/cache/{user}
+//
+// - Drops the cached limit of the user, so that the next lookup goes to the limit providers
+func invalidateCacheHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	user := mux.Vars(r)["user"]
+	invalidateLimit(user)
+	logf(ctx, "LOG", "", "invalidated the cached limit of user '%v'", user)
+}
+
+// GET /admin/blocklist
+//
+// - Returns the blocked users
+func blocklistHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blocked.get())
+}
+
+// PUT /admin/blocklist/{user}?reason=...
+//
+// - Adds the user to the blocklist on all the sites
+// - The update events of the user are rejected and the checks return forbidden until unblocked
+func blockUserHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	user := mux.Vars(r)["user"]
+	entry := blockEntry{
+		Reason:    r.URL.Query().Get("reason"),
+		BlockedAt: time.Now().UTC(),
+	}
+	if err := updateBlocklist(ctx, func(users map[string]blockEntry) {
+		users[user] = entry
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("unable to block user %v; %v", user, err), http.StatusInternalServerError)
+		return
+	}
+	logf(ctx, "LOG", "", "blocked user '%v'", user)
+}
+
+// DELETE /admin/blocklist/{user}
+//
+// - Removes the user from the blocklist on all the sites
+func unblockUserHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	user := mux.Vars(r)["user"]
+	if err := updateBlocklist(ctx, func(users map[string]blockEntry) {
+		delete(users, user)
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("unable to unblock user %v; %v", user, err), http.StatusInternalServerError)
+		return
+	}
+	logf(ctx, "LOG", "", "unblocked user '%v'", user)
+}
+
+// POST /quota/{user}/suspend?until=2024-01-31T00:00:00Z
+//
+//   - Suspends the user on all the sites until the provided time
+//   - The update events of the user are rejected and the checks return forbidden until then,
+//     after which the enforcement returns to normal
+func suspendUserHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	user := mux.Vars(r)["user"]
+	value := r.URL.Query().Get("until")
+	until, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid until '%v'; %v", value, err), http.StatusBadRequest)
+		return
+	}
+	if !until.After(time.Now()) {
+		http.Error(w, fmt.Sprintf("until '%v' is in the past", value), http.StatusBadRequest)
+		return
+	}
+	until = until.UTC()
+	entry := blockEntry{
+		Reason:    r.URL.Query().Get("reason"),
+		BlockedAt: time.Now().UTC(),
+		Until:     &until,
+	}
+	if err := updateBlocklist(ctx, func(users map[string]blockEntry) {
+		users[user] = entry
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("unable to suspend user %v; %v", user, err), http.StatusInternalServerError)
+		return
+	}
+	logf(ctx, "LOG", "", "suspended user '%v' until %v", user, until.Format(time.RFC3339))
+}
+
+// POST /admin/tokens/{user}
+//
+// - Issues the token the user authenticates with on the self-service endpoints
+func issueTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if userTokenSecret == "" {
+		http.Error(w, "USER_TOKEN_SECRET env is not set", http.StatusBadRequest)
+		return
+	}
+	user := mux.Vars(r)["user"]
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"token": issueUserToken(user)})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/pkg/env"
+	"github.com/rs/xid"
+)
+
+const (
+	// archivePrefix is where the received notification payloads are archived in the quota bucket,
+	// as archive/DATE/HOUR/ID.json.gz
+	archivePrefix = "archive/"
+	// archiveRequestIDKey is the user metadata of the archived payloads holding the id of the
+	// request which delivered them
+	archiveRequestIDKey = "Quota-Request-Id"
+)
+
+// archiveNotifications archives every accepted notification payload before processing it
+var archiveNotifications = env.Get("ARCHIVE_NOTIFICATIONS", "off") == "on"
+
+func archiveKey(t time.Time, id string) string {
+	return fmt.Sprintf("%v%v/%02d/%v.json.gz", archivePrefix, t.Format(dateFormat), t.Hour(), id)
+}
+
+// archivePayload writes the compressed payload to the first site which takes it, in the
+// order of the read preference
+func archivePayload(ctx context.Context, body []byte) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	// generated, as the request ids are supplied by the clients and two payloads must never
+	// overwrite each other
+	key := archiveKey(time.Now().UTC(), xid.New().String())
+	opts := minio.PutObjectOptions{
+		ContentType:     "application/json",
+		ContentEncoding: "gzip",
+	}
+	if id := traceFromContext(ctx).RequestID; id != "" {
+		opts.UserMetadata = map[string]string{archiveRequestIDKey: id}
+	}
+	err := errors.New("no sites configured")
+	for _, site := range readOrder() {
+		if site.Client() == nil {
+			continue
+		}
+		_, err = site.Client().PutObject(ctx, quotaBucket, key, bytes.NewReader(buf.Bytes()), int64(buf.Len()), opts)
+		if err == nil {
+			return nil
+		}
+		logf(ctx, "WARNING", site.name, "unable to archive the notification as '%v'; trying the next site; %v", key, err)
+	}
+	return err
+}
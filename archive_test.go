@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestArchivePayloadsOfSameRequestID(t *testing.T) {
+	setupTestSites(t, 1)
+	ctx := withTrace(context.Background(), traceInfo{RequestID: "same"})
+	for _, body := range []string{`{"Records":[]}`, `{"Records":[{}]}`} {
+		if err := archivePayload(ctx, []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var keys []string
+	for object := range sites[0].Client().ListObjects(ctx, quotaBucket, minio.ListObjectsOptions{Prefix: archivePrefix, Recursive: true}) {
+		if object.Err != nil {
+			t.Fatal(object.Err)
+		}
+		if strings.Contains(object.Key, "same") {
+			t.Errorf("expected the key generated by the server, got %v", object.Key)
+		}
+		keys = append(keys, object.Key)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 archived payloads, got %v", keys)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minio/pkg/env"
+)
+
+const (
+	timestampHeader = "X-Quota-Timestamp"
+	nonceHeader     = "X-Quota-Nonce"
+	signatureHeader = "X-Quota-Signature"
+)
+
+var (
+	// requireSignature rejects the unsigned requests on the destructive endpoints
+	requireSignature = env.Get("AUTH_REQUIRE_SIGNATURE", "off") == "on"
+	// maxClockSkew is the max age of the timestamp of a signed request
+	maxClockSkew = 5 * time.Minute
+
+	nonces = &nonceCache{seen: map[string]time.Time{}}
+
+	errSignatureMissing = errors.New("request signature missing")
+	errSignatureInvalid = errors.New("request signature does not match")
+	errTimestampStale   = errors.New("request timestamp is stale")
+	errNonceReplayed    = errors.New("request nonce already used")
+)
+
+// nonceCache remembers the nonces of the signed requests until their timestamps go stale
+type nonceCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// add records the nonce, returning false if it is already used
+func (c *nonceCache) add(nonce string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n, expiry := range c.seen {
+		if now.After(expiry) {
+			delete(c.seen, n)
+		}
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	// a replay after this is rejected as stale
+	c.seen[nonce] = now.Add(2 * maxClockSkew)
+	return true
+}
+
+// signRequest computes the signature of the request as hex(HMAC-SHA256(WEBHOOK_AUTH_TOKEN, METHOD\nURI\nTIMESTAMP\nNONCE))
+func signRequest(method, uri, timestamp, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(authToken))
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature verifies the timestamp+nonce signature of the request
+func verifySignature(r *http.Request) error {
+	signature := r.Header.Get(signatureHeader)
+	if signature == "" {
+		return errSignatureMissing
+	}
+	timestamp := r.Header.Get(timestampHeader)
+	nonce := r.Header.Get(nonceHeader)
+	if timestamp == "" || nonce == "" {
+		return errSignatureInvalid
+	}
+	expected := signRequest(r.Method, r.URL.RequestURI(), timestamp, nonce)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errSignatureInvalid
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errSignatureInvalid
+	}
+	now := time.Now()
+	if skew := now.Sub(time.Unix(unix, 0)); skew > maxClockSkew || skew < -maxClockSkew {
+		return errTimestampStale
+	}
+	if !nonces.add(nonce, now) {
+		return errNonceReplayed
+	}
+	return nil
+}
+
+// auth authenticates the requests by the WEBHOOK_AUTH_TOKEN in the Authorization header
+// or by a timestamp+nonce signature computed with it
+func auth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authToken != "" {
+			if r.Header.Get(signatureHeader) != "" {
+				if err := verifySignature(r); err != nil {
+					http.Error(w, err.Error(), http.StatusUnauthorized)
+					return
+				}
+			} else if authToken != r.Header.Get("Authorization") {
+				http.Error(w, "authorization header missing", http.StatusBadRequest)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// signedAuth authenticates the requests to the destructive endpoints; with
+// AUTH_REQUIRE_SIGNATURE=on, only signed requests are accepted, protecting them
+// from replays
+func signedAuth(h http.Handler) http.Handler {
+	if !requireSignature {
+		return auth(h)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authToken != "" {
+			if err := verifySignature(r); err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+)
+
+// runBench fires synthetic notification events at the target quota server, or through the
+// update pipeline with in-memory sites if no target is provided, and reports the throughput
+// and the latency percentiles
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := fs.String("target", "", "URL of the quota server to POST the events to; in-process with in-memory sites if not set")
+	token := fs.String("token", os.Getenv("WEBHOOK_AUTH_TOKEN"), "auth token of the target")
+	requests := fs.Int("requests", 1000, "number of events to send")
+	concurrency := fs.Int("concurrency", 16, "number of concurrent senders")
+	users := fs.Int("users", 100, "number of users to spread the events over")
+	siteCount := fs.Int("sites", 2, "number of in-memory sites for the in-process run")
+	size := fs.Int64("size", 1024, "object size in bytes reported by the events")
+	fs.Parse(args)
+
+	if *requests <= 0 || *concurrency <= 0 || *users <= 0 {
+		return errors.New("requests, concurrency and users must be greater than 0")
+	}
+
+	var send func(ctx context.Context, event notification.Event) error
+	if *target != "" {
+		client := &http.Client{Timeout: 30 * time.Second}
+		url := strings.TrimSuffix(*target, "/") + "/quota/update"
+		send = func(ctx context.Context, event notification.Event) error {
+			return postEvent(ctx, client, url, *token, event)
+		}
+		if dataBucket == "" {
+			dataBucket = "bench"
+		}
+	} else {
+		if err := setupBenchSites(*siteCount, *requests); err != nil {
+			return err
+		}
+		send = processEvent
+	}
+
+	latencies := make([]time.Duration, *requests)
+	var (
+		next   int64 = -1
+		failed int64
+		wg     sync.WaitGroup
+	)
+	date := getCurrentDateInUTC().Format(dateFormat)
+	start := time.Now()
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n := int(atomic.AddInt64(&next, 1))
+				if n >= *requests {
+					return
+				}
+				event := benchEvent(fmt.Sprintf("%v/user-%v/object-%v", date, n%*users, n), *size)
+				sent := time.Now()
+				if err := send(context.Background(), event); err != nil {
+					atomic.AddInt64(&failed, 1)
+				}
+				latencies[n] = time.Since(sent)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	percentile := func(p float64) time.Duration {
+		return latencies[int(float64(len(latencies)-1)*p)]
+	}
+	fmt.Printf("Events:     %v (%v failed)\n", *requests, failed)
+	fmt.Printf("Duration:   %v\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("Throughput: %.1f events/s\n", float64(*requests)/elapsed.Seconds())
+	fmt.Printf("Latency:    p50 %v, p90 %v, p99 %v, max %v\n", percentile(0.5), percentile(0.9), percentile(0.99), latencies[len(latencies)-1])
+	return nil
+}
+
+// setupBenchSites configures the in-memory sites for the in-process run
+func setupBenchSites(count, requests int) error {
+	if count <= 0 {
+		return errors.New("sites must be greater than 0")
+	}
+	dataBucket, quotaBucket = "bench", "bench-quota"
+	if maxLimit <= 0 {
+		// never reject, so that every event goes through the whole pipeline
+		maxLimit = requests
+	}
+	sites = nil
+	for i := 1; i <= count; i++ {
+		name := fmt.Sprintf("site%v", i)
+		sites = append(sites, newStoreSite(name, newMemStore(name, dataBucket, quotaBucket)))
+	}
+	return initBlocklist(context.Background())
+}
+
+// benchEvent returns a synthetic PUT event of the object
+func benchEvent(key string, size int64) notification.Event {
+	var event notification.Event
+	event.EventName = "s3:ObjectCreated:Put"
+	event.EventTime = time.Now().UTC().Format(time.RFC3339Nano)
+	event.S3.Bucket.Name = dataBucket
+	event.S3.Object.Key = key
+	event.S3.Object.Size = size
+	return event
+}
+
+// postEvent POSTs the event as a notification payload
+func postEvent(ctx context.Context, client *http.Client, url, token string, event notification.Event) error {
+	data, err := json.Marshal(notificationPayload{Records: []notification.Event{event}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v", resp.Status)
+	}
+	return nil
+}
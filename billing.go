@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/pkg/env"
+)
+
+var (
+	// billingWebhookURL is where the usage of the expired days is POSTed to at the rollover
+	billingWebhookURL       = env.Get("BILLING_WEBHOOK_URL", "")
+	billingWebhookAuthToken = env.Get("BILLING_WEBHOOK_AUTH_TOKEN", "")
+	// billingSite is the site whose rollovers are reported, so that every record is sent once
+	billingSite = env.Get("BILLING_SITE", "")
+
+	billingClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// billingFailedPrefix is where the records failed after the retries are kept in the quota bucket
+// of the billing site, so that they can be reconciled instead of being lost
+const billingFailedPrefix = ".billing/failed/"
+
+// billingRecord represents the final usage of a user on an expired day
+type billingRecord struct {
+	User    string `json:"user"`
+	Date    string `json:"date"`
+	Objects int    `json:"objects"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// initBilling registers the prune hook reporting the rollovers, if configured
+func initBilling() error {
+	if billingWebhookURL == "" {
+		return nil
+	}
+	if billingSite == "" {
+		// first configured site by default
+		billingSite = sites[0].name
+	}
+	site := findSite(billingSite)
+	if site == nil {
+		return fmt.Errorf("BILLING_SITE %v is not configured", billingSite)
+	}
+	pruneHooks = append(pruneHooks, func(ctx context.Context, s3Client ObjectStore, user string, pruned map[string]quotaEntry) {
+		if s3Client != site.Client() {
+			return
+		}
+		for _, record := range billingRecords(user, pruned) {
+			record := record
+			go func() {
+				if err := defaultRetry.do(ctx, func() error {
+					return postJSON(ctx, billingClient, billingWebhookURL, billingWebhookAuthToken, record)
+				}); err != nil {
+					logf(ctx, "ERROR", site.name, "unable to send the usage of user '%v' on %v; %v", user, record.Date, err)
+					storeFailedBilling(ctx, site, record)
+				}
+			}()
+		}
+	})
+	return nil
+}
+
+// billingRecords sums the pruned objects of the user per day
+func billingRecords(user string, pruned map[string]quotaEntry) []billingRecord {
+	days := map[string]*billingRecord{}
+	for object, entry := range pruned {
+		pathDate, err := time.Parse(dateFormat, strings.Split(object, "/")[0])
+		if err != nil {
+			continue
+		}
+		date := entry.date(pathDate).Format(dateFormat)
+		record, ok := days[date]
+		if !ok {
+			record = &billingRecord{User: user, Date: date}
+			days[date] = record
+		}
+		record.Objects++
+		record.Bytes += entry.Size
+	}
+	records := make([]billingRecord, 0, len(days))
+	for _, record := range days {
+		records = append(records, *record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Date < records[j].Date
+	})
+	return records
+}
+
+// storeFailedBilling keeps the record failed to be sent under billingFailedPrefix
+func storeFailedBilling(ctx context.Context, site *site, record billingRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		logf(ctx, "ERROR", site.name, "unable to encode the usage of user '%v' on %v; %v", record.User, record.Date, err)
+		return
+	}
+	key := billingFailedPrefix + record.Date + "/" + record.User + ".json"
+	if err := defaultRetry.do(ctx, func() error {
+		_, err := site.Client().PutObject(ctx, quotaBucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+			ContentType: "application/json",
+		})
+		return err
+	}); err != nil {
+		logf(ctx, "ERROR", site.name, "unable to keep the unsent usage of user '%v' on %v; %v", record.User, record.Date, err)
+		return
+	}
+	logf(ctx, "WARNING", site.name, "kept the unsent usage of user '%v' on %v in '%v/%v'", record.User, record.Date, quotaBucket, key)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/pkg/sync/errgroup"
+)
+
+// blocklistKey is where the blocked users are stored in the quota bucket
+const blocklistKey = ".blocklist"
+
+var (
+	errUserBlocked = errors.New("user is blocked")
+
+	blocked = &blocklist{users: map[string]blockEntry{}}
+)
+
+// blockEntry represents a blocked user; suspended users are blocked until the expiry
+type blockEntry struct {
+	Reason    string     `json:"reason,omitempty"`
+	BlockedAt time.Time  `json:"blockedAt"`
+	Until     *time.Time `json:"until,omitempty"`
+}
+
+// expired returns true if the suspension of the user is over
+func (entry blockEntry) expired() bool {
+	return entry.Until != nil && !time.Now().Before(*entry.Until)
+}
+
+// blocklist keeps the blocked users in memory, reloading them from the quota bucket
+// periodically so that the changes made through the other servers are picked up
+type blocklist struct {
+	mu             sync.Mutex
+	users          map[string]blockEntry
+	loadedAt       time.Time
+	reloadInterval time.Duration
+}
+
+// initBlocklist loads the blocked users
+func initBlocklist(ctx context.Context) (err error) {
+	if blocked.reloadInterval, err = getDurationEnv("BLOCKLIST_RELOAD_INTERVAL", 30*time.Second); err != nil {
+		return err
+	}
+	users, err := loadBlocklist(ctx)
+	if err != nil {
+		// the sites may still be initializing; loaded again by the next check
+		logf(ctx, "WARNING", "", "unable to load the blocklist; %v", err)
+		return nil
+	}
+	blocked.set(users)
+	return nil
+}
+
+// check returns errUserBlocked if the user is blocked or suspended
+func (b *blocklist) check(ctx context.Context, user string) error {
+	b.reload(ctx)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry, ok := b.users[user]
+	if !ok || entry.expired() {
+		return nil
+	}
+	if entry.Until != nil {
+		return fmt.Errorf("%w until %v", errUserBlocked, entry.Until.Format(time.RFC3339))
+	}
+	return errUserBlocked
+}
+
+// get returns a copy of the blocked users
+func (b *blocklist) get() map[string]blockEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	users := make(map[string]blockEntry, len(b.users))
+	for user, entry := range b.users {
+		users[user] = entry
+	}
+	return users
+}
+
+func (b *blocklist) set(users map[string]blockEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.users = users
+	b.loadedAt = time.Now()
+}
+
+// reload reloads the blocked users if they are older than the reload interval; the
+// loaded users are kept if the reload fails
+func (b *blocklist) reload(ctx context.Context) {
+	b.mu.Lock()
+	if time.Since(b.loadedAt) < b.reloadInterval {
+		b.mu.Unlock()
+		return
+	}
+	// the other callers carry on with the loaded users meanwhile
+	b.loadedAt = time.Now()
+	b.mu.Unlock()
+
+	users, err := loadBlocklist(ctx)
+	if err != nil {
+		logf(ctx, "WARNING", "", "unable to reload the blocklist; %v", err)
+		return
+	}
+	b.set(users)
+}
+
+// loadBlocklist reads the blocked users from one site picked by the read preference,
+// falling back to the other sites if it fails
+func loadBlocklist(ctx context.Context) (users map[string]blockEntry, err error) {
+	for _, site := range readOrder() {
+		if site.Client() == nil {
+			err = errors.New("s3Client is nil")
+			continue
+		}
+		users, _, err = readBlocklist(ctx, site.Client())
+		if err == nil {
+			return users, nil
+		}
+		logf(ctx, "WARNING", site.name, "unable to read the blocklist; trying the next site; %v", err)
+	}
+	return nil, err
+}
+
+// readBlocklist GETs the blocked users; empty if none are blocked yet
+func readBlocklist(ctx context.Context, s3Client ObjectStore) (map[string]blockEntry, string, error) {
+	reader, stat, err := s3Client.ReadObject(ctx, quotaBucket, blocklistKey)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return map[string]blockEntry{}, "", nil
+		}
+		return nil, "", err
+	}
+	defer reader.Close()
+	decoded := map[string]blockEntry{}
+	if err := json.NewDecoder(reader).Decode(&decoded); err != nil {
+		return nil, "", err
+	}
+	// the users blocked before their names were canonicalized
+	users := make(map[string]blockEntry, len(decoded))
+	for user, entry := range decoded {
+		user = canonicalUser(user)
+		if other, ok := users[user]; ok && (other.Until == nil || (entry.Until != nil && other.Until.After(*entry.Until))) {
+			// the longest block wins
+			continue
+		}
+		users[user] = entry
+	}
+	return users, stat.ETag, nil
+}
+
+// updateBlocklist applies the change on the blocked users of all the configured sites
+func updateBlocklist(ctx context.Context, change func(users map[string]blockEntry)) error {
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
+		index := index
+		g.Go(func() (err error) {
+			s3Client := sites[index].Client()
+			if s3Client == nil {
+				return errors.New("s3Client is nil")
+			}
+			return defaultRetry.do(ctx, func() error {
+				err := updateSiteBlocklist(ctx, s3Client, change)
+				if err != nil {
+					logf(ctx, "ERROR", sites[index].name, "unable to update the blocklist; %v", err)
+				}
+				return err
+			})
+		}, index)
+	}
+	if err := g.WaitErr(); err != nil {
+		return err
+	}
+	users, err := loadBlocklist(ctx)
+	if err != nil {
+		return err
+	}
+	blocked.set(users)
+	return nil
+}
+
+func updateSiteBlocklist(ctx context.Context, s3Client ObjectStore, change func(users map[string]blockEntry)) error {
+	users, etag, err := readBlocklist(ctx, s3Client)
+	if err != nil {
+		return fmt.Errorf("unable to read the blocklist; %v", err)
+	}
+	change(users)
+	for user, entry := range users {
+		if entry.expired() {
+			delete(users, user)
+		}
+	}
+	data, err := json.Marshal(users)
+	if err != nil {
+		return err
+	}
+	opts := minio.PutObjectOptions{
+		ContentType: "application/json",
+	}
+	opts.SetMatchETag(etag)
+	_, err = s3Client.PutObject(ctx, quotaBucket, blocklistKey, bytes.NewReader(data), int64(len(data)), opts)
+	return err
+}
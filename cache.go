@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ttlCache is an in-memory cache whose entries expire after the ttl, holding up to
+// maxEntries entries if set
+type ttlCache[V any] struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]ttlCacheEntry[V]
+}
+
+type ttlCacheEntry[V any] struct {
+	value  V
+	expiry time.Time
+}
+
+// newTTLCache returns a new cache whose entries expire after the ttl, holding up to maxEntries
+// entries; unbounded if maxEntries is 0
+func newTTLCache[V any](ttl time.Duration, maxEntries int) *ttlCache[V] {
+	return &ttlCache[V]{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]ttlCacheEntry[V]{},
+	}
+}
+
+// Get returns the value of the key, if present and not expired
+func (c *ttlCache[V]) Get(key string) (value V, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return value, false
+	}
+	if time.Now().After(entry.expiry) {
+		delete(c.entries, key)
+		return value, false
+	}
+	return entry.value, true
+}
+
+// Set sets the value of the key
+func (c *ttlCache[V]) Set(key string, value V) {
+	c.SetWithTTL(key, value, c.ttl)
+}
+
+// SetWithTTL sets the value of the key expiring after the provided ttl; a new key is not cached
+// while the cache holds maxEntries entries not expired
+func (c *ttlCache[V]) SetWithTTL(key string, value V, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		c.evictLocked(time.Now())
+		if len(c.entries) >= c.maxEntries {
+			return
+		}
+	}
+	c.entries[key] = ttlCacheEntry[V]{
+		value:  value,
+		expiry: time.Now().Add(ttl),
+	}
+}
+
+// Delete removes the key
+func (c *ttlCache[V]) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// Clear removes all the keys
+func (c *ttlCache[V]) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]ttlCacheEntry[V]{}
+}
+
+// Full returns true if the cache holds maxEntries entries
+func (c *ttlCache[V]) Full() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.maxEntries > 0 && len(c.entries) >= c.maxEntries
+}
+
+// evictLocked drops the expired entries
+func (c *ttlCache[V]) evictLocked(now time.Time) {
+	for key, entry := range c.entries {
+		if now.After(entry.expiry) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// janitor drops the expired entries every ttl, so that the keys never read again are not kept
+func (c *ttlCache[V]) janitor(ctx context.Context) {
+	ticker := time.NewTicker(c.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			c.evictLocked(now)
+			c.mu.Unlock()
+		}
+	}
+}
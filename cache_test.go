@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLCacheMaxEntries(t *testing.T) {
+	cache := newTTLCache[int](time.Hour, 2)
+	cache.Set("a", 1)
+	cache.SetWithTTL("b", 2, time.Millisecond)
+	if !cache.Full() {
+		t.Fatal("expected the cache to be full")
+	}
+	cache.Set("c", 3)
+	if _, ok := cache.Get("c"); ok {
+		t.Fatal("expected a new key not to be cached while the cache is full")
+	}
+	time.Sleep(2 * time.Millisecond)
+	cache.Set("c", 3)
+	if value, ok := cache.Get("c"); !ok || value != 3 {
+		t.Fatalf("expected the expired entry evicted for a new key, got %v, %v", value, ok)
+	}
+	cache.Set("a", 4)
+	if value, ok := cache.Get("a"); !ok || value != 4 {
+		t.Fatalf("expected a cached key to be updated while the cache is full, got %v, %v", value, ok)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/minio/pkg/sync/errgroup"
+)
+
+// siteCheck represents the usage of the user as checked on a site
+type siteCheck struct {
+	Site     string `json:"site"`
+	Objects  int    `json:"objects"`
+	Reserved int    `json:"reserved,omitempty"`
+	Limit    int    `json:"limit"`
+	Exceeded bool   `json:"exceeded"`
+	Error    string `json:"error,omitempty"`
+}
+
+// checkDetail represents the answer of a check along with the usage of the user on every site,
+// to tell which sites block the user when they diverged
+type checkDetail struct {
+	User     string      `json:"user"`
+	Allowed  bool        `json:"allowed"`
+	Error    string      `json:"error,omitempty"`
+	Exceeded []string    `json:"exceeded"`
+	Sites    []siteCheck `json:"sites"`
+}
+
+// checkSites checks the usage of the user on every site, regardless of the read preference;
+// the user quota found diverged across the sites is read-repaired by READ_REPAIR
+func checkSites(ctx context.Context, user string) []siteCheck {
+	checks := make([]siteCheck, len(sites))
+	quotas := make([]*UserQuota, len(sites))
+	read := make([]bool, len(sites))
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
+		index := index
+		g.Go(func() (err error) {
+			checks[index] = siteCheck{Site: sites[index].name}
+			if quotas[index], err = readCheckedQuota(ctx, sites[index], user); err != nil {
+				checks[index].Error = err.Error()
+				return nil
+			}
+			read[index] = true
+			checks[index].count(ctx, user, quotas[index])
+			return nil
+		}, index)
+	}
+	g.Wait()
+	if readRepairMode != readRepairOff && diverged(quotas, read) {
+		readRepair(ctx, user)
+	}
+	return checks
+}
+
+// count fills the usage of the user in the check of the site
+func (check *siteCheck) count(ctx context.Context, user string, userQuota *UserQuota) {
+	if userQuota == nil {
+		// new user
+		userQuota = NewUserQuota()
+	}
+	check.Objects = len(userQuota.Objects)
+	check.Reserved = userQuota.held()
+	check.Limit = effectiveLimit(ctx, user, userQuota)
+	check.Exceeded = check.Objects+check.Reserved >= check.Limit
+}
+
+// writeCheckDetail writes the answer of the check with the usage of the user on every site
+func writeCheckDetail(ctx context.Context, w http.ResponseWriter, user string, status int, err error) {
+	detail := checkDetail{
+		User:     user,
+		Allowed:  err == nil,
+		Exceeded: []string{},
+		Sites:    checkSites(ctx, user),
+	}
+	if err != nil {
+		detail.Error = err.Error()
+	}
+	for _, check := range detail.Sites {
+		if check.Exceeded {
+			detail.Exceeded = append(detail.Exceeded, check.Site)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(detail)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// checkObject is the object written to and removed from the buckets by check-config
+const checkObject = ".check-config"
+
+// runCheckConfig validates the config, connects to each site and verifies the permissions
+// on the buckets, reporting all the problems at once
+func runCheckConfig(args []string) error {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 30*time.Second, "timeout of the checks of each site")
+	fs.Parse(args)
+
+	var errs []error
+	if err := loadConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	targets, err := loadSites()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if dataBucket == "" || quotaBucket == "" {
+		// the site checks need both the buckets
+		return errors.Join(errs...)
+	}
+	for _, site := range targets {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		err := checkSite(ctx, site)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("site %v: %w", site.name, err))
+			continue
+		}
+		fmt.Printf("Site %v: OK\n", site.name)
+	}
+	return errors.Join(errs...)
+}
+
+// checkSite connects to the site and verifies the read/write permissions on the quota
+// bucket and the list/delete permissions on the data bucket
+func checkSite(ctx context.Context, s *site) error {
+	if err := s.connect(ctx); err != nil {
+		return err
+	}
+	client := s.Client()
+	var errs []error
+
+	data := []byte(time.Now().UTC().Format(time.RFC3339))
+	if _, err := client.PutObject(ctx, quotaBucket, checkObject, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{}); err != nil {
+		errs = append(errs, fmt.Errorf("unable to write to QUOTA_BUCKET %v; %v", quotaBucket, err))
+	} else {
+		reader, _, err := client.ReadObject(ctx, quotaBucket, checkObject)
+		if err == nil {
+			_, err = io.Copy(io.Discard, reader)
+			reader.Close()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to read from QUOTA_BUCKET %v; %v", quotaBucket, err))
+		}
+		if err := client.RemoveObject(ctx, quotaBucket, checkObject, minio.RemoveObjectOptions{}); err != nil {
+			errs = append(errs, fmt.Errorf("unable to remove %v from QUOTA_BUCKET %v; %v", checkObject, quotaBucket, err))
+		}
+	}
+
+	for object := range client.ListObjects(ctx, dataBucket, minio.ListObjectsOptions{MaxKeys: 1}) {
+		if object.Err != nil {
+			errs = append(errs, fmt.Errorf("unable to list DATA_BUCKET %v; %v", dataBucket, object.Err))
+		}
+		break
+	}
+	// removing a missing object succeeds as long as the deletes are allowed
+	if err := client.RemoveObject(ctx, dataBucket, checkObject, minio.RemoveObjectOptions{}); err != nil {
+		errs = append(errs, fmt.Errorf("unable to delete from DATA_BUCKET %v; %v", dataBucket, err))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	// manifestChecksumKey is the user metadata carrying the SHA-256 of the quota content
+	manifestChecksumKey = "Quota-Checksum"
+	// quarantinePrefix is where the broken user quotas are moved before they are rebuilt,
+	// as quarantine/USER/TIME.quota
+	quarantinePrefix = "quarantine/"
+)
+
+var (
+	errManifestCorrupted  = errors.New("user quota does not match its checksum")
+	errManifestUnparsable = errors.New("user quota cannot be parsed")
+
+	// rebuilding are the user quotas being rebuilt, keyed by the site and the user
+	rebuilding sync.Map
+)
+
+func manifestChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyManifest returns errManifestCorrupted if the content does not match the checksum;
+// the quotas written before the checksums were recorded have none
+func verifyManifest(data []byte, checksum string) error {
+	if checksum == "" || checksum == manifestChecksum(data) {
+		return nil
+	}
+	return errManifestCorrupted
+}
+
+// siteOf returns the site of the client
+func siteOf(s3Client ObjectStore) *site {
+	for _, site := range sites {
+		if site.Client() == s3Client {
+			return site
+		}
+	}
+	return nil
+}
+
+// rebuildManifest moves the broken user quota of the site aside to the quarantine prefix and
+// recalculates it from the data bucket in the background, once at a time
+func rebuildManifest(ctx context.Context, s3Client ObjectStore, user string, data []byte) {
+	countCorruptManifest()
+	site := siteOf(s3Client)
+	if site == nil {
+		return
+	}
+	key := manifestCacheKey(site, user)
+	if _, ok := rebuilding.LoadOrStore(key, struct{}{}); ok {
+		return
+	}
+	logf(ctx, "ERROR", site.name, "user quota of '%v' is broken; rebuilding it from the data bucket", user)
+	captureError(ctx, nil, "error", fmt.Sprintf("user quota of %v is broken on site %v", user, site.name),
+		map[string]string{"type": "corrupt_manifest", "site": site.name})
+	go func() {
+		defer rebuilding.Delete(key)
+		ctx := context.WithoutCancel(ctx)
+		quarantineKey := quarantinePrefix + user + "/" + time.Now().UTC().Format("20060102T150405Z") + quotaExt
+		if _, err := s3Client.PutObject(ctx, quotaBucket, quarantineKey, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+			ContentType: "application/octet-stream",
+		}); err != nil {
+			// not rebuilt over the only copy of the broken quota
+			logf(ctx, "ERROR", site.name, "unable to move the broken user quota of '%v' to '%v'; %v", user, quarantineKey, err)
+			return
+		}
+		logf(ctx, "LOG", site.name, "moved the broken user quota of '%v' to '%v'", user, quarantineKey)
+		if err := recalculateSiteQuota(ctx, site, user, false); err != nil {
+			logf(ctx, "ERROR", site.name, "unable to rebuild the broken user quota of '%v'; %v", user, err)
+			return
+		}
+		invalidateManifest(site, user)
+	}()
+}
@@ -0,0 +1,20 @@
+package main
+
+import "time"
+
+// Clock tells the current time to the daily rollover of the quotas; the refresh, the purge and
+// the reservations read it instead of time.Now, so that the dev builds can freeze or advance it
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the clock of the system
+type systemClock struct{}
+
+// Now returns the current time of the system
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// clock is the clock of the rollover; the system clock unless traveled by the dev builds
+var clock Clock = systemClock{}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/pkg/env"
+)
+
+// nodeHeader is the header of the readiness response naming the replica
+const nodeHeader = "X-Quota-Server-Node"
+
+var (
+	// clusterPeers are the base URLs of the other replicas, e.g. http://replica2:8080
+	clusterPeers = parseList(env.Get("CLUSTER_PEERS", ""))
+	// nodeName is the name of this replica among its peers
+	nodeName = env.Get("CLUSTER_NODE_NAME", "")
+
+	peerClient = &http.Client{Timeout: siteProbeTimeout}
+
+	// cluster is the membership of the replicas; nil if CLUSTER_PEERS is not set
+	cluster *clusterMembership
+)
+
+// peer represents another replica of the cluster
+type peer struct {
+	url string
+
+	mu       sync.Mutex
+	node     string
+	alive    bool
+	lastSeen time.Time
+	latency  time.Duration
+	err      error
+}
+
+// peerStatus represents the status of a peer, as last probed
+type peerStatus struct {
+	URL      string     `json:"url"`
+	Node     string     `json:"node,omitempty"`
+	Alive    bool       `json:"alive"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+	Latency  string     `json:"latency,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// clusterStatus represents this replica and its peers
+type clusterStatus struct {
+	Node    string       `json:"node"`
+	Members []string     `json:"members"`
+	Peers   []peerStatus `json:"peers"`
+}
+
+// clusterMembership keeps track of the peers, probing their readiness periodically
+type clusterMembership struct {
+	interval time.Duration
+	peers    []*peer
+}
+
+// initCluster validates the peers and starts probing them in the background
+func initCluster(ctx context.Context) error {
+	if len(clusterPeers) == 0 {
+		return nil
+	}
+	interval, err := getDurationEnv("CLUSTER_PROBE_INTERVAL", 10*time.Second)
+	if err != nil {
+		return err
+	}
+	if nodeName == "" {
+		if nodeName, err = os.Hostname(); err != nil {
+			return fmt.Errorf("CLUSTER_NODE_NAME env is not set and the hostname is unknown; %v", err)
+		}
+	}
+	membership := &clusterMembership{interval: interval}
+	for _, peerURL := range clusterPeers {
+		u, err := url.Parse(peerURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("CLUSTER_PEERS env must be the base URLs of the replicas; invalid '%v'", peerURL)
+		}
+		membership.peers = append(membership.peers, &peer{url: strings.TrimSuffix(peerURL, "/")})
+	}
+	cluster = membership
+	go membership.probeLoop(ctx)
+	return nil
+}
+
+func (c *clusterMembership) probeLoop(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, p := range c.peers {
+			wg.Add(1)
+			go func(p *peer) {
+				defer wg.Done()
+				p.probe(ctx)
+			}(p)
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe checks the readiness of the peer; a peer is alive as long as it responds, even
+// if none of its sites are ready yet
+func (p *peer) probe(ctx context.Context) {
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url+"/ready", nil)
+	if err != nil {
+		p.update("", 0, err)
+		return
+	}
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		p.update("", 0, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		p.update("", 0, fmt.Errorf("unexpected response %v", resp.Status))
+		return
+	}
+	p.update(resp.Header.Get(nodeHeader), time.Since(start), nil)
+}
+
+func (p *peer) update(node string, latency time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		if p.alive {
+			logf(context.Background(), "WARNING", "", "lost the peer %v; %v", p.url, err)
+		}
+		p.alive = false
+		p.err = err
+		return
+	}
+	if !p.alive {
+		logf(context.Background(), "LOG", "", "joined the peer %v (%v)", p.url, node)
+	}
+	p.node = node
+	p.alive = true
+	p.lastSeen = time.Now().UTC()
+	p.latency = latency
+	p.err = nil
+}
+
+func (p *peer) status() peerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := peerStatus{
+		URL:   p.url,
+		Node:  p.node,
+		Alive: p.alive,
+	}
+	if !p.lastSeen.IsZero() {
+		lastSeen := p.lastSeen
+		status.LastSeen = &lastSeen
+	}
+	if p.latency > 0 {
+		status.Latency = p.latency.String()
+	}
+	if p.err != nil {
+		status.Error = p.err.Error()
+	}
+	return status
+}
+
+// members returns the names of this replica and the alive peers, sorted, so that every replica
+// agrees on them once the probes converge
+func (c *clusterMembership) members() []string {
+	members := []string{nodeName}
+	for _, p := range c.peers {
+		if status := p.status(); status.Alive && status.Node != "" {
+			members = append(members, status.Node)
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// status returns this replica and the status of its peers
+func (c *clusterMembership) status() *clusterStatus {
+	if c == nil {
+		return nil
+	}
+	status := &clusterStatus{
+		Node:    nodeName,
+		Members: c.members(),
+		Peers:   make([]peerStatus, len(c.peers)),
+	}
+	for i, p := range c.peers {
+		status.Peers[i] = p.status()
+	}
+	return status
+}
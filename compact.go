@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/pkg/sync/errgroup"
+)
+
+// maxManifestSize is the size in bytes above which the user quotas are compacted before
+// they are written; disabled if zero
+var maxManifestSize int
+
+// compactions are the steps shrinking the user quota, least lossy first; none of them changes
+// what is counted towards the limit, nor the sizes of the byte usage, the billing and the history
+var compactions = []struct {
+	name  string
+	apply func(quota *UserQuota)
+}{
+	{"expired objects", func(quota *UserQuota) {
+		quota.Refresh()
+	}},
+	{"etags", func(quota *UserQuota) {
+		for object, entry := range quota.Objects {
+			entry.ETag = ""
+			quota.Objects[object] = entry
+		}
+	}},
+	{"event times matching the path dates", func(quota *UserQuota) {
+		for object, entry := range quota.Objects {
+			pathDate, err := time.Parse(dateFormat, strings.Split(object, "/")[0])
+			if err != nil || entry.EventTime.IsZero() || !entry.date(pathDate).Equal(pathDate) {
+				continue
+			}
+			entry.EventTime = time.Time{}
+			quota.Objects[object] = entry
+		}
+	}},
+}
+
+// encodeUserQuota encodes the user quota, compacting it step by step while it is larger
+// than the max manifest size
+func encodeUserQuota(ctx context.Context, host, user string, userQuota *UserQuota) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := userQuota.Write(&buf); err != nil {
+		return nil, err
+	}
+	if maxManifestSize <= 0 || buf.Len() <= maxManifestSize {
+		return buf.Bytes(), nil
+	}
+	size := buf.Len()
+	for _, step := range compactions {
+		step.apply(userQuota)
+		buf.Reset()
+		if err := userQuota.Write(&buf); err != nil {
+			return nil, err
+		}
+		logf(ctx, "WARNING", host, "compacted the user quota of '%v' by dropping the %v; %v -> %v bytes", user, step.name, size, buf.Len())
+		if buf.Len() <= maxManifestSize {
+			break
+		}
+	}
+	countCompaction()
+	if buf.Len() > maxManifestSize {
+		logf(ctx, "WARNING", host, "user quota of '%v' is still %v bytes after compaction, above the max of %v bytes", user, buf.Len(), maxManifestSize)
+	}
+	return buf.Bytes(), nil
+}
+
+// compactionResult represents the space saved by compacting the user quotas of a site
+type compactionResult struct {
+	Site        string `json:"site"`
+	Users       int    `json:"users"`
+	Failed      int    `json:"failed"`
+	BytesBefore int64  `json:"bytesBefore"`
+	BytesAfter  int64  `json:"bytesAfter"`
+	BytesSaved  int64  `json:"bytesSaved"`
+}
+
+// compactQuotas rewrites every user quota on all the sites in the current representation,
+// pruned and compacted, reporting the space saved per site
+func compactQuotas(ctx context.Context) ([]compactionResult, error) {
+	results := make([]compactionResult, len(sites))
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
+		index := index
+		g.Go(func() error {
+			result, err := compactSiteQuotas(ctx, sites[index])
+			results[index] = result
+			return err
+		}, index)
+	}
+	return results, g.WaitErr()
+}
+
+func compactSiteQuotas(ctx context.Context, site *site) (compactionResult, error) {
+	result := compactionResult{Site: site.name}
+	s3Client := site.Client()
+	if s3Client == nil {
+		return result, errors.New("s3Client is nil")
+	}
+	for object := range s3Client.ListObjects(ctx, quotaBucket, minio.ListObjectsOptions{}) {
+		if object.Err != nil {
+			logf(ctx, "ERROR", site.name, "unable to list objects from '%v' bucket; %v", quotaBucket, object.Err)
+			return result, fmt.Errorf("unable to list objects; %v", object.Err)
+		}
+		if !strings.HasSuffix(object.Key, quotaExt) {
+			continue
+		}
+		user := strings.TrimSuffix(object.Key, quotaExt)
+		err := defaultRetry.do(ctx, func() error {
+			userQuota, etag, err := readUserQuota(ctx, s3Client, user)
+			if err != nil {
+				return err
+			}
+			userQuota.Refresh()
+			if err := updateUserQuota(ctx, s3Client, user, userQuota, etag); err != nil {
+				return err
+			}
+			// as written, compacted if needed
+			var buf bytes.Buffer
+			if err := userQuota.Write(&buf); err != nil {
+				return err
+			}
+			result.BytesBefore += object.Size
+			result.BytesAfter += int64(buf.Len())
+			return nil
+		})
+		if err != nil {
+			logf(ctx, "ERROR", site.name, "unable to compact the user quota of '%v'; %v", user, err)
+			result.Failed++
+			continue
+		}
+		invalidateManifest(site, user)
+		result.Users++
+	}
+	result.BytesSaved = result.BytesBefore - result.BytesAfter
+	logf(ctx, "LOG", site.name, "compacted %v user quotas, saving %v bytes", result.Users, result.BytesSaved)
+	if result.Failed > 0 {
+		return result, fmt.Errorf("unable to compact %v user quotas on %v", result.Failed, site.name)
+	}
+	return result, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/pkg/env"
+)
+
+// loadConfig reads and validates the global config from the envs, reporting all the
+// problems at once
+func loadConfig() error {
+	var errs []error
+	var err error
+	maxLimit, err = env.GetInt("MAX_OBJECT_LIMIT_PER_USER", 0)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("unable to read MAX_OBJECT_LIMIT_PER_USER env; %v", err))
+	} else if maxLimit <= 0 {
+		errs = append(errs, errors.New("MAX_OBJECT_LIMIT_PER_USER env is not set"))
+	}
+	if dataBucket == "" {
+		errs = append(errs, errors.New("DATA_BUCKET env is not set"))
+	}
+	if quotaBucket == "" {
+		errs = append(errs, errors.New("QUOTA_BUCKET env is not set"))
+	}
+
+	if value := env.Get("MIN_OBJECT_SIZE", ""); value != "" {
+		if minObjectSize, err = strconv.ParseInt(value, 10, 64); err != nil {
+			errs = append(errs, fmt.Errorf("unable to parse MIN_OBJECT_SIZE env; %v", err))
+		}
+	}
+
+	maxManifestSize, err = env.GetInt("MAX_MANIFEST_SIZE", 0)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("unable to read MAX_MANIFEST_SIZE env; %v", err))
+	}
+
+	refreshWorkers, err = env.GetInt("REFRESH_WORKERS", 4)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("unable to read REFRESH_WORKERS env; %v", err))
+	} else if refreshWorkers <= 0 {
+		errs = append(errs, errors.New("REFRESH_WORKERS env must be greater than 0"))
+	}
+
+	maxInflightS3, err := env.GetInt("GLOBAL_MAX_INFLIGHT_S3", 0)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("unable to read GLOBAL_MAX_INFLIGHT_S3 env; %v", err))
+	} else if maxInflightS3 > 0 {
+		s3Semaphore = make(chan struct{}, maxInflightS3)
+	}
+
+	if value := env.Get("LATE_EVENT_TOLERANCE", ""); value != "" {
+		if lateEventTolerance, err = time.ParseDuration(value); err != nil {
+			errs = append(errs, fmt.Errorf("unable to parse LATE_EVENT_TOLERANCE env; %v", err))
+		}
+	}
+	if err := loadRetryPolicy(); err != nil {
+		errs = append(errs, err)
+	}
+	// the user names are canonicalized by the rules before the configured users are read
+	if err := loadUserNameRules(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := loadMetricsConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateEnforcementMode(); err != nil {
+		errs = append(errs, err)
+	} else if err := loadEnforcementPolicies(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := loadQuotaProtection(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := loadCountTags(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := loadMaxUsers(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := loadStreamConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := loadHedgeConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := loadReservationConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := loadMultipartConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := loadSTSDuration(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateDegradedChecks(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := loadFeatureFlags(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// loadSites reads the sites configured by the MINIO_ENDPOINT_{name} envs, without connecting to them
+func loadSites() ([]*site, error) {
+	var (
+		targets []*site
+		errs    []error
+	)
+	for _, k := range env.List("MINIO_ENDPOINT_") {
+		targetName := strings.TrimPrefix(k, "MINIO_ENDPOINT_")
+		endpoint := env.Get("MINIO_ENDPOINT_"+targetName, "")
+		accessKey := env.Get("MINIO_ACCESS_"+targetName, "")
+		secretKey := env.Get("MINIO_SECRET_"+targetName, "")
+		if endpoint == "" {
+			errs = append(errs, fmt.Errorf("MINIO_ENDPOINT_%v is empty", targetName))
+		}
+		if accessKey == "" {
+			errs = append(errs, fmt.Errorf("MINIO_ACCESS_%v is not set", targetName))
+		}
+		if secretKey == "" {
+			errs = append(errs, fmt.Errorf("MINIO_SECRET_%v is not set", targetName))
+		}
+		tc, err := loadTransportConfig(targetName)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to read the transport config for site %v; %v", targetName, err))
+		}
+		targets = append(targets, &site{
+			name:      targetName,
+			endpoint:  endpoint,
+			accessKey: accessKey,
+			secretKey: secretKey,
+			insecure:  env.Get("MINIO_INSECURE_"+targetName, strconv.FormatBool(insecure)) == "true",
+			transport: tc,
+		})
+	}
+	if len(targets) == 0 {
+		errs = append(errs, errors.New("no MinIO sites provided"))
+	}
+	return targets, errors.Join(errs...)
+}
+
+// connectSites connects to the configured sites and validates the read preference; the sites
+// unreachable on startup are initialized in the background, while the sites failing by their
+// configuration fail the startup
+func connectSites(ctx context.Context) error {
+	targets, err := loadSites()
+	if err != nil {
+		return err
+	}
+	for _, site := range targets {
+		if err := site.connect(ctx); err != nil {
+			if !unreachable(err) {
+				return fmt.Errorf("unable to connect to site %v; %v", site.name, err)
+			}
+			logf(ctx, "WARNING", site.name, "unable to connect to site; initializing it in the background; %v", err)
+			if err := site.initialize(ctx, err); err != nil {
+				return fmt.Errorf("unable to connect to site %v; %v", site.name, err)
+			}
+		}
+		sites = append(sites, site)
+	}
+	return validateReadPreference()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/minio/pkg/env"
+)
+
+const (
+	degradedChecksFailClosed = "fail-closed"
+	degradedChecksFailOpen   = "fail-open"
+	degradedChecksLastKnown  = "last-known"
+)
+
+var (
+	// degradedChecks decides how the checks are answered when every site is unreachable
+	degradedChecks = env.Get("DEGRADED_CHECKS", degradedChecksFailClosed)
+
+	errSitesUnreachable = errors.New("all the sites are unreachable")
+)
+
+// validateDegradedChecks validates the configured degradation policy of the checks
+func validateDegradedChecks() error {
+	switch degradedChecks {
+	case degradedChecksFailClosed, degradedChecksFailOpen, degradedChecksLastKnown:
+		return nil
+	default:
+		return fmt.Errorf("invalid DEGRADED_CHECKS %v", degradedChecks)
+	}
+}
+
+// degradedCheck answers the check of the user by the degradation policy while every site
+// is unreachable; returns false if the check is to fail as usual, and the error rejecting it
+// if the last known usage is over the limit
+func degradedCheck(w http.ResponseWriter, user string) (bool, error) {
+	switch degradedChecks {
+	case degradedChecksFailOpen:
+		w.Header().Set("X-Quota-Degraded", degradedChecksFailOpen)
+		countCheck("degraded")
+		return true, nil
+	case degradedChecksLastKnown:
+		last, ok := usage.get(user)
+		if !ok {
+			return false, nil
+		}
+		w.Header().Set("X-Quota-Degraded", degradedChecksLastKnown)
+		w.Header().Set("X-Quota-Staleness", strconv.Itoa(int(time.Since(last.seenAt).Seconds())))
+		if last.objects >= last.limit && !isMonitored(user) {
+			countCheck("exceeded")
+			return true, errMaxLimitExceeded
+		}
+		countCheck("degraded")
+		return true, nil
+	default:
+		return false, nil
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/minio/pkg/sync/errgroup"
+)
+
+// siteDeletion represents the removal of the object from the data bucket of a site
+type siteDeletion struct {
+	Site    string `json:"site"`
+	Removed bool   `json:"removed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// objectDeletion represents the outcome of the removal of an object along with its quota entry
+type objectDeletion struct {
+	Path  string         `json:"path"`
+	User  string         `json:"user"`
+	Sites []siteDeletion `json:"sites"`
+	// Freed is true if the object was dropped from the quota of the user on all the sites
+	Freed bool `json:"freed"`
+	// Queued is true if the quota update failed and was stored as a dead letter to be replayed
+	Queued bool   `json:"queued,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// deleteObject removes the object DATE/USER/object from the data bucket and drops it from the
+// quota of the user on all the sites. The quota is left untouched unless the object was removed
+// from every site, as it still takes space on the others, so that the deletion is retried; a
+// failed quota update is stored as a dead letter.
+func deleteObject(ctx context.Context, path string) (*objectDeletion, error) {
+	// the removal event of the object, as MinIO would have sent it
+	event := notification.Event{
+		EventName: "s3:ObjectRemoved:Delete",
+		EventTime: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	event.S3.Bucket.Name = dataBucket
+	event.S3.Object.Key = path
+	qe, err := parseEvent(event)
+	if err != nil {
+		return nil, err
+	}
+	deletion := &objectDeletion{
+		Path: qe.Path,
+		User: qe.User,
+	}
+	var failed []string
+	deletion.Sites = removeDataObject(ctx, qe.Path)
+	for _, site := range deletion.Sites {
+		if !site.Removed {
+			failed = append(failed, site.Site)
+		}
+	}
+	if len(failed) > 0 {
+		deletion.Error = fmt.Sprintf("unable to delete the object on the sites %v; the quota is left untouched", strings.Join(failed, ", "))
+		return deletion, nil
+	}
+
+	if err := removeQuota(ctx, qe); err != nil {
+		deletion.Error = err.Error()
+		storeDeadLetter(ctx, event, err)
+		deletion.Queued = deadLetterDir != ""
+		return deletion, nil
+	}
+	deletion.Freed = true
+	logf(ctx, "LOG", "", "deleted '%v' and removed it from the quota of '%v'", qe.Path, qe.User)
+	return deletion, nil
+}
+
+// removeDataObject removes the object from the data bucket on all the sites
+func removeDataObject(ctx context.Context, path string) []siteDeletion {
+	deletions := make([]siteDeletion, len(sites))
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
+		index := index
+		g.Go(func() error {
+			deletions[index].Site = sites[index].name
+			if sites[index].Client() == nil {
+				return errors.New("s3Client is nil")
+			}
+			return defaultRetry.do(ctx, func() error {
+				return sites[index].Client().RemoveObject(ctx, dataBucket, path, minio.RemoveObjectOptions{})
+			})
+		}, index)
+	}
+	for index, err := range g.Wait() {
+		if err != nil {
+			logf(ctx, "ERROR", sites[index].name, "unable to delete the object '%v/%v'; %v", dataBucket, path, err)
+			deletions[index].Error = err.Error()
+			continue
+		}
+		deletions[index].Removed = true
+	}
+	return deletions
+}
+
+// deleteOverLimit removes the object rejected for going over the limit from the data bucket on
+// all the sites, so that the limit holds even though the event arrives after the upload
+func deleteOverLimit(ctx context.Context, qe *quotaEvent) error {
+	deletions := removeDataObject(ctx, qe.Path)
+	var failed []string
+	for _, deletion := range deletions {
+		if !deletion.Removed {
+			failed = append(failed, deletion.Site)
+		}
+	}
+	message := fmt.Sprintf("user %v went over the limit with %v; deleted the object", qe.User, qe.Path)
+	if len(failed) > 0 {
+		message = fmt.Sprintf("user %v went over the limit with %v; unable to delete the object on the sites %v", qe.User, qe.Path, strings.Join(failed, ", "))
+	}
+	logf(ctx, "WARNING", "", "%v", message)
+	sendAlert(ctx, alert{
+		Type:    "over_limit_deleted",
+		User:    qe.User,
+		Message: message,
+	})
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to update quota; %w; unable to delete the object on the sites %v", errMaxLimitExceeded, strings.Join(failed, ", "))
+	}
+	return fmt.Errorf("unable to update quota; %w", errOverLimitDeleted)
+}
+
+// DELETE /objects?path=DATE/USER/object
+//
+//   - Removes the object from the data bucket on all the sites
+//   - Drops the object from the quota of the user on all the sites once removed from every site,
+//     storing a dead letter to be replayed if that fails
+//   - Returns 200 if the quota was freed, 202 if the quota update was queued and 502 otherwise
+func deleteObjectHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "missing path", http.StatusBadRequest)
+		return
+	}
+	deletion, err := deleteObject(ctx, path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	status := http.StatusOK
+	switch {
+	case deletion.Queued:
+		status = http.StatusAccepted
+	case !deletion.Freed:
+		status = http.StatusBadGateway
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(deletion)
+}
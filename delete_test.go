@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDeleteObjectFreesOnlyOnceRemovedEverywhere(t *testing.T) {
+	setupTestSites(t, 2)
+	saved := defaultRetry
+	defaultRetry = retryPolicy{maxAttempts: 1}
+	t.Cleanup(func() { defaultRetry = saved })
+	// the data bucket is missing on site2, failing the removals there
+	sites[1] = newStoreSite("site2", newMemStore("site2", quotaBucket))
+	ctx := context.Background()
+	if err := processEvent(ctx, testEvent("s3:ObjectCreated:Put", "usera", "a")); err != nil {
+		t.Fatal(err)
+	}
+	path := getCurrentDateInUTC().Format(dateFormat) + "/usera/a"
+
+	deletion, err := deleteObject(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deletion.Freed || !deletion.Sites[0].Removed || deletion.Sites[1].Removed {
+		t.Fatalf("expected the quota left untouched after the removal failed on site2, got %+v", deletion)
+	}
+	userQuota, _, err := readUserQuota(ctx, sites[0].Client(), "usera")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := userQuota.Objects[path]; !ok {
+		t.Fatalf("expected '%v' still counted, got %v", path, userQuota.Objects)
+	}
+
+	sites[1] = newStoreSite("site2", newMemStore("site2", dataBucket, quotaBucket))
+	if deletion, err = deleteObject(ctx, path); err != nil || !deletion.Freed {
+		t.Fatalf("expected the quota freed once removed from every site, got %+v, %v", deletion, err)
+	}
+	if userQuota, _, err = readUserQuota(ctx, sites[0].Client(), "usera"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := userQuota.Objects[path]; ok {
+		t.Fatalf("expected '%v' freed, got %v", path, userQuota.Objects)
+	}
+}
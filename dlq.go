@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/minio/pkg/env"
+)
+
+// deadLetterDir is the local directory the events failed on every site are kept in, so
+// that they are not lost even when the sites are unreachable; disabled if empty
+var deadLetterDir = env.Get("DEAD_LETTER_DIR", "")
+
+// deadLetter represents an event which could not be applied on the quotas
+type deadLetter struct {
+	ID        string             `json:"id"`
+	Time      time.Time          `json:"time"`
+	RequestID string             `json:"requestId,omitempty"`
+	Error     string             `json:"error"`
+	Event     notification.Event `json:"event"`
+}
+
+// initDeadLetters creates the dead-letter directory
+func initDeadLetters() error {
+	if deadLetterDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(deadLetterDir, 0o700); err != nil {
+		return fmt.Errorf("unable to create DEAD_LETTER_DIR %v; %v", deadLetterDir, err)
+	}
+	return nil
+}
+
+// deadLetterID returns the id of the dead letter of the event, the same for all the deliveries
+// of the event, by its object, name and sequencer
+func deadLetterID(event notification.Event) string {
+	sequencer := event.S3.Object.Sequencer
+	if sequencer == "" {
+		sequencer = event.EventTime
+	}
+	sum := sha256.Sum256([]byte(event.S3.Object.Key + "\x00" + event.EventName + "\x00" + sequencer))
+	return hex.EncodeToString(sum[:16])
+}
+
+// storeDeadLetter keeps the failed event along with the failure; the failed deliveries of the
+// same event, retried by MinIO, keep a single letter with the last failure
+func storeDeadLetter(ctx context.Context, event notification.Event, cause error) {
+	if deadLetterDir == "" || ctx.Value(replayKey) != nil {
+		// the replayed letters are kept until they succeed
+		return
+	}
+	letter := deadLetter{
+		ID:        deadLetterID(event),
+		Time:      time.Now().UTC(),
+		RequestID: traceFromContext(ctx).RequestID,
+		Error:     cause.Error(),
+		Event:     event,
+	}
+	data, err := json.Marshal(letter)
+	if err != nil {
+		logf(ctx, "ERROR", "", "unable to encode the dead letter; %v", err)
+		return
+	}
+	// written aside and renamed, so that a partial letter is never listed
+	path := filepath.Join(deadLetterDir, letter.ID+".json")
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		logf(ctx, "ERROR", "", "unable to store the dead letter of '%v'; %v", event.S3.Object.Key, err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		logf(ctx, "ERROR", "", "unable to store the dead letter of '%v'; %v", event.S3.Object.Key, err)
+		return
+	}
+	logf(ctx, "WARNING", "", "stored the failed event of '%v' as dead letter %v", event.S3.Object.Key, letter.ID)
+	incidents.checkDeadLetters(ctx)
+}
+
+// clearDeadLetter removes the dead letter of the event once a later delivery of it succeeded, so
+// that only the events which never succeeded are kept
+func clearDeadLetter(ctx context.Context, event notification.Event) {
+	if deadLetterDir == "" {
+		return
+	}
+	id := deadLetterID(event)
+	err := os.Remove(filepath.Join(deadLetterDir, id+".json"))
+	if err == nil {
+		logf(ctx, "LOG", "", "removed the dead letter %v of '%v' as it succeeded", id, event.S3.Object.Key)
+		incidents.checkDeadLetters(ctx)
+		return
+	}
+	if !os.IsNotExist(err) {
+		logf(ctx, "ERROR", "", "unable to remove the dead letter %v; %v", id, err)
+	}
+}
+
+// listDeadLetters reads the stored dead letters, oldest first
+func listDeadLetters() ([]deadLetter, error) {
+	letters := []deadLetter{}
+	if deadLetterDir == "" {
+		return letters, nil
+	}
+	entries, err := os.ReadDir(deadLetterDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		letter, err := readDeadLetter(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, *letter)
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].Time.Before(letters[j].Time)
+	})
+	return letters, nil
+}
+
+// countDeadLetters returns the number of the stored dead letters
+func countDeadLetters() int {
+	if deadLetterDir == "" {
+		return 0
+	}
+	entries, err := os.ReadDir(deadLetterDir)
+	if err != nil {
+		return 0
+	}
+	var count int
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			count++
+		}
+	}
+	return count
+}
+
+// readDeadLetter reads the dead letter by its id
+func readDeadLetter(id string) (*deadLetter, error) {
+	data, err := os.ReadFile(filepath.Join(deadLetterDir, filepath.Base(id)+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var letter deadLetter
+	if err := json.Unmarshal(data, &letter); err != nil {
+		return nil, fmt.Errorf("unable to parse the dead letter %v; %v", id, err)
+	}
+	return &letter, nil
+}
+
+// GET /dlq
+//
+// - Returns the events which failed on every site, along with the failure, oldest first
+func deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	letters, err := listDeadLetters()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(letters)
+}
+
+// replayResult represents the outcome of a replay of the dead letters
+type replayResult struct {
+	Replayed int      `json:"replayed"`
+	Skipped  int      `json:"skipped"`
+	Failed   int      `json:"failed"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// replayDeadLetters processes the dead letters of the user (all if empty) received within
+// the range again, removing the ones which succeed; the letters of the objects no longer existing
+// on any site are removed without being replayed, so that a deleted object is not counted again
+func replayDeadLetters(ctx context.Context, user string, since, until time.Time) (replayResult, error) {
+	result := replayResult{}
+	letters, err := listDeadLetters()
+	if err != nil {
+		return result, err
+	}
+	ctx = context.WithValue(ctx, replayKey, true)
+	for _, letter := range letters {
+		if (!since.IsZero() && letter.Time.Before(since)) || (!until.IsZero() && letter.Time.After(until)) {
+			continue
+		}
+		qe, err := parseEvent(letter.Event)
+		if user != "" && (err != nil || qe.User != user) {
+			continue
+		}
+		if err == nil && !qe.IsRemoval() {
+			found, err := verifyObject(ctx, qe)
+			if err != nil {
+				result.Failed++
+				result.Errors = append(result.Errors, fmt.Sprintf("%v: unable to verify '%v'; %v", letter.ID, qe.Path, err))
+				continue
+			}
+			if !found {
+				removeDeadLetter(ctx, letter.ID)
+				logf(ctx, "LOG", "", "skipped dead letter %v; '%v' no longer exists on any site", letter.ID, qe.Path)
+				result.Skipped++
+				continue
+			}
+		}
+		if err := processEvent(ctx, letter.Event); err != nil {
+			result.Failed++
+			result.Errors = append(result.Errors, fmt.Sprintf("%v: %v", letter.ID, err))
+			continue
+		}
+		removeDeadLetter(ctx, letter.ID)
+		logf(ctx, "LOG", "", "replayed dead letter %v of '%v'", letter.ID, letter.Event.S3.Object.Key)
+		result.Replayed++
+	}
+	incidents.checkDeadLetters(ctx)
+	return result, nil
+}
+
+// removeDeadLetter removes the dead letter, which may already be removed by its success
+func removeDeadLetter(ctx context.Context, id string) {
+	if err := os.Remove(filepath.Join(deadLetterDir, id+".json")); err != nil && !os.IsNotExist(err) {
+		logf(ctx, "ERROR", "", "unable to remove the replayed dead letter %v; %v", id, err)
+	}
+}
+
+// POST /dlq/replay?user=usera&since=2024-01-15T00:00:00Z&until=2024-01-15T12:00:00Z
+//
+//   - Processes the dead letters again through the update path, optionally only the ones of
+//     the user and/or received within the RFC3339 range
+//   - Removes the dead letters which succeed, and the ones of the objects no longer existing on
+//     any site, keeping the others
+func replayDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	query := r.URL.Query()
+	var since, until time.Time
+	for key, t := range map[string]*time.Time{"since": &since, "until": &until} {
+		value := query.Get(key)
+		if value == "" {
+			continue
+		}
+		var err error
+		if *t, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, fmt.Sprintf("invalid %v '%v'; %v", key, value, err), http.StatusBadRequest)
+			return
+		}
+	}
+	result, err := replayDeadLetters(ctx, query.Get("user"), since, until)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDeadLetters(t *testing.T) {
+	setupTestSites(t, 1)
+	saved := deadLetterDir
+	deadLetterDir = t.TempDir()
+	t.Cleanup(func() { deadLetterDir = saved })
+	ctx := context.Background()
+
+	event := testEvent("s3:ObjectCreated:Put", "usera", "a")
+	event.S3.Object.Sequencer = "17A1B2C3D4E5F607"
+	healthy := sites
+	sites = append(sites, newStoreSite("site2", nil))
+	for i := 0; i < 2; i++ {
+		if err := processEvent(ctx, event); err == nil {
+			t.Fatal("expected the delivery to fail")
+		}
+	}
+	if count := countDeadLetters(); count != 1 {
+		t.Fatalf("expected the failed deliveries to share 1 letter, got %v", count)
+	}
+
+	// the delivery succeeding removes its letter
+	sites = healthy
+	if err := processEvent(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	if count := countDeadLetters(); count != 0 {
+		t.Fatalf("expected the letter removed once the delivery succeeded, got %v", count)
+	}
+
+	// the letter of an object no longer existing is not replayed
+	storeDeadLetter(ctx, testEvent("s3:ObjectCreated:Put", "usera", "deleted"), context.DeadlineExceeded)
+	result, err := replayDeadLetters(ctx, "", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Skipped != 1 || result.Replayed != 0 || countDeadLetters() != 0 {
+		t.Fatalf("expected the letter skipped and removed, got %+v", result)
+	}
+	userQuota, _, err := readUserQuota(ctx, sites[0].Client(), "usera")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userQuota.Objects) != 1 {
+		t.Fatalf("expected the deleted object not counted, got %v", userQuota.Objects)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/notification"
+)
+
+// errInvalidEvent is the error of the events which cannot be counted however many times retried
+var errInvalidEvent = errors.New("invalid event")
+
+// notificationPayload represents the body of a MinIO bucket notification webhook
+type notificationPayload struct {
+	Records []notification.Event `json:"Records"`
+}
+
+// quotaEvent represents a bucket notification event parsed for the quota logic
+type quotaEvent struct {
+	Name      string
+	Time      time.Time
+	Path      string
+	Date      time.Time
+	User      string
+	Size      int64
+	ETag      string
+	Principal string
+	Source    string
+	Metadata  map[string]string
+}
+
+// parseEvent parses the notification event of the object DATE/USER/object
+func parseEvent(event notification.Event) (*quotaEvent, error) {
+	path, err := url.PathUnescape(event.S3.Object.Key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to escape the object path '%v'; %v", event.S3.Object.Key, err)
+	}
+	qe, err := parseObjectPath(path)
+	if err != nil {
+		return nil, err
+	}
+	qe.Name = event.EventName
+	qe.Size = event.S3.Object.Size
+	qe.ETag = event.S3.Object.ETag
+	qe.Principal = event.UserIdentity.PrincipalID
+	qe.Source = event.Source.Host
+	qe.Metadata = event.S3.Object.UserMetadata
+	if event.EventTime != "" {
+		if qe.Time, err = time.Parse(time.RFC3339Nano, event.EventTime); err != nil {
+			return nil, fmt.Errorf("unable to parse the event time '%v'; %v", event.EventTime, err)
+		}
+	}
+	return qe, nil
+}
+
+// parseObjectPath parses the object path DATE/USER/object
+func parseObjectPath(path string) (*quotaEvent, error) {
+	tokens := strings.Split(path, "/")
+	if len(tokens) < 3 {
+		return nil, fmt.Errorf("invalid path '%v'", path)
+	}
+	date, err := time.Parse(dateFormat, tokens[0])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the date '%v' in the '%v'; %v", tokens[0], path, err)
+	}
+	user := canonicalUser(tokens[1])
+	if err := validateUserName(user); err != nil {
+		return nil, fmt.Errorf("%w in the '%v'", err, path)
+	}
+	return &quotaEvent{Path: path, Date: date.UTC(), User: user}, nil
+}
+
+// validateUserPath validates that the object path DATE/USER/object belongs to the user
+func validateUserPath(path, user string) error {
+	tokens := strings.Split(path, "/")
+	if len(tokens) < 3 {
+		return fmt.Errorf("invalid path '%v'", path)
+	}
+	if _, err := time.Parse(dateFormat, tokens[0]); err != nil {
+		return fmt.Errorf("unable to parse the date '%v' in the '%v'; %v", tokens[0], path, err)
+	}
+	if err := validateUserName(canonicalUser(tokens[1])); err != nil {
+		return fmt.Errorf("%w in the '%v'", err, path)
+	}
+	if canonicalUser(tokens[1]) != user {
+		return fmt.Errorf("path '%v' does not belong to user '%v'", path, user)
+	}
+	return nil
+}
+
+// entry returns the quota entry of the object of the event
+func (qe *quotaEvent) entry() quotaEntry {
+	return quotaEntry{
+		Size:      qe.Size,
+		EventTime: qe.Time,
+		ETag:      qe.ETag,
+	}
+}
+
+// reservation returns the id of the reservation the object of the event was uploaded under, if any
+func (qe *quotaEvent) reservation() string {
+	for k, v := range qe.Metadata {
+		if strings.EqualFold(k, reservationMetadataKey) || strings.EqualFold(k, "X-Amz-Meta-"+reservationMetadataKey) {
+			return v
+		}
+	}
+	return ""
+}
+
+// IsRemoval returns true if the event frees the object from the quota
+func (qe *quotaEvent) IsRemoval() bool {
+	return strings.HasPrefix(qe.Name, "s3:ObjectRemoved:") ||
+		strings.HasPrefix(qe.Name, "s3:LifecycleExpiration:")
+}
+
+// isReplicaEvent returns true if the event is for an object written by bucket replication
+func isReplicaEvent(userMetadata map[string]string) bool {
+	for k, v := range userMetadata {
+		if strings.EqualFold(k, "X-Amz-Replication-Status") {
+			return strings.EqualFold(v, "REPLICA")
+		}
+	}
+	return false
+}
+
+// verifyObject returns true if the object of the event exists on any of the sites
+func verifyObject(ctx context.Context, qe *quotaEvent) (bool, error) {
+	var lastErr error
+	for _, site := range readOrder() {
+		if site.Client() == nil {
+			lastErr = errors.New("s3Client is nil")
+			continue
+		}
+		_, err := site.Client().StatObject(ctx, dataBucket, qe.Path, minio.StatObjectOptions{})
+		if err == nil {
+			return true, nil
+		}
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			logf(ctx, "WARNING", site.name, "unable to stat '%v'; %v", qe.Path, err)
+			lastErr = err
+		}
+	}
+	// the object may be on the unreachable site
+	return false, lastErr
+}
+
+// processEvent applies the bucket notification event on the user quota
+func processEvent(ctx context.Context, event notification.Event) error {
+	qe, err := admitEvent(ctx, event)
+	if err != nil || qe == nil {
+		return err
+	}
+	ctx = withLogUser(ctx, qe.User)
+	if qe.IsRemoval() {
+		return finishEvent(ctx, event, qe, removeQuota(ctx, qe))
+	}
+	return finishEvent(ctx, event, qe, updateQuota(ctx, qe))
+}
+
+// admitEvent parses the bucket notification event and runs the checks of its user; returns nil
+// for the events skipped on purpose, and the error of the events failing a check
+func admitEvent(ctx context.Context, event notification.Event) (*quotaEvent, error) {
+	if event.S3.Bucket.Name == "" || event.S3.Object.Key == "" {
+		logf(ctx, "ERROR", "", "bucket or object found to be empty")
+		return nil, nil
+	}
+	if replicationDedup && isReplicaEvent(event.S3.Object.UserMetadata) {
+		// the origin site sends its own event for this object
+		logf(ctx, "LOG", "", "skipping replica event for '%v'", event.S3.Object.Key)
+		countEvent("skipped")
+		return nil, nil
+	}
+	if originSite != "" && !origins.accept(ctx, event) {
+		// the active origin site sends its own event for this object; buffered in case it does not
+		logf(ctx, "LOG", "", "skipping '%v' from site %v; counting the events of site %v", event.S3.Object.Key, eventOrigin(event), activeOrigin())
+		countEvent("skipped")
+		return nil, nil
+	}
+	qe, err := parseEvent(event)
+	if err != nil {
+		if errors.Is(err, errInvalidUser) {
+			logf(ctx, "WARNING", "", "ignoring '%v'; %v", event.S3.Object.Key, err)
+			// purposefully not failing, as the retries of the event cannot make the user valid
+			countEvent("invalid_user")
+			return nil, nil
+		}
+		logf(ctx, "ERROR", "", "%v", err)
+		return nil, fmt.Errorf("%w; %v", errInvalidEvent, err)
+	}
+	ctx = withLogUser(ctx, qe.User)
+	if isTooLate(qe.Date) {
+		logf(ctx, "ERROR", "", "unable to update the quota; the date found in the path '%v' is older than the current date", qe.Path)
+		// purposefully not failing because we don't want such events to be retried
+		countEvent("dropped_late")
+		return nil, nil
+	}
+	if qe.IsRemoval() {
+		return qe, nil
+	}
+	if qe.Size < minObjectSize {
+		logf(ctx, "LOG", "", "ignoring '%v'; %v bytes is below the minimum object size", qe.Path, qe.Size)
+		countEvent("ignored")
+		return nil, nil
+	}
+	if len(countTags) > 0 {
+		counted, err := matchCountTags(ctx, qe)
+		if err != nil {
+			countEvent("failed")
+			return nil, fmt.Errorf("unable to read the tags of '%v'; %v", qe.Path, err)
+		}
+		if !counted {
+			logf(ctx, "LOG", "", "ignoring '%v'; the object has none of the tags counted", qe.Path)
+			countEvent("ignored")
+			return nil, nil
+		}
+	}
+	if verifyObjects {
+		found, err := verifyObject(ctx, qe)
+		if err != nil {
+			countEvent("failed")
+			return nil, fmt.Errorf("unable to verify '%v'; %v", qe.Path, err)
+		}
+		if !found {
+			logf(ctx, "WARNING", "", "ignoring '%v'; the object does not exist on any site", qe.Path)
+			countEvent("unverified")
+			return nil, nil
+		}
+	}
+	if userRateLimiter != nil && !userRateLimiter.allow(qe.User) {
+		logf(ctx, "WARNING", "", "rejecting '%v' of user '%v'; %v", qe.Path, qe.User, errRateLimited)
+		countEvent("rate_limited")
+		return nil, fmt.Errorf("unable to update quota; %w", errRateLimited)
+	}
+	if err := blocked.check(ctx, qe.User); err != nil {
+		logf(ctx, "WARNING", "", "rejecting '%v' of user '%v'; %v", qe.Path, qe.User, err)
+		countEvent("blocked")
+		return nil, fmt.Errorf("unable to update quota; %w", err)
+	}
+	return qe, nil
+}
+
+// finishEvent counts the event applied on the user quota, enforcing the limit on the updates
+// rejected by it and dead-lettering the failed ones
+func finishEvent(ctx context.Context, event notification.Event, qe *quotaEvent, err error) error {
+	if qe.IsRemoval() {
+		if err != nil {
+			countEvent("failed")
+			storeDeadLetter(ctx, event, err)
+			return fmt.Errorf("unable to update quota; %v", err)
+		}
+		logf(ctx, "LOG", "", "removed '%v' from the quota of '%v'", qe.Path, qe.User)
+		countEvent("removed")
+		clearDeadLetter(ctx, event)
+		return nil
+	}
+	if err != nil {
+		if errors.Is(err, errMaxLimitExceeded) {
+			rejections.add(qe.User)
+			usage.reject(qe.User)
+		}
+		if errors.Is(err, errOverLimitMonitored) || errors.Is(err, errMaxLimitExceeded) {
+			return enforce(ctx, event, qe, err)
+		}
+		if errors.Is(err, errMaxUsersExceeded) {
+			// not retried from the dead letters but by MinIO, answered 503; the user is created once there is room
+			countEvent("max_users")
+			return fmt.Errorf("unable to update quota; %w", err)
+		}
+		countEvent("failed")
+		storeDeadLetter(ctx, event, err)
+		return fmt.Errorf("unable to update quota; %v", err)
+	}
+	logf(ctx, "LOG", "", "updated quota for '%v' with '%v' (%v bytes) uploaded by '%v'", qe.User, qe.Path, qe.Size, qe.Principal)
+	countEvent("updated")
+	clearDeadLetter(ctx, event)
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"expvar"
+	"sync/atomic"
+)
+
+// the runtime counters published by expvar on GET /admin/debug/vars, for the environments
+// without Prometheus
+var (
+	expEvents  = expvar.NewMap("events")
+	expChecks  = expvar.NewMap("checks")
+	expShed    = expvar.NewMap("shed_requests")
+	expCache   = expvar.NewMap("manifest_cache")
+	expQuotas  = expvar.NewMap("manifests")
+	expRepairs = expvar.NewMap("read_repairs")
+	expHedges  = expvar.NewMap("hedged_checks")
+)
+
+func init() {
+	expvar.Publish("queues", expvar.Func(queueDepths))
+}
+
+// queueDepths returns the depths of the in-memory queues; the writes deferred per quarantined
+// site, the stored dead letters, the update requests in flight and the queued read-repairs
+func queueDepths() interface{} {
+	pending := map[string]int{}
+	for _, site := range sites {
+		pending[site.name] = site.PendingWrites()
+	}
+	return map[string]interface{}{
+		"pendingWrites":  pending,
+		"deadLetters":    countDeadLetters(),
+		"inflightUpdate": atomic.LoadInt64(&shedding.inflight),
+		"readRepairs":    readRepairs.depth(),
+	}
+}
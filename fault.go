@@ -0,0 +1,17 @@
+//go:build !dev
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// injectFaults returns the transport as is; the faults are injected in the dev builds only
+func injectFaults(site string, rt http.RoundTripper) http.RoundTripper {
+	return rt
+}
+
+// registerFaultRoutes registers nothing; the fault endpoints are served by the dev builds only
+func registerFaultRoutes(router *mux.Router) {}
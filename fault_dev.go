@@ -0,0 +1,151 @@
+//go:build dev
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	faults = &faultRegistry{sites: map[string]fault{}}
+
+	errInjectedFault = errors.New("injected fault")
+)
+
+// fault represents the faults injected into the requests to a site
+type fault struct {
+	// Latency is added to every request
+	Latency string `json:"latency,omitempty"`
+	// ErrorRate is the fraction of the requests failed, between 0 and 1
+	ErrorRate float64 `json:"errorRate,omitempty"`
+	// StatusCode is responded for the failed requests; a connection error if zero
+	StatusCode int `json:"statusCode,omitempty"`
+
+	latency time.Duration
+}
+
+// faultRegistry keeps the faults injected per site
+type faultRegistry struct {
+	mu    sync.RWMutex
+	sites map[string]fault
+}
+
+func (r *faultRegistry) get(site string) (fault, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	f, ok := r.sites[site]
+	return f, ok
+}
+
+// faultTransport injects the faults of the site into its requests
+type faultTransport struct {
+	site string
+	next http.RoundTripper
+}
+
+// RoundTrip delays and fails the request as configured for the site
+func (t faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f, ok := faults.get(t.site)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	if f.latency > 0 {
+		select {
+		case <-time.After(f.latency):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	if f.ErrorRate > 0 && rand.Float64() < f.ErrorRate {
+		if f.StatusCode == 0 {
+			return nil, errInjectedFault
+		}
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %v", f.StatusCode, http.StatusText(f.StatusCode)),
+			StatusCode: f.StatusCode,
+			Proto:      req.Proto,
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	}
+	return t.next.RoundTrip(req)
+}
+
+// injectFaults wraps the transport of the site to inject the configured faults
+func injectFaults(site string, rt http.RoundTripper) http.RoundTripper {
+	return faultTransport{site: site, next: rt}
+}
+
+// registerFaultRoutes registers the endpoints to inject the faults
+func registerFaultRoutes(router *mux.Router) {
+	router.Handle("/admin/faults", adminAuth(http.HandlerFunc(listFaultsHandler))).Methods("GET")
+	router.Handle("/admin/faults/{name}", adminAuth(http.HandlerFunc(injectFaultHandler))).Methods("PUT")
+	router.Handle("/admin/faults/{name}", adminAuth(http.HandlerFunc(clearFaultHandler))).Methods("DELETE")
+}
+
+// GET /admin/faults
+//
+// - Returns the faults injected per site
+func listFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	faults.mu.RLock()
+	defer faults.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(faults.sites)
+}
+
+// PUT /admin/faults/{name}
+//
+// - Injects the latency and the errors of the body into the requests to the site
+func injectFaultHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	name := mux.Vars(r)["name"]
+	if findSite(name) == nil {
+		http.Error(w, fmt.Sprintf("site %v is not configured", name), http.StatusNotFound)
+		return
+	}
+	var f fault
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		http.Error(w, fmt.Sprintf("unable to parse the body; %v", err), http.StatusBadRequest)
+		return
+	}
+	if f.Latency != "" {
+		var err error
+		if f.latency, err = time.ParseDuration(f.Latency); err != nil {
+			http.Error(w, fmt.Sprintf("invalid latency '%v'; %v", f.Latency, err), http.StatusBadRequest)
+			return
+		}
+	}
+	if f.ErrorRate < 0 || f.ErrorRate > 1 {
+		http.Error(w, "errorRate must be between 0 and 1", http.StatusBadRequest)
+		return
+	}
+	faults.mu.Lock()
+	faults.sites[name] = f
+	faults.mu.Unlock()
+	logf(ctx, "WARNING", name, "injecting faults; latency: %v, error rate: %v", f.latency, f.ErrorRate)
+}
+
+// DELETE /admin/faults/{name}
+//
+// - Stops injecting the faults into the requests to the site
+func clearFaultHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	name := mux.Vars(r)["name"]
+	faults.mu.Lock()
+	delete(faults.sites, name)
+	faults.mu.Unlock()
+	logf(ctx, "LOG", name, "cleared the injected faults")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/minio/pkg/env"
+)
+
+// featureFlags are the registered flags by their names
+var featureFlags = map[string]*featureFlag{}
+
+// featureFlag gates a risky behavior, so that it can be rolled out per environment
+type featureFlag struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+}
+
+// newFeatureFlag registers a flag turned on or off by default, until set by the FEATURE_FLAGS
+// env or its own FEATURE_{NAME} env
+func newFeatureFlag(name, description string, enabled bool) *featureFlag {
+	flag := &featureFlag{Name: name, Description: description, Enabled: enabled}
+	featureFlags[name] = flag
+	return flag
+}
+
+// enabled returns true if the behavior gated by the flag is turned on
+func (f *featureFlag) enabled() bool {
+	return f.Enabled
+}
+
+// loadFeatureFlags turns on the flags listed in the FEATURE_FLAGS env, and the ones set by
+// their own FEATURE_{NAME} env like FEATURE_READ_REPAIR_WRITES=off
+func loadFeatureFlags() error {
+	for _, name := range parseList(env.Get("FEATURE_FLAGS", "")) {
+		flag, ok := featureFlags[name]
+		if !ok {
+			return fmt.Errorf("unknown feature flag %v in FEATURE_FLAGS", name)
+		}
+		flag.Enabled = true
+	}
+	for name, flag := range featureFlags {
+		key := "FEATURE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		switch value := env.Get(key, ""); value {
+		case "":
+		case "on":
+			flag.Enabled = true
+		case "off":
+			flag.Enabled = false
+		default:
+			return fmt.Errorf("invalid %v %v; must be on or off", key, value)
+		}
+	}
+	return nil
+}
+
+// listFeatureFlags returns the registered flags sorted by their names
+func listFeatureFlags() []featureFlag {
+	flags := make([]featureFlag, 0, len(featureFlags))
+	for _, flag := range featureFlags {
+		flags = append(flags, *flag)
+	}
+	sort.Slice(flags, func(i, j int) bool {
+		return flags[i].Name < flags[j].Name
+	})
+	return flags
+}
+
+// GET /admin/flags
+//
+// - Returns the registered feature flags and whether they are turned on
+func flagsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listFeatureFlags())
+}
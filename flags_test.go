@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadFeatureFlags(t *testing.T) {
+	testCases := []struct {
+		envs     map[string]string
+		expected map[string]bool
+		err      string
+	}{
+		{
+			expected: map[string]bool{"read-repair-writes": true, "user-name-migration": true},
+		},
+		{
+			envs:     map[string]string{"FEATURE_READ_REPAIR_WRITES": "off"},
+			expected: map[string]bool{"read-repair-writes": false, "user-name-migration": true},
+		},
+		{
+			envs:     map[string]string{"FEATURE_FLAGS": "read-repair-writes", "FEATURE_USER_NAME_MIGRATION": "off"},
+			expected: map[string]bool{"read-repair-writes": true, "user-name-migration": false},
+		},
+		{envs: map[string]string{"FEATURE_FLAGS": "quorum-writes"}, err: "unknown feature flag quorum-writes"},
+		{envs: map[string]string{"FEATURE_USER_NAME_MIGRATION": "yes"}, err: "must be on or off"},
+	}
+	for i, testCase := range testCases {
+		t.Run("", func(t *testing.T) {
+			saved := map[string]bool{}
+			for name, flag := range featureFlags {
+				saved[name] = flag.Enabled
+			}
+			t.Cleanup(func() {
+				for name, enabled := range saved {
+					featureFlags[name].Enabled = enabled
+				}
+			})
+			for key, value := range testCase.envs {
+				t.Setenv(key, value)
+			}
+			err := loadFeatureFlags()
+			if testCase.err != "" {
+				if err == nil || !strings.Contains(err.Error(), testCase.err) {
+					t.Fatalf("case %v: expected the error '%v', got %v", i+1, testCase.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("case %v: unexpected error; %v", i+1, err)
+			}
+			for name, enabled := range testCase.expected {
+				if featureFlags[name].enabled() != enabled {
+					t.Errorf("case %v: expected %v to be %v", i+1, name, enabled)
+				}
+			}
+		})
+	}
+}
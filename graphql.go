@@ -0,0 +1,560 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// gqlMaxRequestSize is the max size in bytes of the body of a GraphQL request
+	gqlMaxRequestSize = 64 << 10
+	// gqlMaxDepth is the max nesting of the selection sets of a GraphQL query
+	gqlMaxDepth = 16
+)
+
+// gqlRequest represents the body of a GraphQL request
+type gqlRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// gqlError represents an error of a GraphQL response
+type gqlError struct {
+	Message string   `json:"message"`
+	Path    []string `json:"path,omitempty"`
+}
+
+// gqlResponse represents the body of a GraphQL response
+type gqlResponse struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []gqlError             `json:"errors,omitempty"`
+}
+
+// gqlField represents a field selected by a GraphQL query
+type gqlField struct {
+	alias  string
+	name   string
+	args   map[string]interface{}
+	fields []gqlField
+}
+
+// gqlVariable represents a reference to a variable in the arguments of a field
+type gqlVariable string
+
+// gqlResolver resolves a root field of the schema from the arguments of the field
+type gqlResolver func(ctx context.Context, args map[string]interface{}) (interface{}, error)
+
+// gqlResolvers are the root fields of the read-only schema, returning the same types as the REST endpoints
+var gqlResolvers = map[string]gqlResolver{
+	// users(minUsedPercent: Float, first: Int): [quotaUsage], closest to their limit first
+	"users": func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+		minUsedPercent, err := gqlFloatArg(args, "minUsedPercent")
+		if err != nil {
+			return nil, err
+		}
+		first, err := gqlFloatArg(args, "first")
+		if err != nil {
+			return nil, err
+		}
+		usages, err := listUsage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		filtered := []*quotaUsage{}
+		for _, usage := range usages {
+			if usage.usedPercent() >= minUsedPercent {
+				filtered = append(filtered, usage)
+			}
+		}
+		sort.SliceStable(filtered, func(i, j int) bool {
+			return filtered[i].usedPercent() > filtered[j].usedPercent()
+		})
+		if first > 0 && int(first) < len(filtered) {
+			filtered = filtered[:int(first)]
+		}
+		return filtered, nil
+	},
+	// user(name: String!): quotaUsage
+	"user": func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+		user, err := gqlStringArg(args, "name", true)
+		if err != nil {
+			return nil, err
+		}
+		// as the {user} of the REST endpoints
+		return readUsage(ctx, canonicalUser(user))
+	},
+	// history(user: String!, from: String, to: String): [dayUsage], the last 7 days by default
+	"history": func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+		user, err := gqlStringArg(args, "user", true)
+		if err != nil {
+			return nil, err
+		}
+		to := getCurrentDateInUTC()
+		from := to.AddDate(0, 0, -6)
+		for _, param := range []struct {
+			name string
+			t    *time.Time
+		}{{"from", &from}, {"to", &to}} {
+			value, err := gqlStringArg(args, param.name, false)
+			if err != nil {
+				return nil, err
+			}
+			if value == "" {
+				continue
+			}
+			if *param.t, err = parseHistoryDate(value); err != nil {
+				return nil, fmt.Errorf("invalid %v '%v'; %v", param.name, value, err)
+			}
+		}
+		return readUsageHistory(ctx, canonicalUser(user), from, to)
+	},
+	// stats: usageStats
+	"stats": func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+		usages, err := listUsage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return getUsageStats(usages), nil
+	},
+	// sites: [siteStatus]
+	"sites": func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+		return getStatus(ctx).Sites, nil
+	},
+	// status: serverStatus
+	"status": func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+		return getStatus(ctx), nil
+	},
+}
+
+// gqlAdminFields are the root fields resolved on /admin/graphql only, as their REST endpoints
+// are admin endpoints
+var gqlAdminFields = map[string]bool{
+	"sites":  true,
+	"status": true,
+}
+
+// GET /graphql?query={...}
+// POST /graphql
+//
+//   - Parses the read-only GraphQL query, with the root fields users, user, history and stats
+//   - Resolves the root fields and returns only the fields selected, named after the JSON fields
+//     of the REST endpoints
+func graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	serveGraphQL(w, r, false)
+}
+
+// GET /admin/graphql?query={...}
+// POST /admin/graphql
+//
+//   - Same as /graphql, along with the admin root fields sites and status
+func adminGraphqlHandler(w http.ResponseWriter, r *http.Request) {
+	serveGraphQL(w, r, true)
+}
+
+func serveGraphQL(w http.ResponseWriter, r *http.Request, admin bool) {
+	ctx := requestContext(r)
+	var req gqlRequest
+	if r.Method == http.MethodGet {
+		req.Query = r.URL.Query().Get("query")
+		if value := r.URL.Query().Get("variables"); value != "" {
+			if err := json.Unmarshal([]byte(value), &req.Variables); err != nil {
+				http.Error(w, fmt.Sprintf("invalid variables; %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+	} else if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, gqlMaxRequestSize)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("unable to decode the request; %v", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fields, err := parseGraphQL(req.Query)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(gqlResponse{Errors: []gqlError{{Message: err.Error()}}})
+		return
+	}
+	json.NewEncoder(w).Encode(executeGraphQL(ctx, fields, req.Variables, admin))
+}
+
+// executeGraphQL resolves the root fields of the query, along with the admin fields if admin;
+// a failed field is returned as null along with its error, as the other fields are still returned
+func executeGraphQL(ctx context.Context, fields []gqlField, variables map[string]interface{}, admin bool) gqlResponse {
+	resp := gqlResponse{Data: map[string]interface{}{}}
+	for _, field := range fields {
+		key := field.key()
+		resp.Data[key] = nil
+		resolve, ok := gqlResolvers[field.name]
+		if !ok {
+			resp.Errors = append(resp.Errors, gqlError{Message: fmt.Sprintf("unknown field '%v'", field.name), Path: []string{key}})
+			continue
+		}
+		if gqlAdminFields[field.name] && !admin {
+			resp.Errors = append(resp.Errors, gqlError{Message: fmt.Sprintf("field '%v' is served by /admin/graphql only", field.name), Path: []string{key}})
+			continue
+		}
+		args, err := field.resolveArgs(variables)
+		if err == nil {
+			var value interface{}
+			if value, err = resolve(ctx, args); err == nil {
+				resp.Data[key], err = selectFields(reflect.ValueOf(value), field.fields)
+			}
+		}
+		if err != nil {
+			resp.Errors = append(resp.Errors, gqlError{Message: err.Error(), Path: []string{key}})
+		}
+	}
+	return resp
+}
+
+// key returns the name of the field in the response
+func (f gqlField) key() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+// resolveArgs replaces the variables in the arguments of the field by their values
+func (f gqlField) resolveArgs(variables map[string]interface{}) (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+	for name, value := range f.args {
+		if variable, ok := value.(gqlVariable); ok {
+			v, ok := variables[string(variable)]
+			if !ok {
+				return nil, fmt.Errorf("variable '$%v' is not provided", variable)
+			}
+			value = v
+		}
+		args[name] = value
+	}
+	return args, nil
+}
+
+// gqlStringArg returns the string argument of the field
+func gqlStringArg(args map[string]interface{}, name string, required bool) (string, error) {
+	value, ok := args[name]
+	if !ok || value == nil {
+		if required {
+			return "", fmt.Errorf("argument '%v' is required", name)
+		}
+		return "", nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("argument '%v' must be a string", name)
+	}
+	return s, nil
+}
+
+// gqlFloatArg returns the numeric argument of the field, 0 if not provided
+func gqlFloatArg(args map[string]interface{}, name string) (float64, error) {
+	value, ok := args[name]
+	if !ok || value == nil {
+		return 0, nil
+	}
+	f, ok := value.(float64)
+	if !ok {
+		return 0, fmt.Errorf("argument '%v' must be a number", name)
+	}
+	return f, nil
+}
+
+// selectFields returns the fields of the value selected by the query, looked up by their JSON names;
+// the maps and the scalars are returned as is
+func selectFields(v reflect.Value, fields []gqlField) (interface{}, error) {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Invalid:
+		return nil, nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return []interface{}{}, nil
+		}
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			item, err := selectFields(v.Index(i), fields)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	case reflect.Struct:
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("fields must be selected on '%v'", v.Type().Name())
+		}
+		selected := map[string]interface{}{}
+		for _, field := range fields {
+			index := jsonFieldIndex(v.Type(), field.name)
+			if index < 0 {
+				return nil, fmt.Errorf("unknown field '%v' on '%v'", field.name, v.Type().Name())
+			}
+			value, err := selectFields(v.Field(index), field.fields)
+			if err != nil {
+				return nil, err
+			}
+			selected[field.key()] = value
+		}
+		return selected, nil
+	default:
+		if len(fields) > 0 {
+			return nil, fmt.Errorf("fields cannot be selected on '%v'", v.Type())
+		}
+		return v.Interface(), nil
+	}
+}
+
+// jsonFieldIndex returns the index of the exported field of the struct with the JSON name, -1 if none
+func jsonFieldIndex(t reflect.Type, name string) int {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if tag == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// gqlParser parses the subset of the GraphQL query language needed by a read-only schema:
+// an optional query operation, fields, aliases and arguments of literals or variables
+type gqlParser struct {
+	query string
+	pos   int
+	// depth is the nesting of the selection set being parsed
+	depth int
+}
+
+// parseGraphQL parses the query into its root fields
+func parseGraphQL(query string) ([]gqlField, error) {
+	p := &gqlParser{query: query}
+	if name := p.peekName(); name != "" {
+		if name != "query" {
+			return nil, fmt.Errorf("unsupported operation '%v'; only queries are supported", name)
+		}
+		p.name()
+		p.name() // the operation name, if any
+		if p.peek() == '(' {
+			// the variable definitions; the variables are checked when used
+			if err := p.skipParens(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	fields, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != 0 {
+		return nil, p.errorf("unexpected '%c'", p.peek())
+	}
+	return fields, nil
+}
+
+func (p *gqlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at %v: %v", p.pos, fmt.Sprintf(format, args...))
+}
+
+// peek skips the ignored tokens and returns the next character, 0 at the end
+func (p *gqlParser) peek() byte {
+	for p.pos < len(p.query) {
+		c := p.query[p.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.query) && p.query[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return c
+		}
+	}
+	return 0
+}
+
+func (p *gqlParser) expect(c byte) error {
+	if p.peek() != c {
+		if p.peek() == 0 {
+			return p.errorf("expected '%c', found the end", c)
+		}
+		return p.errorf("expected '%c', found '%c'", c, p.peek())
+	}
+	p.pos++
+	return nil
+}
+
+func isNameChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+// peekName returns the next name without consuming it
+func (p *gqlParser) peekName() string {
+	pos := p.pos
+	name := p.name()
+	p.pos = pos
+	return name
+}
+
+// name consumes the next name, empty if the next token is not a name
+func (p *gqlParser) name() string {
+	if c := p.peek(); c == 0 || !isNameChar(c, true) {
+		return ""
+	}
+	start := p.pos
+	for p.pos < len(p.query) && isNameChar(p.query[p.pos], false) {
+		p.pos++
+	}
+	return p.query[start:p.pos]
+}
+
+func (p *gqlParser) skipParens() error {
+	depth := 0
+	for p.pos < len(p.query) {
+		switch p.query[p.pos] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+		p.pos++
+		if depth == 0 {
+			return nil
+		}
+	}
+	return p.errorf("unterminated '('")
+}
+
+func (p *gqlParser) selectionSet() ([]gqlField, error) {
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	if p.depth++; p.depth > gqlMaxDepth {
+		return nil, p.errorf("selection sets nested deeper than %v", gqlMaxDepth)
+	}
+	defer func() { p.depth-- }()
+	var fields []gqlField
+	for p.peek() != '}' {
+		field, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	p.pos++
+	if len(fields) == 0 {
+		return nil, p.errorf("empty selection")
+	}
+	return fields, nil
+}
+
+func (p *gqlParser) field() (gqlField, error) {
+	var field gqlField
+	if field.name = p.name(); field.name == "" {
+		if p.peek() == 0 {
+			return field, p.errorf("expected a field, found the end")
+		}
+		return field, p.errorf("expected a field, found '%c'", p.peek())
+	}
+	if p.peek() == ':' {
+		p.pos++
+		field.alias = field.name
+		if field.name = p.name(); field.name == "" {
+			return field, p.errorf("expected a field after the alias '%v'", field.alias)
+		}
+	}
+	if p.peek() == '(' {
+		p.pos++
+		field.args = map[string]interface{}{}
+		for p.peek() != ')' {
+			name := p.name()
+			if name == "" {
+				return field, p.errorf("expected an argument of '%v'", field.name)
+			}
+			if err := p.expect(':'); err != nil {
+				return field, err
+			}
+			value, err := p.value()
+			if err != nil {
+				return field, err
+			}
+			field.args[name] = value
+		}
+		p.pos++
+	}
+	if p.peek() == '{' {
+		fields, err := p.selectionSet()
+		if err != nil {
+			return field, err
+		}
+		field.fields = fields
+	}
+	return field, nil
+}
+
+func (p *gqlParser) value() (interface{}, error) {
+	switch c := p.peek(); {
+	case c == '$':
+		p.pos++
+		name := p.name()
+		if name == "" {
+			return nil, p.errorf("expected a variable name")
+		}
+		return gqlVariable(name), nil
+	case c == '"':
+		start := p.pos
+		for p.pos++; p.pos < len(p.query); p.pos++ {
+			switch p.query[p.pos] {
+			case '\\':
+				p.pos++
+			case '"':
+				p.pos++
+				s, err := strconv.Unquote(p.query[start:p.pos])
+				if err != nil {
+					return nil, p.errorf("invalid string; %v", err)
+				}
+				return s, nil
+			}
+		}
+		return nil, p.errorf("unterminated string")
+	case c == '-' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos++; p.pos < len(p.query) && strings.IndexByte("0123456789.eE+-", p.query[p.pos]) >= 0; p.pos++ {
+		}
+		f, err := strconv.ParseFloat(p.query[start:p.pos], 64)
+		if err != nil {
+			return nil, p.errorf("invalid number '%v'", p.query[start:p.pos])
+		}
+		return f, nil
+	default:
+		switch name := p.name(); name {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		case "":
+			return nil, p.errorf("expected a value")
+		default:
+			// enum values are passed as strings
+			return name, nil
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseGraphQL(t *testing.T) {
+	testCases := []struct {
+		query    string
+		expected []gqlField
+		err      string
+	}{
+		{
+			query:    "{ stats { users } }",
+			expected: []gqlField{{name: "stats", fields: []gqlField{{name: "users"}}}},
+		},
+		{
+			query: `query Top($n: Int) { top: users(first: $n, minUsedPercent: 50.5) { user, objects } }`,
+			expected: []gqlField{{
+				alias:  "top",
+				name:   "users",
+				args:   map[string]interface{}{"first": gqlVariable("n"), "minUsedPercent": 50.5},
+				fields: []gqlField{{name: "user"}, {name: "objects"}},
+			}},
+		},
+		{
+			query: "{\n  # the usage of usera\n  user(name: \"user\\\"a\") { days { date } }\n}",
+			expected: []gqlField{{
+				name:   "user",
+				args:   map[string]interface{}{"name": `user"a`},
+				fields: []gqlField{{name: "days", fields: []gqlField{{name: "date"}}}},
+			}},
+		},
+		{
+			query:    "{ history(user: null, from: -1, to: true) { date } }",
+			expected: []gqlField{{name: "history", args: map[string]interface{}{"user": nil, "from": -1.0, "to": true}, fields: []gqlField{{name: "date"}}}},
+		},
+		{query: "mutation { users { user } }", err: "only queries are supported"},
+		{query: "{ }", err: "empty selection"},
+		{query: "{ users { user }", err: "expected a field, found the end"},
+		{query: "{ users } }", err: "unexpected '}'"},
+		{query: "{ a: { user } }", err: "expected a field after the alias 'a'"},
+		{query: `{ user(name: "usera) { user } }`, err: "unterminated string"},
+		{query: "{ user(name: ) { user } }", err: "expected a value"},
+		{query: "{ user(name: $) { user } }", err: "expected a variable name"},
+		{query: "query($u: String { user { user } }", err: "unterminated '('"},
+		{query: strings.Repeat("{ a ", gqlMaxDepth) + "{ a }" + strings.Repeat(" }", gqlMaxDepth), err: "nested deeper than 16"},
+	}
+	for i, testCase := range testCases {
+		fields, err := parseGraphQL(testCase.query)
+		if testCase.err != "" {
+			if err == nil || !strings.Contains(err.Error(), testCase.err) {
+				t.Errorf("case %v: expected the error '%v', got %v", i+1, testCase.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %v: unexpected error; %v", i+1, err)
+			continue
+		}
+		if !reflect.DeepEqual(fields, testCase.expected) {
+			t.Errorf("case %v: expected %#v, got %#v", i+1, testCase.expected, fields)
+		}
+	}
+}
+
+func TestSelectFields(t *testing.T) {
+	usage := &quotaUsage{User: "usera", Objects: 2, Limit: 3, Days: []dayUsage{{Objects: 2}}}
+	testCases := []struct {
+		fields   []gqlField
+		expected interface{}
+		err      string
+	}{
+		{
+			fields:   []gqlField{{name: "user"}, {alias: "count", name: "objects"}},
+			expected: map[string]interface{}{"user": "usera", "count": 2},
+		},
+		{
+			fields:   []gqlField{{name: "days", fields: []gqlField{{name: "objects"}}}},
+			expected: map[string]interface{}{"days": []interface{}{map[string]interface{}{"objects": 2}}},
+		},
+		{fields: nil, err: "fields must be selected on 'quotaUsage'"},
+		{fields: []gqlField{{name: "secret"}}, err: "unknown field 'secret' on 'quotaUsage'"},
+		{fields: []gqlField{{name: "user", fields: []gqlField{{name: "x"}}}}, err: "fields cannot be selected on 'string'"},
+	}
+	for i, testCase := range testCases {
+		selected, err := selectFields(reflect.ValueOf(usage), testCase.fields)
+		if testCase.err != "" {
+			if err == nil || err.Error() != testCase.err {
+				t.Errorf("case %v: expected the error '%v', got %v", i+1, testCase.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %v: unexpected error; %v", i+1, err)
+			continue
+		}
+		if !reflect.DeepEqual(selected, testCase.expected) {
+			t.Errorf("case %v: expected %v, got %v", i+1, testCase.expected, selected)
+		}
+	}
+}
+
+func TestExecuteGraphQL(t *testing.T) {
+	setupTestSites(t, 1)
+	ctx := context.Background()
+	for _, object := range []string{"a", "b"} {
+		if err := processEvent(ctx, testEvent("s3:ObjectCreated:Put", "usera", object)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := processEvent(ctx, testEvent("s3:ObjectCreated:Put", "userb", "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		query     string
+		variables map[string]interface{}
+		admin     bool
+		expected  string
+	}{
+		{
+			query:     "query($u: String!) { user(name: $u) { user objects limit } }",
+			variables: map[string]interface{}{"u": "usera"},
+			expected:  `{"data":{"user":{"limit":3,"objects":2,"user":"usera"}}}`,
+		},
+		{
+			query:    "{ top: users(first: 1) { user objects } stats { users objects } }",
+			expected: `{"data":{"stats":{"objects":3,"users":2},"top":[{"objects":2,"user":"usera"}]}}`,
+		},
+		{
+			query:    "{ users(minUsedPercent: 50) { user } }",
+			expected: `{"data":{"users":[{"user":"usera"}]}}`,
+		},
+		{
+			query:    "{ user(name: $u) { user } }",
+			expected: `{"data":{"user":null},"errors":[{"message":"variable '$u' is not provided","path":["user"]}]}`,
+		},
+		{
+			query:    "{ user { user } }",
+			expected: `{"data":{"user":null},"errors":[{"message":"argument 'name' is required","path":["user"]}]}`,
+		},
+		{
+			query:    "{ unknown { user } }",
+			expected: `{"data":{"unknown":null},"errors":[{"message":"unknown field 'unknown'","path":["unknown"]}]}`,
+		},
+		{
+			query:    "{ sites { name } status { sites { name } } }",
+			expected: `{"data":{"sites":null,"status":null},"errors":[{"message":"field 'sites' is served by /admin/graphql only","path":["sites"]},{"message":"field 'status' is served by /admin/graphql only","path":["status"]}]}`,
+		},
+		{
+			query:    "{ sites { name } }",
+			admin:    true,
+			expected: `{"data":{"sites":[{"name":"site1"}]}}`,
+		},
+	}
+	for i, testCase := range testCases {
+		fields, err := parseGraphQL(testCase.query)
+		if err != nil {
+			t.Fatalf("case %v: %v", i+1, err)
+		}
+		data, err := json.Marshal(executeGraphQL(ctx, fields, testCase.variables, testCase.admin))
+		if err != nil {
+			t.Fatalf("case %v: %v", i+1, err)
+		}
+		if string(data) != testCase.expected {
+			t.Errorf("case %v: expected %v, got %v", i+1, testCase.expected, string(data))
+		}
+	}
+}
+
+func TestExecuteGraphQLCanonicalUser(t *testing.T) {
+	setupTestSites(t, 1)
+	userNameCaseInsensitive = true
+	t.Cleanup(func() { userNameCaseInsensitive = false })
+	ctx := context.Background()
+	if err := processEvent(ctx, testEvent("s3:ObjectCreated:Put", "alice", "a")); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"Alice", "alice"} {
+		fields, err := parseGraphQL(`query($u: String!) { user(name: $u) { user objects } history(user: $u) { objects } }`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(executeGraphQL(ctx, fields, map[string]interface{}{"u": user}, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := `{"data":{"history":[{"objects":1}],"user":{"objects":1,"user":"alice"}}}`; string(data) != expected {
+			t.Errorf("%v: expected %v, got %v", user, expected, string(data))
+		}
+	}
+}
+
+func TestGraphQLHandler(t *testing.T) {
+	setupTestSites(t, 1)
+	testCases := []struct {
+		method   string
+		target   string
+		body     string
+		status   int
+		contains string
+	}{
+		{http.MethodGet, "/graphql?query=" + "%7B%20stats%20%7B%20users%20%7D%20%7D", "", http.StatusOK, `"users":0`},
+		{http.MethodPost, "/graphql", `{"query": "{ user(name: $u) { objects } }", "variables": {"u": "usera"}}`, http.StatusOK, `"objects":0`},
+		{http.MethodPost, "/graphql", `{"query": "{ user"}`, http.StatusBadRequest, "syntax error"},
+		{http.MethodPost, "/graphql", `not json`, http.StatusBadRequest, "unable to decode the request"},
+		{http.MethodGet, "/graphql?query=%7B%7D&variables=nope", "", http.StatusBadRequest, "invalid variables"},
+		{http.MethodPost, "/graphql", `{"query": "` + strings.Repeat(" ", gqlMaxRequestSize) + `"}`, http.StatusBadRequest, "request body too large"},
+	}
+	for i, testCase := range testCases {
+		r := httptest.NewRequest(testCase.method, testCase.target, strings.NewReader(testCase.body))
+		w := httptest.NewRecorder()
+		graphqlHandler(w, r)
+		if w.Code != testCase.status {
+			t.Errorf("case %v: expected %v, got %v; %v", i+1, testCase.status, w.Code, w.Body.String())
+		}
+		if !strings.Contains(w.Body.String(), testCase.contains) {
+			t.Errorf("case %v: expected the body to contain %v, got %v", i+1, testCase.contains, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/minio/pkg/env"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// checkHedgeDelay is how long a check waits on the site picked by the read preference before
+	// sending a backup check to the next site; disabled if 0
+	checkHedgeDelay time.Duration
+
+	hedgedChecksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "hedged_checks_total",
+		Help:      "Total number of backup checks sent to another site after CHECK_HEDGE_DELAY by result",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(hedgedChecksTotal)
+}
+
+// loadHedgeConfig reads the CHECK_HEDGE_DELAY env
+func loadHedgeConfig() (err error) {
+	if checkHedgeDelay, err = getDurationEnv("CHECK_HEDGE_DELAY", 0); err != nil {
+		return err
+	}
+	if checkHedgeDelay < 0 {
+		return errors.New("CHECK_HEDGE_DELAY env must not be negative")
+	}
+	return nil
+}
+
+// loadSiteWeights reads the weight of each site for READ_PREFERENCE=weighted from the
+// SITE_WEIGHT_{name} envs, 1 by default
+func loadSiteWeights() error {
+	total := 0
+	for _, site := range sites {
+		site.weight = 1
+		if value := env.Get("SITE_WEIGHT_"+site.name, ""); value != "" {
+			weight, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("unable to parse SITE_WEIGHT_%v env; %v", site.name, err)
+			}
+			if weight < 0 {
+				return fmt.Errorf("SITE_WEIGHT_%v env must not be negative", site.name)
+			}
+			site.weight = weight
+		}
+		total += site.weight
+	}
+	if total == 0 {
+		return errors.New("SITE_WEIGHT envs must give a weight to at least one site")
+	}
+	return nil
+}
+
+// weightedOrder returns the sites drawn one after the other by their weights, so that each site
+// is tried first in proportion to its weight; the sites weighted 0 are only tried last
+func weightedOrder(ordered []*site) []*site {
+	remaining := append([]*site(nil), sites...)
+	for len(remaining) > 0 {
+		total := 0
+		for _, site := range remaining {
+			total += site.weight
+		}
+		if total == 0 {
+			return append(ordered, remaining...)
+		}
+		pick := rand.Intn(total)
+		for index, site := range remaining {
+			if pick < site.weight {
+				ordered = append(ordered, site)
+				remaining = append(remaining[:index], remaining[index+1:]...)
+				break
+			}
+			pick -= site.weight
+		}
+	}
+	return ordered
+}
+
+// countHedgedCheck counts a backup check sent to another site
+func countHedgedCheck(result string) {
+	hedgedChecksTotal.WithLabelValues(result).Inc()
+	expHedges.Add(result, 1)
+	statsd.Count("hedged_checks_total", "result:"+result)
+}
+
+// siteCheckResult is the answer of a site to a check
+type siteCheckResult struct {
+	site   *site
+	backup bool
+	err    error
+}
+
+// checkQuotaHedged checks the userquota on the site picked by the read preference, sending a
+// backup check to the next site if it does not answer within CHECK_HEDGE_DELAY; the first
+// answer wins, and the sites failing are failed over like checkQuotaWithFailover
+func checkQuotaHedged(ctx context.Context, user string) (err error) {
+	order := readOrder()
+	// buffered so that the checks outrun by another site do not block
+	results := make(chan siteCheckResult, len(order))
+	next := 0
+	send := func(backup bool) {
+		site := order[next]
+		next++
+		go func() {
+			results <- siteCheckResult{site: site, backup: backup, err: checkSiteQuota(ctx, site, user)}
+		}()
+	}
+	send(false)
+	pending := 1
+	// a single backup check is sent, so that a slow site doubles the checks at most
+	hedge := time.NewTimer(checkHedgeDelay)
+	defer hedge.Stop()
+	for pending > 0 {
+		select {
+		case <-hedge.C:
+			if next < len(order) {
+				logf(ctx, "LOG", order[next-1].name, "sending a backup check for user '%v' to site %v after %v", user, order[next].name, checkHedgeDelay)
+				countHedgedCheck("sent")
+				send(true)
+				pending++
+			}
+		case result := <-results:
+			pending--
+			if result.err == nil || errors.Is(result.err, errMaxLimitExceeded) {
+				if result.backup {
+					countHedgedCheck("won")
+				}
+				return result.err
+			}
+			err = result.err
+			logf(ctx, "WARNING", result.site.name, "unable to check quota for user '%v'; trying the next site; %v", user, err)
+			if pending == 0 && next < len(order) {
+				send(false)
+				pending++
+			}
+		}
+	}
+	return fmt.Errorf("%w; %v", errSitesUnreachable, err)
+}
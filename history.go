@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/pkg/env"
+)
+
+// historyPrefix is where the snapshots of the pruned objects are kept in the quota bucket,
+// as history/USER/DATE.json
+const historyPrefix = "history/"
+
+// historyRetentionDays is the number of days the snapshots are kept for; disabled if zero
+var historyRetentionDays int
+
+// historySnapshot represents the objects of a user pruned for a day
+type historySnapshot struct {
+	User    string                `json:"user"`
+	Date    string                `json:"date"`
+	Objects int                   `json:"objects"`
+	Bytes   int64                 `json:"bytes"`
+	Entries map[string]quotaEntry `json:"entries"`
+}
+
+// initHistory reads the history retention
+func initHistory() (err error) {
+	historyRetentionDays, err = env.GetInt("HISTORY_RETENTION_DAYS", 0)
+	if err != nil {
+		return fmt.Errorf("unable to read HISTORY_RETENTION_DAYS env; %v", err)
+	}
+	return nil
+}
+
+func historyKey(user, date string) string {
+	return historyPrefix + user + "/" + date + ".json"
+}
+
+// writeHistory merges the pruned objects of the user into the snapshots of their days, and
+// removes the snapshots older than the retention
+func writeHistory(ctx context.Context, s3Client ObjectStore, user string, pruned map[string]quotaEntry) error {
+	days := map[string]map[string]quotaEntry{}
+	for object, entry := range pruned {
+		pathDate, err := time.Parse(dateFormat, strings.Split(object, "/")[0])
+		if err != nil {
+			continue
+		}
+		date := entry.date(pathDate).Format(dateFormat)
+		if days[date] == nil {
+			days[date] = map[string]quotaEntry{}
+		}
+		days[date][object] = entry
+	}
+	for date, entries := range days {
+		snapshot, err := readHistory(ctx, s3Client, user, date)
+		if err != nil {
+			if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+				return fmt.Errorf("unable to read the history of user '%v' on %v; %v", user, date, err)
+			}
+			snapshot = &historySnapshot{User: user, Date: date, Entries: map[string]quotaEntry{}}
+		}
+		for object, entry := range entries {
+			if _, ok := snapshot.Entries[object]; ok {
+				continue
+			}
+			snapshot.Entries[object] = entry
+			snapshot.Objects++
+			snapshot.Bytes += entry.Size
+		}
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			return err
+		}
+		if _, err := s3Client.PutObject(ctx, quotaBucket, historyKey(user, date), bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+			ContentType: "application/json",
+		}); err != nil {
+			return fmt.Errorf("unable to write the history of user '%v' on %v; %v", user, date, err)
+		}
+	}
+	removeExpiredHistory(ctx, s3Client, user)
+	return nil
+}
+
+// readHistory GETs the snapshot of the user on the date
+func readHistory(ctx context.Context, s3Client ObjectStore, user, date string) (*historySnapshot, error) {
+	reader, _, err := s3Client.ReadObject(ctx, quotaBucket, historyKey(user, date))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	var snapshot historySnapshot
+	if err := json.NewDecoder(reader).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Entries == nil {
+		snapshot.Entries = map[string]quotaEntry{}
+	}
+	return &snapshot, nil
+}
+
+// removeExpiredHistory removes the snapshots of the user older than the retention; failures
+// are logged, the next prune retries them. With QUOTA_BUCKET_PROTECTION, the removal leaves a
+// delete marker, and the snapshot is expired by the lifecycle of the quota bucket
+func removeExpiredHistory(ctx context.Context, s3Client ObjectStore, user string) {
+	cutoff := getCurrentDateInUTC().AddDate(0, 0, -historyRetentionDays)
+	for object := range s3Client.ListObjects(ctx, quotaBucket, minio.ListObjectsOptions{Prefix: historyPrefix + user + "/"}) {
+		if object.Err != nil {
+			logf(ctx, "WARNING", s3Client.EndpointURL().Host, "unable to list the history of user '%v'; %v", user, object.Err)
+			return
+		}
+		date := strings.TrimSuffix(strings.TrimPrefix(object.Key, historyPrefix+user+"/"), ".json")
+		t, err := time.Parse(dateFormat, date)
+		if err != nil || !t.Before(cutoff) {
+			continue
+		}
+		if err := s3Client.RemoveObject(ctx, quotaBucket, object.Key, minio.RemoveObjectOptions{}); err != nil {
+			logf(ctx, "WARNING", s3Client.EndpointURL().Host, "unable to remove the history '%v'; %v", object.Key, err)
+		}
+	}
+}
+
+// parseHistoryDate parses the date of the history query, either as 2006-Jan-02 or 2006-01-02
+func parseHistoryDate(value string) (time.Time, error) {
+	if t, err := time.Parse(dateFormat, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// readUsageHistory reads the per-day usage of the user between the dates (inclusive) from one
+// site picked by the read preference, falling back to the other sites if it fails
+func readUsageHistory(ctx context.Context, user string, from, to time.Time) (days []dayUsage, err error) {
+	for _, site := range readOrder() {
+		days, err = readSiteUsageHistory(ctx, site, user, from, to)
+		if err == nil {
+			return days, nil
+		}
+		logf(ctx, "WARNING", site.name, "unable to read the history of user '%v'; trying the next site; %v", user, err)
+	}
+	return nil, err
+}
+
+// readSiteUsageHistory merges the snapshots of the pruned days with the usage of the days
+// still counted in the user quota
+func readSiteUsageHistory(ctx context.Context, site *site, user string, from, to time.Time) ([]dayUsage, error) {
+	if site.Client() == nil {
+		return nil, errors.New("s3Client is nil")
+	}
+	inRange := func(date string) bool {
+		t, err := time.Parse(dateFormat, date)
+		return err == nil && !t.Before(from) && !t.After(to)
+	}
+	usage := map[string]dayUsage{}
+	prefix := historyPrefix + user + "/"
+	for object := range site.Client().ListObjects(ctx, quotaBucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return nil, fmt.Errorf("unable to list the history; %v", object.Err)
+		}
+		date := strings.TrimSuffix(strings.TrimPrefix(object.Key, prefix), ".json")
+		if !inRange(date) {
+			continue
+		}
+		snapshot, err := readHistory(ctx, site.Client(), user, date)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the history of %v; %v", date, err)
+		}
+		usage[date] = dayUsage{Date: date, Objects: snapshot.Objects, Bytes: snapshot.Bytes}
+	}
+	current, err := readSiteUsage(ctx, site, user)
+	if err != nil {
+		return nil, err
+	}
+	for _, day := range current.Days {
+		if !inRange(day.Date) {
+			continue
+		}
+		// the objects pruned late, after the snapshot
+		pruned := usage[day.Date]
+		day.Objects += pruned.Objects
+		day.Bytes += pruned.Bytes
+		usage[day.Date] = day
+	}
+	days := make([]dayUsage, 0, len(usage))
+	for _, day := range usage {
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool {
+		ti, _ := time.Parse(dateFormat, days[i].Date)
+		tj, _ := time.Parse(dateFormat, days[j].Date)
+		return ti.Before(tj)
+	})
+	return days, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// importRecord represents a line of `mc ls --json`
+type importRecord struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// parseImport parses the object paths to import, one per line; a line is either a JSON
+// object with the key, size and lastModified, or a CSV record with the path and the
+// optional size. The paths may be prefixed with the data bucket
+func parseImport(r io.Reader) (map[string]quotaEntry, error) {
+	entries := map[string]quotaEntry{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var (
+			path  string
+			entry quotaEntry
+		)
+		if strings.HasPrefix(text, "{") {
+			var record importRecord
+			if err := json.Unmarshal([]byte(text), &record); err != nil {
+				return nil, fmt.Errorf("line %v; %v", line, err)
+			}
+			path = record.Key
+			entry.Size = record.Size
+			entry.EventTime = record.LastModified.UTC()
+		} else {
+			fields, err := csv.NewReader(strings.NewReader(text)).Read()
+			if err != nil {
+				return nil, fmt.Errorf("line %v; %v", line, err)
+			}
+			path = strings.TrimSpace(fields[0])
+			if len(fields) > 1 {
+				if entry.Size, err = strconv.ParseInt(strings.TrimSpace(fields[1]), 10, 64); err != nil {
+					return nil, fmt.Errorf("line %v; invalid size '%v'", line, fields[1])
+				}
+			}
+		}
+		path = strings.TrimPrefix(strings.TrimPrefix(path, "/"), dataBucket+"/")
+		entries[path] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
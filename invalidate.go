@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/pkg/env"
+	"github.com/rs/xid"
+)
+
+const (
+	// invalidationQueueSize is the number of invalidations waiting to be published, dropped beyond
+	invalidationQueueSize = 1000
+	// invalidationRetryInterval is the interval between the attempts to subscribe to the channel
+	invalidationRetryInterval = 5 * time.Second
+	// invalidationPingInterval is the interval of the pings detecting a dead subscription
+	invalidationPingInterval = 30 * time.Second
+	// invalidationTimeout is the timeout of connecting and publishing to the Redis server
+	invalidationTimeout = 10 * time.Second
+)
+
+var (
+	// invalidationURL is the Redis server broadcasting the invalidations of the cached quotas and limits
+	// to the other replicas, as redis://[user:password@]host:port or rediss:// for TLS; disabled if empty
+	invalidationURL = env.Get("CACHE_INVALIDATION_URL", "")
+	// invalidationChannel is the Redis channel of the invalidations
+	invalidationChannel = env.Get("CACHE_INVALIDATION_CHANNEL", "quota-server:invalidate")
+	// invalidations publishes and receives the invalidations; nil if CACHE_INVALIDATION_URL is not set
+	invalidations *invalidationBus
+)
+
+var errNotSubscribed = errors.New("unable to subscribe")
+
+// invalidationMessage represents the invalidation of the cached quota or limit of a user
+type invalidationMessage struct {
+	// Origin is the replica publishing the invalidation, which ignores its own messages
+	Origin string `json:"origin"`
+	// Site is the site of the quota invalidated; all the sites if empty
+	Site  string `json:"site,omitempty"`
+	User  string `json:"user"`
+	Limit bool   `json:"limit,omitempty"`
+}
+
+// invalidationBus broadcasts the invalidations over a Redis pub/sub channel
+type invalidationBus struct {
+	addr     string
+	tls      bool
+	username string
+	password string
+	id       string
+	outbox   chan invalidationMessage
+}
+
+// initInvalidations connects to the Redis server broadcasting the invalidations, in the background
+func initInvalidations(ctx context.Context) error {
+	if invalidationURL == "" {
+		return nil
+	}
+	u, err := url.Parse(invalidationURL)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Hostname() == "" {
+		return fmt.Errorf("CACHE_INVALIDATION_URL env must be redis://host:port or rediss://host:port; %v", invalidationURL)
+	}
+	bus := &invalidationBus{
+		addr:   u.Host,
+		tls:    u.Scheme == "rediss",
+		id:     xid.New().String(),
+		outbox: make(chan invalidationMessage, invalidationQueueSize),
+	}
+	if u.Port() == "" {
+		bus.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		bus.username = u.User.Username()
+		bus.password, _ = u.User.Password()
+	}
+	go bus.publishLoop(ctx)
+	go bus.subscribeLoop(ctx)
+	invalidations = bus
+	return nil
+}
+
+// publish queues the invalidation to be broadcast; the caches of the replicas missing it
+// still expire after their ttl
+func (bus *invalidationBus) publish(ctx context.Context, msg invalidationMessage) {
+	if bus == nil {
+		return
+	}
+	msg.Origin = bus.id
+	select {
+	case bus.outbox <- msg:
+	default:
+		logf(ctx, "WARNING", "", "dropping the invalidation of user '%v'; too many invalidations waiting to be published", msg.User)
+	}
+}
+
+func (bus *invalidationBus) publishLoop(ctx context.Context) {
+	var (
+		conn net.Conn
+		r    *bufio.Reader
+	)
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		var msg invalidationMessage
+		select {
+		case <-ctx.Done():
+			return
+		case msg = <-bus.outbox:
+		}
+		data, err := json.Marshal(msg)
+		if err != nil {
+			continue
+		}
+		if conn == nil {
+			if conn, r, err = bus.dial(ctx); err != nil {
+				logf(ctx, "WARNING", "", "unable to publish the invalidation of user '%v'; %v", msg.User, err)
+				continue
+			}
+		}
+		conn.SetDeadline(time.Now().Add(invalidationTimeout))
+		if _, err := redisCall(conn, r, "PUBLISH", invalidationChannel, string(data)); err != nil {
+			logf(ctx, "WARNING", "", "unable to publish the invalidation of user '%v'; %v", msg.User, err)
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+func (bus *invalidationBus) subscribeLoop(ctx context.Context) {
+	for subscribed := false; ; {
+		err := bus.subscribe(ctx, subscribed)
+		if ctx.Err() != nil {
+			return
+		}
+		subscribed = subscribed || !errors.Is(err, errNotSubscribed)
+		logf(ctx, "WARNING", "", "lost the cache invalidation channel; retrying in %v; %v", invalidationRetryInterval, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(invalidationRetryInterval):
+		}
+	}
+}
+
+// subscribe applies the invalidations of the other replicas until the subscription is lost;
+// the caches are dropped on resubscribing, as the invalidations published meanwhile are lost
+func (bus *invalidationBus) subscribe(ctx context.Context, resubscribe bool) error {
+	conn, r, err := bus.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("%w; %v", errNotSubscribed, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(invalidationTimeout))
+	if _, err := redisCall(conn, r, "SUBSCRIBE", invalidationChannel); err != nil {
+		return fmt.Errorf("%w; %v", errNotSubscribed, err)
+	}
+	conn.SetDeadline(time.Time{})
+	if resubscribe {
+		dropCaches()
+	}
+	logf(ctx, "LOG", "", "subscribed to the cache invalidation channel '%v'", invalidationChannel)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// the channel is otherwise silent, and the pings detect a dead connection
+		ticker := time.NewTicker(invalidationPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+				conn.SetWriteDeadline(time.Now().Add(invalidationTimeout))
+				writeRedisCommand(conn, "PING")
+			}
+		}
+	}()
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * invalidationPingInterval))
+		reply, err := readRedisReply(r)
+		if err != nil {
+			return err
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 3 || items[0] != "message" {
+			// the pongs and the confirmations
+			continue
+		}
+		payload, _ := items[2].(string)
+		var msg invalidationMessage
+		if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+			logf(ctx, "WARNING", "", "ignoring the invalid cache invalidation '%v'; %v", payload, err)
+			continue
+		}
+		if msg.Origin == bus.id {
+			continue
+		}
+		applyInvalidation(msg)
+	}
+}
+
+// applyInvalidation drops the cached quota or limit of the invalidation received
+func applyInvalidation(msg invalidationMessage) {
+	expCache.Add("remote_invalidations", 1)
+	if msg.Limit {
+		dropCachedLimit(msg.User)
+		return
+	}
+	for _, site := range sites {
+		if msg.Site == "" || msg.Site == site.name {
+			dropCachedManifest(site, msg.User)
+		}
+	}
+}
+
+// dropCaches drops all the cached quotas and limits
+func dropCaches() {
+	if manifestCache != nil {
+		manifestCache.Clear()
+	}
+	if missingManifestCache != nil {
+		missingManifestCache.Clear()
+	}
+	for _, provider := range limitProviders {
+		if cached, ok := provider.(*cachedLimitProvider); ok {
+			cached.cache.Clear()
+		}
+	}
+}
+
+// dial connects and authenticates to the Redis server
+func (bus *invalidationBus) dial(ctx context.Context) (net.Conn, *bufio.Reader, error) {
+	dialer := &net.Dialer{Timeout: invalidationTimeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if bus.tls {
+		conn, err = (&tls.Dialer{NetDialer: dialer}).DialContext(ctx, "tcp", bus.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", bus.addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+	if bus.password != "" {
+		args := []string{"AUTH", bus.password}
+		if bus.username != "" {
+			args = []string{"AUTH", bus.username, bus.password}
+		}
+		conn.SetDeadline(time.Now().Add(invalidationTimeout))
+		if _, err := redisCall(conn, r, args...); err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("unable to authenticate; %v", err)
+		}
+	}
+	return conn, r, nil
+}
+
+// redisCall sends the command and reads its reply
+func redisCall(conn net.Conn, r *bufio.Reader, args ...string) (interface{}, error) {
+	if err := writeRedisCommand(conn, args...); err != nil {
+		return nil, err
+	}
+	return readRedisReply(r)
+}
+
+// writeRedisCommand writes the command in the Redis protocol (RESP)
+func writeRedisCommand(w io.Writer, args ...string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readRedisReply reads a reply in the Redis protocol (RESP); the error replies are returned as errors
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %v", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected reply '%v'", line)
+}
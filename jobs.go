@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	// refreshCheckpointKey is where the refresh job persists its progress in the quota bucket
+	refreshCheckpointKey = ".checkpoints/refresh"
+	// checkpointInterval is the number of keys processed between the checkpoints
+	checkpointInterval = 100
+)
+
+var jobs = &jobTracker{progress: map[string]map[string]*jobProgress{}}
+
+// jobProgress represents the progress of a job on a site
+type jobProgress struct {
+	StartedAt time.Time `json:"startedAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	LastKey   string    `json:"lastKey,omitempty"`
+	Processed int       `json:"processed"`
+	Done      bool      `json:"done"`
+}
+
+// jobTracker keeps the progress of the running and the last jobs per site
+type jobTracker struct {
+	mu       sync.Mutex
+	progress map[string]map[string]*jobProgress
+}
+
+// start resets the progress of the job on the site, resuming from the checkpoint if any
+func (t *jobTracker) start(job, site string, checkpoint *jobProgress) {
+	now := time.Now().UTC()
+	progress := &jobProgress{StartedAt: now, UpdatedAt: now}
+	if checkpoint != nil {
+		progress.StartedAt = checkpoint.StartedAt
+		progress.LastKey = checkpoint.LastKey
+		progress.Processed = checkpoint.Processed
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.progress[job] == nil {
+		t.progress[job] = map[string]*jobProgress{}
+	}
+	t.progress[job][site] = progress
+}
+
+// advance records the n keys processed by the job on the site, up to the key, and returns
+// a copy of the progress
+func (t *jobTracker) advance(job, site, key string, n int) jobProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	progress := t.progress[job][site]
+	progress.LastKey = key
+	progress.Processed += n
+	progress.UpdatedAt = time.Now().UTC()
+	return *progress
+}
+
+// finish marks the job on the site as done
+func (t *jobTracker) finish(job, site string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	progress := t.progress[job][site]
+	progress.Done = true
+	progress.UpdatedAt = time.Now().UTC()
+}
+
+// get returns a copy of the progress of the jobs
+func (t *jobTracker) get() map[string]map[string]jobProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	progress := make(map[string]map[string]jobProgress, len(t.progress))
+	for job, sites := range t.progress {
+		progress[job] = make(map[string]jobProgress, len(sites))
+		for site, p := range sites {
+			progress[job][site] = *p
+		}
+	}
+	return progress
+}
+
+// readCheckpoint reads the checkpoint of the job persisted on the site; nil if the
+// last run completed
+func readCheckpoint(ctx context.Context, s3Client ObjectStore, key string) (*jobProgress, error) {
+	reader, _, err := s3Client.ReadObject(ctx, quotaBucket, key)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer reader.Close()
+	var checkpoint jobProgress
+	if err := json.NewDecoder(reader).Decode(&checkpoint); err != nil {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+// writeCheckpoint persists the progress of the job on the site
+func writeCheckpoint(ctx context.Context, s3Client ObjectStore, key string, progress jobProgress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	_, err = s3Client.PutObject(ctx, quotaBucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType: "application/json",
+	})
+	return err
+}
+
+// removeCheckpoint removes the checkpoint of the job on the site once it completes
+func removeCheckpoint(ctx context.Context, s3Client ObjectStore, key string) error {
+	return s3Client.RemoveObject(ctx, quotaBucket, key, minio.RemoveObjectOptions{})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/pkg/env"
+	"github.com/minio/pkg/ldap"
+)
+
+// ldapLimitProvider resolves the limit of a user by their LDAP group membership
+type ldapLimitProvider struct {
+	config      *ldap.Config
+	groupLimits map[string]int
+}
+
+// newLDAPLimitProvider reads the LDAP config and the per-group limits from the envs;
+// returns nil if LDAP is not configured
+func newLDAPLimitProvider() (LimitProvider, error) {
+	serverAddr := env.Get("LDAP_SERVER_ADDR", "")
+	if serverAddr == "" {
+		return nil, nil
+	}
+	ldapConfig := &ldap.Config{
+		Enabled:                   true,
+		ServerAddr:                serverAddr,
+		TLSSkipVerify:             env.Get("LDAP_TLS_SKIP_VERIFY", "off") == "on",
+		ServerInsecure:            env.Get("LDAP_SERVER_INSECURE", "off") == "on",
+		ServerStartTLS:            env.Get("LDAP_SERVER_STARTTLS", "off") == "on",
+		LookupBindDN:              env.Get("LDAP_LOOKUP_BIND_DN", ""),
+		LookupBindPassword:        env.Get("LDAP_LOOKUP_BIND_PASSWORD", ""),
+		UserDNSearchBaseDistNames: parseDNList(env.Get("LDAP_USER_DN_SEARCH_BASE_DN", "")),
+		UserDNSearchFilter:        env.Get("LDAP_USER_DN_SEARCH_FILTER", ""),
+		GroupSearchBaseDistNames:  parseDNList(env.Get("LDAP_GROUP_SEARCH_BASE_DN", "")),
+		GroupSearchFilter:         env.Get("LDAP_GROUP_SEARCH_FILTER", ""),
+	}
+	if ldapConfig.LookupBindDN == "" {
+		return nil, errors.New("LDAP_LOOKUP_BIND_DN env is not set")
+	}
+	if len(ldapConfig.UserDNSearchBaseDistNames) == 0 || ldapConfig.UserDNSearchFilter == "" {
+		return nil, errors.New("LDAP_USER_DN_SEARCH_BASE_DN and LDAP_USER_DN_SEARCH_FILTER envs must be set")
+	}
+	if len(ldapConfig.GroupSearchBaseDistNames) == 0 || ldapConfig.GroupSearchFilter == "" {
+		return nil, errors.New("LDAP_GROUP_SEARCH_BASE_DN and LDAP_GROUP_SEARCH_FILTER envs must be set")
+	}
+	groupLimits, err := parseGroupLimits(env.Get("GROUP_LIMITS", ""))
+	if err != nil {
+		return nil, err
+	}
+	hitTTL, err := getDurationEnv("LDAP_CACHE_TTL", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	missTTL, err := getDurationEnv("LDAP_NEGATIVE_CACHE_TTL", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	return newCachedLimitProvider(&ldapLimitProvider{
+		config:      ldapConfig,
+		groupLimits: groupLimits,
+	}, hitTTL, missTTL), nil
+}
+
+// parseDNList parses the ';' separated list of DNs
+func parseDNList(value string) (dns []string) {
+	for _, dn := range strings.Split(value, ";") {
+		if dn = strings.TrimSpace(dn); dn != "" {
+			dns = append(dns, dn)
+		}
+	}
+	return
+}
+
+// parseGroupLimits parses the ';' separated list of GROUP_DN=LIMIT entries
+func parseGroupLimits(value string) (map[string]int, error) {
+	limits := map[string]int{}
+	for _, entry := range parseDNList(value) {
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid GROUP_LIMITS entry %v", entry)
+		}
+		limit, err := strconv.Atoi(entry[i+1:])
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid limit in GROUP_LIMITS entry %v", entry)
+		}
+		limits[strings.ToLower(strings.TrimSpace(entry[:i]))] = limit
+	}
+	return limits, nil
+}
+
+// Limit resolves the groups of the user from LDAP and returns the highest limit
+// configured for them; zero if none of the groups has a limit
+func (p *ldapLimitProvider) Limit(ctx context.Context, user string) (int, error) {
+	conn, err := p.config.Connect()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if err := p.config.LookupBind(conn); err != nil {
+		return 0, err
+	}
+	userDN, err := p.config.LookupUserDN(conn, user)
+	if err != nil {
+		return 0, err
+	}
+	groups, err := p.config.SearchForUserGroups(conn, user, userDN)
+	if err != nil {
+		return 0, err
+	}
+	var limit int
+	for _, group := range groups {
+		if groupLimit := p.groupLimits[strings.ToLower(group)]; groupLimit > limit {
+			limit = groupLimit
+		}
+	}
+	return limit, nil
+}
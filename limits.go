@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/minio/pkg/env"
+)
+
+// LimitProvider resolves the limit of a user from an external source
+type LimitProvider interface {
+	// Limit returns the limit of the user; zero if the source has no limit for the user
+	Limit(ctx context.Context, user string) (int, error)
+}
+
+// limitProviders are consulted in order, the first non-zero limit is enforced
+var limitProviders []LimitProvider
+
+// initLimitProviders sets up the configured limit providers
+func initLimitProviders() error {
+	httpProvider, err := newHTTPLimitProvider()
+	if err != nil {
+		return fmt.Errorf("unable to initialize the limit provider; %v", err)
+	}
+	if httpProvider != nil {
+		limitProviders = append(limitProviders, httpProvider)
+	}
+	ldapProvider, err := newLDAPLimitProvider()
+	if err != nil {
+		return fmt.Errorf("unable to initialize LDAP; %v", err)
+	}
+	if ldapProvider != nil {
+		limitProviders = append(limitProviders, ldapProvider)
+	}
+	return nil
+}
+
+// getDurationEnv reads the duration from the env
+func getDurationEnv(key string, defaultValue time.Duration) (time.Duration, error) {
+	value := env.Get(key, "")
+	if value == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse %v env; %v", key, err)
+	}
+	return d, nil
+}
+
+// fallbackError is the failure of a provider which has a fallback limit to enforce meanwhile;
+// returned as an error so that the fallback is never cached
+type fallbackError struct {
+	err   error
+	limit int
+}
+
+func (e fallbackError) Error() string { return e.err.Error() }
+
+// effectiveLimit returns the limit to enforce on the user quota
+func effectiveLimit(ctx context.Context, user string, userQuota *UserQuota) int {
+	for _, provider := range limitProviders {
+		limit, err := provider.Limit(ctx, user)
+		var fallback fallbackError
+		if errors.As(err, &fallback) {
+			logf(ctx, "WARNING", "", "unable to lookup the limit of user '%v'; using the fallback limit %v; %v", user, fallback.limit, err)
+			return fallback.limit
+		}
+		if err != nil {
+			logf(ctx, "WARNING", "", "unable to lookup the limit of user '%v'; %v", user, err)
+			continue
+		}
+		if limit > 0 {
+			return limit
+		}
+	}
+	return userQuota.MaxLimit
+}
+
+// invalidateLimit drops the cached limit of the user from all the limit providers, on all the replicas
+func invalidateLimit(user string) {
+	dropCachedLimit(user)
+	invalidations.publish(context.Background(), invalidationMessage{User: user, Limit: true})
+}
+
+// dropCachedLimit drops the cached limit of the user from all the limit providers
+func dropCachedLimit(user string) {
+	for _, provider := range limitProviders {
+		if cached, ok := provider.(*cachedLimitProvider); ok {
+			cached.cache.Delete(user)
+		}
+	}
+}
+
+// cachedLimitProvider caches the limits resolved by the provider, with separate
+// ttls for the users having a limit (hits) and the users without one (misses)
+type cachedLimitProvider struct {
+	provider LimitProvider
+	cache    *ttlCache[int]
+	missTTL  time.Duration
+}
+
+// newCachedLimitProvider caches the limits resolved by the provider
+func newCachedLimitProvider(provider LimitProvider, hitTTL, missTTL time.Duration) LimitProvider {
+	return &cachedLimitProvider{
+		provider: provider,
+		cache:    newTTLCache[int](hitTTL, 0),
+		missTTL:  missTTL,
+	}
+}
+
+// Limit returns the cached limit, resolving it from the provider if missing or
+// expired; failures are not cached
+func (p *cachedLimitProvider) Limit(ctx context.Context, user string) (int, error) {
+	if limit, ok := p.cache.Get(user); ok {
+		return limit, nil
+	}
+	limit, err := p.provider.Limit(ctx, user)
+	if err != nil {
+		return 0, err
+	}
+	if limit > 0 {
+		p.cache.Set(user, limit)
+	} else {
+		p.cache.SetWithTTL(user, limit, p.missTTL)
+	}
+	return limit, nil
+}
+
+// httpLimitProvider fetches the limit of a user from an external billing/subscription service
+type httpLimitProvider struct {
+	url       string
+	authToken string
+	client    *http.Client
+	// fallback is the limit returned when the service fails
+	fallback int
+}
+
+// newHTTPLimitProvider reads the limit provider config from the envs; returns nil
+// if it is not configured
+func newHTTPLimitProvider() (LimitProvider, error) {
+	providerURL := env.Get("LIMIT_PROVIDER_URL", "")
+	if providerURL == "" {
+		return nil, nil
+	}
+	if !strings.Contains(providerURL, "{user}") {
+		return nil, errors.New("LIMIT_PROVIDER_URL must contain the {user} placeholder")
+	}
+	timeout, err := getDurationEnv("LIMIT_PROVIDER_TIMEOUT", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	hitTTL, err := getDurationEnv("LIMIT_PROVIDER_CACHE_TTL", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	missTTL, err := getDurationEnv("LIMIT_PROVIDER_NEGATIVE_CACHE_TTL", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	fallback, err := env.GetInt("LIMIT_PROVIDER_FALLBACK", 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read LIMIT_PROVIDER_FALLBACK env; %v", err)
+	}
+	return newCachedLimitProvider(&httpLimitProvider{
+		url:       providerURL,
+		authToken: env.Get("LIMIT_PROVIDER_AUTH_TOKEN", ""),
+		client:    &http.Client{Timeout: timeout},
+		fallback:  fallback,
+	}, hitTTL, missTTL), nil
+}
+
+// Limit GETs the limit of the user from the service, which responds with {"limit": N};
+// 404 Not Found means the service has no limit for the user. A failure carries the fallback
+// limit, if configured
+func (p *httpLimitProvider) Limit(ctx context.Context, user string) (int, error) {
+	limit, err := p.fetch(ctx, user)
+	if err != nil && p.fallback > 0 {
+		return 0, fallbackError{err: err, limit: p.fallback}
+	}
+	return limit, err
+}
+
+func (p *httpLimitProvider) fetch(ctx context.Context, user string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.ReplaceAll(p.url, "{user}", url.PathEscape(user)), nil)
+	if err != nil {
+		return 0, err
+	}
+	if p.authToken != "" {
+		req.Header.Set("Authorization", p.authToken)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("unexpected response %v", resp.Status)
+	}
+	var result struct {
+		Limit int `json:"limit"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("unable to parse the response; %v", err)
+	}
+	return result.Limit, nil
+}
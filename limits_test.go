@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimitProviderFallbackNotCached(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"limit": 50}`))
+	}))
+	defer server.Close()
+
+	saved := limitProviders
+	t.Cleanup(func() { limitProviders = saved })
+	limitProviders = []LimitProvider{newCachedLimitProvider(&httpLimitProvider{
+		url:      server.URL + "/limits/{user}",
+		client:   server.Client(),
+		fallback: 5,
+	}, time.Hour, time.Hour)}
+
+	ctx := context.Background()
+	userQuota := NewUserQuota()
+	userQuota.MaxLimit = 3
+	if limit := effectiveLimit(ctx, "usera", userQuota); limit != 5 {
+		t.Fatalf("service failing: expected the fallback limit 5, got %v", limit)
+	}
+	failing.Store(false)
+	if limit := effectiveLimit(ctx, "usera", userQuota); limit != 50 {
+		t.Fatalf("service recovered: expected the limit 50, got %v", limit)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/xid"
+)
+
+type contextKey int
+
+const (
+	traceKey contextKey = iota
+	userKey
+	replayKey
+	logUserKey
+)
+
+// traceInfo represents the identifiers which correlate a request across MinIO and the quota server
+type traceInfo struct {
+	RequestID   string
+	TraceParent string
+}
+
+// withTrace returns a copy of the context carrying the trace identifiers
+func withTrace(ctx context.Context, trace traceInfo) context.Context {
+	return context.WithValue(ctx, traceKey, trace)
+}
+
+// traceFromContext returns the trace identifiers carried by the context, if any
+func traceFromContext(ctx context.Context) traceInfo {
+	trace, _ := ctx.Value(traceKey).(traceInfo)
+	return trace
+}
+
+// requestContext returns the context to serve the request with; it carries the trace
+// identifiers of the request but is not canceled when the client goes away
+func requestContext(r *http.Request) context.Context {
+	return context.WithoutCancel(r.Context())
+}
+
+// logf prints the log message tagged with the level, the site (if any) and the request id,
+// and keeps it for the log streams
+func logf(ctx context.Context, level, site, format string, args ...interface{}) {
+	message := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	trace := traceFromContext(ctx)
+	var tags strings.Builder
+	tags.WriteString("[" + level + "]")
+	if site != "" {
+		tags.WriteString("[" + site + "]")
+	}
+	if trace.RequestID != "" {
+		tags.WriteString("[" + trace.RequestID + "]")
+	}
+	fmt.Println(tags.String() + " " + message)
+	logs.record(logEntry{
+		Time:      time.Now().UTC(),
+		Level:     level,
+		Site:      site,
+		RequestID: trace.RequestID,
+		User:      logUserFromContext(ctx),
+		Message:   message,
+	})
+}
+
+// tracing extracts the W3C traceparent and the X-Amz-Request-Id headers from the
+// incoming requests (generating a request id if missing), attaches them to the
+// request context along with the user of the route and echoes them in the response headers
+func tracing(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace := traceInfo{
+			RequestID:   r.Header.Get("X-Amz-Request-Id"),
+			TraceParent: r.Header.Get("Traceparent"),
+		}
+		if trace.RequestID == "" {
+			trace.RequestID = r.Header.Get("X-Request-Id")
+		}
+		if trace.RequestID == "" {
+			trace.RequestID = xid.New().String()
+		}
+		w.Header().Set("X-Request-Id", trace.RequestID)
+		if trace.TraceParent != "" {
+			w.Header().Set("Traceparent", trace.TraceParent)
+		}
+		ctx := withTrace(r.Context(), trace)
+		if user := mux.Vars(r)["user"]; user != "" {
+			ctx = withLogUser(ctx, user)
+		}
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// traceTransport propagates the trace identifiers of the request context to the outbound S3 calls
+type traceTransport struct {
+	http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t traceTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	trace := traceFromContext(r.Context())
+	if trace.RequestID == "" {
+		return t.RoundTripper.RoundTrip(r)
+	}
+	// the headers are added after signing and hence stay unsigned
+	r = r.Clone(r.Context())
+	r.Header.Set("X-Quota-Request-Id", trace.RequestID)
+	if trace.TraceParent != "" {
+		r.Header.Set("Traceparent", trace.TraceParent)
+	}
+	r.Header.Set("User-Agent", r.Header.Get("User-Agent")+" quota-server/"+trace.RequestID)
+	return t.RoundTripper.RoundTrip(r)
+}
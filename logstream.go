@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// logBufferSize is the number of the recent log entries kept in memory
+	logBufferSize = 1000
+	// logStreamKeepAlive is how often the idle log streams are sent a comment, so that the
+	// proxies in between do not close them
+	logStreamKeepAlive = 15 * time.Second
+)
+
+// logs keeps the recent log entries and fans them out to the log streams
+var logs = &logBuffer{
+	entries:     make([]logEntry, 0, logBufferSize),
+	subscribers: map[chan logEntry]struct{}{},
+}
+
+// logEntry represents a log message printed by logf
+type logEntry struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	Site      string    `json:"site,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Message   string    `json:"message"`
+}
+
+// logBuffer is a ring buffer of the recent log entries
+type logBuffer struct {
+	mu          sync.Mutex
+	entries     []logEntry
+	next        int
+	subscribers map[chan logEntry]struct{}
+}
+
+// record keeps the entry and sends it to the subscribers; the entries are dropped for the
+// subscribers which do not keep up, so that the logging never blocks
+func (b *logBuffer) record(entry logEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.entries) < logBufferSize {
+		b.entries = append(b.entries, entry)
+	} else {
+		b.entries[b.next] = entry
+		b.next = (b.next + 1) % logBufferSize
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- entry:
+		default:
+		}
+	}
+}
+
+// subscribe returns the last n entries, oldest first, along with the channel of the new ones
+func (b *logBuffer) subscribe(n int) ([]logEntry, chan logEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	recent := make([]logEntry, 0, len(b.entries))
+	recent = append(recent, b.entries[b.next:]...)
+	recent = append(recent, b.entries[:b.next]...)
+	if n < len(recent) {
+		recent = recent[len(recent)-n:]
+	}
+	ch := make(chan logEntry, 100)
+	b.subscribers[ch] = struct{}{}
+	return recent, ch
+}
+
+func (b *logBuffer) unsubscribe(ch chan logEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, ch)
+}
+
+// withLogUser returns a copy of the context tagging the log entries with the user
+func withLogUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, logUserKey, user)
+}
+
+// logUserFromContext returns the user the log entries are tagged with, if any
+func logUserFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(logUserKey).(string)
+	return user
+}
+
+// logFilter selects the log entries by their level and user
+type logFilter struct {
+	levels map[string]bool
+	user   string
+}
+
+func (f logFilter) match(entry logEntry) bool {
+	if len(f.levels) > 0 && !f.levels[entry.Level] {
+		return false
+	}
+	return f.user == "" || entry.User == f.user
+}
+
+// GET /admin/logs/stream?level=ERROR,WARNING&user=usera&tail=100
+//
+//   - Streams the log entries as Server-Sent Events, each a JSON logEntry, optionally only the
+//     ones of the levels and/or the user
+//   - Starts with the last tail entries kept in memory (default 100, up to 1000)
+func logStreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	query := r.URL.Query()
+	filter := logFilter{levels: map[string]bool{}, user: query.Get("user")}
+	for _, level := range parseList(query.Get("level")) {
+		filter.levels[strings.ToUpper(level)] = true
+	}
+	tail := 100
+	if value := query.Get("tail"); value != "" {
+		var err error
+		if tail, err = strconv.Atoi(value); err != nil || tail < 0 {
+			http.Error(w, fmt.Sprintf("invalid tail '%v'", value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	recent, ch := logs.subscribe(logBufferSize)
+	defer logs.unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(entry logEntry) bool {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return true
+		}
+		_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+		return err == nil
+	}
+	var matched []logEntry
+	for _, entry := range recent {
+		if filter.match(entry) {
+			matched = append(matched, entry)
+		}
+	}
+	if tail < len(matched) {
+		matched = matched[len(matched)-tail:]
+	}
+	for _, entry := range matched {
+		if !send(entry) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(logStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			// the client went away, or the server is shutting down
+			return
+		case entry := <-ch:
+			if !filter.match(entry) {
+				continue
+			}
+			if !send(entry) {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/minio/pkg/sync/errgroup"
+)
+
+// pathSiteLookup represents the state of the path in the user quota of a site
+type pathSiteLookup struct {
+	Site     string      `json:"site"`
+	Counted  bool        `json:"counted"`
+	Entry    *quotaEntry `json:"entry,omitempty"`
+	Objects  int         `json:"objects"`
+	Limit    int         `json:"limit"`
+	Rejected int         `json:"rejected,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// pathLookup represents the owner of the path and whether it is counted on each site
+type pathLookup struct {
+	Path    string           `json:"path"`
+	User    string           `json:"user"`
+	Date    string           `json:"date"`
+	Expired bool             `json:"expired"`
+	Sites   []pathSiteLookup `json:"sites"`
+}
+
+// lookupPath parses the path DATE/USER/object and looks it up in the quota of its user on every site
+func lookupPath(ctx context.Context, path string) (*pathLookup, error) {
+	var event notification.Event
+	event.S3.Object.Key = path
+	qe, err := parseEvent(event)
+	if err != nil {
+		return nil, err
+	}
+	lookup := &pathLookup{
+		Path:    qe.Path,
+		User:    qe.User,
+		Date:    qe.Date.Format(dateFormat),
+		Expired: isExpired(qe.Date),
+		Sites:   make([]pathSiteLookup, len(sites)),
+	}
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
+		index := index
+		g.Go(func() error {
+			lookup.Sites[index] = lookupSitePath(ctx, sites[index], qe)
+			return nil
+		}, index)
+	}
+	g.Wait()
+	return lookup, nil
+}
+
+func lookupSitePath(ctx context.Context, site *site, qe *quotaEvent) pathSiteLookup {
+	result := pathSiteLookup{Site: site.name}
+	if site.Client() == nil {
+		result.Error = errors.New("s3Client is nil").Error()
+		return result
+	}
+	userQuota, _, err := readUserQuota(ctx, site.Client(), qe.User)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			result.Error = err.Error()
+			return result
+		}
+		userQuota = NewUserQuota()
+	}
+	rejections.merge(site.name, qe.User, userQuota)
+	userQuota.Refresh()
+	if entry, ok := userQuota.Objects[qe.Path]; ok {
+		result.Counted = true
+		result.Entry = &entry
+	}
+	result.Objects = len(userQuota.Objects)
+	result.Limit = effectiveLimit(ctx, qe.User, userQuota)
+	result.Rejected = userQuota.Rejections[getCurrentDateInUTC().Format(dateFormat)]
+	return result
+}
+
+// GET /lookup?path=DATE/USER/object
+//
+//   - Parses the owning user out of the path
+//   - Returns whether the path is counted in the quota of the user on each site, along with
+//     their usage, limit and the updates rejected today
+func lookupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "missing path", http.StatusBadRequest)
+		return
+	}
+	lookup, err := lookupPath(ctx, path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lookup)
+}
@@ -2,13 +2,15 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
-	"strconv"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/minio/minio-go/v7"
@@ -22,106 +24,260 @@ var (
 	insecure    = env.Get("MINIO_INSECURE", "false") == "true"
 	dataBucket  = env.Get("DATA_BUCKET", "")
 	quotaBucket = env.Get("QUOTA_BUCKET", "")
-	s3Clients   []*minio.Client
+	sites       []*site
 	dryRun      bool
 	maxLimit    int
+
+	syncOnStartup bool
+
+	// replicationDedup skips the events of replicated objects, counting the origin event only
+	replicationDedup = env.Get("REPLICATION_DEDUP", "off") == "on"
+	// readPreference decides the sites to read from for quota checks
+	readPreference = env.Get("READ_PREFERENCE", readPreferenceAll)
+	primarySite    = env.Get("PRIMARY_SITE", "")
+	// lazyRefresh writes back the user quotas having stale objects when they are read
+	lazyRefresh = env.Get("LAZY_REFRESH", "on") == "on"
+	// refreshWorkers is the number of users refreshed concurrently per site
+	refreshWorkers int
+	// verifyObjects stats the objects of the update events before counting them
+	verifyObjects = env.Get("VERIFY_OBJECTS", "off") == "on"
+	// minObjectSize is the size in bytes below which the objects are not counted
+	minObjectSize int64
+	// lateEventTolerance is how long past the midnight UTC the events of the previous day are still accepted
+	lateEventTolerance time.Duration
+
+	// createBuckets creates the buckets missing on the sites on startup, with the configured
+	// region, object locking and versioning
+	createBuckets bool
+	// configureEvents registers the bucket notifications of the data bucket on startup
+	configureEvents     bool
+	bucketRegion        = env.Get("BUCKET_REGION", "")
+	bucketObjectLocking = env.Get("BUCKET_OBJECT_LOCKING", "off") == "on"
+	bucketVersioning    = env.Get("BUCKET_VERSIONING", "off") == "on"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			if err := runBench(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "replay":
+			if err := runReplay(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "check-config":
+			if err := runCheckConfig(os.Args[2:]); err != nil {
+				log.Fatalf("invalid config;\n%v", err)
+			}
+			fmt.Println("Config OK")
+			return
+		}
+	}
+
 	flag.StringVar(&address, "address", ":8080", "bind to a specific ADDRESS:PORT, ADDRESS can be an IP or hostname")
 	flag.BoolVar(&dryRun, "dry-run", false, "Enable dry run mode")
+	flag.BoolVar(&syncOnStartup, "sync", false, "Sync the user quotas across the sites before serving")
+	flag.BoolVar(&createBuckets, "create-buckets", false, "Create DATA_BUCKET and QUOTA_BUCKET on the sites missing them")
+	flag.BoolVar(&configureEvents, "configure-notifications", false, "Register the put and delete notifications of DATA_BUCKET with the NOTIFICATION_ARN webhook on the sites")
 	flag.Parse()
 
-	var err error
-	maxLimit, err = env.GetInt("MAX_OBJECT_LIMIT_PER_USER", 0)
-	if err != nil {
-		log.Fatalf("unable to read MAX_OBJECT_LIMIT_PER_USER env; %v", err)
+	if err := loadConfig(); err != nil {
+		log.Fatal(err)
 	}
-	if dataBucket == "" {
-		log.Fatal("DATA_BUCKET env is not set")
+	if err := connectSites(context.Background()); err != nil {
+		log.Fatal(err)
 	}
-	if quotaBucket == "" {
-		log.Fatal("QUOTA_BUCKET env is not set")
+	if configureEvents {
+		if err := configureNotifications(context.Background()); err != nil {
+			log.Fatal(err)
+		}
 	}
-	if maxLimit <= 0 {
-		log.Fatalf("MAX_OBJECT_LIMIT_PER_USER env is not set")
+
+	if err := initLimitProviders(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initOIDC(context.Background()); err != nil {
+		log.Fatalf("unable to initialize OpenID Connect; %v", err)
+	}
+	if err := initStatsd(); err != nil {
+		log.Fatalf("unable to connect to the StatsD agent %v; %v", statsdAddress, err)
 	}
 
-	envs := env.List("MINIO_ENDPOINT_")
-	for _, k := range envs {
-		targetName := strings.TrimPrefix(k, "MINIO_ENDPOINT_")
-		endpoint := env.Get("MINIO_ENDPOINT_"+targetName, "")
-		accessKey := env.Get("MINIO_ACCESS_"+targetName, "")
-		secretKey := env.Get("MINIO_SECRET_"+targetName, "")
-		if endpoint == "" {
-			log.Fatalf("MINIO_ENDPOINT_%v is empty", targetName)
-		}
-		if accessKey == "" {
-			log.Fatalf("MINIO_ACCESS_%v is not set", targetName)
-		}
-		if secretKey == "" {
-			log.Fatalf("MINIO_SECRET_%v is not set", targetName)
-		}
-		insecure := env.Get("MINIO_INSECURE_"+targetName, strconv.FormatBool(insecure)) == "true"
-		s3Client, err := getS3Client(endpoint, accessKey, secretKey, insecure)
-		if err != nil {
-			log.Fatalf("unable to create s3 client for site %v; %v", targetName, err)
-		}
-		found, err := s3Client.BucketExists(context.Background(), dataBucket)
-		if err != nil {
-			log.Fatalf("unable to stat the bucket %v in %v; %v", dataBucket, s3Client.EndpointURL().Host, err)
-		}
-		if !found {
-			log.Fatalf("DATA_BUCKET %v does not exist in %v", dataBucket, s3Client.EndpointURL().Host)
-		}
-		found, err = s3Client.BucketExists(context.Background(), quotaBucket)
-		if err != nil {
-			log.Fatalf("unable to stat the bucket %v in %v; %v", quotaBucket, s3Client.EndpointURL().Host, err)
-		}
-		if !found {
-			log.Fatalf("QUOTA_BUCKET %v does not exist in %v", quotaBucket, s3Client.EndpointURL().Host)
-		}
-		s3Clients = append(s3Clients, s3Client)
+	if err := initSentry(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initPagerDuty(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initCluster(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := initDeadLetters(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initQuarantine(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initOrigin(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initRateLimiter(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initReadRepair(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	if err := initRejections(context.Background()); err != nil {
+		log.Fatal(err)
 	}
-	if len(s3Clients) == 0 {
-		log.Fatal("no MinIO sites provided")
+	if err := initShedding(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initHistory(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initBilling(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initBlocklist(context.Background()); err != nil {
+		log.Fatalf("unable to load the blocklist; %v", err)
+	}
+	if err := initManifestCache(context.Background()); err != nil {
+		log.Fatalf("unable to initialize the quota cache; %v", err)
+	}
+	if err := initInvalidations(context.Background()); err != nil {
+		log.Fatal(err)
 	}
 
+	if syncOnStartup {
+		fmt.Println("Syncing user quotas across the sites ...")
+		if err := syncQuota(context.Background(), allSites); err != nil {
+			log.Fatalf("unable to sync user quotas; %v", err)
+		}
+	} else {
+		syncPendingWrites(context.Background())
+	}
+	go migrateUserNames(context.Background())
+
 	router := mux.NewRouter()
+	router.Use(canonicalUserVars, tracing, recovery)
 
-	router.Handle("/quota/update", auth(http.HandlerFunc(updateQuotaHandler))).Methods("POST")
-	router.Handle("/quota/check/{user}", auth(http.HandlerFunc(quotaCheckHandler))).Methods("GET")
-	router.Handle("/quota/refresh", auth(http.HandlerFunc(quotaRefreshHandler)))
-	router.Handle("/purge", auth(http.HandlerFunc(purgeHandler))).Methods("DELETE")
+	router.Handle("/quota/update", shed(auth(instrument("update", http.HandlerFunc(updateQuotaHandler))))).Methods("POST")
+	router.Handle("/quota/stream", shed(auth(instrument("stream", http.HandlerFunc(streamUpdateHandler))))).Methods("POST")
+	router.Handle("/quota/check/{user}", auth(instrument("check", http.HandlerFunc(quotaCheckHandler)))).Methods("GET")
+	router.Handle("/quota/{user}/import", adminAuth(instrument("import", http.HandlerFunc(quotaImportHandler)))).Methods("POST")
+	router.Handle("/quota/{user}/recalculate", adminAuth(instrument("recalculate", http.HandlerFunc(quotaRecalculateHandler)))).Methods("POST")
+	router.Handle("/quota/{user}/reserve", auth(instrument("reserve", http.HandlerFunc(reserveHandler)))).Methods("POST")
+	router.Handle("/quota/{user}/reserve/{id}/commit", auth(instrument("reserve_commit", http.HandlerFunc(commitReservationHandler)))).Methods("POST")
+	router.Handle("/quota/{user}/reserve/{id}", auth(instrument("reserve_release", http.HandlerFunc(releaseReservationHandler)))).Methods("DELETE")
+	router.Handle("/quota/{user}/history", auth(instrument("history", http.HandlerFunc(quotaHistoryHandler)))).Methods("GET")
+	router.Handle("/quota/{user}/suspend", adminAuth(http.HandlerFunc(suspendUserHandler))).Methods("POST")
+	router.Handle("/quota/refresh", signedAuth(instrument("refresh", http.HandlerFunc(quotaRefreshHandler))))
+	router.Handle("/my/quota", userAuth(instrument("my_quota", http.HandlerFunc(myQuotaHandler)))).Methods("GET")
+	if uploadProxy {
+		router.Handle("/upload/{name}", userAuth(instrument("upload", http.HandlerFunc(uploadHandler)))).Methods("PUT")
+	}
+	if stsCredentials {
+		router.Handle("/my/credentials", userAuth(instrument("credentials", http.HandlerFunc(credentialsHandler)))).Methods("POST")
+	}
+	if multipartUploads {
+		router.Handle("/multipart/{user}", auth(instrument("multipart_initiate", http.HandlerFunc(initiateMultipartHandler)))).Methods("POST")
+		router.Handle("/multipart/{user}/parts", auth(instrument("multipart_sign", http.HandlerFunc(signPartsHandler)))).Methods("GET")
+		router.Handle("/multipart/{user}/complete", auth(instrument("multipart_complete", http.HandlerFunc(completeMultipartHandler)))).Methods("POST")
+		router.Handle("/multipart/{user}", auth(instrument("multipart_abort", http.HandlerFunc(abortMultipartHandler)))).Methods("DELETE")
+	}
+	router.Handle("/objects", signedAuth(instrument("delete", http.HandlerFunc(deleteObjectHandler)))).Methods("DELETE")
+	router.Handle("/lookup", auth(instrument("lookup", http.HandlerFunc(lookupHandler)))).Methods("GET")
+	router.Handle("/quotas", auth(instrument("list", http.HandlerFunc(quotaListHandler)))).Methods("GET")
+	router.Handle("/quotas/stats", auth(instrument("stats", http.HandlerFunc(quotaStatsHandler)))).Methods("GET")
+	router.Handle("/graphql", auth(instrument("graphql", http.HandlerFunc(graphqlHandler)))).Methods("GET", "POST")
+	router.Handle("/admin/graphql", adminAuth(instrument("admin_graphql", http.HandlerFunc(adminGraphqlHandler)))).Methods("GET", "POST")
+	router.Handle("/dlq", adminAuth(http.HandlerFunc(deadLettersHandler))).Methods("GET")
+	router.Handle("/dlq/replay", adminAuth(instrument("dlq_replay", http.HandlerFunc(replayDeadLettersHandler)))).Methods("POST")
+	router.Handle("/purge", signedAuth(instrument("purge", http.HandlerFunc(purgeHandler)))).Methods("DELETE")
+	router.Handle("/admin/compact", adminAuth(instrument("compact", http.HandlerFunc(compactHandler)))).Methods("POST")
+	router.Handle("/admin/sync", adminAuth(instrument("sync", http.HandlerFunc(syncHandler)))).Methods("POST")
+	router.Handle("/admin/status", adminAuth(http.HandlerFunc(statusHandler))).Methods("GET")
+	router.Handle("/admin/jobs", adminAuth(http.HandlerFunc(jobsHandler))).Methods("GET")
+	router.Handle("/admin/logs/stream", adminAuth(http.HandlerFunc(logStreamHandler))).Methods("GET")
+	router.Handle("/admin/flags", adminAuth(http.HandlerFunc(flagsHandler))).Methods("GET")
+	router.Handle("/admin/blocklist", adminAuth(http.HandlerFunc(blocklistHandler))).Methods("GET")
+	router.Handle("/admin/blocklist/{user}", adminAuth(http.HandlerFunc(blockUserHandler))).Methods("PUT")
+	router.Handle("/admin/blocklist/{user}", adminAuth(http.HandlerFunc(unblockUserHandler))).Methods("DELETE")
+	router.Handle("/admin/tokens/{user}", adminAuth(http.HandlerFunc(issueTokenHandler))).Methods("POST")
+	router.Handle("/admin/cache/{user}", adminAuth(http.HandlerFunc(invalidateCacheHandler))).Methods("DELETE")
+	router.Handle("/admin/sites/{name}/reconnect", adminAuth(http.HandlerFunc(reconnectHandler))).Methods("POST")
+	router.Handle("/admin/debug/vars", adminAuth(expvar.Handler())).Methods("GET")
+	router.Handle("/metrics", auth(metricsHandler())).Methods("GET")
+	router.Handle("/ready", http.HandlerFunc(readyHandler)).Methods("GET")
+	router.Handle("/version", auth(http.HandlerFunc(versionHandler))).Methods("GET")
+	registerFaultRoutes(router)
+	registerClockRoutes(router)
+	// registered last, so that it does not shadow the other /quota/ routes
+	router.Handle("/quota/{user}", auth(instrument("usage", http.HandlerFunc(quotaUsageHandler)))).Methods("GET")
+	router.Handle("/quota/{user}", adminAuth(instrument("adjust", http.HandlerFunc(quotaAdjustHandler)))).Methods("PATCH")
 
-	for _, s3Client := range s3Clients {
-		fmt.Printf("Configured MinIO Site: %v\n", s3Client.EndpointURL().Host)
+	for _, site := range sites {
+		if site.InitError() != nil {
+			fmt.Printf("Configured MinIO Site: %v (initializing)\n", site.Client().EndpointURL().Host)
+			continue
+		}
+		fmt.Printf("Configured MinIO Site: %v\n", site.Client().EndpointURL().Host)
 	}
 	fmt.Printf("Configured data bucket: %v\n", dataBucket)
 	fmt.Printf("Configured quota bucket: %v\n", quotaBucket)
 	fmt.Printf("Configured max limit per user: %v\n", maxLimit)
+	if replicationDedup {
+		fmt.Println("Replication event deduplication: on")
+	}
+	if originSite != "" {
+		fmt.Printf("Counting the events of origin site: %v\n", originSite)
+	}
+	if readPreference != readPreferenceAll {
+		fmt.Printf("Configured read preference: %v\n", readPreference)
+	}
+	if checkHedgeDelay > 0 && readPreference != readPreferenceAll {
+		fmt.Printf("Hedged checks: after %v\n", checkHedgeDelay)
+	}
+	if enforcementMode == enforcementModeMonitor {
+		fmt.Println("Enforcement mode: monitor (over-limit users are not rejected)")
+	}
+	if enforcementMode == enforcementModeDelete {
+		fmt.Println("Enforcement mode: delete (over-limit objects are deleted)")
+	}
+	if enforcementMode == enforcementModeTag {
+		fmt.Printf("Enforcement mode: tag (over-limit objects are tagged %v)\n", overLimitTag)
+	}
+	if value := env.Get("ENFORCEMENT_ACTIONS", ""); value != "" {
+		fmt.Printf("Enforcement actions: %v\n", strings.Join(defaultPolicy.names, ","))
+	}
+	if uploadProxy {
+		fmt.Printf("Upload proxy: on (site %v)\n", uploadSite().name)
+	}
+	if s3ProxyAddress != "" {
+		fmt.Printf("S3 proxy: on %v\n", s3ProxyAddress)
+	}
+	for _, flag := range listFeatureFlags() {
+		if flag.Enabled {
+			fmt.Printf("Feature flag: %v\n", flag.Name)
+		}
+	}
 	fmt.Println()
+	fmt.Printf("Version: %v (commit %v, built %v)\n", version, commit, buildDate)
 	fmt.Printf("Listening on %v ...\n", address)
 	fmt.Println()
 
-	if err := http.ListenAndServe(address, router); err != nil {
+	if err := serve(router); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func auth(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if authToken != "" {
-			if authToken != r.Header.Get("Authorization") {
-				http.Error(w, "authorization header missing", http.StatusBadRequest)
-				return
-			}
-		}
-		h.ServeHTTP(w, r)
-	})
-}
-
-func getS3Client(endpoint string, accessKey string, secretKey string, insecure bool) (*minio.Client, error) {
+func getS3Client(endpoint string, accessKey string, secretKey string, insecure bool, tc transportConfig) (*minio.Client, error) {
 	u, err := url.Parse(endpoint)
 	if err != nil {
 		return nil, err
@@ -134,10 +290,11 @@ func getS3Client(endpoint string, accessKey string, secretKey string, insecure b
 	if transport.TLSClientConfig != nil {
 		transport.TLSClientConfig.InsecureSkipVerify = insecure
 	}
+	tc.apply(transport)
 	s3Client, err := minio.New(u.Host, &minio.Options{
 		Creds:     credentials.NewStaticV4(accessKey, secretKey, ""),
 		Secure:    secure,
-		Transport: transport,
+		Transport: injectFaults(tc.site, traceTransport{transport}),
 	})
 	if err != nil {
 		return nil, err
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/pkg/env"
+	"github.com/minio/pkg/sync/errgroup"
+)
+
+var (
+	// manifestCache caches the user quotas read by the checks, keyed by the site and the user;
+	// nil if QUOTA_CACHE_TTL is not set
+	manifestCache *ttlCache[*UserQuota]
+	// missingManifestCache caches the users found without a quota by the checks, keyed by the
+	// site and the user; nil if QUOTA_NEGATIVE_CACHE_TTL is not set
+	missingManifestCache *ttlCache[struct{}]
+)
+
+// initManifestCache sets up the manifest caches, dropping their expired entries in the
+// background, and optionally warms them up
+func initManifestCache(ctx context.Context) error {
+	maxEntries, err := env.GetInt("QUOTA_CACHE_MAX_ENTRIES", 100000)
+	if err != nil {
+		return fmt.Errorf("unable to read QUOTA_CACHE_MAX_ENTRIES env; %v", err)
+	}
+	if maxEntries <= 0 {
+		return errors.New("QUOTA_CACHE_MAX_ENTRIES env must be greater than 0")
+	}
+	negativeTTL, err := getDurationEnv("QUOTA_NEGATIVE_CACHE_TTL", 0)
+	if err != nil {
+		return err
+	}
+	if negativeTTL > 0 {
+		missingManifestCache = newTTLCache[struct{}](negativeTTL, maxEntries)
+		go missingManifestCache.janitor(ctx)
+	}
+	ttl, err := getDurationEnv("QUOTA_CACHE_TTL", 0)
+	if err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return nil
+	}
+	manifestCache = newTTLCache[*UserQuota](ttl, maxEntries)
+	go manifestCache.janitor(ctx)
+	if env.Get("QUOTA_CACHE_WARMUP", "off") != "on" {
+		return nil
+	}
+	window, err := getDurationEnv("QUOTA_CACHE_WARMUP_WINDOW", 24*time.Hour)
+	if err != nil {
+		return err
+	}
+	return warmManifestCache(ctx, window)
+}
+
+func manifestCacheKey(site *site, user string) string {
+	return site.name + "/" + user
+}
+
+// clone returns a copy of the quota, so that the cached quotas are never mutated
+func (quota *UserQuota) clone() *UserQuota {
+	objects := make(map[string]quotaEntry, len(quota.Objects))
+	for object, entry := range quota.Objects {
+		objects[object] = entry
+	}
+	var rejections map[string]int
+	if quota.Rejections != nil {
+		rejections = make(map[string]int, len(quota.Rejections))
+		for date, count := range quota.Rejections {
+			rejections[date] = count
+		}
+	}
+	var holds map[string]quotaHold
+	if quota.Holds != nil {
+		holds = make(map[string]quotaHold, len(quota.Holds))
+		for id, hold := range quota.Holds {
+			holds[id] = hold
+		}
+	}
+	return &UserQuota{
+		Objects:    objects,
+		MaxLimit:   quota.MaxLimit,
+		Rejections: rejections,
+		Holds:      holds,
+	}
+}
+
+// cachedManifest returns a copy of the cached user quota of the site, if present
+func cachedManifest(site *site, user string) (*UserQuota, bool) {
+	if manifestCache == nil {
+		return nil, false
+	}
+	userQuota, ok := manifestCache.Get(manifestCacheKey(site, user))
+	if !ok {
+		expCache.Add("misses", 1)
+		return nil, false
+	}
+	expCache.Add("hits", 1)
+	return userQuota.clone(), true
+}
+
+// cacheManifest caches a copy of the user quota of the site
+func cacheManifest(site *site, user string, userQuota *UserQuota) {
+	if manifestCache == nil {
+		return
+	}
+	manifestCache.Set(manifestCacheKey(site, user), userQuota.clone())
+}
+
+// cachedMissingManifest returns true if the user was recently found without a quota on the site
+func cachedMissingManifest(site *site, user string) bool {
+	if missingManifestCache == nil {
+		return false
+	}
+	_, ok := missingManifestCache.Get(manifestCacheKey(site, user))
+	if ok {
+		expCache.Add("negative_hits", 1)
+	}
+	return ok
+}
+
+// cacheMissingManifest caches that the user has no quota on the site
+func cacheMissingManifest(site *site, user string) {
+	if missingManifestCache == nil {
+		return
+	}
+	missingManifestCache.Set(manifestCacheKey(site, user), struct{}{})
+}
+
+// invalidateManifest drops the cached user quota of the site, after it is written, on all the replicas
+func invalidateManifest(site *site, user string) {
+	dropCachedManifest(site, user)
+	if manifestCache != nil || missingManifestCache != nil {
+		invalidations.publish(context.Background(), invalidationMessage{Site: site.name, User: user})
+	}
+}
+
+// dropCachedManifest drops the cached user quota of the site
+func dropCachedManifest(site *site, user string) {
+	if missingManifestCache != nil {
+		missingManifestCache.Delete(manifestCacheKey(site, user))
+	}
+	if manifestCache == nil {
+		return
+	}
+	manifestCache.Delete(manifestCacheKey(site, user))
+}
+
+// warmManifestCache loads the user quotas modified within the window into the cache, until it
+// is full, so that the checks right after a restart are served from memory
+func warmManifestCache(ctx context.Context, window time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	since := time.Now().Add(-window)
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
+		index := index
+		g.Go(func() error {
+			site := sites[index]
+			if site.Client() == nil {
+				return errors.New("s3Client is nil")
+			}
+			if site.InitError() != nil {
+				logf(ctx, "WARNING", site.name, "not warming the cache; the site is still initializing")
+				return nil
+			}
+			var loaded int
+			for object := range site.Client().ListObjects(ctx, quotaBucket, minio.ListObjectsOptions{}) {
+				if object.Err != nil {
+					logf(ctx, "ERROR", site.name, "unable to list objects from '%v' bucket; %v", quotaBucket, object.Err)
+					return fmt.Errorf("unable to list objects; %v", object.Err)
+				}
+				if !strings.HasSuffix(object.Key, quotaExt) || object.LastModified.Before(since) {
+					continue
+				}
+				if manifestCache.Full() {
+					logf(ctx, "WARNING", site.name, "not warming the cache further; QUOTA_CACHE_MAX_ENTRIES reached")
+					break
+				}
+				user := strings.TrimSuffix(object.Key, quotaExt)
+				userQuota, _, err := readUserQuota(ctx, site.Client(), user)
+				if err != nil {
+					logf(ctx, "WARNING", site.name, "unable to warm the cache for user '%v'; %v", user, err)
+					continue
+				}
+				cacheManifest(site, user, userQuota)
+				loaded++
+			}
+			logf(ctx, "LOG", site.name, "warmed the cache with %v user quotas", loaded)
+			return nil
+		}, index)
+	}
+	return g.WaitErr()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/pkg/env"
+)
+
+// userCountTTL is how long the number of the users listed from the quota bucket of a site is
+// trusted before it is listed again
+const userCountTTL = time.Minute
+
+var (
+	// maxUsers is the max number of the user quotas in the quota bucket of a site, so that the
+	// malformed paths cannot grow it with bogus users; unlimited if 0
+	maxUsers int
+
+	errMaxUsersExceeded = errors.New("max number of users exceeded")
+
+	userCounts = &userCounter{sites: map[string]*siteUserCount{}}
+)
+
+// siteUserCount is the number of the user quotas of a site, as last listed plus the quotas
+// created since
+type siteUserCount struct {
+	listed   int
+	listedAt time.Time
+	// created are the users whose quota was created since the listing started, by their time
+	created map[string]time.Time
+	// listing is closed once the listing in flight is done; nil if none
+	listing chan struct{}
+}
+
+// userCounter counts the user quotas of the sites to enforce MAX_USERS
+type userCounter struct {
+	mu    sync.Mutex
+	sites map[string]*siteUserCount
+}
+
+// loadMaxUsers reads the MAX_USERS env
+func loadMaxUsers() (err error) {
+	if maxUsers, err = env.GetInt("MAX_USERS", 0); err != nil {
+		return fmt.Errorf("unable to read MAX_USERS env; %v", err)
+	}
+	if maxUsers < 0 {
+		return errors.New("MAX_USERS env must not be negative")
+	}
+	return nil
+}
+
+// admitUser returns a final error if creating the quota of the new user would exceed MAX_USERS
+// on the site; the user is counted once their quota is written
+func admitUser(ctx context.Context, s3Client ObjectStore, user string) error {
+	if maxUsers <= 0 {
+		return nil
+	}
+	count, err := userCounts.count(ctx, s3Client)
+	if err != nil {
+		return fmt.Errorf("unable to count the users; %v", err)
+	}
+	if count >= maxUsers {
+		logf(ctx, "ERROR", s3Client.EndpointURL().Host, "unable to create the quota of user '%v'; %v users already", user, count)
+		return final(fmt.Errorf("%w; %v", errMaxUsersExceeded, maxUsers))
+	}
+	return nil
+}
+
+// site returns the count of the site; called with the lock held
+func (c *userCounter) site(host string) *siteUserCount {
+	counted, ok := c.sites[host]
+	if !ok {
+		counted = &siteUserCount{created: map[string]time.Time{}}
+		c.sites[host] = counted
+	}
+	return counted
+}
+
+// count returns the number of the user quotas of the site, listing them again once the last
+// listing is older than userCountTTL; a single listing per site is in flight, outside of the
+// lock, and the other callers wait for it
+func (c *userCounter) count(ctx context.Context, s3Client ObjectStore) (int, error) {
+	host := s3Client.EndpointURL().Host
+	for {
+		c.mu.Lock()
+		counted := c.site(host)
+		if !counted.listedAt.IsZero() && time.Since(counted.listedAt) <= userCountTTL {
+			count := counted.listed + len(counted.created)
+			c.mu.Unlock()
+			return count, nil
+		}
+		if listing := counted.listing; listing != nil {
+			c.mu.Unlock()
+			select {
+			case <-listing:
+				continue
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+		}
+		listing := make(chan struct{})
+		counted.listing = listing
+		c.mu.Unlock()
+
+		start := time.Now()
+		listed, err := countUsers(ctx, s3Client)
+		c.mu.Lock()
+		counted.listing = nil
+		close(listing)
+		if err != nil {
+			c.mu.Unlock()
+			return 0, err
+		}
+		counted.listed, counted.listedAt = listed, time.Now()
+		for user, createdAt := range counted.created {
+			// listed already
+			if createdAt.Before(start) {
+				delete(counted.created, user)
+			}
+		}
+		count := counted.listed + len(counted.created)
+		c.mu.Unlock()
+		return count, nil
+	}
+}
+
+// add counts the user whose quota was created on the site, once however many times written
+func (c *userCounter) add(host, user string) {
+	if maxUsers <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.site(host).created[user] = time.Now()
+}
+
+// countUsers lists the user quotas in the quota bucket
+func countUsers(ctx context.Context, s3Client ObjectStore) (count int, err error) {
+	for object := range s3Client.ListObjects(ctx, quotaBucket, minio.ListObjectsOptions{}) {
+		if object.Err != nil {
+			return 0, object.Err
+		}
+		if strings.HasSuffix(object.Key, quotaExt) {
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestMaxUsers(t *testing.T) {
+	setupTestSites(t, 1)
+	maxUsers, userCounts = 2, &userCounter{sites: map[string]*siteUserCount{}}
+	t.Cleanup(func() { maxUsers, userCounts = 0, &userCounter{sites: map[string]*siteUserCount{}} })
+	ctx := context.Background()
+
+	// the users are counted once, however many objects they upload
+	for _, event := range [][]string{{"usera", "a"}, {"usera", "b"}, {"userb", "a"}} {
+		if err := processEvent(ctx, testEvent("s3:ObjectCreated:Put", event[0], event[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count, err := userCounts.count(ctx, sites[0].Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 users, got %v", count)
+	}
+	if err := processEvent(ctx, testEvent("s3:ObjectCreated:Put", "userc", "a")); !errors.Is(err, errMaxUsersExceeded) {
+		t.Fatalf("expected %v, got %v", errMaxUsersExceeded, err)
+	}
+	if err := processEvent(ctx, testEvent("s3:ObjectCreated:Put", "usera", "c")); err != nil {
+		t.Fatalf("existing user: expected nil, got %v", err)
+	}
+
+	// a new listing counts the users created before it once
+	counted := userCounts.sites[sites[0].Client().EndpointURL().Host]
+	counted.listedAt = counted.listedAt.Add(-2 * userCountTTL)
+	if count, err = userCounts.count(ctx, sites[0].Client()); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 users once listed again, got %v", count)
+	}
+}
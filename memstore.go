@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// memStore is an in-memory ObjectStore, standing in for a MinIO site in the tests and
+// the benchmarks
+type memStore struct {
+	mu       sync.Mutex
+	endpoint *url.URL
+	buckets  map[string]map[string]memObject
+}
+
+type memObject struct {
+	data []byte
+	info minio.ObjectInfo
+}
+
+// newMemStore returns an empty in-memory store with the provided buckets
+func newMemStore(name string, buckets ...string) *memStore {
+	s := &memStore{
+		endpoint: &url.URL{Scheme: "mem", Host: name},
+		buckets:  map[string]map[string]memObject{},
+	}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = map[string]memObject{}
+	}
+	return s
+}
+
+func noSuchKey(bucket, key string) error {
+	return minio.ErrorResponse{
+		StatusCode: http.StatusNotFound,
+		Code:       "NoSuchKey",
+		Message:    "The specified key does not exist.",
+		BucketName: bucket,
+		Key:        key,
+	}
+}
+
+func noSuchBucket(bucket string) error {
+	return minio.ErrorResponse{
+		StatusCode: http.StatusNotFound,
+		Code:       "NoSuchBucket",
+		Message:    "The specified bucket does not exist",
+		BucketName: bucket,
+	}
+}
+
+// ReadObject returns the object along with its info
+func (s *memStore) ReadObject(ctx context.Context, bucket, key string) (io.ReadCloser, minio.ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		return nil, minio.ObjectInfo{}, noSuchBucket(bucket)
+	}
+	object, ok := objects[key]
+	if !ok {
+		return nil, minio.ObjectInfo{}, noSuchKey(bucket, key)
+	}
+	return io.NopCloser(bytes.NewReader(object.data)), object.info, nil
+}
+
+// PutObject stores the object, honoring the match ETag of the options
+func (s *memStore) PutObject(ctx context.Context, bucket, key string, reader io.Reader, size int64, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	sum := md5.Sum(data)
+	etag := hex.EncodeToString(sum[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		return minio.UploadInfo{}, noSuchBucket(bucket)
+	}
+	if match := opts.Header().Get("If-Match"); match != "" {
+		if object, ok := objects[key]; ok && object.info.ETag != strings.Trim(match, "\"") {
+			return minio.UploadInfo{}, minio.ErrorResponse{
+				StatusCode: http.StatusPreconditionFailed,
+				Code:       "PreconditionFailed",
+				Message:    "At least one of the pre-conditions you specified did not hold",
+				BucketName: bucket,
+				Key:        key,
+			}
+		}
+	}
+	userMetadata := minio.StringMap{}
+	for k, v := range opts.UserMetadata {
+		userMetadata[k] = v
+	}
+	now := time.Now().UTC()
+	objects[key] = memObject{
+		data: data,
+		info: minio.ObjectInfo{
+			Key:          key,
+			ETag:         etag,
+			Size:         int64(len(data)),
+			LastModified: now,
+			ContentType:  opts.ContentType,
+			UserMetadata: userMetadata,
+		},
+	}
+	return minio.UploadInfo{
+		Bucket:       bucket,
+		Key:          key,
+		ETag:         etag,
+		Size:         int64(len(data)),
+		LastModified: now,
+	}, nil
+}
+
+// ListObjects lists the objects sorted by the key; without recursion, the keys are
+// grouped by the next "/" after the prefix
+func (s *memStore) ListObjects(ctx context.Context, bucket string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	s.mu.Lock()
+	var infos []minio.ObjectInfo
+	objects, ok := s.buckets[bucket]
+	if ok {
+		prefixes := map[string]struct{}{}
+		for key, object := range objects {
+			if !strings.HasPrefix(key, opts.Prefix) {
+				continue
+			}
+			if !opts.Recursive {
+				if i := strings.Index(key[len(opts.Prefix):], "/"); i >= 0 {
+					prefix := key[:len(opts.Prefix)+i+1]
+					if _, ok := prefixes[prefix]; !ok {
+						prefixes[prefix] = struct{}{}
+						infos = append(infos, minio.ObjectInfo{Key: prefix})
+					}
+					continue
+				}
+			}
+			infos = append(infos, object.info)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Key < infos[j].Key
+	})
+	ch := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(ch)
+		if !ok {
+			ch <- minio.ObjectInfo{Err: noSuchBucket(bucket)}
+			return
+		}
+		for _, info := range infos {
+			if opts.StartAfter != "" && info.Key <= opts.StartAfter {
+				continue
+			}
+			select {
+			case ch <- info:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// RemoveObject removes the object; a force delete removes the objects under the key
+// as a prefix too, like MinIO
+func (s *memStore) RemoveObject(ctx context.Context, bucket, key string, opts minio.RemoveObjectOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		return noSuchBucket(bucket)
+	}
+	delete(objects, key)
+	if opts.ForceDelete {
+		prefix := strings.TrimSuffix(key, "/") + "/"
+		for k := range objects {
+			if strings.HasPrefix(k, prefix) {
+				delete(objects, k)
+			}
+		}
+	}
+	return nil
+}
+
+// StatObject returns the info of the object
+func (s *memStore) StatObject(ctx context.Context, bucket, key string, opts minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		return minio.ObjectInfo{}, noSuchBucket(bucket)
+	}
+	object, ok := objects[key]
+	if !ok {
+		return minio.ObjectInfo{}, noSuchKey(bucket, key)
+	}
+	return object.info, nil
+}
+
+// BucketExists returns true if the bucket exists
+func (s *memStore) BucketExists(ctx context.Context, bucket string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.buckets[bucket]
+	return ok, nil
+}
+
+// EndpointURL returns the mem://NAME url of the store
+func (s *memStore) EndpointURL() *url.URL {
+	return s.endpoint
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/notification"
+)
+
+// setupTestSites configures the in-memory sites with a limit of 3 objects per user, restoring
+// the configuration once the test is done
+func setupTestSites(t *testing.T, count int) {
+	t.Helper()
+	savedSites, savedData, savedQuota, savedLimit, savedRejections := sites, dataBucket, quotaBucket, maxLimit, rejections
+	t.Cleanup(func() {
+		sites, dataBucket, quotaBucket, maxLimit, rejections = savedSites, savedData, savedQuota, savedLimit, savedRejections
+	})
+	dataBucket, quotaBucket, maxLimit, rejections = "data", "quota", 3, newRejectionCounter()
+	sites = nil
+	for i := 1; i <= count; i++ {
+		name := fmt.Sprintf("site%v", i)
+		sites = append(sites, newStoreSite(name, newMemStore(name, dataBucket, quotaBucket)))
+	}
+	if err := loadEnforcementPolicies(); err != nil {
+		t.Fatal(err)
+	}
+	if err := initBlocklist(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testEvent returns the event of the object uploaded today by the user
+func testEvent(name, user, object string) notification.Event {
+	var event notification.Event
+	event.EventName = name
+	event.EventTime = time.Now().UTC().Format(time.RFC3339Nano)
+	event.S3.Bucket.Name = dataBucket
+	event.S3.Object.Key = getCurrentDateInUTC().Format(dateFormat) + "/" + user + "/" + object
+	event.S3.Object.Size = 1024
+	return event
+}
+
+func TestMemStorePutObjectIfMatch(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore("site1", "quota")
+	info, err := store.PutObject(ctx, "quota", "usera.quota", bytes.NewReader([]byte("v1")), 2, minio.PutObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := minio.PutObjectOptions{}
+	opts.SetMatchETag(info.ETag)
+	if _, err := store.PutObject(ctx, "quota", "usera.quota", bytes.NewReader([]byte("v2")), 2, opts); err != nil {
+		t.Fatalf("PUT matching the ETag failed; %v", err)
+	}
+	if _, err := store.PutObject(ctx, "quota", "usera.quota", bytes.NewReader([]byte("v3")), 2, opts); minio.ToErrorResponse(err).Code != "PreconditionFailed" {
+		t.Fatalf("PUT with a stale ETag: expected PreconditionFailed, got %v", err)
+	}
+	if _, _, err := store.ReadObject(ctx, "quota", "userb.quota"); minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		t.Fatalf("missing object: expected NoSuchKey, got %v", err)
+	}
+}
+
+func TestMemStoreListObjects(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore("site1", "data")
+	for _, key := range []string{"2024-Jan-02/usera/b", "2024-Jan-01/usera/a", "2024-Jan-01/userb/c"} {
+		if _, err := store.PutObject(ctx, "data", key, bytes.NewReader(nil), 0, minio.PutObjectOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testCases := []struct {
+		opts     minio.ListObjectsOptions
+		expected []string
+	}{
+		{minio.ListObjectsOptions{}, []string{"2024-Jan-01/", "2024-Jan-02/"}},
+		{minio.ListObjectsOptions{Recursive: true}, []string{"2024-Jan-01/usera/a", "2024-Jan-01/userb/c", "2024-Jan-02/usera/b"}},
+		{minio.ListObjectsOptions{Prefix: "2024-Jan-01/", Recursive: true, StartAfter: "2024-Jan-01/usera/a"}, []string{"2024-Jan-01/userb/c"}},
+	}
+	for i, testCase := range testCases {
+		var keys []string
+		for object := range store.ListObjects(ctx, "data", testCase.opts) {
+			if object.Err != nil {
+				t.Fatal(object.Err)
+			}
+			keys = append(keys, object.Key)
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(testCase.expected) {
+			t.Errorf("case %v: expected %v, got %v", i+1, testCase.expected, keys)
+		}
+	}
+}
+
+func TestProcessEventCountsOnAllSites(t *testing.T) {
+	setupTestSites(t, 2)
+	ctx := context.Background()
+	for _, object := range []string{"a", "b", "a"} {
+		if err := processEvent(ctx, testEvent("s3:ObjectCreated:Put", "usera", object)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, site := range sites {
+		userQuota, _, err := readUserQuota(ctx, site.Client(), "usera")
+		if err != nil {
+			t.Fatalf("%v: %v", site.name, err)
+		}
+		if len(userQuota.Objects) != 2 {
+			t.Errorf("%v: expected 2 objects, got %v", site.name, len(userQuota.Objects))
+		}
+	}
+	if err := processEvent(ctx, testEvent("s3:ObjectRemoved:Delete", "usera", "a")); err != nil {
+		t.Fatal(err)
+	}
+	userQuota, _, err := readUserQuota(ctx, sites[1].Client(), "usera")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userQuota.Objects) != 1 {
+		t.Errorf("expected 1 object after the removal, got %v", len(userQuota.Objects))
+	}
+}
+
+func TestCheckQuotaOverLimit(t *testing.T) {
+	setupTestSites(t, 2)
+	ctx := context.Background()
+	if err := checkQuota(ctx, "usera"); err != nil {
+		t.Fatalf("new user: expected nil, got %v", err)
+	}
+	for _, object := range []string{"a", "b", "c"} {
+		if err := processEvent(ctx, testEvent("s3:ObjectCreated:Put", "usera", object)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := checkQuota(ctx, "usera"); !errors.Is(err, errMaxLimitExceeded) {
+		t.Fatalf("user at the limit: expected %v, got %v", errMaxLimitExceeded, err)
+	}
+	if err := checkQuota(ctx, "userb"); err != nil {
+		t.Fatalf("other user: expected nil, got %v", err)
+	}
+}
+
+func TestRefreshDropsExpiredObjects(t *testing.T) {
+	yesterday := getCurrentDateInUTC().AddDate(0, 0, -1).Format(dateFormat)
+	today := getCurrentDateInUTC().Format(dateFormat)
+	userQuota := NewUserQuota()
+	userQuota.Objects[yesterday+"/usera/a"] = quotaEntry{}
+	userQuota.Objects[today+"/usera/b"] = quotaEntry{}
+	userQuota.Objects["malformed"] = quotaEntry{}
+	if !userQuota.Refresh() {
+		t.Fatal("expected the quota to be updated")
+	}
+	if len(userQuota.Objects) != 1 {
+		t.Fatalf("expected 1 object left, got %v", userQuota.Objects)
+	}
+	if _, ok := userQuota.Objects[today+"/usera/b"]; !ok {
+		t.Fatalf("expected the object of today to be kept, got %v", userQuota.Objects)
+	}
+	if userQuota.Refresh() {
+		t.Fatal("expected a refreshed quota to be unchanged")
+	}
+}
+
+func TestLateEventNotCountedToday(t *testing.T) {
+	setupTestSites(t, 1)
+	saved := lateEventTolerance
+	lateEventTolerance = 48 * time.Hour
+	t.Cleanup(func() { lateEventTolerance = saved })
+	ctx := context.Background()
+	for _, object := range []string{"a", "b", "c"} {
+		if err := processEvent(ctx, testEvent("s3:ObjectCreated:Put", "usera", object)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	yesterday := getCurrentDateInUTC().AddDate(0, 0, -1)
+	late := testEvent("s3:ObjectCreated:Put", "usera", "late")
+	late.EventTime = yesterday.Add(23 * time.Hour).Format(time.RFC3339Nano)
+	late.S3.Object.Key = yesterday.Format(dateFormat) + "/usera/late"
+	if err := processEvent(ctx, late); err != nil {
+		t.Fatalf("late event: expected to be accepted, got %v", err)
+	}
+	userQuota, _, err := readUserQuota(ctx, sites[0].Client(), "usera")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !userQuota.Refresh() || len(userQuota.Objects) != 3 {
+		t.Fatalf("expected the late object pruned by the refresh, got %v", userQuota.Objects)
+	}
+}
+
+func TestRefreshCheckpointBeforeFailedUser(t *testing.T) {
+	setupTestSites(t, 1)
+	savedRetry, savedWorkers := defaultRetry, refreshWorkers
+	t.Cleanup(func() { defaultRetry, refreshWorkers = savedRetry, savedWorkers })
+	defaultRetry, refreshWorkers = retryPolicy{maxAttempts: 1}, 4
+	ctx := context.Background()
+	s3Client := sites[0].Client()
+	// the quota of the user failing to be refreshed, in the middle of the second batch, cannot be decoded
+	failed := checkpointInterval + 5
+	for i := 0; i < 2*checkpointInterval+10; i++ {
+		user := fmt.Sprintf("user%04d", i)
+		if i == failed {
+			if _, err := s3Client.PutObject(ctx, quotaBucket, user+quotaExt, bytes.NewReader([]byte("{")), 1, minio.PutObjectOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := processEvent(ctx, testEvent("s3:ObjectCreated:Put", user, "a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := refreshQuota(ctx, siteTargets{}, userFilter{}); err == nil {
+		t.Fatal("expected the failed refresh to be returned")
+	}
+	checkpoint, err := readCheckpoint(ctx, s3Client, refreshCheckpointKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("user%04d%v", failed-1, quotaExt); checkpoint == nil || checkpoint.LastKey != expected {
+		t.Fatalf("expected the checkpoint kept at %v, right before the failed user, got %+v", expected, checkpoint)
+	}
+}
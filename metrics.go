@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/pkg/env"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "quota_server"
+
+var (
+	// metricsTopUsers is the number of users with the highest usage to export the per-user gauges for
+	metricsTopUsers = 10
+	// metricsUsers is the allowlist of users to always export the per-user gauges for
+	metricsUsers []string
+	// metricsUsageRetention is how long the last seen usage of a user is kept once they are no
+	// longer seen
+	metricsUsageRetention = 24 * time.Hour
+
+	eventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_total",
+		Help:      "Total number of bucket notification events processed by result",
+	}, []string{"result"})
+	checksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "checks_total",
+		Help:      "Total number of quota checks by result",
+	}, []string{"result"})
+	shedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "shed_requests_total",
+		Help:      "Total number of update requests shed while overloaded by reason",
+	}, []string{"reason"})
+	siteQuarantined = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "site_quarantined",
+		Help:      "Whether the writes to the site are deferred after repeated failures",
+	}, []string{"site"})
+	corruptManifestsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "corrupt_manifests_total",
+		Help:      "Total number of user quotas read not matching their checksum or not parsable",
+	})
+	compactedManifestsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "compacted_manifests_total",
+		Help:      "Total number of user quotas compacted for exceeding the max manifest size",
+	})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to serve the API requests",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"api"})
+
+	userObjectsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "user", "objects"),
+		"Number of objects counted in the user quota",
+		[]string{"user"}, nil)
+	userLimitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "user", "limit"),
+		"Max limit of objects of the user quota",
+		[]string{"user"}, nil)
+	userRejectionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "user", "rejections"),
+		"Number of updates of the user rejected today for exceeding the limit",
+		[]string{"user"}, nil)
+
+	usage = &usageTracker{users: map[string]userUsage{}}
+)
+
+// loadMetricsConfig reads the METRICS_TOP_USERS and METRICS_USAGE_RETENTION envs, and the
+// METRICS_USERS env by the canonical names of the users
+func loadMetricsConfig() (err error) {
+	if metricsTopUsers, err = env.GetInt("METRICS_TOP_USERS", 10); err != nil {
+		return fmt.Errorf("unable to read METRICS_TOP_USERS env; %v", err)
+	}
+	if metricsTopUsers < 0 {
+		return errors.New("METRICS_TOP_USERS env must not be negative")
+	}
+	if metricsUsageRetention, err = getDurationEnv("METRICS_USAGE_RETENTION", metricsUsageRetention); err != nil {
+		return err
+	}
+	if metricsUsageRetention <= 0 {
+		return errors.New("METRICS_USAGE_RETENTION env must be greater than 0")
+	}
+	metricsUsers = nil
+	for _, user := range parseList(env.Get("METRICS_USERS", "")) {
+		metricsUsers = append(metricsUsers, canonicalUser(user))
+	}
+	return nil
+}
+
+func init() {
+	prometheus.MustRegister(eventsTotal, checksTotal, shedTotal, siteQuarantined, corruptManifestsTotal, compactedManifestsTotal, requestDuration, usage)
+}
+
+// parseList parses a comma separated list of values
+func parseList(value string) (list []string) {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return
+}
+
+// countEvent counts a processed bucket notification event
+func countEvent(result string) {
+	eventsTotal.WithLabelValues(result).Inc()
+	expEvents.Add(result, 1)
+	statsd.Count("events_total", "result:"+result)
+}
+
+// countCheck counts a quota check
+func countCheck(result string) {
+	checksTotal.WithLabelValues(result).Inc()
+	expChecks.Add(result, 1)
+	statsd.Count("checks_total", "result:"+result)
+}
+
+// countShed counts an update request shed while overloaded
+func countShed(reason string) {
+	shedTotal.WithLabelValues(reason).Inc()
+	expShed.Add(reason, 1)
+	statsd.Count("shed_requests_total", "reason:"+reason)
+}
+
+// countCorruptManifest counts a broken user quota
+func countCorruptManifest() {
+	corruptManifestsTotal.Inc()
+	expQuotas.Add("corrupt", 1)
+	statsd.Count("corrupt_manifests_total")
+}
+
+// countCompaction counts a user quota compacted for exceeding the max manifest size
+func countCompaction() {
+	compactedManifestsTotal.Inc()
+	expQuotas.Add("compacted", 1)
+	statsd.Count("compacted_manifests_total")
+}
+
+// instrument records the time taken to serve the requests of the api
+func instrument(api string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h.ServeHTTP(w, r)
+		elapsed := time.Since(start)
+		requestDuration.WithLabelValues(api).Observe(elapsed.Seconds())
+		statsd.Timing("request_duration", elapsed, "api:"+api)
+	})
+}
+
+// metricsHandler serves the metrics in Prometheus format
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// userUsage represents the last seen usage of a user
+type userUsage struct {
+	objects    int
+	limit      int
+	rejections int
+	rejectedOn time.Time
+	seenAt     time.Time
+}
+
+// usageTracker tracks the last seen usage of the users and exports the per-user gauges
+// for the top users and the allowlisted users only, to keep the cardinality bounded; the
+// users not seen for METRICS_USAGE_RETENTION are forgotten
+type usageTracker struct {
+	mu    sync.Mutex
+	users map[string]userUsage
+	swept time.Time
+}
+
+// sweepLocked forgets the users not seen for METRICS_USAGE_RETENTION, at most once per retention
+func (t *usageTracker) sweepLocked(now time.Time) {
+	if now.Sub(t.swept) < metricsUsageRetention {
+		return
+	}
+	for user, u := range t.users {
+		if now.Sub(u.seenAt) >= metricsUsageRetention {
+			delete(t.users, user)
+		}
+	}
+	t.swept = now
+}
+
+// track records the usage of the user
+func (t *usageTracker) track(user string, objects, limit int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweepLocked(time.Now())
+	if objects == 0 {
+		delete(t.users, user)
+		return
+	}
+	u := t.users[user]
+	u.objects, u.limit, u.seenAt = objects, limit, time.Now()
+	t.users[user] = u
+}
+
+// trackRejections records the usage of the user along with the number of their updates rejected today
+func (t *usageTracker) trackRejections(user string, objects, limit, rejections int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweepLocked(time.Now())
+	t.users[user] = userUsage{
+		objects:    objects,
+		limit:      limit,
+		rejections: rejections,
+		rejectedOn: getCurrentDateInUTC(),
+		seenAt:     time.Now(),
+	}
+}
+
+// reject counts an update of the user rejected today, until the rejections are flushed to their quota
+func (t *usageTracker) reject(user string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweepLocked(time.Now())
+	today := getCurrentDateInUTC()
+	u := t.users[user]
+	if !u.rejectedOn.Equal(today) {
+		u.rejections, u.rejectedOn = 0, today
+	}
+	u.rejections++
+	u.seenAt = time.Now()
+	t.users[user] = u
+}
+
+// get returns the last seen usage of the user
+func (t *usageTracker) get(user string) (userUsage, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u, ok := t.users[user]
+	return u, ok
+}
+
+// Describe implements prometheus.Collector
+func (t *usageTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- userObjectsDesc
+	ch <- userLimitDesc
+	ch <- userRejectionsDesc
+}
+
+// Collect implements prometheus.Collector
+func (t *usageTracker) Collect(ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	usages := make(map[string]userUsage, len(t.users))
+	users := make([]string, 0, len(t.users))
+	for user, u := range t.users {
+		usages[user] = u
+		users = append(users, user)
+	}
+	t.mu.Unlock()
+
+	// closest to their limit first
+	sort.Slice(users, func(i, j int) bool {
+		ui, uj := usages[users[i]], usages[users[j]]
+		if ui.objects*uj.limit != uj.objects*ui.limit {
+			return ui.objects*uj.limit > uj.objects*ui.limit
+		}
+		return users[i] < users[j]
+	})
+	selected := map[string]struct{}{}
+	for i := 0; i < len(users) && i < metricsTopUsers; i++ {
+		selected[users[i]] = struct{}{}
+	}
+	for _, user := range metricsUsers {
+		selected[user] = struct{}{}
+	}
+	today := getCurrentDateInUTC()
+	for user := range selected {
+		u, ok := usages[user]
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(userObjectsDesc, prometheus.GaugeValue, float64(u.objects), user)
+		ch <- prometheus.MustNewConstMetric(userLimitDesc, prometheus.GaugeValue, float64(u.limit), user)
+		if u.rejectedOn.Equal(today) {
+			ch <- prometheus.MustNewConstMetric(userRejectionsDesc, prometheus.GaugeValue, float64(u.rejections), user)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUsageTrackerForgetsStaleUsers(t *testing.T) {
+	saved := metricsUsageRetention
+	t.Cleanup(func() { metricsUsageRetention = saved })
+	metricsUsageRetention = 20 * time.Millisecond
+
+	tracker := &usageTracker{users: map[string]userUsage{}}
+	tracker.track("usera", 1, 3)
+	tracker.reject("userb")
+	time.Sleep(metricsUsageRetention)
+	tracker.track("userc", 1, 3)
+	if _, ok := tracker.get("usera"); ok {
+		t.Fatal("expected the usage of usera not seen for the retention to be forgotten")
+	}
+	if _, ok := tracker.get("userb"); ok {
+		t.Fatal("expected the rejections of userb not seen for the retention to be forgotten")
+	}
+	if _, ok := tracker.get("userc"); !ok {
+		t.Fatal("expected the usage of userc to be kept")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/minio/pkg/env"
+)
+
+const (
+	enforcementModeEnforce = "enforce"
+	enforcementModeMonitor = "monitor"
+	enforcementModeTag     = "tag"
+	enforcementModeDelete  = "delete"
+)
+
+var (
+	// enforcementMode decides if the over-limit users are rejected, or only tracked and flagged;
+	// the objects going over the limit are deleted in the delete mode, and tagged in the tag mode
+	enforcementMode = env.Get("ENFORCEMENT_MODE", enforcementModeEnforce)
+	// overLimitTag is the tag set on the objects going over the limit in the tag mode
+	overLimitTag = env.Get("OVER_LIMIT_TAG", "quota=exceeded")
+	// monitorUsers are only tracked and flagged even if the limits are enforced
+	monitorUsers []string
+
+	// errOverLimitMonitored is returned when the update of a monitored user went over the limit
+	// and was recorded nevertheless
+	errOverLimitMonitored = errors.New("max limit exceeded; recorded in monitor mode")
+	// errOverLimitDeleted is returned when the object of the update going over the limit was
+	// deleted in the delete mode
+	errOverLimitDeleted = fmt.Errorf("%w; object deleted", errMaxLimitExceeded)
+)
+
+// validateEnforcementMode validates the configured enforcement mode
+func validateEnforcementMode() error {
+	switch enforcementMode {
+	case enforcementModeEnforce, enforcementModeMonitor, enforcementModeDelete:
+		return nil
+	case enforcementModeTag:
+		if key, _, ok := strings.Cut(overLimitTag, "="); !ok || key == "" {
+			return fmt.Errorf("OVER_LIMIT_TAG env must be key=value; %v", overLimitTag)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid ENFORCEMENT_MODE %v", enforcementMode)
+	}
+}
+
+// isMonitored returns true if the limit of the user is not enforced, as none of the
+// enforcement actions of the user rejects the updates
+func isMonitored(user string) bool {
+	return !policyOf(user).rejects()
+}
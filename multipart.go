@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/pkg/env"
+)
+
+const (
+	// declaredSizeKey is the user metadata of the multipart uploads recording the size declared on initiation
+	declaredSizeKey = "Quota-Declared-Size"
+	// partURLExpiry is the validity of the presigned part URLs
+	partURLExpiry = time.Hour
+	// maxParts is the max number of parts of a multipart upload
+	maxParts = 10000
+	// minPartSize is the min size of the parts, but the last
+	minPartSize = 5 << 20
+)
+
+var (
+	// multipartUploads serves the /multipart/{user} endpoints, initiating and completing the multipart
+	// uploads of the users on their behalf
+	multipartUploads = env.Get("MULTIPART_UPLOADS", "off") == "on"
+	// multipartMaxSize is the max size in bytes of an object uploaded in parts; unlimited if 0
+	multipartMaxSize int64
+	// multipartPartSize is the size in bytes of the parts the uploads are split into
+	multipartPartSize int64 = 64 << 20
+	// multipartBytesLimit is the max bytes of the objects counted today for a user that the
+	// multipart uploads may bring them to; unlimited if 0
+	multipartBytesLimit int64
+)
+
+var errDeclaredSizeExceeded = errors.New("object exceeds the size declared on initiation")
+
+// multipartUpload represents a multipart upload initiated on behalf of a user
+type multipartUpload struct {
+	Path     string `json:"path"`
+	UploadID string `json:"uploadId"`
+	Size     int64  `json:"size"`
+	PartSize int64  `json:"partSize"`
+	Parts    int    `json:"parts"`
+	// Reservation holds the object and its declared size in the quota of the user until the
+	// upload is completed or aborted
+	Reservation string `json:"reservation"`
+}
+
+// partURL represents a presigned URL to upload a part to
+type partURL struct {
+	PartNumber int    `json:"partNumber"`
+	URL        string `json:"url"`
+}
+
+// completedPart represents a part uploaded by the user, as returned by the upload of the part
+type completedPart struct {
+	PartNumber int    `json:"partNumber"`
+	ETag       string `json:"etag"`
+}
+
+// loadMultipartConfig reads the sizes of the multipart uploads
+func loadMultipartConfig() error {
+	var errs []error
+	if value := env.Get("MULTIPART_MAX_SIZE", ""); value != "" {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			errs = append(errs, fmt.Errorf("MULTIPART_MAX_SIZE env must be a size in bytes; %v", value))
+		}
+		multipartMaxSize = size
+	}
+	if value := env.Get("MULTIPART_PART_SIZE", ""); value != "" {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < minPartSize {
+			errs = append(errs, fmt.Errorf("MULTIPART_PART_SIZE env must be a size in bytes of at least %v; %v", minPartSize, value))
+		}
+		multipartPartSize = size
+	}
+	if value := env.Get("MULTIPART_BYTES_LIMIT_PER_USER", ""); value != "" {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			errs = append(errs, fmt.Errorf("MULTIPART_BYTES_LIMIT_PER_USER env must be a size in bytes; %v", value))
+		}
+		multipartBytesLimit = size
+	}
+	return errors.Join(errs...)
+}
+
+// multipartCore returns the upload site along with its multipart client
+func multipartCore() (*site, *minio.Core, error) {
+	site := uploadSite()
+	core := site.Core()
+	if core == nil {
+		return nil, nil, fmt.Errorf("multipart uploads are not supported by site %v", site.name)
+	}
+	return site, core, nil
+}
+
+// multipartParts validates the declared size and returns the number of parts to upload it in
+func multipartParts(size int64) (int, error) {
+	if multipartMaxSize > 0 && size > multipartMaxSize {
+		return 0, fmt.Errorf("size %v exceeds the max of %v bytes", size, multipartMaxSize)
+	}
+	parts := int((size + multipartPartSize - 1) / multipartPartSize)
+	if parts > maxParts {
+		return 0, fmt.Errorf("size %v needs more than %v parts of %v bytes", size, maxParts, multipartPartSize)
+	}
+	return parts, nil
+}
+
+// initiateMultipart reserves the object and its declared size in the quota of the user, and
+// initiates the upload of DATE/USER/name on the upload site under the reservation
+func initiateMultipart(ctx context.Context, user, name string, size int64, parts int) (*multipartUpload, error) {
+	site, core, err := multipartCore()
+	if err != nil {
+		return nil, err
+	}
+	res, err := reserveQuota(ctx, user, quotaHold{
+		Objects: 1,
+		Bytes:   size,
+		Expires: clock.Now().UTC().Add(reservationMaxTTL),
+	}, multipartBytesLimit)
+	if err != nil {
+		return nil, err
+	}
+	path := getCurrentDateInUTC().Format(dateFormat) + "/" + user + "/" + name
+	uploadID, err := core.NewMultipartUpload(ctx, dataBucket, path, minio.PutObjectOptions{
+		UserMetadata: map[string]string{
+			declaredSizeKey:        strconv.FormatInt(size, 10),
+			reservationMetadataKey: res.ID,
+		},
+	})
+	if err != nil {
+		logf(ctx, "ERROR", site.name, "unable to initiate the multipart upload of '%v/%v'; %v", dataBucket, path, err)
+		releaseUpload(ctx, user, res.ID)
+		return nil, fmt.Errorf("unable to initiate the upload; %v", err)
+	}
+	logf(ctx, "LOG", site.name, "initiated the multipart upload of '%v' of %v bytes for user '%v'", path, size, user)
+	return &multipartUpload{
+		Path:        path,
+		UploadID:    uploadID,
+		Size:        size,
+		PartSize:    multipartPartSize,
+		Parts:       parts,
+		Reservation: res.ID,
+	}, nil
+}
+
+// releaseUpload releases the reservation of an upload which will not be counted; left to expire
+// if it cannot be released
+func releaseUpload(ctx context.Context, user, id string) {
+	if id == "" {
+		return
+	}
+	if err := releaseReservation(ctx, user, id); err != nil {
+		logf(ctx, "WARNING", "", "unable to release the reservation %v of user '%v'; left to expire; %v", id, user, err)
+	}
+}
+
+// signParts returns the presigned URLs to upload the parts of the upload to
+func signParts(ctx context.Context, path, uploadID string, parts int) ([]partURL, error) {
+	site, core, err := multipartCore()
+	if err != nil {
+		return nil, err
+	}
+	urls := make([]partURL, 0, parts)
+	for part := 1; part <= parts; part++ {
+		params := url.Values{}
+		params.Set("partNumber", strconv.Itoa(part))
+		params.Set("uploadId", uploadID)
+		u, err := core.Presign(ctx, http.MethodPut, dataBucket, path, partURLExpiry, params)
+		if err != nil {
+			logf(ctx, "ERROR", site.name, "unable to sign the part %v of '%v/%v'; %v", part, dataBucket, path, err)
+			return nil, fmt.Errorf("unable to sign the part %v; %v", part, err)
+		}
+		urls = append(urls, partURL{PartNumber: part, URL: u.String()})
+	}
+	return urls, nil
+}
+
+// completeMultipart completes the upload and reconciles the object with the quota of the user,
+// in the slot of its reservation; the object is removed again, and its reservation released, if
+// it exceeds the declared size or the bytes limit, or could not be counted
+func completeMultipart(ctx context.Context, user, path, uploadID string, parts []completedPart) (*uploadResult, error) {
+	site, core, err := multipartCore()
+	if err != nil {
+		return nil, err
+	}
+	completeParts := make([]minio.CompletePart, 0, len(parts))
+	for _, part := range parts {
+		completeParts = append(completeParts, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+	}
+	if _, err := core.CompleteMultipartUpload(ctx, dataBucket, path, uploadID, completeParts, minio.PutObjectOptions{}); err != nil {
+		logf(ctx, "ERROR", site.name, "unable to complete the multipart upload of '%v/%v'; %v", dataBucket, path, err)
+		return nil, fmt.Errorf("unable to complete the upload; %v", err)
+	}
+	removeUpload := func() {
+		if err := defaultRetry.do(ctx, func() error {
+			return core.RemoveObject(ctx, dataBucket, path, minio.RemoveObjectOptions{})
+		}); err != nil {
+			logf(ctx, "ERROR", site.name, "unable to remove the uncounted upload '%v/%v'; %v", dataBucket, path, err)
+		}
+	}
+	info, err := core.StatObject(ctx, dataBucket, path, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to stat the completed upload; %v", err)
+	}
+	id := info.UserMetadata[reservationMetadataKey]
+	declared, err := strconv.ParseInt(info.UserMetadata[declaredSizeKey], 10, 64)
+	if err != nil || info.Size > declared {
+		logf(ctx, "WARNING", site.name, "removing '%v' of %v bytes; %v", path, info.Size, errDeclaredSizeExceeded)
+		removeUpload()
+		releaseUpload(ctx, user, id)
+		return nil, errDeclaredSizeExceeded
+	}
+	if multipartBytesLimit > 0 && !isMonitored(user) {
+		// the bytes counted since the initiation, by the events of the other uploads, may leave
+		// no room for the object anymore
+		usage, err := readUsage(ctx, user)
+		if err != nil {
+			return nil, err
+		}
+		if usage.Bytes+info.Size > multipartBytesLimit {
+			logf(ctx, "WARNING", site.name, "removing '%v' of %v bytes; %v for user '%v'", path, info.Size, errBytesLimitExceeded, user)
+			removeUpload()
+			releaseUpload(ctx, user, id)
+			return nil, errBytesLimitExceeded
+		}
+	}
+	date, err := time.Parse(dateFormat, strings.SplitN(path, "/", 2)[0])
+	if err != nil {
+		return nil, err
+	}
+	qe := &quotaEvent{
+		Name:     "s3:ObjectCreated:CompleteMultipartUpload",
+		Time:     time.Now().UTC(),
+		Path:     path,
+		Date:     date.UTC(),
+		User:     user,
+		Size:     info.Size,
+		ETag:     info.ETag,
+		Metadata: map[string]string{reservationMetadataKey: id},
+	}
+	if err := updateQuota(ctx, qe); err != nil && !errors.Is(err, errOverLimitMonitored) {
+		// the reservation expired and another upload of the user took its slot, or the quota
+		// could not be written
+		removeUpload()
+		releaseUpload(ctx, user, id)
+		return nil, err
+	}
+	logf(ctx, "LOG", site.name, "completed the multipart upload of '%v' of %v bytes for user '%v'", path, info.Size, user)
+	return &uploadResult{
+		Path: path,
+		Site: site.name,
+		Size: info.Size,
+		ETag: info.ETag,
+	}, nil
+}
+
+// abortMultipart aborts the upload, removing its uploaded parts, and releases its reservation
+func abortMultipart(ctx context.Context, user, path, uploadID, id string) error {
+	site, core, err := multipartCore()
+	if err != nil {
+		return err
+	}
+	if err := core.AbortMultipartUpload(ctx, dataBucket, path, uploadID); err != nil {
+		logf(ctx, "ERROR", site.name, "unable to abort the multipart upload of '%v/%v'; %v", dataBucket, path, err)
+		return fmt.Errorf("unable to abort the upload; %v", err)
+	}
+	releaseUpload(ctx, user, id)
+	logf(ctx, "LOG", site.name, "aborted the multipart upload of '%v' for user '%v'", path, user)
+	return nil
+}
+
+// writeMultipartError writes the error of the multipart endpoints with the matching status
+func writeMultipartError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errMaxLimitExceeded), errors.Is(err, errUserBlocked), errors.Is(err, errDeclaredSizeExceeded):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// POST /multipart/{user}?name=recording.wav&size=104857600
+//
+//   - Checks the size against MULTIPART_MAX_SIZE
+//   - Reserves the object and its size in the quota of the user, within MULTIPART_BYTES_LIMIT_PER_USER
+//   - Initiates the multipart upload of DATE/USER/name on the primary site
+//   - Returns the path, the upload id, the reservation and the number of parts of MULTIPART_PART_SIZE
+//     to upload
+func initiateMultipartHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	user := mux.Vars(r)["user"]
+	query := r.URL.Query()
+	name := query.Get("name")
+	if name == "" || strings.HasPrefix(name, ".") || strings.Contains(name, "/") {
+		http.Error(w, fmt.Sprintf("invalid object name '%v'", name), http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.ParseInt(query.Get("size"), 10, 64)
+	if err != nil || size <= 0 {
+		http.Error(w, fmt.Sprintf("invalid size '%v'", query.Get("size")), http.StatusBadRequest)
+		return
+	}
+	parts, err := multipartParts(size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	upload, err := initiateMultipart(ctx, user, name, size, parts)
+	if err != nil {
+		writeMultipartError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(upload)
+}
+
+// GET /multipart/{user}/parts?path=DATE/USER/name&uploadId=ID&parts=2
+//
+// - Returns the presigned URLs to PUT the parts 1 to parts of the upload to, valid for an hour
+func signPartsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	user := mux.Vars(r)["user"]
+	query := r.URL.Query()
+	path, uploadID := query.Get("path"), query.Get("uploadId")
+	if err := validateUserPath(path, user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	parts, err := strconv.Atoi(query.Get("parts"))
+	if err != nil || parts <= 0 || parts > maxParts || uploadID == "" {
+		http.Error(w, "uploadId and parts between 1 and 10000 are required", http.StatusBadRequest)
+		return
+	}
+	urls, err := signParts(ctx, path, uploadID, parts)
+	if err != nil {
+		writeMultipartError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(urls)
+}
+
+// POST /multipart/{user}/complete?path=DATE/USER/name&uploadId=ID
+//
+//   - Completes the upload with the parts in the body, [{"partNumber":1,"etag":"..."}]
+//   - Counts the object in the quota of the user on all the sites; the object is removed again if
+//     it exceeds the size declared on initiation or MULTIPART_BYTES_LIMIT_PER_USER, or could not be
+//     counted
+func completeMultipartHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	user := mux.Vars(r)["user"]
+	query := r.URL.Query()
+	path, uploadID := query.Get("path"), query.Get("uploadId")
+	if err := validateUserPath(path, user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var parts []completedPart
+	if err := json.NewDecoder(r.Body).Decode(&parts); err != nil || len(parts) == 0 || uploadID == "" {
+		http.Error(w, "uploadId and the uploaded parts are required", http.StatusBadRequest)
+		return
+	}
+	result, err := completeMultipart(ctx, user, path, uploadID, parts)
+	if err != nil {
+		writeMultipartError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// DELETE /multipart/{user}?path=DATE/USER/name&uploadId=ID&reservation=ID
+//
+//   - Aborts the upload, removing its uploaded parts
+//   - Releases the reservation returned on initiation, if provided; otherwise it is held until
+//     RESERVATION_MAX_TTL passed
+func abortMultipartHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	user := mux.Vars(r)["user"]
+	query := r.URL.Query()
+	path, uploadID := query.Get("path"), query.Get("uploadId")
+	if err := validateUserPath(path, user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if uploadID == "" {
+		http.Error(w, "uploadId is required", http.StatusBadRequest)
+		return
+	}
+	if err := abortMultipart(ctx, user, path, uploadID, query.Get("reservation")); err != nil {
+		writeMultipartError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
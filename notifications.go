@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/minio/pkg/env"
+)
+
+// configureNotifications registers the ObjectCreated and ObjectRemoved events of the data bucket
+// with the webhook target of this server on every site, instead of running `mc event add` on each
+func configureNotifications(ctx context.Context) error {
+	for _, site := range sites {
+		if site.InitError() != nil {
+			logf(ctx, "WARNING", site.name, "not configuring the bucket notifications; the site is still initializing")
+			continue
+		}
+		if err := configureSiteNotifications(ctx, site); err != nil {
+			return fmt.Errorf("unable to configure the bucket notifications on site %v; %v", site.name, err)
+		}
+	}
+	return nil
+}
+
+// configureSiteNotifications adds the events of the webhook target in NOTIFICATION_ARN (or
+// NOTIFICATION_ARN_site1) to the notification config of the data bucket, keeping the others
+func configureSiteNotifications(ctx context.Context, site *site) error {
+	value := env.Get("NOTIFICATION_ARN_"+site.name, env.Get("NOTIFICATION_ARN", ""))
+	if value == "" {
+		return fmt.Errorf("NOTIFICATION_ARN env is not set")
+	}
+	arn, err := notification.NewArnFromString(value)
+	if err != nil {
+		return fmt.Errorf("invalid NOTIFICATION_ARN %v; %v", value, err)
+	}
+	core := site.Core()
+	if core == nil {
+		return fmt.Errorf("bucket notifications are not supported by the site")
+	}
+	config, err := core.GetBucketNotification(ctx, dataBucket)
+	if err != nil {
+		return err
+	}
+	queue := notification.NewConfig(arn)
+	queue.AddEvents(notification.ObjectCreatedAll, notification.ObjectRemovedAll)
+	if !config.AddQueue(queue) {
+		logf(ctx, "LOG", site.name, "bucket notifications of %v already configured with %v", dataBucket, arn)
+		return nil
+	}
+	if err := core.SetBucketNotification(ctx, dataBucket, config); err != nil {
+		return err
+	}
+	logf(ctx, "LOG", site.name, "configured the bucket notifications of %v with %v", dataBucket, arn)
+	return nil
+}
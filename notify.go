@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/minio/pkg/env"
+)
+
+var (
+	// alertWebhookURL is where the alerts are POSTed to as JSON
+	alertWebhookURL       = env.Get("ALERT_WEBHOOK_URL", "")
+	alertWebhookAuthToken = env.Get("ALERT_WEBHOOK_AUTH_TOKEN", "")
+
+	alertClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+// alert represents a notification sent when a user or a site needs attention
+type alert struct {
+	Type    string    `json:"type"`
+	User    string    `json:"user,omitempty"`
+	Site    string    `json:"site,omitempty"`
+	Objects int       `json:"objects,omitempty"`
+	Limit   int       `json:"limit,omitempty"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// sendAlert POSTs the alert to the configured webhook in the background; failures are logged
+func sendAlert(ctx context.Context, a alert) {
+	if alertWebhookURL == "" {
+		return
+	}
+	if a.Time.IsZero() {
+		a.Time = time.Now().UTC()
+	}
+	go func() {
+		if err := postAlert(ctx, a); err != nil {
+			logf(ctx, "WARNING", "", "unable to send the %v alert; %v", a.Type, err)
+		}
+	}()
+}
+
+func postAlert(ctx context.Context, a alert) error {
+	return postJSON(ctx, alertClient, alertWebhookURL, alertWebhookAuthToken, a)
+}
+
+// postJSON POSTs the value as JSON to the webhook
+func postJSON(ctx context.Context, client *http.Client, url, authToken string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if authToken != "" {
+		req.Header.Set("Authorization", authToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook responded with %v", resp.Status)
+	}
+	return nil
+}
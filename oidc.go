@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/minio/pkg/env"
+)
+
+var (
+	oidcIssuer        = strings.TrimSuffix(env.Get("OIDC_ISSUER", ""), "/")
+	oidcClientID      = env.Get("OIDC_CLIENT_ID", "")
+	oidcGroupsClaim   = env.Get("OIDC_GROUPS_CLAIM", "groups")
+	oidcAllowedGroups = parseList(env.Get("OIDC_ALLOWED_GROUPS", ""))
+
+	oidc *oidcVerifier
+
+	errGroupNotAllowed = errors.New("user is not a member of the allowed groups")
+)
+
+// oidcVerifier verifies the ID tokens issued by the configured OpenID Connect provider
+type oidcVerifier struct {
+	jwksURI string
+	keys    *jwk.AutoRefresh
+}
+
+// initOIDC discovers the configured OpenID Connect provider, if any
+func initOIDC(ctx context.Context) error {
+	if oidcIssuer == "" {
+		return nil
+	}
+	if oidcClientID == "" {
+		return errors.New("OIDC_CLIENT_ID env is not set")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, oidcIssuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to fetch the openid configuration; %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to fetch the openid configuration; %v", resp.Status)
+	}
+	var config struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return fmt.Errorf("unable to parse the openid configuration; %v", err)
+	}
+	if config.JWKSURI == "" {
+		return errors.New("jwks_uri missing in the openid configuration")
+	}
+	keys := jwk.NewAutoRefresh(context.Background())
+	keys.Configure(config.JWKSURI)
+	if _, err := keys.Refresh(ctx, config.JWKSURI); err != nil {
+		return fmt.Errorf("unable to fetch the keys from %v; %v", config.JWKSURI, err)
+	}
+	oidc = &oidcVerifier{
+		jwksURI: config.JWKSURI,
+		keys:    keys,
+	}
+	return nil
+}
+
+// verify parses the ID token and validates its signature, issuer, audience and expiry
+func (v *oidcVerifier) verify(ctx context.Context, idToken string) (jwt.Token, error) {
+	keySet, err := v.keys.Fetch(ctx, v.jwksURI)
+	if err != nil {
+		return nil, err
+	}
+	return jwt.Parse([]byte(idToken),
+		jwt.WithKeySet(keySet),
+		jwt.WithValidate(true),
+		jwt.WithIssuer(oidcIssuer),
+		jwt.WithAudience(oidcClientID),
+	)
+}
+
+// verifyGroups checks if the token carries any of the allowed groups
+func verifyGroups(token jwt.Token) error {
+	if len(oidcAllowedGroups) == 0 {
+		return nil
+	}
+	claim, _ := token.Get(oidcGroupsClaim)
+	var groups []string
+	switch value := claim.(type) {
+	case string:
+		groups = parseList(value)
+	case []interface{}:
+		for _, group := range value {
+			if group, ok := group.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+	}
+	for _, group := range groups {
+		for _, allowed := range oidcAllowedGroups {
+			if group == allowed {
+				return nil
+			}
+		}
+	}
+	return errGroupNotAllowed
+}
+
+// bearerToken returns the bearer token of the Authorization header, if any
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return header[len("Bearer "):]
+	}
+	return ""
+}
+
+// adminAuth authenticates the requests to the admin endpoints by an ID token of the
+// configured OpenID Connect provider, falling back to the shared token if set; without a
+// shared token, the ID token is required
+func adminAuth(h http.Handler) http.Handler {
+	fallback := signedAuth(h)
+	if oidcIssuer == "" {
+		return fallback
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idToken := bearerToken(r)
+		if idToken == "" || oidc == nil {
+			if authToken == "" {
+				http.Error(w, "ID token missing", http.StatusUnauthorized)
+				return
+			}
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		token, err := oidc.verify(r.Context(), idToken)
+		if err != nil {
+			logf(r.Context(), "ERROR", "", "unable to verify the ID token; %v", err)
+			http.Error(w, "invalid ID token", http.StatusUnauthorized)
+			return
+		}
+		if err := verifyGroups(token); err != nil {
+			logf(r.Context(), "ERROR", "", "access denied to '%v'; %v", token.Subject(), err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/minio/pkg/env"
+)
+
+// originEndpointKey is the response element of the MinIO events naming the node generating the event
+const originEndpointKey = "x-minio-origin-endpoint"
+
+// originSite is the site whose events are counted when every site of an active-active
+// replication sends the events; disabled if empty
+var originSite = env.Get("ORIGIN_SITE", "")
+
+// origins designates the site whose events are counted, failing over to the next site while
+// the designated one is unhealthy or silent
+var origins = &originDesignation{lastSeen: map[string]time.Time{}, skipped: map[string][]skippedEvent{}}
+
+// originDesignation tracks the events seen from each site to fail over the designation
+type originDesignation struct {
+	// silence is how long the designated site may send no events while the others do
+	silence time.Duration
+	// order is the designated site followed by the other sites in the configured order
+	order []string
+	// hosts are the hosts of the nodes of each site, as in their origin endpoints
+	hosts map[string]string
+	// bufferSize is the max number of the skipped events kept per site
+	bufferSize int
+
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+	active   string
+	// skipped are the events of each site skipped since the active site last sent an event,
+	// replayed if the site becomes the active one, as the active site may have gone silent
+	// without sending its own
+	skipped map[string][]skippedEvent
+	// replays are the replays of the skipped events in flight, awaited on shutdown
+	replays sync.WaitGroup
+}
+
+// skippedEvent represents an event of a site other than the active one, with when it was received
+type skippedEvent struct {
+	event    notification.Event
+	received time.Time
+}
+
+// initOrigin reads the hosts of the nodes of the sites, naming the origin site of the events,
+// and validates the designated origin site
+func initOrigin() (err error) {
+	origins.hosts = map[string]string{}
+	for _, site := range sites {
+		// the nodes of a site behind a load balancer generate the events with their own endpoints
+		hosts := parseList(env.Get("ORIGIN_HOSTS_"+site.name, ""))
+		if len(hosts) == 0 {
+			hosts = []string{endpointHost(site.endpoint)}
+		}
+		for _, host := range hosts {
+			if other, ok := origins.hosts[host]; ok && originSite != "" {
+				return fmt.Errorf("origin host %v is configured for both the sites %v and %v", host, other, site.name)
+			}
+			origins.hosts[host] = site.name
+		}
+	}
+	if originSite == "" {
+		return nil
+	}
+	if findSite(originSite) == nil {
+		return fmt.Errorf("ORIGIN_SITE %v is not configured", originSite)
+	}
+	if origins.silence, err = getDurationEnv("ORIGIN_FAILOVER_SILENCE", 2*time.Minute); err != nil {
+		return err
+	}
+	if origins.bufferSize, err = env.GetInt("ORIGIN_BUFFER_SIZE", 10000); err != nil {
+		return fmt.Errorf("unable to read ORIGIN_BUFFER_SIZE env; %v", err)
+	}
+	if origins.bufferSize < 0 {
+		return errors.New("ORIGIN_BUFFER_SIZE env must not be negative")
+	}
+	origins.order = []string{originSite}
+	for _, site := range sites {
+		// no site is silent until it has had the time to send its events
+		origins.lastSeen[site.name] = time.Now()
+		if site.name != originSite {
+			origins.order = append(origins.order, site.name)
+		}
+	}
+	origins.active = originSite
+	return nil
+}
+
+// endpointHost returns the host:port of the endpoint, with or without the scheme
+func endpointHost(endpoint string) string {
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return strings.TrimSuffix(endpoint, "/")
+}
+
+// eventOrigin returns the site generating the event; empty if unknown
+func eventOrigin(event notification.Event) string {
+	endpoint := event.ResponseElements[originEndpointKey]
+	if endpoint == "" {
+		return ""
+	}
+	return origins.hosts[endpointHost(endpoint)]
+}
+
+// accept returns true if the event is from the active origin site, or from an unknown origin;
+// the events of the other sites are recorded to detect a silent origin, and buffered to be
+// replayed if their site becomes the active one
+func (o *originDesignation) accept(ctx context.Context, event notification.Event) bool {
+	origin := eventOrigin(event)
+	if origin == "" {
+		logf(ctx, "WARNING", "", "counting '%v' of an unknown origin '%v'", event.S3.Object.Key, event.ResponseElements[originEndpointKey])
+		return true
+	}
+	now := time.Now()
+	o.mu.Lock()
+	o.lastSeen[origin] = now
+	o.mu.Unlock()
+	if origin == o.current(ctx) {
+		return true
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	skipped := o.pruneSkipped(origin)
+	if len(skipped) >= o.bufferSize {
+		logf(ctx, "WARNING", origin, "dropping the skipped '%v'; %v events of site %v buffered already", event.S3.Object.Key, len(skipped), origin)
+		return false
+	}
+	o.skipped[origin] = append(skipped, skippedEvent{event: event, received: now})
+	return false
+}
+
+// pruneSkipped drops the skipped events of the site received before the last event of the active
+// site, which sent its own for them; called with the lock held
+func (o *originDesignation) pruneSkipped(name string) []skippedEvent {
+	skipped := o.skipped[name]
+	since := o.lastSeen[o.active]
+	i := 0
+	for i < len(skipped) && skipped[i].received.Before(since) {
+		i++
+	}
+	skipped = skipped[i:]
+	o.skipped[name] = skipped
+	return skipped
+}
+
+// replay counts the events skipped from the site which became the active one, in the order
+// they were received; the events the previous active site counted already are found counted,
+// and the failed ones are stored as dead letters
+func (o *originDesignation) replay(ctx context.Context, name string, skipped []skippedEvent) {
+	defer o.replays.Done()
+	failed := 0
+	for _, skipped := range skipped {
+		if err := processEvent(ctx, skipped.event); err != nil {
+			failed++
+		}
+	}
+	logf(ctx, "LOG", name, "replayed %v events skipped from site %v before the failover; %v failed", len(skipped), name, failed)
+}
+
+// current returns the active origin site, failing over from the designated site while it is
+// initializing, quarantined or silent, and back to it once it recovers
+func (o *originDesignation) current(ctx context.Context) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	active := o.order[0]
+	for _, name := range o.order {
+		site := findSite(name)
+		if site.InitError() == nil && !site.Quarantined() && !o.silent(name) {
+			active = name
+			break
+		}
+	}
+	if active != o.active {
+		// the events the new active site sent since the previous one last did are not counted
+		if skipped := o.pruneSkipped(active); len(skipped) > 0 {
+			delete(o.skipped, active)
+			o.replays.Add(1)
+			go o.replay(context.WithoutCancel(ctx), active, skipped)
+		}
+		message := fmt.Sprintf("counting the events of site %v instead of %v", active, o.active)
+		logf(ctx, "WARNING", active, "origin failover; %v", message)
+		sendAlert(ctx, alert{
+			Type:    "origin_failover",
+			Site:    active,
+			Message: message,
+		})
+		o.active = active
+	}
+	return active
+}
+
+// silent returns true if the site sent no events within the silence while another site did;
+// called with the lock held
+func (o *originDesignation) silent(name string) bool {
+	if time.Since(o.lastSeen[name]) < o.silence {
+		return false
+	}
+	for other, seen := range o.lastSeen {
+		if other != name && time.Since(seen) < o.silence {
+			return true
+		}
+	}
+	return false
+}
+
+// waitReplays waits for the replays of the skipped events in flight, until the context is done
+func (o *originDesignation) waitReplays(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		o.replays.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logf(ctx, "WARNING", "", "unable to complete the replays of the skipped events; %v", ctx.Err())
+	}
+}
+
+// activeOrigin returns the active origin site; empty if ORIGIN_SITE is not set
+func activeOrigin() string {
+	if originSite == "" {
+		return ""
+	}
+	origins.mu.Lock()
+	defer origins.mu.Unlock()
+	return origins.active
+}
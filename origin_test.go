@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+)
+
+func TestOriginFailoverReplaysSkippedEvents(t *testing.T) {
+	setupTestSites(t, 2)
+	savedSite, savedOrigins := originSite, origins
+	t.Cleanup(func() { originSite, origins = savedSite, savedOrigins })
+	now := time.Now()
+	originSite = "site1"
+	origins = &originDesignation{
+		silence:    time.Minute,
+		order:      []string{"site1", "site2"},
+		hosts:      map[string]string{"node1:9000": "site1", "node2:9000": "site2"},
+		bufferSize: 10,
+		lastSeen:   map[string]time.Time{"site1": now, "site2": now},
+		skipped:    map[string][]skippedEvent{},
+		active:     "site1",
+	}
+	fromSite2 := func(object string) notification.Event {
+		event := testEvent("s3:ObjectCreated:Put", "usera", object)
+		event.ResponseElements = map[string]string{originEndpointKey: "http://node2:9000"}
+		return event
+	}
+	ctx := context.Background()
+	if err := processEvent(ctx, fromSite2("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readUserQuota(ctx, sites[0].Client(), "usera"); err == nil {
+		t.Fatal("expected the event of site2 to be skipped while site1 is active")
+	}
+
+	// site1 went silent without sending its own event of a
+	origins.mu.Lock()
+	origins.lastSeen["site1"] = now.Add(-2 * time.Minute)
+	origins.mu.Unlock()
+	if err := processEvent(ctx, fromSite2("b")); err != nil {
+		t.Fatal(err)
+	}
+	if active := activeOrigin(); active != "site2" {
+		t.Fatalf("expected the failover to site2, got %v", active)
+	}
+	origins.waitReplays(ctx)
+	for _, site := range sites {
+		userQuota, _, err := readUserQuota(ctx, site.Client(), "usera")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(userQuota.Objects) != 2 {
+			t.Errorf("%v: expected the skipped event replayed after the failover, got %v", site.name, userQuota.Objects)
+		}
+	}
+}
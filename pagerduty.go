@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/minio/pkg/env"
+)
+
+const (
+	incidentSitesUnreachable  = "sites-unreachable"
+	incidentDeadLetters       = "dead-letters"
+	incidentDriftPrefix       = "drift-"
+	incidentSiteFailingPrefix = "site-failing-"
+)
+
+var (
+	// pagerDutyRoutingKey is the integration key of the PagerDuty service the critical conditions
+	// open incidents on
+	pagerDutyRoutingKey = env.Get("PAGERDUTY_ROUTING_KEY", "")
+	pagerDutyURL        = env.Get("PAGERDUTY_EVENTS_URL", "https://events.pagerduty.com/v2/enqueue")
+
+	pagerDutyClient = &http.Client{Timeout: 5 * time.Second}
+
+	// incidents are the open PagerDuty incidents by their dedup keys
+	incidents = &incidentTracker{open: map[string]bool{}}
+)
+
+// pagerDutyEvent represents an event of the PagerDuty Events API v2
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string                 `json:"summary"`
+	Source        string                 `json:"source"`
+	Severity      string                 `json:"severity"`
+	Component     string                 `json:"component"`
+	CustomDetails map[string]interface{} `json:"custom_details,omitempty"`
+}
+
+// incidentTracker opens an incident once per condition and resolves it once the condition clears
+type incidentTracker struct {
+	mu   sync.Mutex
+	open map[string]bool
+	// deadLetterThreshold is the number of the stored dead letters opening an incident
+	deadLetterThreshold int
+	// driftThreshold is the number of the objects a recalculation adds or removes opening an incident
+	driftThreshold int
+}
+
+// initPagerDuty reads the thresholds of the incidents
+func initPagerDuty() (err error) {
+	if incidents.deadLetterThreshold, err = env.GetInt("PAGERDUTY_DLQ_THRESHOLD", 100); err != nil {
+		return err
+	}
+	if incidents.driftThreshold, err = env.GetInt("PAGERDUTY_DRIFT_THRESHOLD", 100); err != nil {
+		return err
+	}
+	return nil
+}
+
+// trigger opens the incident of the condition, unless it is already open
+func (t *incidentTracker) trigger(ctx context.Context, key, summary string, details map[string]interface{}) {
+	if pagerDutyRoutingKey == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.open[key] {
+		return
+	}
+	t.open[key] = true
+	hostname, _ := os.Hostname()
+	t.send(ctx, key, pagerDutyEvent{
+		RoutingKey:  pagerDutyRoutingKey,
+		EventAction: "trigger",
+		DedupKey:    key,
+		Payload: &pagerDutyPayload{
+			Summary:       summary,
+			Source:        hostname,
+			Severity:      "critical",
+			Component:     "quota-server",
+			CustomDetails: details,
+		},
+	})
+}
+
+// resolve resolves the incident of the condition, if it is open
+func (t *incidentTracker) resolve(ctx context.Context, key string) {
+	if pagerDutyRoutingKey == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.open[key] {
+		return
+	}
+	delete(t.open, key)
+	t.send(ctx, key, pagerDutyEvent{
+		RoutingKey:  pagerDutyRoutingKey,
+		EventAction: "resolve",
+		DedupKey:    key,
+	})
+}
+
+// send POSTs the event in the background; a failed trigger is forgotten, so that the next
+// occurrence of the condition triggers it again
+func (t *incidentTracker) send(ctx context.Context, key string, event pagerDutyEvent) {
+	go func() {
+		err := postJSON(context.WithoutCancel(ctx), pagerDutyClient, pagerDutyURL, "", event)
+		if err == nil {
+			logf(ctx, "LOG", "", "sent the PagerDuty %v of %v", event.EventAction, key)
+			return
+		}
+		logf(ctx, "WARNING", "", "unable to send the PagerDuty %v of %v; %v", event.EventAction, key, err)
+		if event.EventAction == "trigger" {
+			t.mu.Lock()
+			delete(t.open, key)
+			t.mu.Unlock()
+		}
+	}()
+}
+
+// checkDeadLetters opens an incident while the stored dead letters are above the threshold
+func (t *incidentTracker) checkDeadLetters(ctx context.Context) {
+	if pagerDutyRoutingKey == "" || deadLetterDir == "" {
+		return
+	}
+	count := countDeadLetters()
+	if count < t.deadLetterThreshold {
+		t.resolve(ctx, incidentDeadLetters)
+		return
+	}
+	t.trigger(ctx, incidentDeadLetters, "quota-server has stored dead letters above the threshold", map[string]interface{}{
+		"deadLetters": count,
+		"threshold":   t.deadLetterThreshold,
+	})
+}
+
+// checkDrift opens an incident of the user if their recalculation on the site added or removed
+// objects above the threshold, and resolves it otherwise
+func (t *incidentTracker) checkDrift(ctx context.Context, site, user string, added, removed int) {
+	key := incidentDriftPrefix + site + "-" + user
+	if added+removed < t.driftThreshold {
+		t.resolve(ctx, key)
+		return
+	}
+	t.trigger(ctx, key, "quota of user "+user+" drifted from the data bucket on site "+site, map[string]interface{}{
+		"site":      site,
+		"user":      user,
+		"added":     added,
+		"removed":   removed,
+		"threshold": t.driftThreshold,
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/pkg/env"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// projectionAlerts alerts the users projected to exhaust their quota before the rollover
+	projectionAlerts = env.Get("PROJECTION_ALERTS", "off") == "on"
+
+	projectedExhaustionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "projected_exhaustions_total",
+		Help:      "Total number of users projected to exhaust their quota before the rollover",
+	})
+
+	projections = &projectionTracker{alerted: map[string]time.Time{}}
+)
+
+func init() {
+	prometheus.MustRegister(projectedExhaustionsTotal)
+}
+
+// projectionAlertMinElapsed is how long into the day the rate is projected from, so that
+// the first uploads of the day do not trigger the alert
+const projectionAlertMinElapsed = time.Hour
+
+// projectionTracker remembers the users alerted today, so that each user is alerted once a day
+// regardless of the number of sites
+type projectionTracker struct {
+	mu      sync.Mutex
+	alerted map[string]time.Time
+}
+
+// alert returns true if the user is not alerted yet on the day
+func (t *projectionTracker) alert(user string, day time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for u, d := range t.alerted {
+		if d.Before(day) {
+			delete(t.alerted, u)
+		}
+	}
+	if _, ok := t.alerted[user]; ok {
+		return false
+	}
+	t.alerted[user] = day
+	return true
+}
+
+// projectExhaustion projects the upload rate of the user today until the rollover, and
+// alerts if the user is projected to go over the limit before it
+func projectExhaustion(ctx context.Context, user string, userQuota *UserQuota, limit int) {
+	if !projectionAlerts || limit <= 0 {
+		return
+	}
+	today := getCurrentDateInUTC()
+	elapsed := clock.Now().Sub(today)
+	if elapsed < projectionAlertMinElapsed {
+		return
+	}
+	total := len(userQuota.Objects)
+	if total >= limit {
+		// already rejected
+		return
+	}
+	var uploadedToday int
+	for object, entry := range userQuota.Objects {
+		pathDate, err := time.Parse(dateFormat, strings.Split(object, "/")[0])
+		if err != nil {
+			continue
+		}
+		if entry.date(pathDate).Equal(today) {
+			uploadedToday++
+		}
+	}
+	remaining := today.AddDate(0, 0, 1).Sub(clock.Now())
+	projected := total + int(float64(uploadedToday)*remaining.Hours()/elapsed.Hours())
+	if projected <= limit || !projections.alert(user, today) {
+		return
+	}
+	logf(ctx, "WARNING", "", "user '%v' is projected to reach %v objects before the rollover; limit %v", user, projected, limit)
+	projectedExhaustionsTotal.Inc()
+	statsd.Count("projected_exhaustions_total")
+	sendAlert(ctx, alert{
+		Type:    "projected_exhaustion",
+		User:    user,
+		Objects: total,
+		Limit:   limit,
+		Message: fmt.Sprintf("user %v is projected to reach %v objects before the rollover, over the limit of %v", user, projected, limit),
+	})
+}
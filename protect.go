@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+	"github.com/minio/pkg/env"
+)
+
+// noncurrentRuleID is the id of the lifecycle rule of the quota bucket expiring the versions
+// overwritten by the updates
+const noncurrentRuleID = "quota-server-noncurrent-versions"
+
+var (
+	// quotaBucketProtection enables the versioning of the quota bucket, so that the user quotas
+	// deleted or overwritten by the other S3 clients can be recovered
+	quotaBucketProtection = env.Get("QUOTA_BUCKET_PROTECTION", "off") == "on"
+	// quotaRetention is the governance retention of the user quotas written; 0 to disable
+	quotaRetention time.Duration
+	// quotaNoncurrentDays is the number of days the versions of the user quotas overwritten or
+	// deleted are kept before the lifecycle of the quota bucket expires them
+	quotaNoncurrentDays int
+)
+
+// loadQuotaProtection reads the retention of the user quotas and of their noncurrent versions
+func loadQuotaProtection() (err error) {
+	if quotaRetention, err = getDurationEnv("QUOTA_BUCKET_RETENTION", 0); err != nil {
+		return err
+	}
+	if quotaRetention > 0 && !quotaBucketProtection {
+		return fmt.Errorf("QUOTA_BUCKET_RETENTION env needs QUOTA_BUCKET_PROTECTION=on")
+	}
+	if quotaNoncurrentDays, err = env.GetInt("QUOTA_BUCKET_NONCURRENT_DAYS", 1); err != nil {
+		return fmt.Errorf("unable to read QUOTA_BUCKET_NONCURRENT_DAYS env; %v", err)
+	}
+	if quotaNoncurrentDays <= 0 {
+		return fmt.Errorf("QUOTA_BUCKET_NONCURRENT_DAYS env must be greater than 0")
+	}
+	// the versions still retained cannot be expired
+	if time.Duration(quotaNoncurrentDays)*24*time.Hour < quotaRetention {
+		return fmt.Errorf("QUOTA_BUCKET_NONCURRENT_DAYS env must not be shorter than QUOTA_BUCKET_RETENTION %v", quotaRetention)
+	}
+	return nil
+}
+
+// protectQuotaBucket enables the versioning of the quota bucket of the site, along with the
+// lifecycle rule expiring its noncurrent versions, and verifies that its object locking is
+// enabled if the user quotas are retained
+func protectQuotaBucket(ctx context.Context, s3Client *minio.Client) error {
+	if !quotaBucketProtection {
+		return nil
+	}
+	if err := s3Client.EnableVersioning(ctx, quotaBucket); err != nil {
+		return fmt.Errorf("unable to enable versioning on the bucket %v in %v; %w", quotaBucket, s3Client.EndpointURL().Host, err)
+	}
+	if err := expireNoncurrentVersions(ctx, s3Client); err != nil {
+		return fmt.Errorf("unable to set the lifecycle of the bucket %v in %v; %w", quotaBucket, s3Client.EndpointURL().Host, err)
+	}
+	if quotaRetention <= 0 {
+		return nil
+	}
+	objectLock, _, _, _, err := s3Client.GetObjectLockConfig(ctx, quotaBucket)
+	if err != nil || objectLock != "Enabled" {
+		return fmt.Errorf("QUOTA_BUCKET %v in %v has no object locking to retain the user quotas; recreate it with object locking", quotaBucket, s3Client.EndpointURL().Host)
+	}
+	return nil
+}
+
+// expireNoncurrentVersions sets the lifecycle rule of the quota bucket expiring the versions
+// overwritten by every update after QUOTA_BUCKET_NONCURRENT_DAYS, and the delete markers left
+// alone, keeping the other rules of the bucket
+func expireNoncurrentVersions(ctx context.Context, s3Client *minio.Client) error {
+	config, err := s3Client.GetBucketLifecycle(ctx, quotaBucket)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code != "NoSuchLifecycleConfiguration" {
+			return err
+		}
+		config = lifecycle.NewConfiguration()
+	}
+	rule := lifecycle.Rule{
+		ID:     noncurrentRuleID,
+		Status: "Enabled",
+		NoncurrentVersionExpiration: lifecycle.NoncurrentVersionExpiration{
+			NoncurrentDays: lifecycle.ExpirationDays(quotaNoncurrentDays),
+		},
+		Expiration: lifecycle.Expiration{
+			DeleteMarker: true,
+		},
+	}
+	rules := []lifecycle.Rule{rule}
+	for _, existing := range config.Rules {
+		if existing.ID != noncurrentRuleID {
+			rules = append(rules, existing)
+		}
+	}
+	config.Rules = rules
+	return s3Client.SetBucketLifecycle(ctx, quotaBucket, config)
+}
+
+// retainQuota sets the governance retention of the user quota written, if configured
+func retainQuota(opts *minio.PutObjectOptions) {
+	if quotaRetention <= 0 {
+		return
+	}
+	opts.Mode = minio.Governance
+	opts.RetainUntilDate = time.Now().UTC().Add(quotaRetention)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// purgeSkip represents an object version kept by the purge for its legal hold or retention
+type purgeSkip struct {
+	Site      string `json:"site"`
+	Key       string `json:"key"`
+	VersionID string `json:"versionId,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+// purgeReport represents the outcome of a purge
+type purgeReport struct {
+	mu sync.Mutex
+	// Prefixes is the number of the expired dates purged entirely
+	Prefixes int         `json:"prefixes"`
+	Skipped  []purgeSkip `json:"skipped,omitempty"`
+}
+
+func (r *purgeReport) purged() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Prefixes++
+}
+
+func (r *purgeReport) skip(skip purgeSkip) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Skipped = append(r.Skipped, skip)
+}
+
+// dataBucketLocked returns true if the object locking of the data bucket of the site is enabled
+func dataBucketLocked(ctx context.Context, core *minio.Core) bool {
+	objectLock, _, _, _, err := core.GetObjectLockConfig(ctx, dataBucket)
+	return err == nil && objectLock == "Enabled"
+}
+
+// purgeLockedPrefix removes the versions of the objects under the expired date one by one, skipping
+// the ones under a legal hold or retention (bypassing the governance retention if requested);
+// returns false if any version was kept
+func purgeLockedPrefix(ctx context.Context, site *site, core *minio.Core, prefix string, bypassGovernance bool, report *purgeReport) (bool, error) {
+	purged := true
+	for object := range core.Client.ListObjects(ctx, dataBucket, minio.ListObjectsOptions{
+		Prefix:       prefix + "/",
+		Recursive:    true,
+		WithVersions: true,
+	}) {
+		if object.Err != nil {
+			return false, fmt.Errorf("unable to list objects; %v", object.Err)
+		}
+		opts := minio.RemoveObjectOptions{VersionID: object.VersionID}
+		if !object.IsDeleteMarker {
+			reason, bypass, err := objectLock(ctx, core, object, bypassGovernance)
+			if err != nil {
+				return false, err
+			}
+			if reason != "" {
+				logf(ctx, "WARNING", site.name, "not purging '%v/%v' (version %v); %v", dataBucket, object.Key, object.VersionID, reason)
+				report.skip(purgeSkip{Site: site.name, Key: object.Key, VersionID: object.VersionID, Reason: reason})
+				purged = false
+				continue
+			}
+			opts.GovernanceBypass = bypass
+		}
+		if err := defaultRetry.do(ctx, func() error {
+			return core.RemoveObject(ctx, dataBucket, object.Key, opts)
+		}); err != nil {
+			logf(ctx, "WARNING", site.name, "not purging '%v/%v' (version %v); %v", dataBucket, object.Key, object.VersionID, err)
+			report.skip(purgeSkip{Site: site.name, Key: object.Key, VersionID: object.VersionID, Reason: err.Error()})
+			purged = false
+		}
+	}
+	return purged, nil
+}
+
+// objectLock returns the reason the object version cannot be removed, if any, and whether its
+// governance retention has to be bypassed to remove it
+func objectLock(ctx context.Context, core *minio.Core, object minio.ObjectInfo, bypassGovernance bool) (string, bool, error) {
+	hold, err := core.GetObjectLegalHold(ctx, dataBucket, object.Key, minio.GetObjectLegalHoldOptions{VersionID: object.VersionID})
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchObjectLockConfiguration" {
+		return "", false, fmt.Errorf("unable to get the legal hold of '%v'; %v", object.Key, err)
+	}
+	if err == nil && hold != nil && *hold == minio.LegalHoldEnabled {
+		return "legal hold", false, nil
+	}
+	mode, until, err := core.GetObjectRetention(ctx, dataBucket, object.Key, object.VersionID)
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchObjectLockConfiguration" {
+		return "", false, fmt.Errorf("unable to get the retention of '%v'; %v", object.Key, err)
+	}
+	if err != nil || mode == nil || until == nil || !until.After(time.Now()) {
+		return "", false, nil
+	}
+	if *mode == minio.Governance && bypassGovernance {
+		return "", true, nil
+	}
+	return fmt.Sprintf("%v retention until %v", *mode, until.UTC().Format(time.RFC3339)), false, nil
+}
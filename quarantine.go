@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/minio/pkg/env"
+)
+
+// quarantine stops the synchronous writes to the sites failing repeatedly, deferring
+// them until the site recovers
+var quarantine struct {
+	// threshold is the number of consecutive failed writes putting a site in quarantine; 0 to disable
+	threshold     int
+	probeInterval time.Duration
+	// maxPending is the number of deferred writes kept per site; the others are left to /admin/sync
+	maxPending int
+}
+
+// siteAlerts alert the operators once the writes to a site keep failing or pile up, at most
+// once per cooldown per site
+var siteAlerts struct {
+	// failures is the number of consecutive failed writes alerting; 0 to disable
+	failures int
+	// pending is the number of deferred writes alerting; 0 to disable
+	pending int
+	// repairs is the number of the users queued for a read-repair alerting; 0 to disable
+	repairs  int
+	cooldown time.Duration
+}
+
+// siteWrite is a write to a site, deferred while the site is quarantined
+type siteWrite func(ctx context.Context, s3Client ObjectStore) error
+
+// siteHealth tracks the consecutive failed writes of a site and its quarantine
+type siteHealth struct {
+	mu          sync.Mutex
+	failures    int
+	quarantined bool
+	pending     []siteWrite
+	dropped     int
+	alertedAt   time.Time
+}
+
+// initQuarantine reads the quarantine and the alert thresholds
+func initQuarantine() (err error) {
+	if quarantine.threshold, err = env.GetInt("SITE_QUARANTINE_THRESHOLD", 0); err != nil {
+		return err
+	}
+	if quarantine.probeInterval, err = getDurationEnv("SITE_QUARANTINE_PROBE_INTERVAL", 10*time.Second); err != nil {
+		return err
+	}
+	if quarantine.maxPending, err = env.GetInt("SITE_QUARANTINE_MAX_PENDING", 10000); err != nil {
+		return err
+	}
+	if siteAlerts.failures, err = env.GetInt("SITE_ALERT_FAILURES", 0); err != nil {
+		return err
+	}
+	if siteAlerts.pending, err = env.GetInt("SITE_ALERT_PENDING", 0); err != nil {
+		return err
+	}
+	if siteAlerts.repairs, err = env.GetInt("SITE_ALERT_REPAIRS", 0); err != nil {
+		return err
+	}
+	if siteAlerts.cooldown, err = getDurationEnv("SITE_ALERT_COOLDOWN", time.Hour); err != nil {
+		return err
+	}
+	for _, site := range sites {
+		siteQuarantined.WithLabelValues(site.name).Set(0)
+	}
+	return nil
+}
+
+// Quarantined returns true if the writes to the site are deferred
+func (s *site) Quarantined() bool {
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	return s.health.quarantined
+}
+
+// PendingWrites returns the number of writes deferred until the site recovers
+func (s *site) PendingWrites() int {
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	return len(s.health.pending)
+}
+
+// writeSite applies the write on the site with the retries, deferring it while the site is
+// quarantined as long as another site takes the write
+func writeSite(ctx context.Context, s *site, write siteWrite) error {
+	if s.Client() == nil {
+		return errors.New("s3Client is nil")
+	}
+	if s.deferWrite(ctx, write) {
+		return nil
+	}
+	err := defaultRetry.do(ctx, func() error {
+		return write(ctx, s.Client())
+	})
+	if err != nil && !errors.Is(err, errMaxLimitExceeded) && !errors.Is(err, errOverLimitMonitored) && !errors.Is(err, errMaxUsersExceeded) {
+		s.recordWriteFailure(ctx)
+	} else {
+		s.recordWriteSuccess()
+	}
+	return err
+}
+
+// deferWrite queues the write if the site is quarantined and another site is healthy
+func (s *site) deferWrite(ctx context.Context, write siteWrite) bool {
+	if quarantine.threshold <= 0 || !s.Quarantined() || !anyHealthySite() {
+		return false
+	}
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	if !s.health.quarantined {
+		return false
+	}
+	if len(s.health.pending) >= quarantine.maxPending {
+		s.health.dropped++
+		return true
+	}
+	s.health.pending = append(s.health.pending, write)
+	s.alertIfFailing(ctx)
+	return true
+}
+
+// anyHealthySite returns true if any of the sites is not quarantined
+func anyHealthySite() bool {
+	for _, site := range sites {
+		if !site.Quarantined() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *site) recordWriteSuccess() {
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	if s.health.failures > 0 && !s.health.quarantined {
+		incidents.resolve(context.Background(), incidentSiteFailingPrefix+s.name)
+	}
+	s.health.failures = 0
+}
+
+// recordWriteFailure counts the failed write, putting the site in quarantine once the
+// threshold is crossed
+func (s *site) recordWriteFailure(ctx context.Context) {
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	s.health.failures++
+	s.alertIfFailing(ctx)
+	if quarantine.threshold <= 0 || s.health.quarantined || s.health.failures < quarantine.threshold {
+		return
+	}
+	s.health.quarantined = true
+	siteQuarantined.WithLabelValues(s.name).Set(1)
+	logf(ctx, "WARNING", s.name, "site quarantined after %v consecutive failed writes; deferring the writes until it recovers", s.health.failures)
+	captureError(ctx, nil, "error", fmt.Sprintf("site %v quarantined after %v consecutive failed writes", s.name, s.health.failures),
+		map[string]string{"type": "site_quarantined", "site": s.name})
+	go s.probe(context.Background())
+}
+
+// alertIfFailing sends a site_failing alert and opens its PagerDuty incident once the
+// consecutive failed writes or the deferred writes of the site, or the users queued for a
+// read-repair, cross their thresholds, unless alerted within the cooldown; called with the
+// health lock held
+func (s *site) alertIfFailing(ctx context.Context) {
+	repairs := readRepairs.depth()
+	failing := siteAlerts.failures > 0 && s.health.failures >= siteAlerts.failures
+	piling := siteAlerts.pending > 0 && len(s.health.pending) >= siteAlerts.pending
+	repairing := siteAlerts.repairs > 0 && repairs >= siteAlerts.repairs
+	if !failing && !piling && !repairing {
+		return
+	}
+	if time.Since(s.health.alertedAt) < siteAlerts.cooldown {
+		return
+	}
+	s.health.alertedAt = time.Now()
+	message := fmt.Sprintf("site %v has %v consecutive failed writes and %v deferred writes, with %v users queued for a read-repair", s.name, s.health.failures, len(s.health.pending), repairs)
+	logf(ctx, "WARNING", s.name, "%v; alerting", message)
+	sendAlert(ctx, alert{
+		Type:    "site_failing",
+		Site:    s.name,
+		Message: message,
+	})
+	incidents.trigger(ctx, incidentSiteFailingPrefix+s.name, message, map[string]interface{}{
+		"site":           s.name,
+		"failures":       s.health.failures,
+		"deferredWrites": len(s.health.pending),
+		"readRepairs":    repairs,
+	})
+}
+
+// probe checks the quarantined site periodically, applying the deferred writes and
+// lifting the quarantine once it is reachable again
+func (s *site) probe(ctx context.Context) {
+	for {
+		time.Sleep(quarantine.probeInterval)
+		probeCtx, cancel := context.WithTimeout(ctx, siteProbeTimeout)
+		_, err := s.Client().BucketExists(probeCtx, quotaBucket)
+		cancel()
+		if err != nil {
+			logf(ctx, "WARNING", s.name, "quarantined site is still unreachable; %v", err)
+			continue
+		}
+		if s.replayWrites(ctx) {
+			return
+		}
+	}
+}
+
+// replayWrites applies the deferred writes in order, lifting the quarantine once they are
+// all applied; returns false if a write failed
+func (s *site) replayWrites(ctx context.Context) bool {
+	var replayed int
+	for {
+		s.health.mu.Lock()
+		if len(s.health.pending) == 0 {
+			dropped := s.health.dropped
+			s.health.quarantined = false
+			s.health.failures = 0
+			s.health.dropped = 0
+			s.health.mu.Unlock()
+			siteQuarantined.WithLabelValues(s.name).Set(0)
+			incidents.resolve(ctx, incidentSiteFailingPrefix+s.name)
+			logf(ctx, "LOG", s.name, "site recovered; lifted the quarantine after applying %v deferred writes", replayed)
+			if dropped > 0 {
+				logf(ctx, "WARNING", s.name, "%v deferred writes were dropped during the quarantine; run /admin/sync to catch up the site", dropped)
+			}
+			return true
+		}
+		write := s.health.pending[0]
+		s.health.mu.Unlock()
+
+		if err := defaultRetry.do(ctx, func() error {
+			return write(ctx, s.Client())
+		}); err != nil && !errors.Is(err, errMaxLimitExceeded) && !errors.Is(err, errOverLimitMonitored) {
+			logf(ctx, "WARNING", s.name, "unable to apply the deferred writes; staying quarantined; %v", err)
+			return false
+		}
+		s.health.mu.Lock()
+		s.health.pending = s.health.pending[1:]
+		s.health.mu.Unlock()
+		replayed++
+	}
+}
@@ -2,13 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
-	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,117 +27,437 @@ var (
 // - Reads the corresponding user quota of the user
 // - If the quota is not present, will add a new quota file - `manifests/USER.quota` and adds the object path to the quota
 // - If quota is present, will append the path to the quota objects list
+// - For removal (DELETE / ILM expiry) events, drops the path from the user quota
+// - Answers 4xx for the events which cannot succeed on a retry, and 503 for the failures of the
+// sites, so that MinIO retries the notification
 func updateQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		fmt.Printf("[ERROR] unable to read the body; %v\n", err)
+		logf(ctx, "ERROR", "", "unable to read the body; %v", err)
 		http.Error(w, "error reading response body", http.StatusBadRequest)
 		return
 	}
-	var jsonData map[string]interface{}
-	if err = json.Unmarshal(body, &jsonData); err != nil {
-		fmt.Printf("[ERROR] unable to unmarshal the body; %v\n", err)
+	var payload notificationPayload
+	if err = json.Unmarshal(body, &payload); err != nil {
+		logf(ctx, "ERROR", "", "unable to unmarshal the body; %v", err)
 		http.Error(w, "error marshalling response body", http.StatusBadRequest)
 		return
 	}
-	records, ok := jsonData["Records"].([]interface{})
-	if !ok || len(records) == 0 {
-		fmt.Println("[ERROR] missing records in the request body")
+	if len(payload.Records) == 0 {
+		logf(ctx, "ERROR", "", "missing records in the request body")
 		http.Error(w, "missing records in the request body", http.StatusBadRequest)
 		return
 	}
-	record := records[0].(map[string]interface{})
-	s3Data, ok := record["s3"].(map[string]interface{})
-	if !ok {
-		fmt.Println("[ERROR] missing records in the request body")
-		http.Error(w, "missing s3 data in the request body", http.StatusBadRequest)
+	if archiveNotifications {
+		if err := archivePayload(ctx, body); err != nil {
+			// the archive is for the audits, and never holds up the updates
+			logf(ctx, "ERROR", "", "unable to archive the notification; %v", err)
+		}
+	}
+	// every record is applied, as a record failing must not drop the others, and the notification
+	// is answered by the failure most in need of a retry
+	var failed error
+	for _, record := range payload.Records {
+		if err := processEvent(ctx, record); err != nil {
+			if failed == nil || eventErrorRank(err) > eventErrorRank(failed) {
+				failed = err
+			}
+		}
+	}
+	if failed != nil {
+		status := eventErrorStatus(failed)
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", strconv.Itoa(userRateLimiter.retryAfter()))
+		}
+		http.Error(w, failed.Error(), status)
+	}
+}
+
+// eventErrorStatus classifies the error of an event; 400 for the invalid events, 403 for the
+// updates rejected by the limits, 429 for the rate limited users, and 503 for the failures of
+// the sites and the new users over MAX_USERS, which a retry can resolve
+func eventErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errInvalidEvent):
+		return http.StatusBadRequest
+	case errors.Is(err, errUserBlocked), errors.Is(err, errMaxLimitExceeded):
+		return http.StatusForbidden
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
+
+// eventErrorRank ranks the error of an event by how much a retry of the notification is needed
+func eventErrorRank(err error) int {
+	switch eventErrorStatus(err) {
+	case http.StatusServiceUnavailable:
+		return 3
+	case http.StatusTooManyRequests:
+		return 2
+	case http.StatusForbidden:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// GET /quota/check/{user}?detail=true
+//
+//   - Reads the quota of the provided user
+//   - Refreshes the quota
+//   - Checks if it exceeds the max limit
+//   - With detail, returns the usage of the user on every site and the sites reporting it exceeded
+func quotaCheckHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	vars := mux.Vars(r)
+	user := vars["user"]
+
+	status, err := answerCheck(ctx, w, user)
+	if r.URL.Query().Get("detail") == "true" {
+		writeCheckDetail(ctx, w, user, status, err)
 		return
 	}
-	var bucket string
-	if bucketData, ok := s3Data["bucket"].(map[string]interface{}); ok {
-		bucket, _ = bucketData["name"].(string)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+	}
+}
+
+// answerCheck checks the quota of the user and counts the result; returns the status answering
+// the check, and the error rejecting it
+func answerCheck(ctx context.Context, w http.ResponseWriter, user string) (int, error) {
+	err := checkQuota(ctx, user)
+	if err == nil {
+		countCheck("allowed")
+		return http.StatusOK, nil
 	}
-	var object string
-	if objectData, ok := s3Data["object"].(map[string]interface{}); ok {
-		object, _ = objectData["key"].(string)
+	if errors.Is(err, errMaxLimitExceeded) && isMonitored(user) {
+		// tracked, but never rejected
+		countCheck("monitored")
+		return http.StatusOK, nil
 	}
-	if bucket == "" || object == "" {
-		log.Println("[ERROR] bucket or object found to be empty")
+	if errors.Is(err, errMaxLimitExceeded) {
+		countCheck("exceeded")
+		return http.StatusForbidden, err
+	}
+	if errors.Is(err, errUserBlocked) {
+		countCheck("blocked")
+		return http.StatusForbidden, err
+	}
+	if errors.Is(err, errSitesUnreachable) {
+		if answered, degradedErr := degradedCheck(w, user); answered {
+			logf(ctx, "WARNING", "", "answered the check of user '%v' by the %v policy; %v", user, degradedChecks, err)
+			if degradedErr != nil {
+				return http.StatusForbidden, degradedErr
+			}
+			return http.StatusOK, nil
+		}
+	}
+	countCheck("failed")
+	return http.StatusInternalServerError, err
+}
+
+// GET /quota/{user}
+//
+// - Reads the user quota from MinIO
+// - Returns the objects and bytes counted in the user quota, along with the per-day breakdown
+// - Returns 304 Not Modified if the usage still matches the ETag in If-None-Match
+func quotaUsageHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	user := mux.Vars(r)["user"]
+	usage, err := readUsage(ctx, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	writeUsage(w, r, usage)
+}
 
-	path, err := url.PathUnescape(object)
+// GET /my/quota
+//
+// - Authenticates the end user by their token
+// - Returns their own usage, same as GET /quota/{user}
+func myQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	usage, err := readUsage(ctx, userFromContext(ctx))
 	if err != nil {
-		fmt.Printf("[ERROR] unable to escape the path '%v'; %v\n", object, err)
-		http.Error(w, "unable to escape the object path", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	writeUsage(w, r, usage)
+}
 
-	tokens := strings.Split(path, "/")
-	if len(tokens) < 3 {
-		fmt.Printf("[ERROR] invalid path '%v'\n", path)
-		http.Error(w, "invalid path", http.StatusBadRequest)
+// writeUsage writes the usage along with its ETag, or 304 Not Modified if the client
+// already has it, so that the polling clients do not transfer it again
+func writeUsage(w http.ResponseWriter, r *http.Request, usage *quotaUsage) {
+	data, err := json.Marshal(usage)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	date := tokens[0]
-	user := tokens[1]
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if match = strings.TrimSpace(match); match == etag || match == "W/"+etag || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(data, '\n'))
+}
 
-	t, err := time.Parse(dateFormat, date)
+// GET /quotas?min-used-percent=80
+//
+//   - Reads the user quotas from MinIO
+//   - Returns the usage of the users having used at least the provided percent of their limit,
+//     closest to their limit first
+func quotaListHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	var minUsedPercent float64
+	if value := r.URL.Query().Get("min-used-percent"); value != "" {
+		var err error
+		if minUsedPercent, err = strconv.ParseFloat(value, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid min-used-percent '%v'; %v", value, err), http.StatusBadRequest)
+			return
+		}
+	}
+	usages, err := listUsage(ctx)
 	if err != nil {
-		fmt.Printf("[ERROR] unable to parse the date '%v' in the '%v'; %v\n", date, path, err)
-		http.Error(w, "invalid path", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	filtered := []*quotaUsage{}
+	for _, usage := range usages {
+		if usage.usedPercent() >= minUsedPercent {
+			filtered = append(filtered, usage)
+		}
 	}
-	if getCurrentDateInUTC().After(t.UTC()) {
-		fmt.Printf("[ERROR] unable to update the quota; the date found in the path '%v' is older than the current date\n", path)
-		// purposefully sending 200 OK because we don't want such events to be retried
+	sort.SliceStable(filtered, func(i, j int) bool {
+		return filtered[i].usedPercent() > filtered[j].usedPercent()
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(filtered)
+}
+
+// GET /quotas/stats
+//
+// - Reads the user quotas from MinIO
+// - Returns the number of users per percent-of-limit range, along with the total users, objects and bytes
+func quotaStatsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	usages, err := listUsage(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if err := updateQuota(context.Background(), user, path); err != nil {
-		http.Error(w, fmt.Sprintf("unable to update quota; %v", err), http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getUsageStats(usages))
+}
+
+// quotaAdjustment represents the object paths to add to and remove from a user quota
+type quotaAdjustment struct {
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// PATCH /quota/{user}
+//
+// - Parses the object paths DATE/USER/object to add and remove from the body
+// - Applies them on the user quota on all the sites
+func quotaAdjustHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	user := mux.Vars(r)["user"]
+	var adjustment quotaAdjustment
+	if err := json.NewDecoder(r.Body).Decode(&adjustment); err != nil {
+		http.Error(w, fmt.Sprintf("unable to parse the body; %v", err), http.StatusBadRequest)
 		return
 	}
-	fmt.Printf("[LOG] updated quota for '%v'\n", user)
+	add := make(map[string]quotaEntry, len(adjustment.Add))
+	for _, path := range append(append([]string{}, adjustment.Add...), adjustment.Remove...) {
+		if err := validateUserPath(path, user); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	for _, path := range adjustment.Add {
+		add[path] = quotaEntry{}
+	}
+	if err := adjustQuota(ctx, user, add, adjustment.Remove); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logf(ctx, "LOG", "", "adjusted quota for '%v'; added %v and removed %v objects", user, len(adjustment.Add), len(adjustment.Remove))
 }
 
-// GET /quota/check/{user}
+// POST /quota/{user}/import
 //
-// - Reads the quota of the provided user
-// - Refreshes the quota
-// - Checks if it exceeds the max limit
-func quotaCheckHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	user := vars["user"]
+//   - Parses the object paths DATE/USER/object from the body, one per line; either as CSV with the
+//     path and the optional size, or as ndjson with the key, size and lastModified (like `mc ls --json`)
+//   - Merges them into the user quota on all the sites
+func quotaImportHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	user := mux.Vars(r)["user"]
+	entries, err := parseImport(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to parse the body; %v", err), http.StatusBadRequest)
+		return
+	}
+	for path := range entries {
+		if err := validateUserPath(path, user); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := adjustQuota(ctx, user, entries, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logf(ctx, "LOG", "", "imported %v objects into the quota of '%v'", len(entries), user)
+}
+
+// POST /quota/{user}/recalculate?site=site1,site2&dryRun=site2
+//
+// - Lists the objects DATE/USER/object of the user in the data bucket, for the dates not expired yet
+// - Replaces the user quota with them on each targeted site, only logging the changes on the dry ones
+func quotaRecalculateHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	user := mux.Vars(r)["user"]
+	targets, err := parseSiteTargets(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := recalculateQuota(ctx, user, targets); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
 
-	if err := checkQuota(context.Background(), user); err != nil {
-		if errors.Is(err, errMaxLimitExceeded) {
-			http.Error(w, err.Error(), http.StatusForbidden)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+// GET /quota/{user}/history?from=2024-Jan-01&to=2024-Jan-31
+//
+// - Reads the snapshots of the days pruned from the user quota, along with the days still counted
+// - Returns the per-day usage between the dates, both inclusive; the last 7 days by default
+func quotaHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	user := mux.Vars(r)["user"]
+	to := getCurrentDateInUTC()
+	from := to.AddDate(0, 0, -6)
+	for param, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		value := r.URL.Query().Get(param)
+		if value == "" {
+			continue
+		}
+		date, err := parseHistoryDate(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %v '%v'; %v", param, value, err), http.StatusBadRequest)
+			return
 		}
+		*t = date
+	}
+	days, err := readUsageHistory(ctx, user, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(days)
 }
 
-// GET /quota/refresh
+// GET /quota/refresh?site=site1,site2&dryRun=site2&prefix=tenant1-&users=usera,userb
 //
 // - Lists the user quotas from MinIO
 // - Refreshes the user quota
 // - PUTs the updated user quota back to MinIO
+// - Runs on the sites in site only (all by default), logging the changes without making them on the sites in dryRun
+// - Runs on the users having the prefix, or on the users only, without listing the others
 func quotaRefreshHandler(w http.ResponseWriter, r *http.Request) {
-	if err := refreshQuota(context.Background()); err != nil {
+	ctx := requestContext(r)
+	targets, err := parseSiteTargets(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err := parseUserFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start := time.Now()
+	err = refreshQuota(ctx, targets, filter)
+	lastRuns.record("refresh", start, err)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-// DELETE /purge
+// DELETE /purge?bypassGovernance=true&site=site1,site2&dryRun=site2
+//
+//   - Lists all the voice mails
+//   - Checks if the objects fall behind the current time
+//   - If yes, force deletes them; if the data bucket has object locking, deletes their versions one
+//     by one, skipping the ones under a legal hold or retention (bypassing the governance retention
+//     if requested and allowed)
+//   - Runs on the sites in site only (all by default), logging the dates to purge without purging
+//     them on the sites in dryRun
+//   - Returns the number of purged dates and the skipped versions
 //
-// - Lists all the voice mails
-// - Checks if the objects fall behind the current time
-// - If yes, force deletes them
 // NOTE: Meant to be run in a CRON-JOB periodically every day
 func purgeHandler(w http.ResponseWriter, r *http.Request) {
-	if err := purge(context.Background()); err != nil {
+	ctx := requestContext(r)
+	targets, err := parseSiteTargets(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start := time.Now()
+	report, err := purge(ctx, targets, r.URL.Query().Get("bypassGovernance") == "true")
+	lastRuns.record("purge", start, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// POST /admin/compact
+//
+// - Rewrites every user quota on all the sites pruned, compacted and in the current schema
+// - Returns the bytes saved per site
+func compactHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	start := time.Now()
+	results, err := compactQuotas(ctx)
+	lastRuns.record("compact", start, err)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(results)
+}
+
+// POST /admin/sync?site=site1,site2&dryRun=site2
+//
+// - Lists the user quotas from all the sites
+// - Merges the user quota of each user to the union across the sites
+// - PUTs the merged user quota to the sites which are missing any objects
+// - Writes to the sites in site only (all by default), logging the writes without making them on the sites in dryRun
+func syncHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	targets, err := parseSiteTargets(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start := time.Now()
+	err = syncQuota(ctx, targets)
+	lastRuns.record("sync", start, err)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
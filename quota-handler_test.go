@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+)
+
+// testPayload returns the body of a notification of the events
+func testPayload(t *testing.T, events ...notification.Event) string {
+	t.Helper()
+	body, err := json.Marshal(notificationPayload{Records: events})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestUpdateQuotaHandler(t *testing.T) {
+	// the events of the paths given, built once the sites set up their bucket
+	pathEvent := func(path string) notification.Event {
+		event := testEvent("s3:ObjectCreated:Put", "usera", "")
+		event.S3.Object.Key = path
+		return event
+	}
+
+	testCases := []struct {
+		name  string
+		setup func(t *testing.T)
+		body  func(t *testing.T) string
+		// status is the expected answer, and counted the objects expected in the quota of usera
+		status  int
+		counted int
+	}{
+		{
+			name:    "updated",
+			body:    func(t *testing.T) string { return testPayload(t, testEvent("s3:ObjectCreated:Put", "usera", "a")) },
+			status:  http.StatusOK,
+			counted: 1,
+		},
+		{
+			name:   "skipped late event",
+			body:   func(t *testing.T) string { return testPayload(t, pathEvent("2020-Jan-01/usera/late")) },
+			status: http.StatusOK,
+		},
+		{
+			name:   "malformed body",
+			body:   func(t *testing.T) string { return "not json" },
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "missing records",
+			body:   func(t *testing.T) string { return `{"Records":[]}` },
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "invalid event does not drop the others",
+			body: func(t *testing.T) string {
+				return testPayload(t, pathEvent("invalid"), testEvent("s3:ObjectCreated:Put", "usera", "a"))
+			},
+			status:  http.StatusBadRequest,
+			counted: 1,
+		},
+		{
+			name: "over the limit",
+			body: func(t *testing.T) string {
+				var events []notification.Event
+				for _, object := range []string{"a", "b", "c", "d"} {
+					events = append(events, testEvent("s3:ObjectCreated:Put", "usera", object))
+				}
+				return testPayload(t, events...)
+			},
+			status:  http.StatusForbidden,
+			counted: 3,
+		},
+		{
+			name: "rate limited over an invalid event",
+			setup: func(t *testing.T) {
+				userRateLimiter = &rateLimiter{rate: 0.001, burst: 1, buckets: map[string]*tokenBucket{}}
+				t.Cleanup(func() { userRateLimiter = nil })
+			},
+			body: func(t *testing.T) string {
+				return testPayload(t, testEvent("s3:ObjectCreated:Put", "usera", "a"), pathEvent("invalid"), testEvent("s3:ObjectCreated:Put", "usera", "b"))
+			},
+			status:  http.StatusTooManyRequests,
+			counted: 1,
+		},
+		{
+			name: "max users",
+			setup: func(t *testing.T) {
+				maxUsers, userCounts = 1, &userCounter{sites: map[string]*siteUserCount{}}
+				t.Cleanup(func() { maxUsers, userCounts = 0, &userCounter{sites: map[string]*siteUserCount{}} })
+			},
+			body: func(t *testing.T) string {
+				return testPayload(t, testEvent("s3:ObjectCreated:Put", "userb", "a"), testEvent("s3:ObjectCreated:Put", "usera", "a"))
+			},
+			status: http.StatusServiceUnavailable,
+		},
+		{
+			name: "site failure",
+			setup: func(t *testing.T) {
+				sites = append(sites, newStoreSite("site2", nil))
+			},
+			body: func(t *testing.T) string {
+				return testPayload(t, testEvent("s3:ObjectCreated:Put", "usera", "a"))
+			},
+			status:  http.StatusServiceUnavailable,
+			counted: 1,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			setupTestSites(t, 1)
+			if testCase.setup != nil {
+				testCase.setup(t)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/quota/update", strings.NewReader(testCase.body(t)))
+			w := httptest.NewRecorder()
+			updateQuotaHandler(w, r)
+			if w.Code != testCase.status {
+				t.Fatalf("expected %v, got %v; %v", testCase.status, w.Code, w.Body.String())
+			}
+			if testCase.status == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+				t.Fatal("expected a Retry-After header")
+			}
+			userQuota, _, err := readUserQuota(context.Background(), sites[0].Client(), "usera")
+			if err != nil {
+				if testCase.counted == 0 {
+					return
+				}
+				t.Fatal(err)
+			}
+			if len(userQuota.Objects) != testCase.counted {
+				t.Fatalf("expected %v objects counted, got %v", testCase.counted, len(userQuota.Objects))
+			}
+		})
+	}
+}
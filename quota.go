@@ -8,43 +8,87 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/pkg/sync/errgroup"
+	"github.com/minio/pkg/workers"
 )
 
 const (
-	dateFormat    = "2006-Jan-02"
-	quotaExt      = ".quota"
-	retryAttempts = 3
-	retryTimeout  = 3 * time.Second
+	dateFormat = "2006-Jan-02"
+	quotaExt   = ".quota"
 )
 
 // UserQuota represents the user quota
 type UserQuota struct {
-	Objects  map[string]struct{} `json:"objects"`
-	MaxLimit int                 `json:"maxLimit,omitempty"`
+	Objects  map[string]quotaEntry `json:"objects"`
+	MaxLimit int                   `json:"maxLimit,omitempty"`
+	// Rejections counts the updates rejected for exceeding the limit by date
+	Rejections map[string]int `json:"rejections,omitempty"`
+	// Holds are the slots reserved for the uploads to come by reservation id
+	Holds map[string]quotaHold `json:"holds,omitempty"`
+
+	// pruned are the expired objects dropped by Refresh, handed to the prune hooks
+	// once the quota is written
+	pruned map[string]quotaEntry
+}
+
+// pruneHooks are called with the expired objects of the user quota written to a site
+var pruneHooks []func(ctx context.Context, s3Client ObjectStore, user string, pruned map[string]quotaEntry)
+
+// quotaEntry represents an object counted in the user quota; the entries written
+// before the metadata was recorded decode to the zero value
+type quotaEntry struct {
+	Size      int64     `json:"size,omitempty"`
+	EventTime time.Time `json:"eventTime"`
+	ETag      string    `json:"etag,omitempty"`
+}
+
+// date returns the date the entry counts towards, preferring the event time over the date in the path
+func (entry quotaEntry) date(pathDate time.Time) time.Time {
+	if entry.EventTime.IsZero() {
+		return pathDate
+	}
+	t := entry.EventTime.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
 }
 
 // NewUserQuota returns a new user quota
 func NewUserQuota() *UserQuota {
 	return &UserQuota{
-		Objects:  make(map[string]struct{}),
+		Objects:  make(map[string]quotaEntry),
 		MaxLimit: maxLimit,
 	}
 }
 
 // getCurrentDateInUTC fetches the current date in UTC format
 func getCurrentDateInUTC() time.Time {
-	currentTime := time.Now().UTC()
+	currentTime := clock.Now().UTC()
 	return time.Date(currentTime.Year(), currentTime.Month(), currentTime.Day(), 0, 0, 0, 0, currentTime.Location())
 }
 
+// isExpired returns true if the objects of the date no longer count towards the quota; a date
+// expires at the next midnight UTC
+func isExpired(date time.Time) bool {
+	return getCurrentDateInUTC().After(date.UTC())
+}
+
+// isTooLate returns true if the events of the date are no longer accepted; the events of an
+// expired date are still accepted for the tolerance past its midnight UTC, to be pruned into
+// the history by the next write instead of being lost
+func isTooLate(date time.Time) bool {
+	if lateEventTolerance <= 0 {
+		return isExpired(date)
+	}
+	return !clock.Now().UTC().Before(date.UTC().AddDate(0, 0, 1).Add(lateEventTolerance))
+}
+
 // Refresh parses the time in the path of the objects and filters them if they are stale
 func (quota *UserQuota) Refresh() (updated bool) {
-	objects := map[string]struct{}{}
-	for object, _ := range quota.Objects {
+	objects := map[string]quotaEntry{}
+	for object, entry := range quota.Objects {
 		tokens := strings.Split(object, "/")
 		if len(tokens) < 3 {
 			updated = true
@@ -56,13 +100,26 @@ func (quota *UserQuota) Refresh() (updated bool) {
 			updated = true
 			continue
 		}
-		if getCurrentDateInUTC().After(t.UTC()) {
+		if isExpired(entry.date(t)) {
+			if quota.pruned == nil {
+				quota.pruned = map[string]quotaEntry{}
+			}
+			quota.pruned[object] = entry
 			updated = true
 			continue
 		}
-		objects[object] = struct{}{}
+		objects[object] = entry
 	}
 	quota.Objects = objects
+	for date := range quota.Rejections {
+		if t, err := time.Parse(dateFormat, date); err != nil || isExpired(t) {
+			delete(quota.Rejections, date)
+			updated = true
+		}
+	}
+	if quota.pruneHolds() {
+		updated = true
+	}
 	return
 }
 
@@ -72,188 +129,737 @@ func (quota UserQuota) Write(w io.Writer) error {
 	return encoder.Encode(quota)
 }
 
-// parseUserQuota reads the user quota from the reader and parses it
-func parseUserQuota(r io.Reader) (*UserQuota, error) {
-	var quota UserQuota
-	if err := json.NewDecoder(r).Decode(&quota); err != nil {
-		return nil, err
+// parseUserQuota parses the user quota strictly, falling back to ignore the fields unknown
+// to this version; the defects found are normalized and returned
+func parseUserQuota(user string, data []byte) (*UserQuota, []string, error) {
+	var (
+		quota   UserQuota
+		defects []string
+	)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&quota); err != nil {
+		quota = UserQuota{}
+		if err := json.Unmarshal(data, &quota); err != nil {
+			return nil, nil, err
+		}
+		defects = append(defects, fmt.Sprintf("ignored unknown fields; %v", err))
+	}
+	return &quota, append(defects, quota.normalize(user)...), nil
+}
+
+// normalize fixes the defects of the decoded quota, so that they never reach the enforcement
+func (quota *UserQuota) normalize(user string) (defects []string) {
+	if quota.Objects == nil {
+		quota.Objects = map[string]quotaEntry{}
+		defects = append(defects, "missing objects")
+	}
+	if quota.MaxLimit <= 0 {
+		if quota.MaxLimit < 0 {
+			defects = append(defects, fmt.Sprintf("invalid max limit %v", quota.MaxLimit))
+		}
+		quota.MaxLimit = maxLimit
+	}
+	// the quotas kept under a name canonicalized since are read by their own name
+	user = canonicalUser(user)
+	for object, entry := range quota.Objects {
+		if tokens := strings.Split(object, "/"); len(tokens) >= 3 && canonicalUser(tokens[1]) != user {
+			delete(quota.Objects, object)
+			defects = append(defects, fmt.Sprintf("dropped object '%v' of another user", object))
+			continue
+		}
+		if entry.Size < 0 {
+			entry.Size = 0
+			quota.Objects[object] = entry
+			defects = append(defects, fmt.Sprintf("invalid size of object '%v'", object))
+		}
+	}
+	for date, count := range quota.Rejections {
+		if count <= 0 {
+			delete(quota.Rejections, date)
+			defects = append(defects, fmt.Sprintf("invalid rejections on %v", date))
+		}
+	}
+	for id, hold := range quota.Holds {
+		if hold.Objects <= 0 {
+			delete(quota.Holds, id)
+			defects = append(defects, fmt.Sprintf("invalid reservation %v", id))
+		}
 	}
-	return &quota, nil
+	return defects
 }
 
-// readUserQuota GETs the user quota, reads and parses it
-func readUserQuota(ctx context.Context, s3Client *minio.Client, user string) (*UserQuota, string, error) {
-	reader, err := s3Client.GetObject(ctx, quotaBucket, user+quotaExt, minio.GetObjectOptions{})
+// readUserQuota GETs the user quota, verifies its checksum, reads and parses it; a corrupted
+// quota is never returned, but rebuilt in the background
+func readUserQuota(ctx context.Context, s3Client ObjectStore, user string) (*UserQuota, string, error) {
+	reader, stat, err := s3Client.ReadObject(ctx, quotaBucket, user+quotaExt)
 	if err != nil {
 		return nil, "", err
 	}
 	defer reader.Close()
 
-	stat, err := reader.Stat()
+	etag := stat.ETag
+	data, err := io.ReadAll(reader)
 	if err != nil {
-		return nil, "", err
+		return nil, etag, err
 	}
-	etag := stat.ETag
-	userQuota, err := parseUserQuota(reader)
-	return userQuota, etag, err
+	if err := verifyManifest(data, stat.UserMetadata[manifestChecksumKey]); err != nil {
+		rebuildManifest(ctx, s3Client, user, data)
+		return nil, etag, err
+	}
+	userQuota, defects, err := parseUserQuota(user, data)
+	if err != nil {
+		rebuildManifest(ctx, s3Client, user, data)
+		return nil, etag, fmt.Errorf("%w; %v", errManifestUnparsable, err)
+	}
+	for _, defect := range defects {
+		logf(ctx, "WARNING", s3Client.EndpointURL().Host, "normalized the user quota of '%v'; %v", user, defect)
+	}
+	return userQuota, etag, nil
 }
 
 // updateUserQuota PUTs the provided user quota to MinIO
-func updateUserQuota(ctx context.Context, s3Client *minio.Client, user string, userQuota *UserQuota, etag string) error {
-	var buf bytes.Buffer
-	if err := userQuota.Write(&buf); err != nil {
+func updateUserQuota(ctx context.Context, s3Client ObjectStore, user string, userQuota *UserQuota, etag string) error {
+	data, err := encodeUserQuota(ctx, s3Client.EndpointURL().Host, user, userQuota)
+	if err != nil {
 		return err
 	}
+	if historyRetentionDays > 0 && len(userQuota.pruned) > 0 {
+		// kept before the quota forgets them
+		if err := writeHistory(ctx, s3Client, user, userQuota.pruned); err != nil {
+			return err
+		}
+	}
 	opts := minio.PutObjectOptions{
-		ContentType: "application/octet-stream",
+		ContentType:  "application/octet-stream",
+		UserMetadata: map[string]string{manifestChecksumKey: manifestChecksum(data)},
 	}
 	opts.SetMatchETag(etag)
+	retainQuota(&opts)
 
-	_, err := s3Client.PutObject(ctx,
+	_, err = s3Client.PutObject(ctx,
 		quotaBucket,
 		user+quotaExt,
-		bytes.NewReader(buf.Bytes()),
-		int64(buf.Len()),
+		bytes.NewReader(data),
+		int64(len(data)),
 		opts)
-	return err
+	if err != nil {
+		return err
+	}
+	if etag == "" {
+		// a new user, counted towards MAX_USERS
+		userCounts.add(s3Client.EndpointURL().Host, user)
+	}
+	if len(userQuota.pruned) > 0 {
+		for _, hook := range pruneHooks {
+			hook(ctx, s3Client, user, userQuota.pruned)
+		}
+	}
+	return nil
 }
 
-// updateQuota updates the quota on all the s3clients configured
-func updateQuota(ctx context.Context, user, path string) error {
-	g := errgroup.WithNErrs(len(s3Clients))
-	for index := range s3Clients {
+// updateQuota adds the object of the event to the quota on all the s3clients configured
+func updateQuota(ctx context.Context, event *quotaEvent) error {
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
 		index := index
-		g.Go(func() (err error) {
-			if s3Clients[index] == nil {
-				return errors.New("s3Client is nil")
-			}
-			for attempts := 1; attempts <= retryAttempts; attempts++ {
-				err = updateLatestUserQuota(ctx, s3Clients[index], user, path)
-				if err == nil {
-					return
+		g.Go(func() error {
+			return writeSite(ctx, sites[index], func(ctx context.Context, s3Client ObjectStore) error {
+				err := updateLatestUserQuota(ctx, s3Client, event.User, event.Path, event.entry(), event.reservation())
+				if errors.Is(err, errMaxLimitExceeded) {
+					// a rejection is final, and leaves the quota unchanged
+					return final(err)
 				}
-				time.Sleep(retryTimeout)
-			}
-			return
+				if err == nil || errors.Is(err, errOverLimitMonitored) {
+					invalidateManifest(sites[index], event.User)
+					if err != nil {
+						return final(err)
+					}
+				}
+				return err
+			})
 		}, index)
 	}
-	return g.WaitErr()
+	var monitored error
+	for _, err := range g.Wait() {
+		if errors.Is(err, errOverLimitMonitored) {
+			monitored = err
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return monitored
 }
 
-func updateLatestUserQuota(ctx context.Context, s3Client *minio.Client, user, path string) error {
+func updateLatestUserQuota(ctx context.Context, s3Client ObjectStore, user, path string, entry quotaEntry, reservation string) error {
 	userQuota, etag, err := readUserQuota(ctx, s3Client, user)
 	if err != nil {
 		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
-			fmt.Printf("[ERROR][%v] unable to GET the manifest for user '%v'; %v\n", s3Client.EndpointURL().Host, user, err)
+			logf(ctx, "ERROR", s3Client.EndpointURL().Host, "unable to GET the manifest for user '%v'; %v", user, err)
 			return fmt.Errorf("user quota cannot be read; %v", err)
 		}
+		if err := admitUser(ctx, s3Client, user); err != nil {
+			return err
+		}
 		userQuota = NewUserQuota()
-		userQuota.Objects[path] = struct{}{}
 	} else {
 		if etag == "" {
-			fmt.Printf("[ERROR][%v] ETag not returned for user quota; user: '%v';", s3Client.EndpointURL().Host, user)
+			logf(ctx, "ERROR", s3Client.EndpointURL().Host, "ETag not returned for user quota; user: '%v';", user)
 			return fmt.Errorf("ETag not found in object; %v", err)
 		}
 		userQuota.Refresh()
-		if _, ok := userQuota.Objects[path]; ok {
-			// Already appended
+	}
+	updated, added := userQuota.addObject(ctx, s3Client.EndpointURL().Host, user, path, entry, reservation)
+	if !updated {
+		return added
+	}
+	if err := updateUserQuota(ctx, s3Client, user, userQuota, etag); err != nil {
+		logf(ctx, "ERROR", s3Client.EndpointURL().Host, "unable to update user quota for user '%v'; %v", user, err)
+		return fmt.Errorf("unable to update user quota for user: %v; %v", user, err)
+	}
+	trackUsage(ctx, user, userQuota)
+	return added
+}
+
+// addObject counts the object in the user quota, unless already counted, in which case only
+// the size and the ETag missing from a reservation commit are filled in; returns false if the
+// quota is unchanged, along with errMaxLimitExceeded if the limit rejected the object, and
+// errOverLimitMonitored if it is counted over the limit
+func (quota *UserQuota) addObject(ctx context.Context, host, user, path string, entry quotaEntry, reservation string) (bool, error) {
+	if counted, ok := quota.Objects[path]; ok {
+		// Already appended, by its reservation commit if without its size and ETag yet
+		if counted.ETag != "" || (entry.ETag == "" && entry.Size == counted.Size) {
+			return false, nil
+		}
+		counted.Size, counted.ETag = entry.Size, entry.ETag
+		quota.Objects[path] = counted
+		return true, nil
+	}
+	quota.Objects[path] = entry
+	if pathDate, err := time.Parse(dateFormat, strings.SplitN(path, "/", 2)[0]); err == nil && isExpired(entry.date(pathDate)) {
+		// a late event of the previous day, not counted towards the limit of today
+		return true, nil
+	}
+	held := quota.Holds
+	if len(held) > 0 {
+		held = make(map[string]quotaHold, len(quota.Holds))
+		for id, hold := range quota.Holds {
+			held[id] = hold
+		}
+		quota.consumeHold(reservation, entry.Size)
+	}
+	overLimit := len(quota.Objects)+quota.held() > effectiveLimit(ctx, user, quota)
+	if overLimit && !isMonitored(user) {
+		logf(ctx, "WARNING", host, "unable to update quota; max limit exceeded for user '%v'", user)
+		delete(quota.Objects, path)
+		quota.Holds = held
+		return false, errMaxLimitExceeded
+	}
+	if overLimit {
+		return true, errOverLimitMonitored
+	}
+	return true, nil
+}
+
+// trackUsage tracks the usage of the user once their quota is written
+func trackUsage(ctx context.Context, user string, userQuota *UserQuota) {
+	limit := effectiveLimit(ctx, user, userQuota)
+	usage.track(user, len(userQuota.Objects), limit)
+	projectExhaustion(ctx, user, userQuota, limit)
+}
+
+// applyQuotaEvents applies the events of the user in order on the user quota on all the
+// s3clients configured, writing the quota once per site; returns the error of each event, the
+// failures of the sites before the rejections over the limit
+func applyQuotaEvents(ctx context.Context, user string, events []*quotaEvent) []error {
+	var mu sync.Mutex
+	results := make([][]error, len(sites))
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
+		index := index
+		g.Go(func() error {
+			return writeSite(ctx, sites[index], func(ctx context.Context, s3Client ObjectStore) error {
+				errs, err := applyLatestQuotaEvents(ctx, s3Client, user, events)
+				if err != nil {
+					return err
+				}
+				invalidateManifest(sites[index], user)
+				mu.Lock()
+				results[index] = errs
+				mu.Unlock()
+				return nil
+			})
+		}, index)
+	}
+	siteErrs := g.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	errs := make([]error, len(events))
+	for i := range events {
+		for index := range sites {
+			err := siteErrs[index]
+			if err == nil && results[index] != nil {
+				err = results[index][i]
+			}
+			if err != nil && (errs[i] == nil || errors.Is(errs[i], errOverLimitMonitored)) {
+				errs[i] = err
+			}
+		}
+	}
+	return errs
+}
+
+func applyLatestQuotaEvents(ctx context.Context, s3Client ObjectStore, user string, events []*quotaEvent) ([]error, error) {
+	host := s3Client.EndpointURL().Host
+	userQuota, etag, err := readUserQuota(ctx, s3Client, user)
+	missing := false
+	if err != nil {
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			logf(ctx, "ERROR", host, "unable to GET the manifest for user '%v'; %v", user, err)
+			return nil, fmt.Errorf("user quota cannot be read; %v", err)
+		}
+		userQuota, missing = NewUserQuota(), true
+	} else if etag == "" {
+		logf(ctx, "ERROR", host, "ETag not returned for user quota; user: '%v';", user)
+		return nil, fmt.Errorf("ETag not found in object; %v", err)
+	}
+	updated := userQuota.Refresh()
+	errs := make([]error, len(events))
+	for i, qe := range events {
+		if qe.IsRemoval() {
+			if _, ok := userQuota.Objects[qe.Path]; ok {
+				delete(userQuota.Objects, qe.Path)
+				updated = true
+			}
+			continue
+		}
+		if missing {
+			if err := admitUser(ctx, s3Client, user); err != nil {
+				return nil, err
+			}
+			missing = false
+		}
+		added, err := userQuota.addObject(ctx, host, user, qe.Path, qe.entry(), qe.reservation())
+		updated = updated || added
+		errs[i] = err
+	}
+	if !updated {
+		return errs, nil
+	}
+	if err := updateUserQuota(ctx, s3Client, user, userQuota, etag); err != nil {
+		logf(ctx, "ERROR", host, "unable to update user quota for user '%v'; %v", user, err)
+		return nil, fmt.Errorf("unable to update user quota for user: %v; %v", user, err)
+	}
+	trackUsage(ctx, user, userQuota)
+	return errs, nil
+}
+
+// removeQuota removes the object of the event from the quota on all the s3clients configured
+func removeQuota(ctx context.Context, event *quotaEvent) error {
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
+		index := index
+		g.Go(func() error {
+			return writeSite(ctx, sites[index], func(ctx context.Context, s3Client ObjectStore) error {
+				err := removeLatestUserQuota(ctx, s3Client, event.User, event.Path)
+				if err == nil {
+					invalidateManifest(sites[index], event.User)
+				}
+				return err
+			})
+		}, index)
+	}
+	return g.WaitErr()
+}
+
+func removeLatestUserQuota(ctx context.Context, s3Client ObjectStore, user, path string) error {
+	userQuota, etag, err := readUserQuota(ctx, s3Client, user)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			// Nothing to free
 			return nil
-		} else {
-			userQuota.Objects[path] = struct{}{}
 		}
+		logf(ctx, "ERROR", s3Client.EndpointURL().Host, "unable to GET the manifest for user '%v'; %v", user, err)
+		return fmt.Errorf("user quota cannot be read; %v", err)
 	}
-	if len(userQuota.Objects) > userQuota.MaxLimit {
-		fmt.Printf("[WARNING][%v] unable to update quota; max limit exceeded for user '%v'\n", s3Client.EndpointURL().Host, user)
-		return errMaxLimitExceeded
+	if etag == "" {
+		logf(ctx, "ERROR", s3Client.EndpointURL().Host, "ETag not returned for user quota; user: '%v';", user)
+		return fmt.Errorf("ETag not found in object; %v", err)
+	}
+	updated := userQuota.Refresh()
+	if _, ok := userQuota.Objects[path]; ok {
+		delete(userQuota.Objects, path)
+		updated = true
+	}
+	if !updated {
+		return nil
 	}
 	if err := updateUserQuota(ctx, s3Client, user, userQuota, etag); err != nil {
-		fmt.Printf("[ERROR][%v] unable to update user quota for user '%v'; %v\n", s3Client.EndpointURL().Host, user, err)
+		logf(ctx, "ERROR", s3Client.EndpointURL().Host, "unable to update user quota for user '%v'; %v", user, err)
 		return fmt.Errorf("unable to update user quota for user: %v; %v", user, err)
 	}
+	usage.track(user, len(userQuota.Objects), effectiveLimit(ctx, user, userQuota))
 	return nil
 }
 
-// checkQuota asks the s3clients to know if the userquota exceeded or not
+// adjustQuota adds and removes the provided object paths on the user quota on all the s3clients configured
+func adjustQuota(ctx context.Context, user string, add map[string]quotaEntry, remove []string) error {
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
+		index := index
+		g.Go(func() error {
+			return writeSite(ctx, sites[index], func(ctx context.Context, s3Client ObjectStore) error {
+				err := adjustLatestUserQuota(ctx, s3Client, user, add, remove)
+				if err == nil {
+					invalidateManifest(sites[index], user)
+				}
+				return err
+			})
+		}, index)
+	}
+	return g.WaitErr()
+}
+
+func adjustLatestUserQuota(ctx context.Context, s3Client ObjectStore, user string, add map[string]quotaEntry, remove []string) error {
+	userQuota, etag, err := readUserQuota(ctx, s3Client, user)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			logf(ctx, "ERROR", s3Client.EndpointURL().Host, "unable to GET the manifest for user '%v'; %v", user, err)
+			return fmt.Errorf("user quota cannot be read; %v", err)
+		}
+		if len(add) == 0 {
+			// Nothing to remove from
+			return nil
+		}
+		if err := admitUser(ctx, s3Client, user); err != nil {
+			return err
+		}
+		userQuota = NewUserQuota()
+	}
+	updated := userQuota.Refresh()
+	for path, entry := range add {
+		if _, ok := userQuota.Objects[path]; !ok {
+			userQuota.Objects[path] = entry
+			updated = true
+		}
+	}
+	for _, path := range remove {
+		if _, ok := userQuota.Objects[path]; ok {
+			delete(userQuota.Objects, path)
+			updated = true
+		}
+	}
+	if !updated {
+		return nil
+	}
+	if err := updateUserQuota(ctx, s3Client, user, userQuota, etag); err != nil {
+		logf(ctx, "ERROR", s3Client.EndpointURL().Host, "unable to update user quota for user '%v'; %v", user, err)
+		return fmt.Errorf("unable to update user quota for user: %v; %v", user, err)
+	}
+	usage.track(user, len(userQuota.Objects), effectiveLimit(ctx, user, userQuota))
+	return nil
+}
+
+// checkQuota asks the s3clients to know if the userquota exceeded or not, opening an incident
+// while all the sites are unreachable
 func checkQuota(ctx context.Context, user string) error {
-	g := errgroup.WithNErrs(len(s3Clients))
-	for index := range s3Clients {
+	if err := blocked.check(ctx, user); err != nil {
+		return err
+	}
+	err := checkSitesQuota(ctx, user)
+	if errors.Is(err, errSitesUnreachable) {
+		incidents.trigger(ctx, incidentSitesUnreachable, "quota-server is unable to reach any MinIO site", map[string]interface{}{
+			"error": err.Error(),
+		})
+	} else {
+		incidents.resolve(ctx, incidentSitesUnreachable)
+	}
+	return err
+}
+
+// checkSitesQuota checks the userquota on the sites by the read preference; the user quotas
+// found diverged across the sites are read-repaired by READ_REPAIR
+func checkSitesQuota(ctx context.Context, user string) error {
+	if readPreference != readPreferenceAll {
+		if checkHedgeDelay > 0 {
+			return checkQuotaHedged(ctx, user)
+		}
+		return checkQuotaWithFailover(ctx, user)
+	}
+	quotas := make([]*UserQuota, len(sites))
+	read := make([]bool, len(sites))
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
 		index := index
 		g.Go(func() (err error) {
-			if s3Clients[index] == nil {
-				return errors.New("s3Client is nil")
-			}
-			userQuota, _, err := readUserQuota(ctx, s3Clients[index], user)
-			if err != nil {
-				if minio.ToErrorResponse(err).Code != "NoSuchKey" {
-					// new user
-					return nil
-				}
-				return fmt.Errorf("unable to GET user quota; %v", err)
-			}
-			userQuota.Refresh()
-			if len(userQuota.Objects) >= userQuota.MaxLimit {
-				return errMaxLimitExceeded
+			if quotas[index], err = readCheckedQuota(ctx, sites[index], user); err != nil {
+				return err
 			}
-			return nil
+			read[index] = true
+			return checkUserQuota(ctx, user, quotas[index])
 		}, index)
 	}
-	var finalErr error
-	for _, err := range g.Wait() {
+	errs := g.Wait()
+	if readRepairMode != readRepairOff && diverged(quotas, read) {
+		readRepair(ctx, user)
+	}
+	var (
+		finalErr error
+		failed   int
+	)
+	for _, err := range errs {
 		if err != nil {
 			if errors.Is(err, errMaxLimitExceeded) {
 				return err
 			}
 			finalErr = err
+			failed++
 		}
 	}
+	if failed == len(sites) {
+		return fmt.Errorf("%w; %v", errSitesUnreachable, finalErr)
+	}
 	return finalErr
 }
 
-// refreshQuota lists and refreshes the quota on all the s3clients configured
-func refreshQuota(ctx context.Context) error {
-	refreshUserQuota := func(s3Client *minio.Client, user string) error {
+// checkQuotaWithFailover checks the userquota on one site picked by the read preference,
+// falling back to the other sites if it fails
+func checkQuotaWithFailover(ctx context.Context, user string) (err error) {
+	for _, site := range readOrder() {
+		err = checkSiteQuota(ctx, site, user)
+		if err == nil || errors.Is(err, errMaxLimitExceeded) {
+			return err
+		}
+		logf(ctx, "WARNING", site.name, "unable to check quota for user '%v'; trying the next site; %v", user, err)
+	}
+	return fmt.Errorf("%w; %v", errSitesUnreachable, err)
+}
+
+// checkSiteQuota checks if the userquota exceeded or not on the provided site
+func checkSiteQuota(ctx context.Context, site *site, user string) error {
+	userQuota, err := readCheckedQuota(ctx, site, user)
+	if err != nil {
+		return err
+	}
+	return checkUserQuota(ctx, user, userQuota)
+}
+
+// checkUserQuota checks if the user quota read by a check exceeded or not; nil for a new user
+func checkUserQuota(ctx context.Context, user string, userQuota *UserQuota) error {
+	if userQuota == nil {
+		return nil
+	}
+	limit := effectiveLimit(ctx, user, userQuota)
+	usage.track(user, len(userQuota.Objects), limit)
+	if len(userQuota.Objects)+userQuota.held() >= limit {
+		return errMaxLimitExceeded
+	}
+	return nil
+}
+
+// readCheckedQuota reads the refreshed user quota of the site for a check, from the cache if
+// present; nil for a new user
+func readCheckedQuota(ctx context.Context, site *site, user string) (*UserQuota, error) {
+	if site.Client() == nil {
+		return nil, errors.New("s3Client is nil")
+	}
+	if cachedMissingManifest(site, user) {
+		return nil, nil
+	}
+	userQuota, ok := cachedManifest(site, user)
+	if ok {
+		userQuota.Refresh()
+		return userQuota, nil
+	}
+	start := time.Now()
+	userQuota, etag, err := readUserQuota(ctx, site.Client(), user)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			// new user
+			site.recordLatency(time.Since(start))
+			cacheMissingManifest(site, user)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to GET user quota; %v", err)
+	}
+	site.recordLatency(time.Since(start))
+	if userQuota.Refresh() && lazyRefresh && etag != "" {
+		go persistRefreshedQuota(ctx, site, user, userQuota.clone(), etag)
+	}
+	cacheManifest(site, user, userQuota)
+	return userQuota, nil
+}
+
+// persistRefreshedQuota writes back the user quota refreshed on read, so that the stale
+// objects are pruned without waiting for the bucket-wide refresh; a concurrent update
+// of the quota wins over it
+func persistRefreshedQuota(ctx context.Context, site *site, user string, userQuota *UserQuota, etag string) {
+	if err := updateUserQuota(ctx, site.Client(), user, userQuota, etag); err != nil {
+		logf(ctx, "WARNING", site.name, "unable to persist the refreshed quota for user '%v'; %v", user, err)
+		return
+	}
+	logf(ctx, "LOG", site.name, "refreshed quota for user '%v'", user)
+}
+
+// refreshQuota lists and refreshes the quota on the targeted s3clients
+func refreshQuota(ctx context.Context, targets siteTargets, filter userFilter) error {
+	refreshUserQuota := func(site *site, user string) error {
+		s3Client := site.Client()
 		userQuota, etag, err := readUserQuota(ctx, s3Client, user)
 		if err != nil {
-			fmt.Printf("[ERROR] unable to read user quota for user '%v'; %v\n", user, err)
+			if !filter.isZero() && minio.ToErrorResponse(err).Code == "NoSuchKey" {
+				// a user of the filter without a quota
+				return nil
+			}
+			logf(ctx, "ERROR", s3Client.EndpointURL().Host, "unable to read user quota for user '%v'; %v", user, err)
 			return fmt.Errorf("unable to read user quota for user '%v'; %v\n", user, err)
 		}
 		if etag == "" {
-			fmt.Printf("[ERROR] ETag not returned for user quota; user: '%v';", user)
+			logf(ctx, "ERROR", s3Client.EndpointURL().Host, "ETag not returned for user quota; user: '%v';", user)
 			return fmt.Errorf("ETag not found in object; %v", err)
 		}
 		if userQuota.Refresh() {
+			if targets.isDry(site) {
+				logf(ctx, "LOG", site.name, "[dry-run] would prune %v expired objects from the quota of user '%v'", len(userQuota.pruned), user)
+				return nil
+			}
 			if err := updateUserQuota(ctx, s3Client, user, userQuota, etag); err != nil {
-				fmt.Printf("[ERROR] unable to update user quota for user '%v'; %v\n", user, err)
+				logf(ctx, "ERROR", s3Client.EndpointURL().Host, "unable to update user quota for user '%v'; %v", user, err)
 				return fmt.Errorf("unable to update user quota for user '%v'; %v\n", user, err)
 			}
 		}
+		usage.track(user, len(userQuota.Objects), effectiveLimit(ctx, user, userQuota))
 		return nil
 	}
 
-	g := errgroup.WithNErrs(len(s3Clients))
-	for index := range s3Clients {
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
 		index := index
 		g.Go(func() (err error) {
-			if s3Clients[index] == nil {
+			if !targets.includes(sites[index]) {
+				return nil
+			}
+			if sites[index].Client() == nil {
 				return errors.New("s3Client is nil")
 			}
-			for object := range s3Clients[index].ListObjects(ctx, quotaBucket, minio.ListObjectsOptions{}) {
+			s3Client := sites[index].Client()
+			// the checkpoint is of the refreshes of all the users only
+			checkpointed := filter.isZero() && !targets.isDry(sites[index])
+			var checkpoint *jobProgress
+			if filter.isZero() {
+				if checkpoint, err = readCheckpoint(ctx, s3Client, refreshCheckpointKey); err != nil {
+					logf(ctx, "ERROR", sites[index].name, "unable to read the refresh checkpoint; %v", err)
+					return fmt.Errorf("unable to read the refresh checkpoint; %v", err)
+				}
+			}
+			opts := minio.ListObjectsOptions{}
+			if checkpoint != nil {
+				logf(ctx, "LOG", sites[index].name, "resuming refresh after '%v'", checkpoint.LastKey)
+				opts.StartAfter = checkpoint.LastKey
+			}
+			jobs.start("refresh", sites[index].name, checkpoint)
+
+			wk, err := workers.New(refreshWorkers)
+			if err != nil {
+				return err
+			}
+			// the users are refreshed concurrently, so the checkpoint is persisted
+			// only after all the users of the batch are done, and never past a user
+			// failing to be refreshed, so that a resumed refresh retries them
+			var (
+				batch    []string
+				mu       sync.Mutex
+				failed   = map[string]bool{}
+				failures int
+				stalled  bool
+			)
+			completeBatch := func(persist bool) {
+				wk.Wait()
+				if len(batch) == 0 {
+					return
+				}
+				progress := jobs.advance("refresh", sites[index].name, batch[len(batch)-1], len(batch))
+				first := len(batch)
+				mu.Lock()
+				for i, key := range batch {
+					if failed[key] {
+						first = i
+						break
+					}
+				}
+				failed = map[string]bool{}
+				mu.Unlock()
+				batchFailed := first < len(batch)
+				if batchFailed {
+					progress.Processed -= len(batch) - first
+					progress.LastKey = ""
+					if first > 0 {
+						progress.LastKey = batch[first-1]
+					}
+				}
+				batch = batch[:0]
+				if !persist || !checkpointed || stalled {
+					return
+				}
+				// the checkpoint stays before the first failed user for the rest of the run
+				stalled = batchFailed
+				if progress.LastKey == "" {
+					return
+				}
+				if err := writeCheckpoint(ctx, s3Client, refreshCheckpointKey, progress); err != nil {
+					logf(ctx, "WARNING", sites[index].name, "unable to persist the refresh checkpoint; %v", err)
+				}
+			}
+			for object := range filter.listQuotas(ctx, s3Client, opts) {
 				if object.Err != nil {
-					fmt.Printf("[ERROR] unable to list objects from '%v' bucket; %v\n", quotaBucket, object.Err)
+					logf(ctx, "ERROR", sites[index].name, "unable to list objects from '%v' bucket; %v", quotaBucket, object.Err)
+					completeBatch(true)
 					return fmt.Errorf("unable to list objects; %v", object.Err)
 				}
+				if !strings.HasSuffix(object.Key, quotaExt) {
+					continue
+				}
 				user := strings.TrimSuffix(object.Key, quotaExt)
-				var err error
-				for attempts := 1; attempts <= retryAttempts; attempts++ {
-					err = refreshUserQuota(s3Clients[index], user)
-					if err == nil {
-						fmt.Printf("[LOG] refreshed quota for user '%v'\n", user)
-						break
+				wk.Take()
+				key := object.Key
+				go func() {
+					defer wk.Give()
+					err := defaultRetry.do(ctx, func() error {
+						err := refreshUserQuota(sites[index], user)
+						if err != nil {
+							logf(ctx, "ERROR", sites[index].name, "%v", err)
+							return err
+						}
+						invalidateManifest(sites[index], user)
+						logf(ctx, "LOG", sites[index].name, "refreshed quota for user '%v'", user)
+						return nil
+					})
+					if err != nil {
+						mu.Lock()
+						failed[key] = true
+						failures++
+						mu.Unlock()
 					}
-					fmt.Println("[ERROR] " + err.Error())
-					time.Sleep(retryTimeout)
+				}()
+				batch = append(batch, object.Key)
+				if len(batch) == checkpointInterval {
+					completeBatch(true)
 				}
 			}
+			completeBatch(false)
+			jobs.finish("refresh", sites[index].name)
+			if failures > 0 {
+				// the checkpoint is kept, so that the next refresh resumes before the failed users
+				return fmt.Errorf("unable to refresh the quota of %v users", failures)
+			}
+			if !checkpointed {
+				return nil
+			}
+			if err := removeCheckpoint(ctx, s3Client, refreshCheckpointKey); err != nil {
+				logf(ctx, "WARNING", sites[index].name, "unable to remove the refresh checkpoint; %v", err)
+			}
 			return nil
 		}, index)
 	}
@@ -261,39 +867,63 @@ func refreshQuota(ctx context.Context) error {
 	return g.WaitErr()
 }
 
-// purge purges expired data objects on all the configured s3 clients
-func purge(ctx context.Context) error {
-	g := errgroup.WithNErrs(len(s3Clients))
-	for index := range s3Clients {
+// purge purges expired data objects on the targeted s3 clients; on the sites with the object
+// locking of the data bucket enabled, the versions under a legal hold or retention are skipped
+// and reported
+func purge(ctx context.Context, targets siteTargets, bypassGovernance bool) (*purgeReport, error) {
+	report := &purgeReport{}
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
 		index := index
 		g.Go(func() (err error) {
-			if s3Clients[index] == nil {
+			if !targets.includes(sites[index]) {
+				return nil
+			}
+			if sites[index].Client() == nil {
 				return errors.New("s3Client is nil")
 			}
-			for object := range s3Clients[index].ListObjects(context.Background(), dataBucket, minio.ListObjectsOptions{}) {
+			core := sites[index].Core()
+			locked := core != nil && dataBucketLocked(ctx, core)
+			for object := range sites[index].Client().ListObjects(ctx, dataBucket, minio.ListObjectsOptions{}) {
 				if object.Err != nil {
-					fmt.Printf("[ERROR] unable to list objects from '%v' bucket; %v\n", dataBucket, object.Err)
+					logf(ctx, "ERROR", sites[index].name, "unable to list objects from '%v' bucket; %v", dataBucket, object.Err)
 					return fmt.Errorf("unable to list objects; %v", object.Err)
 				}
 				key := strings.TrimSuffix(object.Key, "/")
 				t, err := time.Parse(dateFormat, key)
 				if err != nil {
-					fmt.Printf("[ERROR] unable to parse key '%v'; %v\n", key, err)
+					logf(ctx, "ERROR", sites[index].name, "unable to parse key '%v'; %v", key, err)
 					continue
 				}
-				if getCurrentDateInUTC().After(t.UTC()) {
-					if err := s3Clients[index].RemoveObject(context.Background(), dataBucket, key, minio.RemoveObjectOptions{
-						ForceDelete: true,
+				if isExpired(t) && targets.isDry(sites[index]) {
+					report.purged()
+					logf(ctx, "LOG", sites[index].name, "[dry-run] would purge '%v/%v'", dataBucket, key)
+				} else if isExpired(t) && locked {
+					purged, err := purgeLockedPrefix(ctx, sites[index], core, key, bypassGovernance, report)
+					if err != nil {
+						logf(ctx, "ERROR", sites[index].name, "unable to purge '%v/%v'; %v", dataBucket, key, err)
+						continue
+					}
+					if purged {
+						report.purged()
+						logf(ctx, "LOG", sites[index].name, "purged '%v/%v'", dataBucket, key)
+					}
+				} else if isExpired(t) {
+					if err := defaultRetry.do(ctx, func() error {
+						return sites[index].Client().RemoveObject(ctx, dataBucket, key, minio.RemoveObjectOptions{
+							ForceDelete: true,
+						})
 					}); err != nil {
-						fmt.Printf("[ERROR] unable to delete the object from source: '%v/%v'; %v\n", dataBucket, key, err)
+						logf(ctx, "ERROR", sites[index].name, "unable to delete the object from source: '%v/%v'; %v", dataBucket, key, err)
 						continue
 					}
-					fmt.Printf("[LOG] purged '%v/%v'\n", dataBucket, key)
+					report.purged()
+					logf(ctx, "LOG", sites[index].name, "purged '%v/%v'", dataBucket, key)
 				}
 			}
 			return nil
 		}, index)
 	}
-	return g.WaitErr()
+	return report, g.WaitErr()
 
 }
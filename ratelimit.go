@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minio/pkg/env"
+)
+
+var (
+	errRateLimited = errors.New("too many update events for the user")
+
+	// userRateLimiter caps the update events per user; nil if USER_EVENT_RATE is not set
+	userRateLimiter *rateLimiter
+)
+
+// rateLimiter is a token bucket per user, refilled at the rate up to the burst
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// initRateLimiter reads the per-user rate limit of the update events
+func initRateLimiter() error {
+	value := env.Get("USER_EVENT_RATE", "")
+	if value == "" {
+		return nil
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate <= 0 {
+		return errors.New("USER_EVENT_RATE env must be a number greater than 0")
+	}
+	burst, err := env.GetInt("USER_EVENT_BURST", int(math.Ceil(rate)))
+	if err != nil {
+		return err
+	}
+	if burst <= 0 {
+		return errors.New("USER_EVENT_BURST env must be greater than 0")
+	}
+	userRateLimiter = &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+	}
+	return nil
+}
+
+// allow takes a token of the user, returning false if they are out of tokens
+func (l *rateLimiter) allow(user string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	bucket, ok := l.buckets[user]
+	if !ok {
+		if len(l.buckets) >= 10000 {
+			l.evict(now)
+		}
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[user] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// evict drops the buckets refilled up to the burst, which are the same as new ones
+func (l *rateLimiter) evict(now time.Time) {
+	for user, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, user)
+		}
+	}
+}
+
+// retryAfter returns the seconds until the rate limited user gets a token back
+func (l *rateLimiter) retryAfter() int {
+	return int(math.Ceil(1 / l.rate))
+}
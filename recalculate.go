@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/pkg/sync/errgroup"
+)
+
+// recalculateQuota rebuilds the user quota on the targeted s3clients from the objects of the
+// user in their data bucket, replacing the stored objects
+func recalculateQuota(ctx context.Context, user string, targets siteTargets) error {
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
+		index := index
+		g.Go(func() (err error) {
+			if !targets.includes(sites[index]) {
+				return nil
+			}
+			if sites[index].Client() == nil {
+				return errors.New("s3Client is nil")
+			}
+			return defaultRetry.do(ctx, func() error {
+				err := recalculateSiteQuota(ctx, sites[index], user, targets.isDry(sites[index]))
+				if err != nil {
+					logf(ctx, "ERROR", sites[index].name, "%v", err)
+					return err
+				}
+				invalidateManifest(sites[index], user)
+				return nil
+			})
+		}, index)
+	}
+	return g.WaitErr()
+}
+
+func recalculateSiteQuota(ctx context.Context, site *site, user string, dryRun bool) error {
+	s3Client := site.Client()
+	objects, err := listUserObjects(ctx, site, user)
+	if err != nil {
+		return err
+	}
+	userQuota, etag, err := readUserQuota(ctx, s3Client, user)
+	if err != nil {
+		if !errors.Is(err, errManifestCorrupted) && !errors.Is(err, errManifestUnparsable) && minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			return fmt.Errorf("unable to read user quota for user '%v'; %v", user, err)
+		}
+		userQuota = NewUserQuota()
+	}
+	var added, removed int
+	for path := range objects {
+		if _, ok := userQuota.Objects[path]; !ok {
+			added++
+		}
+	}
+	for path := range userQuota.Objects {
+		if _, ok := objects[path]; !ok {
+			removed++
+		}
+	}
+	incidents.checkDrift(ctx, site.name, user, added, removed)
+	if dryRun {
+		logf(ctx, "LOG", site.name, "[dry-run] would recalculate quota for user '%v' with %v objects, adding %v and removing %v", user, len(objects), added, removed)
+		return nil
+	}
+	userQuota.Objects = objects
+	if err := updateUserQuota(ctx, s3Client, user, userQuota, etag); err != nil {
+		return fmt.Errorf("unable to update user quota for user '%v'; %v", user, err)
+	}
+	usage.track(user, len(userQuota.Objects), effectiveLimit(ctx, user, userQuota))
+	logf(ctx, "LOG", site.name, "recalculated quota for user '%v' with %v objects", user, len(objects))
+	return nil
+}
+
+// listUserObjects lists the objects DATE/USER/object of the user in the data bucket of the
+// site, for the dates which are not expired yet
+func listUserObjects(ctx context.Context, site *site, user string) (map[string]quotaEntry, error) {
+	s3Client := site.Client()
+	objects := map[string]quotaEntry{}
+	for prefix := range s3Client.ListObjects(ctx, dataBucket, minio.ListObjectsOptions{}) {
+		if prefix.Err != nil {
+			logf(ctx, "ERROR", site.name, "unable to list objects from '%v' bucket; %v", dataBucket, prefix.Err)
+			return nil, fmt.Errorf("unable to list objects; %v", prefix.Err)
+		}
+		date := strings.TrimSuffix(prefix.Key, "/")
+		t, err := time.Parse(dateFormat, date)
+		if err != nil || isExpired(t) {
+			continue
+		}
+		prefix := date + "/" + user + "/"
+		if canonicalUsers() {
+			// the objects of the user may be under any of the names canonicalized to it
+			prefix = date + "/"
+		}
+		for object := range s3Client.ListObjects(ctx, dataBucket, minio.ListObjectsOptions{
+			Prefix:    prefix,
+			Recursive: true,
+		}) {
+			if object.Err != nil {
+				logf(ctx, "ERROR", site.name, "unable to list objects from '%v' bucket; %v", dataBucket, object.Err)
+				return nil, fmt.Errorf("unable to list objects; %v", object.Err)
+			}
+			if tokens := strings.Split(object.Key, "/"); len(tokens) < 3 || canonicalUser(tokens[1]) != user {
+				continue
+			}
+			objects[object.Key] = quotaEntry{
+				Size:      object.Size,
+				EventTime: object.LastModified.UTC(),
+				ETag:      object.ETag,
+			}
+		}
+	}
+	return objects, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRecalculateQuotaDryRun(t *testing.T) {
+	setupTestSites(t, 2)
+	ctx := context.Background()
+	// counted without an object in the data bucket
+	if err := processEvent(ctx, testEvent("s3:ObjectCreated:Put", "usera", "a")); err != nil {
+		t.Fatal(err)
+	}
+	targets := siteTargets{dry: map[string]bool{"site2": true}}
+	if err := recalculateQuota(ctx, "usera", targets); err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []int{0, 1} {
+		userQuota, _, err := readUserQuota(ctx, sites[i].Client(), "usera")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(userQuota.Objects) != expected {
+			t.Errorf("%v: expected %v objects, got %v", sites[i].name, expected, userQuota.Objects)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/pkg/sync/errgroup"
+)
+
+var (
+	// rejectionFlushInterval is how often the rejections counted in memory are added to the
+	// user quotas of the sites
+	rejectionFlushInterval = 10 * time.Second
+
+	// rejections counts the updates rejected for exceeding the limit until they are flushed
+	rejections = newRejectionCounter()
+)
+
+// rejectionCounter counts the rejected updates in memory by site, user and date, so that a user
+// over the limit does not rewrite their quota on every rejected upload; the counts are added to
+// the user quotas in batches, once per user and site
+type rejectionCounter struct {
+	mu      sync.Mutex
+	pending map[string]map[string]map[string]int
+}
+
+func newRejectionCounter() *rejectionCounter {
+	return &rejectionCounter{pending: map[string]map[string]map[string]int{}}
+}
+
+// initRejections validates REJECTION_FLUSH_INTERVAL and flushes the rejections in the background
+func initRejections(ctx context.Context) (err error) {
+	if rejectionFlushInterval, err = getDurationEnv("REJECTION_FLUSH_INTERVAL", rejectionFlushInterval); err != nil {
+		return err
+	}
+	if rejectionFlushInterval <= 0 {
+		return errors.New("REJECTION_FLUSH_INTERVAL env must be greater than 0")
+	}
+	go rejections.flushLoop(ctx)
+	return nil
+}
+
+// add counts a rejected update of the user today on all the sites
+func (c *rejectionCounter) add(user string) {
+	date := getCurrentDateInUTC().Format(dateFormat)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, site := range sites {
+		c.addLocked(site.name, user, map[string]int{date: 1})
+	}
+}
+
+func (c *rejectionCounter) addLocked(site, user string, counts map[string]int) {
+	users, ok := c.pending[site]
+	if !ok {
+		users = map[string]map[string]int{}
+		c.pending[site] = users
+	}
+	dates, ok := users[user]
+	if !ok {
+		dates = map[string]int{}
+		users[user] = dates
+	}
+	for date, count := range counts {
+		dates[date] += count
+	}
+}
+
+// merge adds the rejections of the user not flushed yet to the site into their quota
+func (c *rejectionCounter) merge(site, user string, quota *UserQuota) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for date, count := range c.pending[site][user] {
+		if quota.Rejections == nil {
+			quota.Rejections = map[string]int{}
+		}
+		quota.Rejections[date] += count
+	}
+}
+
+// take returns the rejections not flushed yet to the site, forgetting them
+func (c *rejectionCounter) take(site string) map[string]map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	users := c.pending[site]
+	delete(c.pending, site)
+	return users
+}
+
+func (c *rejectionCounter) flushLoop(ctx context.Context) {
+	ticker := time.NewTicker(rejectionFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.flush(ctx)
+		}
+	}
+}
+
+// flush adds the rejections counted in memory to the user quotas on all the sites; the counts
+// failing to be written are kept for the next flush
+func (c *rejectionCounter) flush(ctx context.Context) {
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
+		index := index
+		g.Go(func() error {
+			site := sites[index]
+			for user, counts := range c.take(site.name) {
+				user, counts := user, counts
+				err := writeSite(ctx, site, func(ctx context.Context, s3Client ObjectStore) error {
+					if err := flushLatestRejections(ctx, s3Client, user, counts); err != nil {
+						return err
+					}
+					invalidateManifest(site, user)
+					return nil
+				})
+				if err != nil {
+					logf(ctx, "WARNING", site.name, "unable to count the rejections of user '%v'; retrying on the next flush; %v", user, err)
+					c.mu.Lock()
+					c.addLocked(site.name, user, counts)
+					c.mu.Unlock()
+				}
+			}
+			return nil
+		}, index)
+	}
+	g.Wait()
+}
+
+func flushLatestRejections(ctx context.Context, s3Client ObjectStore, user string, counts map[string]int) error {
+	host := s3Client.EndpointURL().Host
+	userQuota, etag, err := readUserQuota(ctx, s3Client, user)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			return fmt.Errorf("user quota cannot be read; %v", err)
+		}
+		// a new user rejected by a limit of 0, admitted when rejected
+		userQuota = NewUserQuota()
+	} else if etag == "" {
+		logf(ctx, "ERROR", host, "ETag not returned for user quota; user: '%v';", user)
+		return fmt.Errorf("ETag not found in object; %v", err)
+	}
+	if userQuota.Rejections == nil {
+		userQuota.Rejections = map[string]int{}
+	}
+	for date, count := range counts {
+		userQuota.Rejections[date] += count
+	}
+	// drops the counts of the days over
+	userQuota.Refresh()
+	if err := updateUserQuota(ctx, s3Client, user, userQuota, etag); err != nil {
+		return fmt.Errorf("unable to update user quota for user: %v; %v", user, err)
+	}
+	usage.trackRejections(user, len(userQuota.Objects), effectiveLimit(ctx, user, userQuota), userQuota.Rejections[getCurrentDateInUTC().Format(dateFormat)])
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRejectionsFlushedInBatches(t *testing.T) {
+	setupTestSites(t, 2)
+	ctx := context.Background()
+	for _, object := range []string{"a", "b", "c"} {
+		if err := processEvent(ctx, testEvent("s3:ObjectCreated:Put", "usera", object)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, etag, err := readUserQuota(ctx, sites[0].Client(), "usera")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, object := range []string{"d", "e"} {
+		if err := processEvent(ctx, testEvent("s3:ObjectCreated:Put", "usera", object)); !errors.Is(err, errMaxLimitExceeded) {
+			t.Fatalf("expected %v, got %v", errMaxLimitExceeded, err)
+		}
+	}
+	today := getCurrentDateInUTC().Format(dateFormat)
+	userQuota, rejectedETag, err := readUserQuota(ctx, sites[0].Client(), "usera")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rejectedETag != etag || len(userQuota.Rejections) != 0 {
+		t.Fatalf("expected the rejections not to rewrite the quota, got %v", userQuota.Rejections)
+	}
+	usage, err := readSiteUsage(ctx, sites[0], "usera")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Rejected != 2 {
+		t.Fatalf("expected the 2 rejections not flushed yet to be reported, got %v", usage.Rejected)
+	}
+
+	rejections.flush(ctx)
+	for _, site := range sites {
+		userQuota, _, err := readUserQuota(ctx, site.Client(), "usera")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(userQuota.Objects) != 3 || userQuota.Rejections[today] != 2 {
+			t.Errorf("%v: expected 3 objects and 2 rejections, got %v and %v", site.name, userQuota.Objects, userQuota.Rejections)
+		}
+	}
+	usage, err = readSiteUsage(ctx, sites[0], "usera")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Rejected != 2 {
+		t.Fatalf("expected the 2 rejections flushed to be reported once, got %v", usage.Rejected)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/pkg/env"
+	"github.com/minio/pkg/sync/errgroup"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	readRepairOff    = "off"
+	readRepairInline = "inline"
+	readRepairQueued = "queued"
+)
+
+var (
+	// readRepairMode decides how the user quotas found diverged across the sites by the checks
+	// are merged to the union of the sites
+	readRepairMode = env.Get("READ_REPAIR", readRepairOff)
+	// readRepairDelay is how long the quota of a user must stay diverged across the checks
+	// before it is repaired, so that the writes in flight to the sites are not repaired
+	readRepairDelay = 30 * time.Second
+	// readRepairInterval is the min time between two repairs of the quota of a user
+	readRepairInterval = 10 * time.Minute
+
+	readRepairsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "read_repairs_total",
+		Help:      "Total number of user quotas found diverged by the checks and reconciled across the sites by result",
+	}, []string{"result"})
+
+	// readRepairs queues the users to repair with READ_REPAIR=queued
+	readRepairs = &repairQueue{pending: map[string]bool{}}
+
+	// repairs tracks the users found diverged and repaired
+	repairs = &repairTracker{suspects: map[string]time.Time{}, repaired: map[string]time.Time{}}
+)
+
+func init() {
+	prometheus.MustRegister(readRepairsTotal)
+}
+
+// repairTracker keeps when the quotas of the users were first found diverged, and last repaired
+type repairTracker struct {
+	mu       sync.Mutex
+	suspects map[string]time.Time
+	repaired map[string]time.Time
+	swept    time.Time
+}
+
+// due returns true if the quota of the user found diverged by a check was already found
+// diverged READ_REPAIR_DELAY ago, and was not repaired in the last READ_REPAIR_INTERVAL
+func (t *repairTracker) due(user string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if now.Sub(t.swept) > readRepairInterval {
+		// forget the users which converged by themselves, and the repairs past the interval
+		for user, first := range t.suspects {
+			if now.Sub(first) > readRepairDelay+readRepairInterval {
+				delete(t.suspects, user)
+			}
+		}
+		for user, last := range t.repaired {
+			if now.Sub(last) >= readRepairInterval {
+				delete(t.repaired, user)
+			}
+		}
+		t.swept = now
+	}
+	if last, ok := t.repaired[user]; ok && now.Sub(last) < readRepairInterval {
+		return false
+	}
+	first, ok := t.suspects[user]
+	if !ok || now.Sub(first) > readRepairDelay+readRepairInterval {
+		t.suspects[user] = now
+		return false
+	}
+	if now.Sub(first) < readRepairDelay {
+		return false
+	}
+	delete(t.suspects, user)
+	t.repaired[user] = now
+	return true
+}
+
+// repairQueue is the users waiting for a read-repair, each queued once
+type repairQueue struct {
+	users chan string
+
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+// initReadRepair validates READ_REPAIR and starts the repairs of the queued users in the background
+func initReadRepair(ctx context.Context) (err error) {
+	switch readRepairMode {
+	case readRepairOff:
+		return nil
+	case readRepairInline, readRepairQueued:
+	default:
+		return fmt.Errorf("invalid READ_REPAIR %v", readRepairMode)
+	}
+	if readRepairDelay, err = getDurationEnv("READ_REPAIR_DELAY", readRepairDelay); err != nil {
+		return err
+	}
+	if readRepairInterval, err = getDurationEnv("READ_REPAIR_INTERVAL", readRepairInterval); err != nil {
+		return err
+	}
+	if readRepairDelay < 0 || readRepairInterval < 0 {
+		return errors.New("READ_REPAIR_DELAY and READ_REPAIR_INTERVAL envs must not be negative")
+	}
+	if readRepairMode == readRepairInline {
+		return nil
+	}
+	size, err := env.GetInt("READ_REPAIR_QUEUE_SIZE", 100)
+	if err != nil {
+		return fmt.Errorf("unable to read READ_REPAIR_QUEUE_SIZE env; %v", err)
+	}
+	if size <= 0 {
+		return errors.New("READ_REPAIR_QUEUE_SIZE env must be greater than 0")
+	}
+	readRepairs.users = make(chan string, size)
+	go readRepairs.repairLoop(ctx)
+	return nil
+}
+
+// readRepairWrites gates the writes of the read-repairs, which only report the divergence once it is off
+var readRepairWrites = newFeatureFlag("read-repair-writes", "Reconcile the user quotas found diverged by the read-repairs, instead of only reporting them", true)
+
+// countReadRepair counts a read-repair of a user quota
+func countReadRepair(result string) {
+	readRepairsTotal.WithLabelValues(result).Inc()
+	expRepairs.Add(result, 1)
+	statsd.Count("read_repairs_total", "result:"+result)
+}
+
+// diverged returns true if the sites read hold different objects in the user quota; the sites
+// which could not be read are left out, and a missing quota holds no objects
+func diverged(quotas []*UserQuota, read []bool) bool {
+	var first *UserQuota
+	found := false
+	for index, userQuota := range quotas {
+		if !read[index] {
+			continue
+		}
+		if userQuota == nil {
+			userQuota = &UserQuota{}
+		}
+		if !found {
+			first, found = userQuota, true
+			continue
+		}
+		if len(userQuota.Objects) != len(first.Objects) {
+			return true
+		}
+		for object := range userQuota.Objects {
+			if _, ok := first.Objects[object]; !ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readRepair merges the user quota found diverged by a check across the sites, once it stayed
+// diverged for READ_REPAIR_DELAY; on the path of the check, or queued by READ_REPAIR
+func readRepair(ctx context.Context, user string) {
+	if !repairs.due(user) {
+		return
+	}
+	switch readRepairMode {
+	case readRepairInline:
+		repairUser(ctx, user)
+	case readRepairQueued:
+		readRepairs.enqueue(ctx, user)
+	}
+}
+
+// repairUser re-reads the user quota of all the sites, bypassing the cache, and merges them to
+// the union of their objects and holds, written to every site
+func repairUser(ctx context.Context, user string) {
+	quotas := make([]*UserQuota, len(sites))
+	read := make([]bool, len(sites))
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
+		index := index
+		g.Go(func() error {
+			if sites[index].Client() == nil {
+				return errors.New("s3Client is nil")
+			}
+			userQuota, _, err := readUserQuota(ctx, sites[index].Client(), user)
+			if err != nil && minio.ToErrorResponse(err).Code != "NoSuchKey" {
+				return fmt.Errorf("unable to read the quota from '%v'; %v", sites[index].name, err)
+			}
+			if userQuota != nil {
+				userQuota.Refresh()
+			}
+			quotas[index], read[index] = userQuota, true
+			return nil
+		}, index)
+	}
+	if err := g.WaitErr(); err != nil {
+		logf(ctx, "WARNING", "", "unable to read-repair the quota of user '%v'; %v", user, err)
+		countReadRepair("failed")
+		return
+	}
+	if !diverged(quotas, read) {
+		countReadRepair("converged")
+		return
+	}
+	if !readRepairWrites.enabled() {
+		logf(ctx, "WARNING", "", "the quota of user '%v' is diverged across the sites; left to /admin/sync as read-repair-writes is off", user)
+		countReadRepair("diverged")
+		return
+	}
+
+	union := &UserQuota{Objects: map[string]quotaEntry{}, Holds: map[string]quotaHold{}}
+	for _, userQuota := range quotas {
+		if userQuota == nil {
+			continue
+		}
+		for object, entry := range userQuota.Objects {
+			union.Objects[object] = entry
+		}
+		for id, hold := range userQuota.Holds {
+			union.Holds[id] = hold
+		}
+	}
+	written := make([]bool, len(sites))
+	g = errgroup.WithNErrs(len(sites))
+	for index := range sites {
+		index := index
+		g.Go(func() error {
+			return writeSite(ctx, sites[index], func(ctx context.Context, s3Client ObjectStore) (err error) {
+				if written[index], err = mergeLatestUserQuota(ctx, s3Client, user, union); err == nil && written[index] {
+					invalidateManifest(sites[index], user)
+				}
+				return err
+			})
+		}, index)
+	}
+	err := g.WaitErr()
+	repaired := false
+	for _, ok := range written {
+		repaired = repaired || ok
+	}
+	if repaired {
+		logf(ctx, "LOG", "", "read-repaired the quota of user '%v' diverged across the sites", user)
+		countReadRepair("repaired")
+	}
+	if err != nil {
+		logf(ctx, "WARNING", "", "unable to read-repair the quota of user '%v'; %v", user, err)
+		countReadRepair("failed")
+	}
+}
+
+// mergeLatestUserQuota adds the objects and holds of the union missing from the latest user
+// quota of the site, returning true if the quota was written
+func mergeLatestUserQuota(ctx context.Context, s3Client ObjectStore, user string, union *UserQuota) (bool, error) {
+	userQuota, etag, err := readUserQuota(ctx, s3Client, user)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			return false, fmt.Errorf("user quota cannot be read; %v", err)
+		}
+		if err := admitUser(ctx, s3Client, user); err != nil {
+			return false, err
+		}
+		userQuota = NewUserQuota()
+	}
+	updated := userQuota.Refresh()
+	for object, entry := range union.Objects {
+		if _, ok := userQuota.Objects[object]; !ok {
+			userQuota.Objects[object] = entry
+			updated = true
+		}
+	}
+	for id, hold := range union.Holds {
+		if _, ok := userQuota.Holds[id]; !ok {
+			if userQuota.Holds == nil {
+				userQuota.Holds = map[string]quotaHold{}
+			}
+			userQuota.Holds[id] = hold
+			updated = true
+		}
+	}
+	if !updated {
+		return false, nil
+	}
+	if err := updateUserQuota(ctx, s3Client, user, userQuota, etag); err != nil {
+		return false, fmt.Errorf("unable to update user quota for user: %v; %v", user, err)
+	}
+	usage.track(user, len(userQuota.Objects), effectiveLimit(ctx, user, userQuota))
+	return true, nil
+}
+
+// enqueue queues the user for a repair unless already queued; dropped if the queue is full,
+// to be found diverged again by a later check
+func (q *repairQueue) enqueue(ctx context.Context, user string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending[user] {
+		return
+	}
+	select {
+	case q.users <- user:
+		q.pending[user] = true
+	default:
+		logf(ctx, "WARNING", "", "dropping the read-repair of user '%v'; too many repairs queued", user)
+		countReadRepair("dropped")
+	}
+}
+
+func (q *repairQueue) repairLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case user := <-q.users:
+			q.mu.Lock()
+			delete(q.pending, user)
+			q.mu.Unlock()
+			repairUser(ctx, user)
+		}
+	}
+}
+
+// drain empties the queue, returning the users waiting for a repair
+func (q *repairQueue) drain() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var users []string
+	for {
+		select {
+		case user := <-q.users:
+			delete(q.pending, user)
+			users = append(users, user)
+		default:
+			return users
+		}
+	}
+}
+
+// depth returns the number of the users waiting for a repair
+func (q *repairQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"testing"
+	"time"
+)
+
+func TestRepairTrackerDue(t *testing.T) {
+	savedDelay, savedInterval := readRepairDelay, readRepairInterval
+	t.Cleanup(func() { readRepairDelay, readRepairInterval = savedDelay, savedInterval })
+	readRepairDelay, readRepairInterval = 20*time.Millisecond, time.Hour
+
+	tracker := &repairTracker{suspects: map[string]time.Time{}, repaired: map[string]time.Time{}}
+	if tracker.due("usera") {
+		t.Fatal("expected the first divergence not to be repaired")
+	}
+	if tracker.due("usera") {
+		t.Fatal("expected a divergence younger than the delay not to be repaired")
+	}
+	time.Sleep(readRepairDelay)
+	if !tracker.due("usera") {
+		t.Fatal("expected a divergence older than the delay to be repaired")
+	}
+	time.Sleep(readRepairDelay)
+	tracker.due("usera")
+	if tracker.due("usera") {
+		t.Fatal("expected a user repaired within the interval not to be repaired again")
+	}
+}
+
+func TestRepairUser(t *testing.T) {
+	setupTestSites(t, 2)
+	ctx := context.Background()
+	date := getCurrentDateInUTC().Format(dateFormat)
+	kept, first, second := date+"/usera/kept", date+"/usera/first", date+"/usera/second"
+
+	// each site missed an event the other counted, and site2 missed a reservation
+	if err := adjustLatestUserQuota(ctx, sites[0].Client(), "usera", map[string]quotaEntry{kept: {}, first: {}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := adjustLatestUserQuota(ctx, sites[1].Client(), "usera", map[string]quotaEntry{kept: {}, second: {}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	userQuota, etag, err := readUserQuota(ctx, sites[0].Client(), "usera")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userQuota.Holds = map[string]quotaHold{"hold": {Objects: 1, Expires: time.Now().Add(time.Hour)}}
+	if err := updateUserQuota(ctx, sites[0].Client(), "usera", userQuota, etag); err != nil {
+		t.Fatal(err)
+	}
+
+	repaired := func() int64 {
+		if count, ok := expRepairs.Get("repaired").(*expvar.Int); ok {
+			return count.Value()
+		}
+		return 0
+	}
+	before := repaired()
+	repairUser(ctx, "usera")
+	for _, site := range sites {
+		userQuota, _, err := readUserQuota(ctx, site.Client(), "usera")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(userQuota.Objects) != 3 || len(userQuota.Holds) != 1 {
+			t.Errorf("%v: expected the union of the objects and holds, got %v and %v", site.name, userQuota.Objects, userQuota.Holds)
+		}
+	}
+	if repaired() != before+1 {
+		t.Fatalf("expected 1 repair counted, got %v", repaired()-before)
+	}
+	repairUser(ctx, "usera")
+	if repaired() != before+1 {
+		t.Fatalf("expected the converged quota not to be counted as repaired, got %v", repaired()-before)
+	}
+}
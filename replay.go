@@ -0,0 +1,149 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// runReplay applies the notifications archived within the date range again, oldest first;
+// the paths already counted in the quotas are skipped, so a replay is idempotent
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	from := fs.String("from", "", "first date of the archive to replay, e.g. 2024-Jan-01")
+	to := fs.String("to", "", "last date of the archive to replay; defaults to the first date")
+	fs.BoolVar(&dryRun, "dry-run", false, "list the archived notifications without applying them")
+	fs.Parse(args)
+
+	if *from == "" {
+		return errors.New("-from is required")
+	}
+	if *to == "" {
+		*to = *from
+	}
+	fromDate, err := time.Parse(dateFormat, *from)
+	if err != nil {
+		return fmt.Errorf("invalid -from %v; %v", *from, err)
+	}
+	toDate, err := time.Parse(dateFormat, *to)
+	if err != nil {
+		return fmt.Errorf("invalid -to %v; %v", *to, err)
+	}
+	if toDate.Before(fromDate) {
+		return errors.New("-to must not be before -from")
+	}
+
+	ctx := context.Background()
+	if err := loadConfig(); err != nil {
+		return err
+	}
+	if err := connectSites(ctx); err != nil {
+		return err
+	}
+	if err := initLimitProviders(); err != nil {
+		return err
+	}
+	if err := initHistory(); err != nil {
+		return err
+	}
+	if err := initBilling(); err != nil {
+		return err
+	}
+	if err := initBlocklist(ctx); err != nil {
+		return fmt.Errorf("unable to load the blocklist; %v", err)
+	}
+
+	var replayed, failed int
+	for date := fromDate; !date.After(toDate); date = date.AddDate(0, 0, 1) {
+		objects, err := listArchive(ctx, date)
+		if err != nil {
+			return err
+		}
+		for _, object := range objects {
+			payload, err := readArchive(ctx, object)
+			if err != nil {
+				return err
+			}
+			for _, record := range payload.Records {
+				if dryRun {
+					fmt.Printf("%v: %v %v\n", object.Key, record.EventName, record.S3.Object.Key)
+					continue
+				}
+				if err := processEvent(ctx, record); err != nil {
+					logf(ctx, "ERROR", "", "unable to replay '%v' from '%v'; %v", record.S3.Object.Key, object.Key, err)
+					failed++
+					continue
+				}
+				replayed++
+			}
+		}
+	}
+	fmt.Printf("Replayed %v events (%v failed)\n", replayed, failed)
+	if failed > 0 {
+		return fmt.Errorf("unable to replay %v events", failed)
+	}
+	return nil
+}
+
+// archivedObject represents an archived notification payload on a site
+type archivedObject struct {
+	Key          string
+	LastModified time.Time
+	site         *site
+}
+
+// listArchive lists the notifications archived on the date across the sites, oldest first
+func listArchive(ctx context.Context, date time.Time) ([]archivedObject, error) {
+	seen := map[string]archivedObject{}
+	prefix := archivePrefix + date.Format(dateFormat) + "/"
+	for _, site := range sites {
+		for object := range site.Client().ListObjects(ctx, quotaBucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+			if object.Err != nil {
+				return nil, fmt.Errorf("unable to list the archive on %v; %v", site.name, object.Err)
+			}
+			if !strings.HasSuffix(object.Key, ".json.gz") {
+				continue
+			}
+			if _, ok := seen[object.Key]; !ok {
+				seen[object.Key] = archivedObject{Key: object.Key, LastModified: object.LastModified, site: site}
+			}
+		}
+	}
+	objects := make([]archivedObject, 0, len(seen))
+	for _, object := range seen {
+		objects = append(objects, object)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		if !objects[i].LastModified.Equal(objects[j].LastModified) {
+			return objects[i].LastModified.Before(objects[j].LastModified)
+		}
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+// readArchive reads the archived notification payload
+func readArchive(ctx context.Context, object archivedObject) (*notificationPayload, error) {
+	reader, _, err := object.site.Client().ReadObject(ctx, quotaBucket, object.Key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read '%v' from %v; %v", object.Key, object.site.name, err)
+	}
+	defer reader.Close()
+	zr, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress '%v'; %v", object.Key, err)
+	}
+	var payload notificationPayload
+	if err := json.NewDecoder(zr).Decode(&payload); err != nil {
+		return nil, fmt.Errorf("unable to parse '%v'; %v", object.Key, err)
+	}
+	return &payload, nil
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/pkg/sync/errgroup"
+	"github.com/rs/xid"
+)
+
+// reservationMetadataKey is the user metadata of the objects uploaded under a reservation, holding
+// the id of the reservation whose slot their events take
+const reservationMetadataKey = "Quota-Reservation"
+
+var (
+	errReservationNotFound = errors.New("reservation not found or expired")
+	errReservationExceeded = errors.New("more objects than reserved")
+	// errBytesLimitExceeded is a rejection over the limit, answered and retried as such
+	errBytesLimitExceeded = fmt.Errorf("%w; bytes limit exceeded", errMaxLimitExceeded)
+
+	// reservationTTL is how long a reservation holds its slots unless the request asks otherwise
+	reservationTTL = 5 * time.Minute
+	// reservationMaxTTL is the longest a reservation can hold its slots
+	reservationMaxTTL = time.Hour
+)
+
+// quotaHold represents the slots reserved in the user quota for the uploads to come; the held
+// slots count towards the limit until the hold is committed, released or expires
+type quotaHold struct {
+	Objects int       `json:"objects"`
+	Bytes   int64     `json:"bytes,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// reservation represents a hold returned to the client
+type reservation struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user"`
+	Objects int       `json:"objects"`
+	Bytes   int64     `json:"bytes,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// reservationRequest represents the body of POST /quota/{user}/reserve
+type reservationRequest struct {
+	Objects int    `json:"objects"`
+	Bytes   int64  `json:"bytes"`
+	TTL     string `json:"ttl"`
+}
+
+// commitRequest represents the body of POST /quota/{user}/reserve/{id}/commit
+type commitRequest struct {
+	Paths []string `json:"paths"`
+	// Sizes are the sizes of the paths, counted in the bytes of the user until their events
+	// fill in the entries
+	Sizes map[string]int64 `json:"sizes,omitempty"`
+}
+
+// loadReservationConfig reads the RESERVATION_TTL and RESERVATION_MAX_TTL envs
+func loadReservationConfig() (err error) {
+	if reservationTTL, err = getDurationEnv("RESERVATION_TTL", reservationTTL); err != nil {
+		return err
+	}
+	if reservationMaxTTL, err = getDurationEnv("RESERVATION_MAX_TTL", reservationMaxTTL); err != nil {
+		return err
+	}
+	if reservationTTL <= 0 || reservationTTL > reservationMaxTTL {
+		return fmt.Errorf("RESERVATION_TTL env must be between 0 and RESERVATION_MAX_TTL %v", reservationMaxTTL)
+	}
+	return nil
+}
+
+// held returns the number of the slots held by the reservations not expired yet
+func (quota *UserQuota) held() (objects int) {
+	now := clock.Now()
+	for _, hold := range quota.Holds {
+		if now.Before(hold.Expires) {
+			objects += hold.Objects
+		}
+	}
+	return objects
+}
+
+// heldBytes returns the number of the bytes held by the reservations not expired yet
+func (quota *UserQuota) heldBytes() (bytes int64) {
+	now := clock.Now()
+	for _, hold := range quota.Holds {
+		if now.Before(hold.Expires) {
+			bytes += hold.Bytes
+		}
+	}
+	return bytes
+}
+
+// pruneHolds drops the expired reservations
+func (quota *UserQuota) pruneHolds() (updated bool) {
+	now := clock.Now()
+	for id, hold := range quota.Holds {
+		if !now.Before(hold.Expires) {
+			delete(quota.Holds, id)
+			updated = true
+		}
+	}
+	return updated
+}
+
+// consumeHold takes a slot of the reservation the object was uploaded under, so that an object
+// uploaded under a reservation is not counted twice before it is committed; the reservation is
+// dropped once all its slots are taken. The uploads under no reservation leave the holds alone
+func (quota *UserQuota) consumeHold(id string, size int64) {
+	hold, ok := quota.Holds[id]
+	if id == "" || !ok {
+		return
+	}
+	hold.Objects--
+	if hold.Bytes -= size; hold.Bytes < 0 {
+		hold.Bytes = 0
+	}
+	if hold.Objects <= 0 {
+		delete(quota.Holds, id)
+		return
+	}
+	quota.Holds[id] = hold
+}
+
+// reserveQuota holds the slots in the user quota on all the sites, if the limit of the user, and
+// the bytes limit unless 0, leave room for them; the hold is released again from the sites which
+// took it if any failed
+func reserveQuota(ctx context.Context, user string, hold quotaHold, bytesLimit int64) (*reservation, error) {
+	if err := blocked.check(ctx, user); err != nil {
+		return nil, err
+	}
+	id := xid.New().String()
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
+		index := index
+		g.Go(func() error {
+			return writeSite(ctx, sites[index], func(ctx context.Context, s3Client ObjectStore) error {
+				err := reserveLatestUserQuota(ctx, s3Client, user, id, hold, bytesLimit)
+				if err == nil || errors.Is(err, errMaxLimitExceeded) {
+					invalidateManifest(sites[index], user)
+					if err != nil {
+						return final(err)
+					}
+				}
+				return err
+			})
+		}, index)
+	}
+	if err := g.WaitErr(); err != nil {
+		if releaseErr := releaseReservation(ctx, user, id); releaseErr != nil {
+			logf(ctx, "WARNING", "", "unable to release the partial reservation %v of user '%v'; left to expire; %v", id, user, releaseErr)
+		}
+		return nil, err
+	}
+	return &reservation{
+		ID:      id,
+		User:    user,
+		Objects: hold.Objects,
+		Bytes:   hold.Bytes,
+		Expires: hold.Expires,
+	}, nil
+}
+
+func reserveLatestUserQuota(ctx context.Context, s3Client ObjectStore, user, id string, hold quotaHold, bytesLimit int64) error {
+	userQuota, etag, err := readUserQuota(ctx, s3Client, user)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			logf(ctx, "ERROR", s3Client.EndpointURL().Host, "unable to GET the manifest for user '%v'; %v", user, err)
+			return fmt.Errorf("user quota cannot be read; %v", err)
+		}
+		if err := admitUser(ctx, s3Client, user); err != nil {
+			return err
+		}
+		userQuota = NewUserQuota()
+	}
+	userQuota.Refresh()
+	limit := effectiveLimit(ctx, user, userQuota)
+	if len(userQuota.Objects)+userQuota.held()+hold.Objects > limit && !isMonitored(user) {
+		logf(ctx, "WARNING", s3Client.EndpointURL().Host, "unable to reserve %v objects; max limit exceeded for user '%v'", hold.Objects, user)
+		return errMaxLimitExceeded
+	}
+	if _, bytes, _ := userQuota.Usage(); bytesLimit > 0 && bytes+userQuota.heldBytes()+hold.Bytes > bytesLimit && !isMonitored(user) {
+		logf(ctx, "WARNING", s3Client.EndpointURL().Host, "unable to reserve %v bytes; bytes limit exceeded for user '%v'", hold.Bytes, user)
+		return errBytesLimitExceeded
+	}
+	if userQuota.Holds == nil {
+		userQuota.Holds = map[string]quotaHold{}
+	}
+	userQuota.Holds[id] = hold
+	if err := updateUserQuota(ctx, s3Client, user, userQuota, etag); err != nil {
+		logf(ctx, "ERROR", s3Client.EndpointURL().Host, "unable to update user quota for user '%v'; %v", user, err)
+		return fmt.Errorf("unable to update user quota for user: %v; %v", user, err)
+	}
+	return nil
+}
+
+// commitReservation counts the uploaded objects in the slots of the reservation on all the sites
+// and releases the slots left
+func commitReservation(ctx context.Context, user, id string, paths []string, sizes map[string]int64) error {
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
+		index := index
+		g.Go(func() error {
+			return writeSite(ctx, sites[index], func(ctx context.Context, s3Client ObjectStore) error {
+				err := commitLatestUserQuota(ctx, s3Client, user, id, paths, sizes)
+				if err == nil {
+					invalidateManifest(sites[index], user)
+				}
+				if errors.Is(err, errReservationNotFound) || errors.Is(err, errReservationExceeded) {
+					return final(err)
+				}
+				return err
+			})
+		}, index)
+	}
+	return g.WaitErr()
+}
+
+func commitLatestUserQuota(ctx context.Context, s3Client ObjectStore, user, id string, paths []string, sizes map[string]int64) error {
+	userQuota, etag, err := readUserQuota(ctx, s3Client, user)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return errReservationNotFound
+		}
+		logf(ctx, "ERROR", s3Client.EndpointURL().Host, "unable to GET the manifest for user '%v'; %v", user, err)
+		return fmt.Errorf("user quota cannot be read; %v", err)
+	}
+	userQuota.Refresh()
+	hold, ok := userQuota.Holds[id]
+	if !ok {
+		return errReservationNotFound
+	}
+	added := 0
+	for _, path := range paths {
+		if _, ok := userQuota.Objects[path]; ok {
+			// already counted by its event, which took a slot
+			continue
+		}
+		userQuota.Objects[path] = quotaEntry{Size: sizes[path], EventTime: clock.Now().UTC()}
+		added++
+	}
+	if added > hold.Objects {
+		return errReservationExceeded
+	}
+	delete(userQuota.Holds, id)
+	if err := updateUserQuota(ctx, s3Client, user, userQuota, etag); err != nil {
+		logf(ctx, "ERROR", s3Client.EndpointURL().Host, "unable to update user quota for user '%v'; %v", user, err)
+		return fmt.Errorf("unable to update user quota for user: %v; %v", user, err)
+	}
+	usage.track(user, len(userQuota.Objects), effectiveLimit(ctx, user, userQuota))
+	return nil
+}
+
+// releaseReservation drops the reservation from the user quota on all the sites; releasing a
+// reservation already gone is not an error
+func releaseReservation(ctx context.Context, user, id string) error {
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
+		index := index
+		g.Go(func() error {
+			return writeSite(ctx, sites[index], func(ctx context.Context, s3Client ObjectStore) error {
+				err := releaseLatestUserQuota(ctx, s3Client, user, id)
+				if err == nil {
+					invalidateManifest(sites[index], user)
+				}
+				return err
+			})
+		}, index)
+	}
+	return g.WaitErr()
+}
+
+func releaseLatestUserQuota(ctx context.Context, s3Client ObjectStore, user, id string) error {
+	userQuota, etag, err := readUserQuota(ctx, s3Client, user)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			// Nothing to release
+			return nil
+		}
+		logf(ctx, "ERROR", s3Client.EndpointURL().Host, "unable to GET the manifest for user '%v'; %v", user, err)
+		return fmt.Errorf("user quota cannot be read; %v", err)
+	}
+	if _, ok := userQuota.Holds[id]; !ok {
+		return nil
+	}
+	delete(userQuota.Holds, id)
+	if err := updateUserQuota(ctx, s3Client, user, userQuota, etag); err != nil {
+		logf(ctx, "ERROR", s3Client.EndpointURL().Host, "unable to update user quota for user '%v'; %v", user, err)
+		return fmt.Errorf("unable to update user quota for user: %v; %v", user, err)
+	}
+	return nil
+}
+
+// POST /quota/{user}/reserve
+//
+//   - Parses the number of objects and the optional bytes and ttl from the body
+//   - Holds the slots in the user quota on all the sites if the limit leaves room for them, so that
+//     the uploads checked by it cannot be raced by the other uploads before their events arrive
+//   - Returns the reservation with its id and expiry, 403 if over the limit
+func reserveHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	user := mux.Vars(r)["user"]
+	var req reservationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("unable to parse the body; %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Objects <= 0 || req.Bytes < 0 {
+		http.Error(w, "objects must be greater than 0 and bytes must not be negative", http.StatusBadRequest)
+		return
+	}
+	ttl := reservationTTL
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 || ttl > reservationMaxTTL {
+			http.Error(w, fmt.Sprintf("ttl must be a duration up to %v; invalid '%v'", reservationMaxTTL, req.TTL), http.StatusBadRequest)
+			return
+		}
+	}
+	res, err := reserveQuota(ctx, user, quotaHold{
+		Objects: req.Objects,
+		Bytes:   req.Bytes,
+		Expires: clock.Now().UTC().Add(ttl),
+	}, 0)
+	if err != nil {
+		if errors.Is(err, errMaxLimitExceeded) || errors.Is(err, errUserBlocked) || errors.Is(err, errMaxUsersExceeded) {
+			countCheck("exceeded")
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		countCheck("failed")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	countCheck("allowed")
+	logf(ctx, "LOG", "", "reserved %v objects for '%v' until %v; %v", res.Objects, user, res.Expires.Format(time.RFC3339), res.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(res)
+}
+
+// POST /quota/{user}/reserve/{id}/commit
+//
+//   - Parses the paths DATE/USER/object uploaded under the reservation, and their optional sizes,
+//     from the body
+//   - Counts them in the user quota on all the sites, in the slots of the reservation, and
+//     releases the slots left; their events find them already counted and fill in their size
+//     and ETag
+//   - Returns 404 if the reservation expired, 409 if more objects are not counted yet than reserved
+func commitReservationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	vars := mux.Vars(r)
+	user, id := vars["user"], vars["id"]
+	var req commitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("unable to parse the body; %v", err), http.StatusBadRequest)
+		return
+	}
+	for _, path := range req.Paths {
+		if err := validateUserPath(path, user); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	for path, size := range req.Sizes {
+		if size < 0 {
+			http.Error(w, fmt.Sprintf("size of '%v' must not be negative", path), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := commitReservation(ctx, user, id, req.Paths, req.Sizes); err != nil {
+		if errors.Is(err, errReservationNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errReservationExceeded) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logf(ctx, "LOG", "", "committed the reservation %v of '%v' with %v objects", id, user, len(req.Paths))
+}
+
+// DELETE /quota/{user}/reserve/{id}
+//
+// - Releases the slots of the reservation on all the sites
+func releaseReservationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	vars := mux.Vars(r)
+	user, id := vars["user"], vars["id"]
+	if err := releaseReservation(ctx, user, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logf(ctx, "LOG", "", "released the reservation %v of '%v'", id, user)
+	w.WriteHeader(http.StatusNoContent)
+}
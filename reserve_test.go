@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReservationHolds(t *testing.T) {
+	setupTestSites(t, 1)
+	ctx := context.Background()
+	res, err := reserveQuota(ctx, "usera", quotaHold{Objects: 2, Expires: time.Now().UTC().Add(time.Minute)}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an upload under no reservation is counted besides the held slots
+	if err := processEvent(ctx, testEvent("s3:ObjectCreated:Put", "usera", "a")); err != nil {
+		t.Fatal(err)
+	}
+	s3Client := sites[0].Client()
+	userQuota, _, err := readUserQuota(ctx, s3Client, "usera")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hold := userQuota.Holds[res.ID]; hold.Objects != 2 {
+		t.Fatalf("expected the reservation to keep its 2 slots, got %v", hold.Objects)
+	}
+
+	// an upload under the reservation takes its slot
+	event := testEvent("s3:ObjectCreated:Put", "usera", "b")
+	event.S3.Object.UserMetadata = map[string]string{"X-Amz-Meta-Quota-Reservation": res.ID}
+	if err := processEvent(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	if userQuota, _, err = readUserQuota(ctx, s3Client, "usera"); err != nil {
+		t.Fatal(err)
+	}
+	if hold := userQuota.Holds[res.ID]; hold.Objects != 1 {
+		t.Fatalf("expected the reservation to have 1 slot left, got %v", hold.Objects)
+	}
+
+	// a committed object is filled in by its event
+	path := getCurrentDateInUTC().Format(dateFormat) + "/usera/c"
+	if err := commitReservation(ctx, "usera", res.ID, []string{path}, map[string]int64{path: 512}); err != nil {
+		t.Fatal(err)
+	}
+	if userQuota, _, err = readUserQuota(ctx, s3Client, "usera"); err != nil {
+		t.Fatal(err)
+	}
+	if entry := userQuota.Objects[path]; entry.Size != 512 || entry.ETag != "" {
+		t.Fatalf("expected the committed entry of 512 bytes without ETag, got %+v", entry)
+	}
+	event = testEvent("s3:ObjectCreated:Put", "usera", "c")
+	event.S3.Object.ETag = "etag-c"
+	if err := processEvent(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	if userQuota, _, err = readUserQuota(ctx, s3Client, "usera"); err != nil {
+		t.Fatal(err)
+	}
+	if entry := userQuota.Objects[path]; entry.Size != 1024 || entry.ETag != "etag-c" {
+		t.Fatalf("expected the entry filled in by the event, got %+v", entry)
+	}
+	if len(userQuota.Objects) != 3 || len(userQuota.Holds) != 0 {
+		t.Fatalf("expected 3 objects and no holds, got %v objects and %v holds", len(userQuota.Objects), len(userQuota.Holds))
+	}
+}
+
+func TestReservationBytesLimit(t *testing.T) {
+	setupTestSites(t, 1)
+	ctx := context.Background()
+	// the 1024 bytes of a counted besides the held bytes
+	if err := processEvent(ctx, testEvent("s3:ObjectCreated:Put", "usera", "a")); err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().UTC().Add(time.Minute)
+	if _, err := reserveQuota(ctx, "usera", quotaHold{Objects: 1, Bytes: 2048, Expires: expires}, 4096); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reserveQuota(ctx, "usera", quotaHold{Objects: 1, Bytes: 1025, Expires: expires}, 4096); !errors.Is(err, errBytesLimitExceeded) || !errors.Is(err, errMaxLimitExceeded) {
+		t.Fatalf("expected %v, got %v", errBytesLimitExceeded, err)
+	}
+	if _, err := reserveQuota(ctx, "usera", quotaHold{Objects: 1, Bytes: 1024, Expires: expires}, 4096); err != nil {
+		t.Fatalf("reservation up to the bytes limit: expected nil, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/minio/pkg/env"
+)
+
+// retryPolicy decides how many times and how far apart the failed operations are retried
+type retryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+}
+
+// defaultRetry is the retry policy of the update, refresh, sync, recalculate and purge operations
+var defaultRetry = retryPolicy{
+	maxAttempts: 3,
+	baseDelay:   3 * time.Second,
+	maxDelay:    3 * time.Second,
+}
+
+// finalError stops the retries, returning the wrapped error as is
+type finalError struct {
+	err error
+}
+
+func (e finalError) Error() string { return e.err.Error() }
+
+// final returns the error of an attempt that is not to be retried
+func final(err error) error {
+	return finalError{err}
+}
+
+// loadRetryPolicy reads the RETRY_MAX_ATTEMPTS, RETRY_BASE_DELAY and RETRY_MAX_DELAY envs
+func loadRetryPolicy() (err error) {
+	if defaultRetry.maxAttempts, err = env.GetInt("RETRY_MAX_ATTEMPTS", defaultRetry.maxAttempts); err != nil {
+		return fmt.Errorf("unable to read RETRY_MAX_ATTEMPTS env; %v", err)
+	}
+	if defaultRetry.maxAttempts <= 0 {
+		return errors.New("RETRY_MAX_ATTEMPTS env must be greater than 0")
+	}
+	if defaultRetry.baseDelay, err = getDurationEnv("RETRY_BASE_DELAY", defaultRetry.baseDelay); err != nil {
+		return err
+	}
+	if defaultRetry.maxDelay, err = getDurationEnv("RETRY_MAX_DELAY", defaultRetry.baseDelay); err != nil {
+		return err
+	}
+	if defaultRetry.maxDelay < defaultRetry.baseDelay {
+		return errors.New("RETRY_MAX_DELAY env must not be less than RETRY_BASE_DELAY")
+	}
+	return nil
+}
+
+// delay returns the backoff after the failed attempt, doubling from the base delay up to the max delay
+func (p retryPolicy) delay(attempt int) time.Duration {
+	delay := p.baseDelay
+	for i := 1; i < attempt && delay < p.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.maxDelay {
+		return p.maxDelay
+	}
+	return delay
+}
+
+// do calls fn until it succeeds, fails with a final error or runs out of attempts,
+// returning the last error
+func (p retryPolicy) do(ctx context.Context, fn func() error) (err error) {
+	for attempt := 1; attempt <= p.maxAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		var fe finalError
+		if errors.As(err, &fe) {
+			return fe.err
+		}
+		if attempt == p.maxAttempts {
+			break
+		}
+		timer := time.NewTimer(p.delay(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+	return err
+}
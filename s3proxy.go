@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/pkg/env"
+)
+
+var (
+	// s3ProxyAddress is the address the S3 API of the upload site is proxied on, enforcing the
+	// quota of the object PUTs before forwarding them; disabled if empty
+	s3ProxyAddress = env.Get("S3_PROXY_ADDRESS", "")
+
+	// reservations are the objects being uploaded through the S3 proxy, counted by the checks
+	// of the other uploads of the user until they are written to the quota
+	reservations = &reservationTable{users: map[string]*userReservations{}}
+
+	// multiparts are the multipart uploads initiated through the S3 proxy, holding the
+	// reservations of their objects
+	multiparts = &multipartTable{uploads: map[string]multipartReservation{}}
+)
+
+// userReservations are the objects of a user being uploaded through the S3 proxy
+type userReservations struct {
+	// mu serializes the checks of the uploads of the user
+	mu    sync.Mutex
+	paths map[string]bool
+	// refs is the number of the uploads of the user being checked or reserved
+	refs int
+}
+
+// reservationTable keeps the reservations of the users
+type reservationTable struct {
+	mu    sync.Mutex
+	users map[string]*userReservations
+}
+
+func (t *reservationTable) acquire(user string) *userReservations {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u, ok := t.users[user]
+	if !ok {
+		u = &userReservations{paths: map[string]bool{}}
+		t.users[user] = u
+	}
+	u.refs++
+	return u
+}
+
+func (t *reservationTable) release(user string, u *userReservations) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if u.refs--; u.refs == 0 {
+		delete(t.users, user)
+	}
+}
+
+// reserveUpload checks the quota of the user counting the objects being uploaded, and reserves
+// the object until the returned release is called; the objects already counted need no reservation
+func reserveUpload(ctx context.Context, user, path string) (release func(), err error) {
+	if err := blocked.check(ctx, user); err != nil {
+		return nil, err
+	}
+	u := reservations.acquire(user)
+	release = func() {
+		u.mu.Lock()
+		delete(u.paths, path)
+		u.mu.Unlock()
+		reservations.release(user, u)
+	}
+	if err := u.reserve(ctx, user, path); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// reserve checks the quota of the user counting the objects being uploaded, and reserves the path
+func (u *userReservations) reserve(ctx context.Context, user, path string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	userQuota, err := readLatestQuota(ctx, user)
+	if err != nil {
+		return err
+	}
+	if _, ok := userQuota.Objects[path]; ok || u.paths[path] {
+		// an overwrite, or a retry of the same upload
+		return nil
+	}
+	limit := effectiveLimit(ctx, user, userQuota)
+	if len(userQuota.Objects)+len(u.paths) >= limit && !isMonitored(user) {
+		return errMaxLimitExceeded
+	}
+	u.paths[path] = true
+	return nil
+}
+
+// readLatestQuota reads the refreshed user quota from one site picked by the read preference,
+// falling back to the other sites if it fails
+func readLatestQuota(ctx context.Context, user string) (userQuota *UserQuota, err error) {
+	for _, site := range readOrder() {
+		if site.Client() == nil {
+			err = errors.New("s3Client is nil")
+			continue
+		}
+		userQuota, _, err = readUserQuota(ctx, site.Client(), user)
+		if err == nil || minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			if err != nil {
+				// new user
+				userQuota = NewUserQuota()
+			}
+			userQuota.Refresh()
+			return userQuota, nil
+		}
+		logf(ctx, "WARNING", site.name, "unable to read the quota of user '%v'; trying the next site; %v", user, err)
+	}
+	return nil, err
+}
+
+// s3Error represents an error response of the S3 API
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(s3Error{Code: code, Message: message, Resource: r.URL.Path})
+}
+
+// the requests of the S3 proxy creating an object in the data bucket
+const (
+	s3ProxyPut      = "put"
+	s3ProxyCreate   = "create"
+	s3ProxyComplete = "complete"
+	s3ProxyAbort    = "abort"
+)
+
+// s3ProxyUpload returns the operation and the object path of the request creating an object in
+// the data bucket, either path-style or virtual-host-style; empty for the other requests. The
+// multipart uploads are reserved when initiated, and counted when completed.
+func s3ProxyUpload(r *http.Request) (op, path string) {
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPut:
+		if query.Has("partNumber") || query.Has("tagging") || query.Has("retention") || query.Has("legal-hold") || query.Has("acl") {
+			// the parts are counted as the object they complete, and the rest modifies the existing objects
+			return "", ""
+		}
+		op = s3ProxyPut
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		op = s3ProxyCreate
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		op = s3ProxyComplete
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		op = s3ProxyAbort
+	default:
+		return "", ""
+	}
+	path = strings.TrimPrefix(r.URL.Path, "/")
+	if host, _, _ := strings.Cut(r.Host, ":"); strings.HasPrefix(host, dataBucket+".") {
+		return op, path
+	}
+	bucket, key, ok := strings.Cut(path, "/")
+	if !ok || bucket != dataBucket {
+		return "", ""
+	}
+	return op, key
+}
+
+// uploadSize returns the size of the object of the PUT; the decoded size for the aws-chunked
+// uploads, whose content length includes the chunk signatures
+func uploadSize(r *http.Request) int64 {
+	if value := r.Header.Get("X-Amz-Decoded-Content-Length"); value != "" {
+		if size, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return size
+		}
+	}
+	return r.ContentLength
+}
+
+// multipartReservation is the reservation of the object of a multipart upload initiated through
+// the S3 proxy, held until the upload is completed or aborted
+type multipartReservation struct {
+	release func()
+	expires time.Time
+}
+
+// multipartTable keeps the reservations of the multipart uploads by their upload id
+type multipartTable struct {
+	mu      sync.Mutex
+	uploads map[string]multipartReservation
+}
+
+// add holds the reservation of the upload for RESERVATION_MAX_TTL at most, dropping the ones of
+// the uploads abandoned without being aborted
+func (t *multipartTable) add(uploadID string, release func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := clock.Now()
+	for id, m := range t.uploads {
+		if !now.Before(m.expires) {
+			m.release()
+			delete(t.uploads, id)
+		}
+	}
+	t.uploads[uploadID] = multipartReservation{release: release, expires: now.Add(reservationMaxTTL)}
+}
+
+// get returns the release of the reservation of the upload; nil if not reserved
+func (t *multipartTable) get(uploadID string) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m, ok := t.uploads[uploadID]
+	if !ok {
+		return nil
+	}
+	return m.release
+}
+
+// remove releases the reservation of the upload
+func (t *multipartTable) remove(uploadID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if m, ok := t.uploads[uploadID]; ok {
+		m.release()
+		delete(t.uploads, uploadID)
+	}
+}
+
+// isSignedRequest returns true if the request carries an S3 signature, in the header or presigned
+func isSignedRequest(r *http.Request) bool {
+	query := r.URL.Query()
+	return r.Header.Get("Authorization") != "" || query.Get("X-Amz-Signature") != "" || query.Get("Signature") != ""
+}
+
+// newS3Proxy returns the server proxying the S3 API of the upload site on S3_PROXY_ADDRESS; nil
+// if not configured. The PUTs of the objects DATE/USER/object are checked and reserved against the
+// quota of the USER before being forwarded, and counted once written; the signatures are verified
+// by MinIO, as the Host of the requests is kept.
+func newS3Proxy(baseCtx context.Context) (*http.Server, error) {
+	if s3ProxyAddress == "" {
+		return nil, nil
+	}
+	target := uploadSite()
+	value := env.Get("S3_PROXY_TARGET", target.endpoint)
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("S3_PROXY_TARGET env must be the URL of the MinIO S3 API; %v", value)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: target.insecure}
+	proxy.Transport = transport
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		logf(requestContext(r), "ERROR", target.name, "unable to proxy %v %v; %v", r.Method, r.URL.Path, err)
+		writeS3Error(w, r, http.StatusBadGateway, "ServiceUnavailable", "unable to reach the S3 API")
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op, path := s3ProxyUpload(r)
+		if op == "" {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		ctx := requestContext(r)
+		if !isSignedRequest(r) {
+			writeS3Error(w, r, http.StatusForbidden, "AccessDenied", "anonymous uploads are not allowed")
+			return
+		}
+		qe, err := parseObjectPath(path)
+		if err != nil {
+			// not an object counted in a quota
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		ctx = withLogUser(ctx, qe.User)
+		uploadID := r.URL.Query().Get("uploadId")
+		switch op {
+		case s3ProxyAbort:
+			rec := &s3ProxyWriter{ResponseWriter: w, status: http.StatusOK}
+			proxy.ServeHTTP(rec, r)
+			if rec.status/100 == 2 {
+				multiparts.remove(uploadID)
+			}
+			return
+		case s3ProxyComplete:
+			if multiparts.get(uploadID) != nil {
+				break
+			}
+			// initiated before a restart or directly on MinIO; checked on completion instead
+			fallthrough
+		default:
+			release, err := reserveUpload(ctx, qe.User, qe.Path)
+			if err != nil {
+				rejectS3Upload(ctx, w, r, target, qe, err)
+				return
+			}
+			countCheck("allowed")
+			if op == s3ProxyCreate {
+				createS3Multipart(ctx, w, r, proxy, target, qe, release)
+				return
+			}
+			defer release()
+		}
+
+		rec := &s3ProxyWriter{ResponseWriter: w, status: http.StatusOK}
+		if op == s3ProxyComplete {
+			rec.body = &bytes.Buffer{}
+		}
+		proxy.ServeHTTP(rec, r)
+		if rec.status/100 != 2 {
+			return
+		}
+		qe.Name = "s3:ObjectCreated:Put"
+		qe.Time = time.Now().UTC()
+		qe.Size = uploadSize(r)
+		qe.ETag = strings.Trim(rec.Header().Get("ETag"), `"`)
+		if op == s3ProxyComplete {
+			// the completion fails with an error in the body of a 200 response too
+			var result completeMultipartResult
+			if err := xml.Unmarshal(rec.body.Bytes(), &result); err != nil || result.XMLName.Local != "CompleteMultipartUploadResult" {
+				return
+			}
+			qe.Name = "s3:ObjectCreated:CompleteMultipartUpload"
+			qe.ETag = strings.Trim(result.ETag, `"`)
+			qe.Size = 0
+			if info, err := target.Client().StatObject(ctx, dataBucket, qe.Path, minio.StatObjectOptions{}); err == nil {
+				qe.Size = info.Size
+			}
+			// the reservation is released once the object is counted
+			defer multiparts.remove(uploadID)
+		}
+		// counted before the reservation is released; the event of the object finds it counted
+		if err := updateQuota(ctx, qe); err != nil && !errors.Is(err, errOverLimitMonitored) {
+			logf(ctx, "WARNING", target.name, "unable to count the upload of '%v'; left to its event; %v", qe.Path, err)
+		}
+	})
+	return &http.Server{
+		Addr:        s3ProxyAddress,
+		Handler:     tracing(recovery(handler)),
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}, nil
+}
+
+// rejectS3Upload answers the upload which could not be reserved
+func rejectS3Upload(ctx context.Context, w http.ResponseWriter, r *http.Request, target *site, qe *quotaEvent, err error) {
+	switch {
+	case errors.Is(err, errMaxLimitExceeded), errors.Is(err, errUserBlocked):
+		logf(ctx, "WARNING", target.name, "rejecting the upload of '%v'; %v", qe.Path, err)
+		countCheck("exceeded")
+		writeS3Error(w, r, http.StatusForbidden, "QuotaExceeded", err.Error())
+	default:
+		logf(ctx, "ERROR", target.name, "unable to check the quota of user '%v'; %v", qe.User, err)
+		countCheck("failed")
+		writeS3Error(w, r, http.StatusServiceUnavailable, "ServiceUnavailable", "unable to check the quota")
+	}
+}
+
+// initiateMultipartResult is the response of CreateMultipartUpload
+type initiateMultipartResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	UploadID string   `xml:"UploadId"`
+}
+
+// completeMultipartResult is the response of CompleteMultipartUpload
+type completeMultipartResult struct {
+	XMLName xml.Name
+	ETag    string `xml:"ETag"`
+}
+
+// createS3Multipart forwards the CreateMultipartUpload holding the reservation of its object until
+// the upload is completed or aborted
+func createS3Multipart(ctx context.Context, w http.ResponseWriter, r *http.Request, proxy http.Handler, target *site, qe *quotaEvent, release func()) {
+	rec := &s3ProxyWriter{ResponseWriter: w, status: http.StatusOK, body: &bytes.Buffer{}}
+	proxy.ServeHTTP(rec, r)
+	var result initiateMultipartResult
+	if rec.status/100 != 2 || xml.Unmarshal(rec.body.Bytes(), &result) != nil || result.UploadID == "" {
+		release()
+		return
+	}
+	multiparts.add(result.UploadID, release)
+	logf(ctx, "LOG", target.name, "reserved the multipart upload '%v' of '%v'", result.UploadID, qe.Path)
+}
+
+// s3ProxyWriter records the status of the proxied response, and its body if set
+type s3ProxyWriter struct {
+	http.ResponseWriter
+	status int
+	body   *bytes.Buffer
+}
+
+func (w *s3ProxyWriter) Write(p []byte) (int, error) {
+	if w.body != nil {
+		w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *s3ProxyWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets the proxy flush the underlying writer
+func (w *s3ProxyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/minio/pkg/env"
+)
+
+var (
+	// userTokenSecret signs the tokens issued to the end users for the self-service endpoints
+	userTokenSecret = env.Get("USER_TOKEN_SECRET", "")
+	// oidcUserClaim is the claim of the ID token carrying the user
+	oidcUserClaim = env.Get("OIDC_USER_CLAIM", "sub")
+
+	errUserTokenInvalid = errors.New("invalid user token")
+)
+
+// issueUserToken returns the token of the user as USER:hex(HMAC-SHA256(USER_TOKEN_SECRET, USER))
+func issueUserToken(user string) string {
+	mac := hmac.New(sha256.New, []byte(userTokenSecret))
+	mac.Write([]byte(user))
+	return user + ":" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyUserToken returns the user of the token issued by issueUserToken
+func verifyUserToken(token string) (string, error) {
+	if userTokenSecret == "" {
+		return "", errUserTokenInvalid
+	}
+	i := strings.LastIndex(token, ":")
+	if i <= 0 {
+		return "", errUserTokenInvalid
+	}
+	user := token[:i]
+	if !hmac.Equal([]byte(issueUserToken(user)), []byte(token)) {
+		return "", errUserTokenInvalid
+	}
+	return user, nil
+}
+
+// withUser returns a copy of the context carrying the authenticated end user
+func withUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey, canonicalUser(user))
+}
+
+// userFromContext returns the authenticated end user carried by the context, if any
+func userFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(userKey).(string)
+	return user
+}
+
+// userAuth authenticates the end user of the request by a token issued with USER_TOKEN_SECRET,
+// or by an ID token of the configured OpenID Connect provider mapped to the user by OIDC_USER_CLAIM
+func userAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		user, err := verifyUserToken(token)
+		if err != nil && oidc != nil {
+			user, err = verifyUserIDToken(r.Context(), token)
+		}
+		if err != nil {
+			logf(r.Context(), "ERROR", "", "unable to authenticate the user; %v", err)
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(withUser(r.Context(), user)))
+	})
+}
+
+// verifyUserIDToken verifies the ID token and returns the user of its OIDC_USER_CLAIM
+func verifyUserIDToken(ctx context.Context, idToken string) (string, error) {
+	token, err := oidc.verify(ctx, idToken)
+	if err != nil {
+		return "", err
+	}
+	claim, _ := token.Get(oidcUserClaim)
+	user, _ := claim.(string)
+	if user == "" {
+		return "", errors.New("claim " + oidcUserClaim + " missing in the ID token")
+	}
+	return user, nil
+}
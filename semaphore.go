@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// s3Semaphore caps the S3 calls in flight across all the sites; nil if GLOBAL_MAX_INFLIGHT_S3 is not set
+var s3Semaphore chan struct{}
+
+// limitedStore is an ObjectStore whose calls wait for a slot of the s3Semaphore
+type limitedStore struct {
+	ObjectStore
+}
+
+// limitStore caps the calls of the store by the s3Semaphore, if set
+func limitStore(store ObjectStore) ObjectStore {
+	if s3Semaphore == nil {
+		return store
+	}
+	return limitedStore{store}
+}
+
+func acquireS3(ctx context.Context) error {
+	select {
+	case s3Semaphore <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func releaseS3() {
+	<-s3Semaphore
+}
+
+// releaseOnClose releases the slot once the object is read and closed
+type releaseOnClose struct {
+	io.ReadCloser
+	released bool
+}
+
+func (r *releaseOnClose) Close() error {
+	if !r.released {
+		r.released = true
+		releaseS3()
+	}
+	return r.ReadCloser.Close()
+}
+
+func (s limitedStore) ReadObject(ctx context.Context, bucket, key string) (io.ReadCloser, minio.ObjectInfo, error) {
+	if err := acquireS3(ctx); err != nil {
+		return nil, minio.ObjectInfo{}, err
+	}
+	reader, info, err := s.ObjectStore.ReadObject(ctx, bucket, key)
+	if err != nil {
+		releaseS3()
+		return nil, info, err
+	}
+	return &releaseOnClose{ReadCloser: reader}, info, nil
+}
+
+func (s limitedStore) PutObject(ctx context.Context, bucket, key string, reader io.Reader, size int64, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	if err := acquireS3(ctx); err != nil {
+		return minio.UploadInfo{}, err
+	}
+	defer releaseS3()
+	return s.ObjectStore.PutObject(ctx, bucket, key, reader, size, opts)
+}
+
+// ListObjects holds a slot while waiting for the next object of the listing, but not while
+// the caller processes it, so that the callers reading the listed objects do not deadlock
+func (s limitedStore) ListObjects(ctx context.Context, bucket string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	ch := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(ch)
+		objects := s.ObjectStore.ListObjects(ctx, bucket, opts)
+		for {
+			if err := acquireS3(ctx); err != nil {
+				select {
+				case ch <- minio.ObjectInfo{Err: err}:
+				case <-time.After(time.Second):
+					// the listing is abandoned by the caller
+				}
+				return
+			}
+			object, ok := <-objects
+			releaseS3()
+			if !ok {
+				return
+			}
+			select {
+			case ch <- object:
+			case <-ctx.Done():
+				// the listing is abandoned by the caller
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+func (s limitedStore) RemoveObject(ctx context.Context, bucket, key string, opts minio.RemoveObjectOptions) error {
+	if err := acquireS3(ctx); err != nil {
+		return err
+	}
+	defer releaseS3()
+	return s.ObjectStore.RemoveObject(ctx, bucket, key, opts)
+}
+
+func (s limitedStore) StatObject(ctx context.Context, bucket, key string, opts minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	if err := acquireS3(ctx); err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	defer releaseS3()
+	return s.ObjectStore.StatObject(ctx, bucket, key, opts)
+}
+
+func (s limitedStore) BucketExists(ctx context.Context, bucket string) (bool, error) {
+	if err := acquireS3(ctx); err != nil {
+		return false, err
+	}
+	defer releaseS3()
+	return s.ObjectStore.BucketExists(ctx, bucket)
+}
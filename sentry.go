@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/minio/pkg/env"
+)
+
+var (
+	// sentryDSN is the DSN of the Sentry (or compatible) project the errors are reported to
+	sentryDSN         = env.Get("SENTRY_DSN", "")
+	sentryEnvironment = env.Get("SENTRY_ENVIRONMENT", "")
+
+	sentry *sentryClient
+)
+
+// sentryClient reports the errors to the store endpoint of a Sentry project
+type sentryClient struct {
+	storeURL string
+	client   *http.Client
+}
+
+// sentryEvent represents an error reported to Sentry
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Release     string            `json:"release,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Message     string            `json:"message"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	User        *sentryUser       `json:"user,omitempty"`
+	Request     *sentryRequest    `json:"request,omitempty"`
+	Extra       map[string]string `json:"extra,omitempty"`
+}
+
+type sentryUser struct {
+	ID string `json:"id"`
+}
+
+type sentryRequest struct {
+	URL    string `json:"url"`
+	Method string `json:"method"`
+}
+
+// initSentry parses the configured DSN, https://KEY@HOST/PROJECT, if any
+func initSentry() error {
+	if sentryDSN == "" {
+		return nil
+	}
+	u, err := url.Parse(sentryDSN)
+	if err != nil {
+		return fmt.Errorf("unable to parse SENTRY_DSN; %v", err)
+	}
+	project := strings.TrimPrefix(u.Path, "/")
+	if u.User == nil || u.User.Username() == "" || project == "" {
+		return fmt.Errorf("invalid SENTRY_DSN; must be SCHEME://KEY@HOST/PROJECT")
+	}
+	// authenticated by the query, as the DSN has no secret key
+	query := url.Values{}
+	query.Set("sentry_version", "7")
+	query.Set("sentry_client", "quota-server/"+version)
+	query.Set("sentry_key", u.User.Username())
+	sentry = &sentryClient{
+		storeURL: fmt.Sprintf("%v://%v/api/%v/store/?%v", u.Scheme, u.Host, project, query.Encode()),
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+	return nil
+}
+
+// captureError reports the error to Sentry in the background along with the request (if any), the
+// request id and the user of the context, and the tags; failures are printed only, not to be
+// reported again
+func captureError(ctx context.Context, r *http.Request, level, message string, tags map[string]string) {
+	if sentry == nil {
+		return
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	hostname, _ := os.Hostname()
+	event := sentryEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   time.Now().UTC(),
+		Level:       level,
+		Platform:    "go",
+		Logger:      "quota-server",
+		ServerName:  hostname,
+		Release:     version,
+		Environment: sentryEnvironment,
+		Message:     message,
+		Tags:        tags,
+	}
+	if user := logUserFromContext(ctx); user != "" {
+		event.User = &sentryUser{ID: user}
+	}
+	if trace := traceFromContext(ctx); trace.RequestID != "" {
+		event.Extra = map[string]string{"request_id": trace.RequestID}
+	}
+	if r != nil {
+		event.Request = &sentryRequest{URL: r.URL.String(), Method: r.Method}
+	}
+	go func() {
+		if err := postJSON(context.Background(), sentry.client, sentry.storeURL, "", event); err != nil {
+			fmt.Printf("[WARNING] unable to report the error to Sentry; %v\n", err)
+		}
+	}()
+}
+
+// recovery recovers the panics of the handlers, reporting them to Sentry with the stack trace
+// and responding with 500
+func recovery(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				ctx := r.Context()
+				stack := string(debug.Stack())
+				logf(ctx, "ERROR", "", "panic serving %v %v; %v\n%v", r.Method, r.URL.Path, v, stack)
+				captureError(ctx, r, "fatal", fmt.Sprintf("panic: %v\n\n%v", v, stack), map[string]string{"type": "panic"})
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/pkg/env"
+)
+
+// shedding decides when the update requests are shed to let MinIO retry them later,
+// instead of queueing them up in memory
+var shedding struct {
+	// maxInflight is the max number of update requests served at once; 0 to disable
+	maxInflight int64
+	// maxLatency is the read latency of the slowest site above which the updates are shed; 0 to disable
+	maxLatency time.Duration
+	retryAfter time.Duration
+	inflight   int64
+}
+
+// initShedding reads the thresholds of the load shedding
+func initShedding() (err error) {
+	maxInflight, err := env.GetInt("SHED_MAX_INFLIGHT", 0)
+	if err != nil {
+		return err
+	}
+	shedding.maxInflight = int64(maxInflight)
+	if shedding.maxLatency, err = getDurationEnv("SHED_MAX_LATENCY", 0); err != nil {
+		return err
+	}
+	if shedding.retryAfter, err = getDurationEnv("SHED_RETRY_AFTER", 5*time.Second); err != nil {
+		return err
+	}
+	return nil
+}
+
+// overloaded returns the reason to shed the request, if any
+func overloaded(inflight int64) string {
+	if shedding.maxInflight > 0 && inflight > shedding.maxInflight {
+		return "inflight"
+	}
+	if shedding.maxLatency > 0 {
+		for _, site := range sites {
+			if site.Latency() > shedding.maxLatency {
+				return "latency"
+			}
+		}
+	}
+	return ""
+}
+
+// shed rejects the requests with 503 and a Retry-After while the server is overloaded
+func shed(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inflight := atomic.AddInt64(&shedding.inflight, 1)
+		defer atomic.AddInt64(&shedding.inflight, -1)
+		if reason := overloaded(inflight); reason != "" {
+			countShed(reason)
+			w.Header().Set("Retry-After", strconv.Itoa(int(shedding.retryAfter.Seconds())))
+			http.Error(w, "server is overloaded; retry later", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
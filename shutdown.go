@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// pendingSyncObject is written to the quota bucket when the server exits with writes still
+// deferred for the quarantined sites, or users queued for a read-repair, so that the next start
+// catches the sites up
+const pendingSyncObject = ".pending-sync"
+
+// pendingSync represents the deferred writes left unapplied and the read-repairs left queued on shutdown
+type pendingSync struct {
+	Time  time.Time      `json:"time"`
+	Sites map[string]int `json:"sites,omitempty"`
+	// Repairs are the users queued for a read-repair, queued again on the next start
+	Repairs []string `json:"repairs,omitempty"`
+}
+
+// serve serves the router, and the S3 proxy if configured, until SIGTERM or SIGINT, then stops
+// accepting the requests, waits for the in-flight ones and flushes the rejections counted in memory
+// and the deferred writes within SHUTDOWN_TIMEOUT, recording the read-repairs queued
+func serve(router http.Handler) error {
+	timeout, err := getDurationEnv("SHUTDOWN_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return err
+	}
+	// canceled on shutdown, ending the log streams; the requests are served by contexts
+	// without cancel, so the in-flight updates complete
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+	srv := &http.Server{
+		Addr:        address,
+		Handler:     router,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+	s3Proxy, err := newS3Proxy(baseCtx)
+	if err != nil {
+		return err
+	}
+	serveErr := make(chan error, 2)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+	if s3Proxy != nil {
+		go func() {
+			serveErr <- s3Proxy.ListenAndServe()
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-signals:
+		logf(context.Background(), "LOG", "", "received %v; shutting down within %v", sig, timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cancelBase()
+	if err := srv.Shutdown(ctx); err != nil {
+		logf(ctx, "WARNING", "", "unable to complete the in-flight requests; %v", err)
+	}
+	if s3Proxy != nil {
+		if err := s3Proxy.Shutdown(ctx); err != nil {
+			logf(ctx, "WARNING", "", "unable to complete the in-flight S3 proxy requests; %v", err)
+		}
+	}
+	origins.waitReplays(ctx)
+	// before the deferred writes, which include the rejections of the quarantined sites
+	rejections.flush(ctx)
+	flushPendingWrites(ctx)
+	return nil
+}
+
+// flushPendingWrites applies the writes deferred for the quarantined sites; the writes left are
+// recorded in the quota bucket of a healthy site, to be caught up by a sync on the next start,
+// along with the users queued for a read-repair
+func flushPendingWrites(ctx context.Context) {
+	repairs := readRepairs.drain()
+	left := map[string]int{}
+	for _, site := range sites {
+		if site.PendingWrites() == 0 {
+			continue
+		}
+		if site.replayWrites(ctx) {
+			continue
+		}
+		left[site.name] = site.PendingWrites()
+		logf(ctx, "WARNING", site.name, "exiting with %v deferred writes not applied", left[site.name])
+	}
+	if len(repairs) > 0 {
+		logf(ctx, "WARNING", "", "exiting with %v read-repairs queued", len(repairs))
+	}
+	if len(left) == 0 && len(repairs) == 0 {
+		return
+	}
+	data, err := json.Marshal(pendingSync{Time: time.Now().UTC(), Sites: left, Repairs: repairs})
+	if err != nil {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	for _, site := range sites {
+		if site.Quarantined() || site.Client() == nil {
+			continue
+		}
+		if _, err := site.Client().PutObject(ctx, quotaBucket, pendingSyncObject, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+			ContentType: "application/json",
+		}); err != nil {
+			logf(ctx, "WARNING", site.name, "unable to record the deferred writes left; %v", err)
+			continue
+		}
+		logf(ctx, "LOG", site.name, "recorded the deferred writes and the read-repairs left; they will be caught up on the next start")
+		return
+	}
+	logf(ctx, "ERROR", "", "unable to record the deferred writes left; run /admin/sync to catch up the sites %v and the users %v", left, repairs)
+}
+
+// syncPendingWrites syncs the sites in the background if the last run exited with deferred writes
+// not applied, and queues again the read-repairs it left, removing the record once caught up
+func syncPendingWrites(ctx context.Context) {
+	var found []*site
+	var repairs []string
+	syncing := false
+	for _, site := range sites {
+		reader, _, err := site.Client().ReadObject(ctx, quotaBucket, pendingSyncObject)
+		if err != nil {
+			if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+				logf(ctx, "WARNING", site.name, "unable to read the deferred writes left by the last run; %v", err)
+			}
+			continue
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		var pending pendingSync
+		if err == nil {
+			err = json.Unmarshal(data, &pending)
+		}
+		if err != nil {
+			logf(ctx, "WARNING", site.name, "unable to read the deferred writes left by the last run; %v", err)
+		}
+		if err != nil || len(pending.Sites) > 0 {
+			logf(ctx, "WARNING", site.name, "the last run exited with deferred writes not applied %v; syncing the sites", pending.Sites)
+			syncing = true
+		}
+		found = append(found, site)
+		repairs = append(repairs, pending.Repairs...)
+	}
+	if len(found) == 0 {
+		return
+	}
+	if len(repairs) > 0 {
+		if readRepairMode == readRepairQueued {
+			logf(ctx, "LOG", "", "queuing again the %v read-repairs left by the last run", len(repairs))
+			for _, user := range repairs {
+				readRepairs.enqueue(ctx, user)
+			}
+		} else {
+			logf(ctx, "WARNING", "", "dropping the read-repairs of the users %v left by the last run; READ_REPAIR is not queued", repairs)
+		}
+	}
+	go func() {
+		if syncing {
+			start := time.Now()
+			err := syncQuota(ctx, allSites)
+			lastRuns.record("sync", start, err)
+			if err != nil {
+				logf(ctx, "ERROR", "", "unable to sync the deferred writes left by the last run; %v", err)
+				return
+			}
+		}
+		var errs []error
+		for _, site := range found {
+			errs = append(errs, site.Client().RemoveObject(ctx, quotaBucket, pendingSyncObject, minio.RemoveObjectOptions{}))
+		}
+		if err := errors.Join(errs...); err != nil {
+			logf(ctx, "WARNING", "", "unable to remove the record of the deferred writes left; %v", err)
+		}
+	}()
+}
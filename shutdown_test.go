@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestShutdownKeepsQueuedRepairs(t *testing.T) {
+	setupTestSites(t, 1)
+	savedQueue, savedMode := readRepairs, readRepairMode
+	t.Cleanup(func() { readRepairs, readRepairMode = savedQueue, savedMode })
+	readRepairs = &repairQueue{users: make(chan string, 10), pending: map[string]bool{}}
+	readRepairMode = readRepairQueued
+	ctx := context.Background()
+	readRepairs.enqueue(ctx, "usera")
+	readRepairs.enqueue(ctx, "userb")
+
+	flushPendingWrites(ctx)
+	if depth := readRepairs.depth(); depth != 0 {
+		t.Fatalf("expected the queue drained on shutdown, got %v users", depth)
+	}
+
+	syncPendingWrites(ctx)
+	users := readRepairs.drain()
+	sort.Strings(users)
+	if len(users) != 2 || users[0] != "usera" || users[1] != "userb" {
+		t.Fatalf("expected the repairs of usera and userb queued again, got %v", users)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reader, _, err := sites[0].Client().ReadObject(ctx, quotaBucket, pendingSyncObject)
+		if err == nil {
+			reader.Close()
+		}
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the record removed once caught up, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	readPreferenceAll        = "all"
+	readPreferencePrimary    = "primary"
+	readPreferenceNearest    = "nearest"
+	readPreferenceRoundRobin = "round-robin"
+	readPreferenceWeighted   = "weighted"
+)
+
+var roundRobinCounter uint64
+
+// siteInitRetryInterval is how often the connection to a site unreachable on startup is retried
+const siteInitRetryInterval = 10 * time.Second
+
+// site represents a configured MinIO site
+type site struct {
+	name      string
+	endpoint  string
+	accessKey string
+	secretKey string
+	insecure  bool
+	transport transportConfig
+
+	mu     sync.RWMutex
+	client ObjectStore
+	// core makes the multipart calls of the site; nil for the sites not backed by MinIO
+	core *minio.Core
+	// initErr is the last failure to connect to the site while it is initializing in the background
+	initErr error
+
+	// latency is the moving average of the read latency in nanoseconds
+	latency int64
+	// weight is the share of the reads of the site with READ_PREFERENCE=weighted
+	weight int
+
+	health siteHealth
+}
+
+// connect (re)creates the s3 client of the site and validates the existence of the buckets
+func (s *site) connect(ctx context.Context) error {
+	s3Client, err := getS3Client(s.endpoint, s.accessKey, s.secretKey, s.insecure, s.transport)
+	if err != nil {
+		return fmt.Errorf("unable to create s3 client; %v", err)
+	}
+	start := time.Now()
+	found, err := s3Client.BucketExists(ctx, dataBucket)
+	if err != nil {
+		return fmt.Errorf("unable to stat the bucket %v in %v; %w", dataBucket, s3Client.EndpointURL().Host, err)
+	}
+	s.recordLatency(time.Since(start))
+	if !found {
+		if !createBuckets {
+			return fmt.Errorf("DATA_BUCKET %v does not exist in %v", dataBucket, s3Client.EndpointURL().Host)
+		}
+		if err := s.createBucket(ctx, s3Client, dataBucket); err != nil {
+			return err
+		}
+	}
+	found, err = s3Client.BucketExists(ctx, quotaBucket)
+	if err != nil {
+		return fmt.Errorf("unable to stat the bucket %v in %v; %w", quotaBucket, s3Client.EndpointURL().Host, err)
+	}
+	if !found {
+		if !createBuckets {
+			return fmt.Errorf("QUOTA_BUCKET %v does not exist in %v", quotaBucket, s3Client.EndpointURL().Host)
+		}
+		if err := s.createBucket(ctx, s3Client, quotaBucket); err != nil {
+			return err
+		}
+	}
+	if err := protectQuotaBucket(ctx, s3Client); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.client = limitStore(minioStore{s3Client})
+	s.core = &minio.Core{Client: s3Client}
+	s.initErr = nil
+	s.mu.Unlock()
+	return nil
+}
+
+// createBucket creates the missing bucket on the site with the configured region, object locking
+// and versioning
+func (s *site) createBucket(ctx context.Context, s3Client *minio.Client, bucket string) error {
+	// the retained user quotas need the object locking of the quota bucket
+	objectLocking := bucketObjectLocking || (bucket == quotaBucket && quotaRetention > 0)
+	if err := s3Client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{
+		Region:        bucketRegion,
+		ObjectLocking: objectLocking,
+	}); err != nil {
+		return fmt.Errorf("unable to create the bucket %v in %v; %w", bucket, s3Client.EndpointURL().Host, err)
+	}
+	// object locking enables the versioning by itself
+	if bucketVersioning && !objectLocking {
+		if err := s3Client.EnableVersioning(ctx, bucket); err != nil {
+			return fmt.Errorf("unable to enable versioning on the bucket %v in %v; %w", bucket, s3Client.EndpointURL().Host, err)
+		}
+	}
+	logf(ctx, "LOG", s.name, "created the bucket %v", bucket)
+	return nil
+}
+
+// initialize connects to the site in the background, retrying until it succeeds; the site is
+// served by an unverified client meanwhile, failing like an unreachable site
+func (s *site) initialize(ctx context.Context, cause error) error {
+	s3Client, err := getS3Client(s.endpoint, s.accessKey, s.secretKey, s.insecure, s.transport)
+	if err != nil {
+		return fmt.Errorf("unable to create s3 client; %v", err)
+	}
+	s.mu.Lock()
+	s.client = limitStore(minioStore{s3Client})
+	s.core = &minio.Core{Client: s3Client}
+	s.initErr = cause
+	s.mu.Unlock()
+	go func() {
+		for {
+			time.Sleep(siteInitRetryInterval)
+			err := s.connect(ctx)
+			if err == nil {
+				logf(ctx, "LOG", s.name, "site initialized")
+				return
+			}
+			s.mu.Lock()
+			s.initErr = err
+			s.mu.Unlock()
+			logf(ctx, "WARNING", s.name, "site is still initializing; %v", err)
+		}
+	}()
+	return nil
+}
+
+// unreachable returns true if the error connecting to a site is of the network, a timeout or
+// the site not serving yet, which a later attempt can resolve, unlike the errors of the
+// configuration such as the credentials or the buckets
+func unreachable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var resp minio.ErrorResponse
+	return errors.As(err, &resp) && resp.StatusCode >= http.StatusInternalServerError
+}
+
+// InitError returns the last failure to connect to the site, if it is still initializing
+func (s *site) InitError() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.initErr
+}
+
+// newStoreSite returns a site backed by the provided store, such as the in-memory store
+func newStoreSite(name string, store ObjectStore) *site {
+	return &site{name: name, client: store}
+}
+
+// Client returns the s3 client of the site
+func (s *site) Client() ObjectStore {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client
+}
+
+// Core returns the client making the multipart calls of the site
+func (s *site) Core() *minio.Core {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.core
+}
+
+// findSite returns the configured site by its name
+func findSite(name string) *site {
+	for _, site := range sites {
+		if site.name == name {
+			return site
+		}
+	}
+	return nil
+}
+
+// recordLatency updates the moving average of the read latency of the site
+func (s *site) recordLatency(d time.Duration) {
+	for {
+		old := atomic.LoadInt64(&s.latency)
+		updated := int64(d)
+		if old != 0 {
+			updated = (old*4 + int64(d)) / 5
+		}
+		if atomic.CompareAndSwapInt64(&s.latency, old, updated) {
+			return
+		}
+	}
+}
+
+// Latency returns the moving average of the read latency of the site
+func (s *site) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.latency))
+}
+
+// validateReadPreference validates the configured read preference and the primary site
+func validateReadPreference() error {
+	switch readPreference {
+	case readPreferenceAll, readPreferenceNearest, readPreferenceRoundRobin:
+	case readPreferenceWeighted:
+		return loadSiteWeights()
+	case readPreferencePrimary:
+		if primarySite == "" || findSite(primarySite) != nil {
+			return nil
+		}
+		return fmt.Errorf("PRIMARY_SITE %v is not configured", primarySite)
+	default:
+		return fmt.Errorf("invalid READ_PREFERENCE %v", readPreference)
+	}
+	return nil
+}
+
+// readOrder returns the sites in the order they should be tried by the configured read preference
+func readOrder() []*site {
+	ordered := make([]*site, 0, len(sites))
+	switch readPreference {
+	case readPreferencePrimary:
+		primary := primarySite
+		if primary == "" {
+			// first configured site is the primary
+			primary = sites[0].name
+		}
+		for _, site := range sites {
+			if site.name == primary {
+				ordered = append(ordered, site)
+			}
+		}
+		for _, site := range sites {
+			if site.name != primary {
+				ordered = append(ordered, site)
+			}
+		}
+	case readPreferenceNearest:
+		ordered = append(ordered, sites...)
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].Latency() < ordered[j].Latency()
+		})
+	case readPreferenceRoundRobin:
+		start := int(atomic.AddUint64(&roundRobinCounter, 1) % uint64(len(sites)))
+		ordered = append(ordered, sites[start:]...)
+		ordered = append(ordered, sites[:start]...)
+	case readPreferenceWeighted:
+		ordered = weightedOrder(ordered)
+	default:
+		ordered = append(ordered, sites...)
+	}
+	return ordered
+}
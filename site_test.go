@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestUnreachable(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected bool
+	}{
+		{&url.Error{Op: "Head", URL: "http://site1:9000/data/", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, true},
+		{fmt.Errorf("unable to stat the bucket; %w", context.DeadlineExceeded), true},
+		{fmt.Errorf("unable to stat the bucket; %w", minio.ErrorResponse{Code: "XMinioServerNotInitialized", StatusCode: http.StatusServiceUnavailable}), true},
+		{fmt.Errorf("unable to stat the bucket; %w", minio.ErrorResponse{Code: "InvalidAccessKeyId", StatusCode: http.StatusForbidden}), false},
+		{errors.New("DATA_BUCKET data does not exist in site1:9000"), false},
+	}
+	for i, testCase := range testCases {
+		if unreachable(testCase.err) != testCase.expected {
+			t.Errorf("case %v: expected %v for %v", i+1, testCase.expected, testCase.err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/minio/pkg/env"
+)
+
+var (
+	// statsdAddress is the address of the StatsD/DogStatsD agent to push the metrics to
+	statsdAddress = env.Get("STATSD_ADDRESS", "")
+	statsdPrefix  = env.Get("STATSD_PREFIX", metricsNamespace+".")
+	// statsdTags are the DogStatsD tags added to every metric
+	statsdTags = parseList(env.Get("STATSD_TAGS", ""))
+
+	statsd *statsdClient
+)
+
+// statsdClient pushes the metrics to a StatsD agent over UDP, with the
+// labels sent as DogStatsD tags
+type statsdClient struct {
+	conn net.Conn
+}
+
+// initStatsd connects to the configured StatsD agent, if any
+func initStatsd() error {
+	if statsdAddress == "" {
+		return nil
+	}
+	conn, err := net.Dial("udp", statsdAddress)
+	if err != nil {
+		return err
+	}
+	statsd = &statsdClient{conn: conn}
+	return nil
+}
+
+// send writes the metric to the agent; being UDP, failures are ignored
+func (c *statsdClient) send(name, value, kind string, tags ...string) {
+	tags = append(tags, statsdTags...)
+	metric := fmt.Sprintf("%v%v:%v|%v", statsdPrefix, name, value, kind)
+	if len(tags) > 0 {
+		metric += "|#" + strings.Join(tags, ",")
+	}
+	c.conn.Write([]byte(metric))
+}
+
+// Count increments the counter
+func (c *statsdClient) Count(name string, tags ...string) {
+	if c == nil {
+		return
+	}
+	c.send(name, "1", "c", tags...)
+}
+
+// Timing records the duration in milliseconds
+func (c *statsdClient) Timing(name string, d time.Duration, tags ...string) {
+	if c == nil {
+		return
+	}
+	c.send(name, fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond)), "ms", tags...)
+}
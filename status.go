@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/minio/pkg/sync/errgroup"
+)
+
+const siteProbeTimeout = 5 * time.Second
+
+var (
+	startTime = time.Now()
+
+	lastRuns = &runHistory{runs: map[string]runResult{}}
+)
+
+// runResult represents the result of the last run of a job
+type runResult struct {
+	StartedAt time.Time `json:"startedAt"`
+	Duration  string    `json:"duration"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// runHistory keeps the results of the last runs of the refresh, purge and sync jobs
+type runHistory struct {
+	mu   sync.Mutex
+	runs map[string]runResult
+}
+
+// record records the result of the run of the job
+func (h *runHistory) record(job string, start time.Time, err error) {
+	result := runResult{
+		StartedAt: start.UTC(),
+		Duration:  time.Since(start).String(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.runs[job] = result
+}
+
+// get returns a copy of the results of the last runs
+func (h *runHistory) get() map[string]runResult {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	runs := make(map[string]runResult, len(h.runs))
+	for job, result := range h.runs {
+		runs[job] = result
+	}
+	return runs
+}
+
+// siteStatus represents the status of a configured site
+type siteStatus struct {
+	Name        string `json:"name"`
+	Endpoint    string `json:"endpoint"`
+	Reachable   bool   `json:"reachable"`
+	Latency     string `json:"latency,omitempty"`
+	ReadLatency string `json:"readLatency,omitempty"`
+	Quarantined bool   `json:"quarantined,omitempty"`
+	// Initializing is true while the site unreachable on startup is connected in the background
+	Initializing bool `json:"initializing,omitempty"`
+	// PendingWrites is the number of writes deferred while the site is quarantined
+	PendingWrites int    `json:"pendingWrites,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// serverStatus represents the status of the server
+type serverStatus struct {
+	Version     string               `json:"version"`
+	Uptime      string               `json:"uptime"`
+	DataBucket  string               `json:"dataBucket"`
+	QuotaBucket string               `json:"quotaBucket"`
+	MaxLimit    int                  `json:"maxLimit"`
+	Sites       []siteStatus         `json:"sites"`
+	LastRuns    map[string]runResult `json:"lastRuns"`
+	// Origin is the site whose events are counted, if ORIGIN_SITE is set
+	Origin string `json:"origin,omitempty"`
+	// Cluster is this replica and its peers, if CLUSTER_PEERS is set
+	Cluster *clusterStatus `json:"cluster,omitempty"`
+	// Cache is the counters of the manifest caches, if QUOTA_CACHE_TTL or QUOTA_NEGATIVE_CACHE_TTL is set
+	Cache *cacheStatus `json:"cache,omitempty"`
+	// RepairQueue is the number of the users waiting for a read-repair
+	RepairQueue int `json:"repairQueue"`
+}
+
+// cacheStatus represents the counters of the manifest caches since the start
+type cacheStatus struct {
+	Hits                int64 `json:"hits"`
+	Misses              int64 `json:"misses"`
+	NegativeHits        int64 `json:"negativeHits"`
+	RemoteInvalidations int64 `json:"remoteInvalidations"`
+}
+
+// getCacheStatus returns the counters of the manifest caches, nil if they are not configured
+func getCacheStatus() *cacheStatus {
+	if manifestCache == nil && missingManifestCache == nil {
+		return nil
+	}
+	counter := func(key string) int64 {
+		if count, ok := expCache.Get(key).(*expvar.Int); ok {
+			return count.Value()
+		}
+		return 0
+	}
+	return &cacheStatus{
+		Hits:                counter("hits"),
+		Misses:              counter("misses"),
+		NegativeHits:        counter("negative_hits"),
+		RemoteInvalidations: counter("remote_invalidations"),
+	}
+}
+
+// getStatus probes the configured sites and collects the status of the server
+func getStatus(ctx context.Context) serverStatus {
+	status := serverStatus{
+		Version:     version,
+		Uptime:      time.Since(startTime).Round(time.Second).String(),
+		DataBucket:  dataBucket,
+		QuotaBucket: quotaBucket,
+		MaxLimit:    maxLimit,
+		Sites:       make([]siteStatus, len(sites)),
+		LastRuns:    lastRuns.get(),
+		Origin:      activeOrigin(),
+		Cluster:     cluster.status(),
+		Cache:       getCacheStatus(),
+		RepairQueue: readRepairs.depth(),
+	}
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
+		index := index
+		g.Go(func() error {
+			status.Sites[index] = probeSite(ctx, sites[index])
+			return nil
+		}, index)
+	}
+	g.Wait()
+	return status
+}
+
+// probeSite checks if the quota bucket is reachable on the site
+func probeSite(ctx context.Context, site *site) siteStatus {
+	status := siteStatus{
+		Name:          site.name,
+		Endpoint:      site.Client().EndpointURL().Host,
+		Quarantined:   site.Quarantined(),
+		PendingWrites: site.PendingWrites(),
+	}
+	if err := site.InitError(); err != nil {
+		status.Initializing = true
+		status.Error = err.Error()
+		return status
+	}
+	if latency := site.Latency(); latency > 0 {
+		status.ReadLatency = latency.String()
+	}
+	ctx, cancel := context.WithTimeout(ctx, siteProbeTimeout)
+	defer cancel()
+	start := time.Now()
+	if _, err := site.Client().BucketExists(ctx, quotaBucket); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Reachable = true
+	status.Latency = time.Since(start).String()
+	return status
+}
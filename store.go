@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/url"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// ObjectStore represents the calls made to the buckets of a site
+type ObjectStore interface {
+	// ReadObject GETs the object along with its info; errors with NoSuchKey if the object does not exist
+	ReadObject(ctx context.Context, bucket, key string) (io.ReadCloser, minio.ObjectInfo, error)
+	// PutObject PUTs the object; a PUT with a match ETag fails with PreconditionFailed if the
+	// object exists with another ETag
+	PutObject(ctx context.Context, bucket, key string, reader io.Reader, size int64, opts minio.PutObjectOptions) (minio.UploadInfo, error)
+	ListObjects(ctx context.Context, bucket string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo
+	RemoveObject(ctx context.Context, bucket, key string, opts minio.RemoveObjectOptions) error
+	StatObject(ctx context.Context, bucket, key string, opts minio.StatObjectOptions) (minio.ObjectInfo, error)
+	BucketExists(ctx context.Context, bucket string) (bool, error)
+	EndpointURL() *url.URL
+}
+
+// minioStore is the ObjectStore of a MinIO site
+type minioStore struct {
+	*minio.Client
+}
+
+// ReadObject GETs the object and stats it, so that the missing objects fail right away
+func (s minioStore) ReadObject(ctx context.Context, bucket, key string) (io.ReadCloser, minio.ObjectInfo, error) {
+	reader, err := s.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, minio.ObjectInfo{}, err
+	}
+	stat, err := reader.Stat()
+	if err != nil {
+		reader.Close()
+		return nil, minio.ObjectInfo{}, err
+	}
+	return reader, stat, nil
+}
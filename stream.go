@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/minio/pkg/env"
+)
+
+// maxStreamLine is the max size of a notification payload on the update stream
+const maxStreamLine = 1 << 20
+
+// streamBatchSize is the max number of payloads applied together from the update stream
+var streamBatchSize int
+
+// streamAck represents the acknowledgement of a payload of the update stream
+type streamAck struct {
+	Seq        int    `json:"seq"`
+	Error      string `json:"error,omitempty"`
+	RetryAfter int    `json:"retryAfter,omitempty"`
+}
+
+// streamRecord represents a record of a payload of the update stream
+type streamRecord struct {
+	seq   int
+	event notification.Event
+}
+
+// loadStreamConfig reads the batch size of the update stream
+func loadStreamConfig() error {
+	var err error
+	streamBatchSize, err = env.GetInt("STREAM_BATCH_SIZE", 100)
+	if err != nil {
+		return fmt.Errorf("unable to read STREAM_BATCH_SIZE env; %v", err)
+	}
+	if streamBatchSize <= 0 {
+		return errors.New("STREAM_BATCH_SIZE env must be greater than 0")
+	}
+	return nil
+}
+
+// POST /quota/stream
+//
+//   - Reads a stream of MinIO bucket notification payloads, one JSON payload per line
+//   - Applies the payloads read together in batches of up to STREAM_BATCH_SIZE, the users
+//     concurrently and the events of each user in order, in one write of the user quota per site
+//   - Writes an acknowledgement line per payload, in the order of the payloads, once its batch
+//     is applied
+func streamUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	// the acknowledgements are written while the stream is still being read
+	if err := http.NewResponseController(w).EnableFullDuplex(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logf(ctx, "WARNING", "", "unable to enable full duplex on the update stream; %v", err)
+	}
+
+	// the reader stops with the request, not with the handler context which outlives it
+	done := r.Context().Done()
+	lines := make(chan []byte)
+	var scanErr error
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 64<<10), maxStreamLine)
+		for scanner.Scan() {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			line := append([]byte(nil), scanner.Bytes()...)
+			select {
+			case lines <- line:
+			case <-done:
+				return
+			}
+		}
+		scanErr = scanner.Err()
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	seq := 0
+	for {
+		// wait for a payload, then take the ones already read along with it
+		line, ok := <-lines
+		if !ok {
+			break
+		}
+		batch := [][]byte{line}
+	collect:
+		for len(batch) < streamBatchSize {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, line)
+			default:
+				break collect
+			}
+		}
+		for _, ack := range applyStreamBatch(ctx, seq, batch) {
+			if err := encoder.Encode(ack); err != nil {
+				logf(ctx, "ERROR", "", "unable to acknowledge the update stream; %v", err)
+				return
+			}
+		}
+		flusher.Flush()
+		seq += len(batch)
+	}
+	if scanErr != nil {
+		logf(ctx, "ERROR", "", "unable to read the update stream; %v", scanErr)
+		encoder.Encode(streamAck{Seq: seq, Error: fmt.Sprintf("unable to read the stream; %v", scanErr)})
+	}
+}
+
+// applyStreamBatch processes the payloads of the batch, grouping their records by user, and
+// returns the acknowledgements of the payloads in order
+func applyStreamBatch(ctx context.Context, seq int, batch [][]byte) []streamAck {
+	acks := make([]streamAck, len(batch))
+	users := map[string][]streamRecord{}
+	var order []string
+	for i, line := range batch {
+		acks[i].Seq = seq + i
+		var payload notificationPayload
+		if err := json.Unmarshal(line, &payload); err != nil {
+			logf(ctx, "ERROR", "", "unable to unmarshal the payload %v of the update stream; %v", seq+i, err)
+			acks[i].Error = fmt.Sprintf("unable to unmarshal the payload; %v", err)
+			continue
+		}
+		if len(payload.Records) == 0 {
+			acks[i].Error = "missing records in the payload"
+			continue
+		}
+		if archiveNotifications {
+			if err := archivePayload(ctx, line); err != nil {
+				// the archive is for the audits, and never holds up the updates
+				logf(ctx, "ERROR", "", "unable to archive the notification; %v", err)
+			}
+		}
+		for _, record := range payload.Records {
+			// the events which fail to parse are reported by processEvent
+			var user string
+			if qe, err := parseEvent(record); err == nil {
+				user = qe.User
+			}
+			if _, ok := users[user]; !ok {
+				order = append(order, user)
+			}
+			users[user] = append(users[user], streamRecord{seq: i, event: record})
+		}
+	}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	fail := func(record streamRecord, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if acks[record.seq].Error == "" {
+			acks[record.seq].Error = err.Error()
+			if errors.Is(err, errRateLimited) {
+				acks[record.seq].RetryAfter = userRateLimiter.retryAfter()
+			}
+		}
+	}
+	for _, user := range order {
+		user, records := user, users[user]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if user == "" {
+				// reported by processEvent one by one
+				for _, record := range records {
+					if err := processEvent(ctx, record.event); err != nil {
+						fail(record, err)
+					}
+				}
+				return
+			}
+			// the events of the user passing their checks are applied in one write per site
+			var (
+				admitted []streamRecord
+				events   []*quotaEvent
+			)
+			for _, record := range records {
+				qe, err := admitEvent(ctx, record.event)
+				if err != nil {
+					fail(record, err)
+					continue
+				}
+				if qe != nil {
+					admitted, events = append(admitted, record), append(events, qe)
+				}
+			}
+			if len(events) == 0 {
+				return
+			}
+			userCtx := withLogUser(ctx, user)
+			for i, err := range applyQuotaEvents(userCtx, user, events) {
+				if err := finishEvent(userCtx, admitted[i].event, events[i], err); err != nil {
+					fail(admitted[i], err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return acks
+}
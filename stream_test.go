@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+)
+
+func TestApplyStreamBatch(t *testing.T) {
+	setupTestSites(t, 2)
+	ctx := context.Background()
+	var batch [][]byte
+	for _, event := range [][]string{
+		{"s3:ObjectCreated:Put", "usera", "a"},
+		{"s3:ObjectCreated:Put", "usera", "b"},
+		{"s3:ObjectCreated:Put", "userb", "a"},
+		{"s3:ObjectRemoved:Delete", "usera", "a"},
+		{"s3:ObjectCreated:Put", "usera", "c"},
+		{"s3:ObjectCreated:Put", "usera", "d"},
+		{"s3:ObjectCreated:Put", "usera", "e"},
+	} {
+		line, err := json.Marshal(notificationPayload{Records: []notification.Event{testEvent(event[0], event[1], event[2])}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch = append(batch, line)
+	}
+	batch = append(batch, []byte("not json"))
+
+	acks := applyStreamBatch(ctx, 10, batch)
+	for i, ack := range acks {
+		if ack.Seq != 10+i {
+			t.Errorf("payload %v: expected the seq %v, got %v", i, 10+i, ack.Seq)
+		}
+		// usera is at the limit of 3 with b, c and d once a is removed
+		failed := i == 6 || i == 7
+		if failed != (ack.Error != "") {
+			t.Errorf("payload %v: unexpected acknowledgement %+v", i, ack)
+		}
+	}
+	rejections.flush(ctx)
+	for _, site := range sites {
+		userQuota, _, err := readUserQuota(ctx, site.Client(), "usera")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(userQuota.Objects) != 3 || userQuota.Rejections[getCurrentDateInUTC().Format(dateFormat)] != 1 {
+			t.Errorf("%v: expected 3 objects and 1 rejection, got %v and %v", site.name, userQuota.Objects, userQuota.Rejections)
+		}
+	}
+}
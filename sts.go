@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/pkg/env"
+)
+
+const (
+	// minSTSDuration is the shortest validity accepted by the MinIO STS AssumeRole API
+	minSTSDuration = 15 * time.Minute
+	// policyChars are the characters of the user names which would widen the resource of the
+	// session policy beyond the prefix of the user: the wildcards, the policy variables and the
+	// path separator
+	policyChars = "*?$/"
+)
+
+var (
+	// stsCredentials serves POST /my/credentials, vending the credentials to upload directly
+	// to MinIO only to the users under their quota
+	stsCredentials = env.Get("STS_CREDENTIALS", "off") == "on"
+	// stsDuration is the validity of the vended credentials
+	stsDuration = minSTSDuration
+)
+
+// uploadCredentials represents the short-lived credentials of a user, scoped to their prefix of today
+type uploadCredentials struct {
+	AccessKey    string    `json:"accessKey"`
+	SecretKey    string    `json:"secretKey"`
+	SessionToken string    `json:"sessionToken"`
+	Expiration   time.Time `json:"expiration"`
+	Endpoint     string    `json:"endpoint"`
+	Bucket       string    `json:"bucket"`
+	Prefix       string    `json:"prefix"`
+}
+
+// loadSTSDuration reads the validity of the vended credentials
+func loadSTSDuration() (err error) {
+	value := env.Get("STS_DURATION", "")
+	if value == "" {
+		return nil
+	}
+	if stsDuration, err = time.ParseDuration(value); err != nil {
+		return fmt.Errorf("unable to parse STS_DURATION env; %v", err)
+	}
+	if stsDuration < minSTSDuration {
+		return fmt.Errorf("STS_DURATION env must be at least %v", minSTSDuration)
+	}
+	return nil
+}
+
+// uploadPolicy returns the session policy allowing the uploads under the prefix of the data bucket only
+func uploadPolicy(prefix string) (string, error) {
+	policy := map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []map[string]interface{}{
+			{
+				"Effect":   "Allow",
+				"Action":   []string{"s3:PutObject", "s3:AbortMultipartUpload", "s3:ListMultipartUploadParts"},
+				"Resource": []string{"arn:aws:s3:::" + dataBucket + "/" + prefix + "*"},
+			},
+		},
+	}
+	data, err := json.Marshal(policy)
+	return string(data), err
+}
+
+// vendCredentials mints the credentials of the user on the upload site through the MinIO STS,
+// scoped to DATE/USER/ of today, if the user is under their quota
+func vendCredentials(ctx context.Context, user string) (*uploadCredentials, error) {
+	if err := validateUserName(user); err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(user, policyChars) {
+		return nil, fmt.Errorf("%w '%v'; contains any of '%v'", errInvalidUser, user, policyChars)
+	}
+	if err := checkQuota(ctx, user); err != nil {
+		if !errors.Is(err, errMaxLimitExceeded) || !isMonitored(user) {
+			return nil, err
+		}
+	}
+	site := uploadSite()
+	prefix := getCurrentDateInUTC().Format(dateFormat) + "/" + user + "/"
+	policy, err := uploadPolicy(prefix)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := credentials.NewSTSAssumeRole(site.endpoint, credentials.STSAssumeRoleOptions{
+		AccessKey:       site.accessKey,
+		SecretKey:       site.secretKey,
+		Policy:          policy,
+		DurationSeconds: int(stsDuration.Seconds()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the expiry is reported by the STS response, which the credentials do not expose
+	expiration := time.Now().UTC().Add(stsDuration)
+	value, err := creds.Get()
+	if err != nil {
+		logf(ctx, "ERROR", site.name, "unable to assume role for user '%v'; %v", user, err)
+		return nil, fmt.Errorf("unable to vend credentials; %v", err)
+	}
+	logf(ctx, "LOG", site.name, "vended credentials for '%v' until %v", prefix, expiration.Format(time.RFC3339))
+	return &uploadCredentials{
+		AccessKey:    value.AccessKeyID,
+		SecretKey:    value.SecretAccessKey,
+		SessionToken: value.SessionToken,
+		Expiration:   expiration,
+		Endpoint:     site.endpoint,
+		Bucket:       dataBucket,
+		Prefix:       prefix,
+	}, nil
+}
+
+// POST /my/credentials
+//
+//   - Authenticates the user by their user token or ID token
+//   - Checks the quota of the user
+//   - Returns short-lived credentials of the MinIO STS allowing the uploads under DATE/USER/ of
+//     today in the data bucket only
+//   - Returns 400 if the user name would widen the session policy, and 403 if the user is over
+//     the limit or blocked
+func credentialsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	creds, err := vendCredentials(ctx, userFromContext(ctx))
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidUser):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, errMaxLimitExceeded), errors.Is(err, errUserBlocked):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(creds)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCredentialsRejectPolicyWildcards(t *testing.T) {
+	setupTestSites(t, 1)
+	for _, user := range []string{"user*", "user?", "${aws:username}", "usera/b"} {
+		r := httptest.NewRequest(http.MethodPost, "/my/credentials", nil)
+		r = r.WithContext(withUser(r.Context(), user))
+		w := httptest.NewRecorder()
+		credentialsHandler(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("user '%v': expected %v, got %v; %v", user, http.StatusBadRequest, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/pkg/sync/errgroup"
+)
+
+// Merge adds the objects of the other quota which are missing in the quota
+func (quota *UserQuota) Merge(other *UserQuota) (updated bool) {
+	for object, entry := range other.Objects {
+		if _, ok := quota.Objects[object]; !ok {
+			quota.Objects[object] = entry
+			updated = true
+		}
+	}
+	return
+}
+
+// listUsers lists the users having a quota on any of the configured sites
+func listUsers(ctx context.Context) (map[string]struct{}, error) {
+	users := map[string]struct{}{}
+	for _, site := range sites {
+		if site.Client() == nil {
+			return nil, errors.New("s3Client is nil")
+		}
+		for object := range site.Client().ListObjects(ctx, quotaBucket, minio.ListObjectsOptions{}) {
+			if object.Err != nil {
+				logf(ctx, "ERROR", site.name, "unable to list objects from '%v' bucket; %v", quotaBucket, object.Err)
+				return nil, fmt.Errorf("unable to list objects; %v", object.Err)
+			}
+			if !strings.HasSuffix(object.Key, quotaExt) {
+				continue
+			}
+			users[strings.TrimSuffix(object.Key, quotaExt)] = struct{}{}
+		}
+	}
+	return users, nil
+}
+
+// syncQuota merges the user quotas across all the configured sites, so that every
+// targeted site holds the union of the objects
+func syncQuota(ctx context.Context, targets siteTargets) error {
+	users, err := listUsers(ctx)
+	if err != nil {
+		return err
+	}
+	var failed int
+	for user := range users {
+		err = defaultRetry.do(ctx, func() error {
+			err := syncUserQuota(ctx, user, targets)
+			if err != nil {
+				logf(ctx, "ERROR", "", "unable to sync quota for user '%v'; %v", user, err)
+			}
+			return err
+		})
+		if err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("unable to sync quota for %v out of %v users", failed, len(users))
+	}
+	return nil
+}
+
+// syncUserQuota reads the user quota from all the sites and writes back the union
+// to the sites which are missing any objects
+func syncUserQuota(ctx context.Context, user string, targets siteTargets) error {
+	quotas := make([]*UserQuota, len(sites))
+	etags := make([]string, len(sites))
+	g := errgroup.WithNErrs(len(sites))
+	for index := range sites {
+		index := index
+		g.Go(func() error {
+			if sites[index].Client() == nil {
+				return errors.New("s3Client is nil")
+			}
+			userQuota, etag, err := readUserQuota(ctx, sites[index].Client(), user)
+			if err != nil {
+				if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+					return nil
+				}
+				return fmt.Errorf("unable to read user quota from '%v'; %v", sites[index].name, err)
+			}
+			quotas[index], etags[index] = userQuota, etag
+			return nil
+		}, index)
+	}
+	if err := g.WaitErr(); err != nil {
+		return err
+	}
+
+	var merged *UserQuota
+	refreshed := make([]bool, len(sites))
+	for index, userQuota := range quotas {
+		if userQuota == nil {
+			continue
+		}
+		refreshed[index] = userQuota.Refresh()
+		if merged == nil {
+			merged = NewUserQuota()
+			merged.MaxLimit = userQuota.MaxLimit
+		}
+		merged.Merge(userQuota)
+	}
+	if merged == nil {
+		return nil
+	}
+
+	g = errgroup.WithNErrs(len(sites))
+	for index := range sites {
+		index := index
+		g.Go(func() error {
+			if !targets.includes(sites[index]) {
+				// read for the union, but not written
+				return nil
+			}
+			userQuota := quotas[index]
+			if userQuota == nil {
+				userQuota = NewUserQuota()
+				userQuota.MaxLimit = merged.MaxLimit
+			}
+			if !userQuota.Merge(merged) && !refreshed[index] {
+				return nil
+			}
+			if targets.isDry(sites[index]) {
+				logf(ctx, "LOG", sites[index].name, "[dry-run] would sync quota for user '%v' to %v objects", user, len(userQuota.Objects))
+				return nil
+			}
+			if err := updateUserQuota(ctx, sites[index].Client(), user, userQuota, etags[index]); err != nil {
+				return fmt.Errorf("unable to update user quota on '%v'; %v", sites[index].name, err)
+			}
+			invalidateManifest(sites[index], user)
+			logf(ctx, "LOG", sites[index].name, "synced quota for user '%v'", user)
+			return nil
+		}, index)
+	}
+	return g.WaitErr()
+}
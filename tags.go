@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/minio/minio-go/v7/pkg/tags"
+	"github.com/minio/pkg/env"
+)
+
+// taggingKey is the metadata of the events carrying the tags of the object, if any
+const taggingKey = "X-Amz-Tagging"
+
+// countTags are the tags, any of which makes an object count towards the quota; all the
+// objects count if empty
+var countTags map[string][]string
+
+// loadCountTags reads the tag rules of COUNT_TAGS, e.g. type=voicemail,type=greeting
+func loadCountTags() error {
+	rules := parseList(env.Get("COUNT_TAGS", ""))
+	if len(rules) == 0 {
+		return nil
+	}
+	countTags = map[string][]string{}
+	for _, rule := range rules {
+		key, value, ok := strings.Cut(rule, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("COUNT_TAGS env must be a list of key=value; invalid '%v'", rule)
+		}
+		countTags[key] = append(countTags[key], value)
+	}
+	return nil
+}
+
+// matchCountTags returns true if the object has any of the tags of COUNT_TAGS; the tags are
+// taken from the event, or fetched from the sites if the event does not carry them
+func matchCountTags(ctx context.Context, qe *quotaEvent) (bool, error) {
+	objectTags, err := eventTags(qe)
+	if err != nil {
+		return false, err
+	}
+	if objectTags == nil {
+		if objectTags, err = fetchTags(ctx, qe.Path); err != nil {
+			return false, err
+		}
+	}
+	for key, values := range countTags {
+		value, ok := objectTags[key]
+		if !ok {
+			continue
+		}
+		for _, v := range values {
+			if v == value {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// eventTags returns the tags in the metadata of the event; nil if the event does not carry them
+func eventTags(qe *quotaEvent) (map[string]string, error) {
+	for k, v := range qe.Metadata {
+		if !strings.EqualFold(k, taggingKey) {
+			continue
+		}
+		t, err := tags.Parse(v, true)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse the tags '%v' of '%v'; %v", v, qe.Path, err)
+		}
+		return t.ToMap(), nil
+	}
+	return nil, nil
+}
+
+// fetchTags GETs the tags of the object from the first site having it
+func fetchTags(ctx context.Context, path string) (map[string]string, error) {
+	lastErr := errors.New("no site supports object tagging")
+	for _, site := range readOrder() {
+		core := site.Core()
+		if core == nil {
+			continue
+		}
+		t, err := core.Client.GetObjectTagging(ctx, dataBucket, path, minio.GetObjectTaggingOptions{})
+		if err == nil {
+			return t.ToMap(), nil
+		}
+		logf(ctx, "WARNING", site.name, "unable to get the tags of '%v'; %v", path, err)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// tagOverLimit tags the object going over the limit with OVER_LIMIT_TAG on the site it was
+// uploaded to, and alerts, so that the downstream workflows decide what to do with it
+func tagOverLimit(ctx context.Context, event notification.Event, qe *quotaEvent) {
+	key, value, _ := strings.Cut(overLimitTag, "=")
+	targets := readOrder()
+	if origin := findSite(eventOrigin(event)); origin != nil {
+		targets = []*site{origin}
+	}
+	var (
+		tagged string
+		err    error
+	)
+	for _, site := range targets {
+		if err = tagObject(ctx, site, qe.Path, key, value); err == nil {
+			tagged = site.name
+			break
+		}
+		logf(ctx, "WARNING", site.name, "unable to tag '%v' going over the limit; %v", qe.Path, err)
+	}
+	message := fmt.Sprintf("user %v went over the limit with %v; tagged %v", qe.User, qe.Path, overLimitTag)
+	if tagged == "" {
+		message = fmt.Sprintf("user %v went over the limit with %v; unable to tag it; %v", qe.User, qe.Path, err)
+	}
+	logf(ctx, "WARNING", tagged, "%v", message)
+	sendAlert(ctx, alert{
+		Type:    "over_limit_tagged",
+		User:    qe.User,
+		Site:    tagged,
+		Message: message,
+	})
+}
+
+// tagObject adds the tag to the object on the site, keeping its other tags
+func tagObject(ctx context.Context, site *site, path, key, value string) error {
+	core := site.Core()
+	if core == nil {
+		return errors.New("the site does not support object tagging")
+	}
+	t, err := core.Client.GetObjectTagging(ctx, dataBucket, path, minio.GetObjectTaggingOptions{})
+	if err != nil {
+		return err
+	}
+	if err := t.Set(key, value); err != nil {
+		return err
+	}
+	return core.Client.PutObjectTagging(ctx, dataBucket, path, t, minio.PutObjectTaggingOptions{})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// siteTargets selects the sites an admin operation runs on, and the ones it only runs dry on,
+// to validate it on a newly added site first; the zero value runs on all the sites
+type siteTargets struct {
+	// sites are the targeted sites; all if nil
+	sites map[string]bool
+	// dry are the sites the operation only logs its changes on
+	dry map[string]bool
+}
+
+// allSites runs the operation on all the sites
+var allSites = siteTargets{}
+
+// parseSiteTargets reads the comma separated sites to target and to run dry on from the site
+// and dryRun query params of the request
+func parseSiteTargets(r *http.Request) (siteTargets, error) {
+	var targets siteTargets
+	query := r.URL.Query()
+	for key, set := range map[string]*map[string]bool{"site": &targets.sites, "dryRun": &targets.dry} {
+		for _, name := range parseList(query.Get(key)) {
+			if findSite(name) == nil {
+				return targets, fmt.Errorf("site %v in %v is not configured", name, key)
+			}
+			if *set == nil {
+				*set = map[string]bool{}
+			}
+			(*set)[name] = true
+		}
+	}
+	return targets, nil
+}
+
+// includes returns true if the operation runs on the site
+func (t siteTargets) includes(s *site) bool {
+	return t.sites == nil || t.sites[s.name]
+}
+
+// isDry returns true if the operation only logs its changes on the site
+func (t siteTargets) isDry(s *site) bool {
+	return t.dry[s.name]
+}
+
+// userFilter selects the users an admin operation runs on, so that it does not list every
+// user quota; the zero value runs on all the users
+type userFilter struct {
+	// prefix is the prefix of the names of the users
+	prefix string
+	// users are the users; all if nil
+	users []string
+}
+
+// parseUserFilter reads the prefix of the users and the comma separated users to run on from
+// the prefix and users query params of the request
+func parseUserFilter(r *http.Request) (userFilter, error) {
+	query := r.URL.Query()
+	filter := userFilter{prefix: query.Get("prefix")}
+	if filter.prefix != "" {
+		filter.prefix = canonicalUser(filter.prefix)
+	}
+	for _, user := range parseList(query.Get("users")) {
+		user = canonicalUser(user)
+		if err := validateUserName(user); err != nil {
+			return filter, err
+		}
+		filter.users = append(filter.users, user)
+	}
+	if filter.prefix != "" && filter.users != nil {
+		return filter, errors.New("prefix and users cannot be combined")
+	}
+	sort.Strings(filter.users)
+	return filter, nil
+}
+
+// isZero returns true if the filter selects all the users
+func (f userFilter) isZero() bool {
+	return f.prefix == "" && f.users == nil
+}
+
+// listQuotas lists the user quotas selected by the filter in the quota bucket; the users of
+// the filter are returned without listing, whether they have a quota or not
+func (f userFilter) listQuotas(ctx context.Context, s3Client ObjectStore, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	if f.users == nil {
+		opts.Prefix = f.prefix
+		return s3Client.ListObjects(ctx, quotaBucket, opts)
+	}
+	ch := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(ch)
+		for _, user := range f.users {
+			select {
+			case ch <- minio.ObjectInfo{Key: user + quotaExt}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,8 @@
+//go:build !dev
+
+package main
+
+import "github.com/gorilla/mux"
+
+// registerClockRoutes registers nothing; the clock is traveled by the dev builds only
+func registerClockRoutes(router *mux.Router) {}
@@ -0,0 +1,144 @@
+//go:build dev
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var travel = &travelClock{}
+
+func init() {
+	clock = travel
+}
+
+// travelClock is the system clock shifted by an offset, or frozen at a time, so that the
+// integration tests can cross the daily rollover without waiting for the midnight UTC
+type travelClock struct {
+	mu     sync.RWMutex
+	offset time.Duration
+	frozen *time.Time
+}
+
+// Now returns the frozen time, or the current time of the system shifted by the offset
+func (c *travelClock) Now() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.frozen != nil {
+		return *c.frozen
+	}
+	return time.Now().Add(c.offset)
+}
+
+// clockState is the state of the clock as answered by GET /admin/clock
+type clockState struct {
+	Now    time.Time `json:"now"`
+	Frozen bool      `json:"frozen"`
+	Offset string    `json:"offset,omitempty"`
+}
+
+// clockChange is the body of PUT /admin/clock
+type clockChange struct {
+	// Time sets the clock to the time
+	Time *time.Time `json:"time,omitempty"`
+	// Advance moves the clock forward, or backward if negative, by the duration
+	Advance string `json:"advance,omitempty"`
+	// Frozen stops the clock at its time, or lets it run again if false
+	Frozen *bool `json:"frozen,omitempty"`
+}
+
+func (c *travelClock) state() clockState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.frozen != nil {
+		return clockState{Now: c.frozen.UTC(), Frozen: true}
+	}
+	return clockState{Now: time.Now().Add(c.offset).UTC(), Offset: c.offset.String()}
+}
+
+// change sets, advances and freezes the clock, in that order
+func (c *travelClock) change(change clockChange, advance time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	current := now.Add(c.offset)
+	if c.frozen != nil {
+		current = *c.frozen
+	}
+	if change.Time != nil {
+		current = *change.Time
+	}
+	current = current.Add(advance)
+	frozen := c.frozen != nil
+	if change.Frozen != nil {
+		frozen = *change.Frozen
+	}
+	if frozen {
+		c.frozen, c.offset = &current, 0
+		return
+	}
+	c.frozen, c.offset = nil, current.Sub(now)
+}
+
+// reset returns the clock to the system clock
+func (c *travelClock) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.frozen, c.offset = nil, 0
+}
+
+// registerClockRoutes registers the endpoints to freeze and advance the clock
+func registerClockRoutes(router *mux.Router) {
+	router.Handle("/admin/clock", adminAuth(http.HandlerFunc(clockHandler))).Methods("GET")
+	router.Handle("/admin/clock", adminAuth(http.HandlerFunc(travelClockHandler))).Methods("PUT")
+	router.Handle("/admin/clock", adminAuth(http.HandlerFunc(resetClockHandler))).Methods("DELETE")
+}
+
+// GET /admin/clock
+//
+// - Returns the time of the clock, and whether it is frozen or shifted from the system clock
+func clockHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(travel.state())
+}
+
+// PUT /admin/clock
+//
+// - Sets the clock to the time of the body, advances it by the duration of the body, and freezes
+// or lets it run again
+func travelClockHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	var change clockChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		http.Error(w, fmt.Sprintf("unable to parse the body; %v", err), http.StatusBadRequest)
+		return
+	}
+	var advance time.Duration
+	if change.Advance != "" {
+		var err error
+		if advance, err = time.ParseDuration(change.Advance); err != nil {
+			http.Error(w, fmt.Sprintf("invalid advance '%v'; %v", change.Advance, err), http.StatusBadRequest)
+			return
+		}
+	}
+	travel.change(change, advance)
+	state := travel.state()
+	logf(ctx, "WARNING", "", "traveled the clock to %v; frozen: %v", state.Now.Format(time.RFC3339), state.Frozen)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// DELETE /admin/clock
+//
+// - Returns the clock to the system clock
+func resetClockHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	travel.reset()
+	logf(ctx, "LOG", "", "reset the clock to the system clock")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/minio/pkg/env"
+)
+
+// transportConfig represents the tuning of the transport of a site,
+// zero values keep the minio-go defaults
+type transportConfig struct {
+	site string
+
+	dialTimeout           time.Duration
+	keepAlive             time.Duration
+	responseHeaderTimeout time.Duration
+	tlsHandshakeTimeout   time.Duration
+	maxIdleConns          int
+	// proxy overrides the HTTP_PROXY/HTTPS_PROXY/NO_PROXY envs for the site,
+	// "off" disables proxying
+	proxy   *url.URL
+	noProxy bool
+}
+
+// getSiteEnv reads the site specific env, falling back to the global env
+func getSiteEnv(key, targetName, defaultValue string) string {
+	return env.Get(key+"_"+targetName, env.Get(key, defaultValue))
+}
+
+// loadTransportConfig reads the transport tuning of the site from the envs
+func loadTransportConfig(targetName string) (tc transportConfig, err error) {
+	tc.site = targetName
+	durations := []struct {
+		key   string
+		value *time.Duration
+	}{
+		{"MINIO_DIAL_TIMEOUT", &tc.dialTimeout},
+		{"MINIO_KEEPALIVE", &tc.keepAlive},
+		{"MINIO_RESPONSE_HEADER_TIMEOUT", &tc.responseHeaderTimeout},
+		{"MINIO_TLS_HANDSHAKE_TIMEOUT", &tc.tlsHandshakeTimeout},
+	}
+	for _, d := range durations {
+		value := getSiteEnv(d.key, targetName, "")
+		if value == "" {
+			continue
+		}
+		if *d.value, err = time.ParseDuration(value); err != nil {
+			return tc, fmt.Errorf("invalid %v %v; %v", d.key, value, err)
+		}
+	}
+	if value := getSiteEnv("MINIO_MAX_IDLE_CONNS", targetName, ""); value != "" {
+		if tc.maxIdleConns, err = strconv.Atoi(value); err != nil {
+			return tc, fmt.Errorf("invalid MINIO_MAX_IDLE_CONNS %v; %v", value, err)
+		}
+	}
+	switch value := getSiteEnv("MINIO_PROXY", targetName, ""); value {
+	case "":
+	case "off":
+		tc.noProxy = true
+	default:
+		if tc.proxy, err = url.Parse(value); err != nil {
+			return tc, fmt.Errorf("invalid MINIO_PROXY %v; %v", value, err)
+		}
+	}
+	return tc, nil
+}
+
+// apply applies the tuning to the transport
+func (tc transportConfig) apply(transport *http.Transport) {
+	if tc.dialTimeout > 0 || tc.keepAlive > 0 {
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}
+		if tc.dialTimeout > 0 {
+			dialer.Timeout = tc.dialTimeout
+		}
+		if tc.keepAlive > 0 {
+			dialer.KeepAlive = tc.keepAlive
+		}
+		transport.DialContext = dialer.DialContext
+	}
+	if tc.responseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = tc.responseHeaderTimeout
+	}
+	if tc.tlsHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = tc.tlsHandshakeTimeout
+	}
+	switch {
+	case tc.noProxy:
+		transport.Proxy = nil
+	case tc.proxy != nil:
+		transport.Proxy = http.ProxyURL(tc.proxy)
+	default:
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+	if tc.maxIdleConns > 0 {
+		transport.MaxIdleConns = tc.maxIdleConns
+		transport.MaxIdleConnsPerHost = tc.maxIdleConns
+	}
+}
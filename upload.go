@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/pkg/env"
+)
+
+// uploadProxy serves PUT /upload/{name} for the user of the credentials, enforcing the quota before
+// the objects are written
+var uploadProxy = env.Get("UPLOAD_PROXY", "off") == "on"
+
+// uploadResult represents an object uploaded through the server
+type uploadResult struct {
+	Path string `json:"path"`
+	Site string `json:"site"`
+	Size int64  `json:"size"`
+	ETag string `json:"etag"`
+}
+
+// uploadSite returns the site the uploads are written to; the PRIMARY_SITE, or the first configured site
+func uploadSite() *site {
+	if s := findSite(primarySite); s != nil {
+		return s
+	}
+	return sites[0]
+}
+
+// uploadObject writes the object of the user to the data bucket under DATE/USER/name on the upload
+// site and counts it in the quota of the user on all the sites. The object is removed again if
+// it could not be counted, so that no object escapes the quota.
+func uploadObject(ctx context.Context, user, name string, r *http.Request) (*uploadResult, error) {
+	if err := checkQuota(ctx, user); err != nil {
+		if !errors.Is(err, errMaxLimitExceeded) || !isMonitored(user) {
+			return nil, err
+		}
+	}
+	site := uploadSite()
+	if site.Client() == nil {
+		return nil, errors.New("s3Client is nil")
+	}
+	now := clock.Now().UTC()
+	date := getCurrentDateInUTC()
+	path := date.Format(dateFormat) + "/" + user + "/" + name
+	info, err := site.Client().PutObject(ctx, dataBucket, path, r.Body, r.ContentLength, minio.PutObjectOptions{
+		ContentType: r.Header.Get("Content-Type"),
+	})
+	if err != nil {
+		logf(ctx, "ERROR", site.name, "unable to upload '%v/%v'; %v", dataBucket, path, err)
+		return nil, fmt.Errorf("unable to upload the object; %v", err)
+	}
+	qe := &quotaEvent{
+		Name: "s3:ObjectCreated:Put",
+		Time: now,
+		Path: path,
+		Date: date,
+		User: user,
+		Size: info.Size,
+		ETag: info.ETag,
+	}
+	if err := updateQuota(ctx, qe); err != nil && !errors.Is(err, errOverLimitMonitored) {
+		// raced with another upload of the user, or the quota could not be written
+		if rerr := defaultRetry.do(ctx, func() error {
+			return site.Client().RemoveObject(ctx, dataBucket, path, minio.RemoveObjectOptions{})
+		}); rerr != nil {
+			logf(ctx, "ERROR", site.name, "unable to remove the uncounted upload '%v/%v'; %v", dataBucket, path, rerr)
+		}
+		return nil, err
+	}
+	logf(ctx, "LOG", site.name, "uploaded '%v' of %v bytes for user '%v'", path, info.Size, user)
+	return &uploadResult{
+		Path: path,
+		Site: site.name,
+		Size: info.Size,
+		ETag: info.ETag,
+	}, nil
+}
+
+// PUT /upload/{name}
+//
+//   - Authenticates the user by their user token or ID token
+//   - Checks the quota of the user
+//   - Streams the body to the data bucket under DATE/USER/name on the primary site
+//   - Counts the object in the quota of the user on all the sites, removing it again if that fails
+//   - Returns 403 if the user is over the limit or blocked, and 429 if the user is rate limited
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	user, name := userFromContext(ctx), mux.Vars(r)["name"]
+	if err := validateUserName(user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if name == "" || strings.HasPrefix(name, ".") {
+		http.Error(w, fmt.Sprintf("invalid object name '%v'", name), http.StatusBadRequest)
+		return
+	}
+	if userRateLimiter != nil && !userRateLimiter.allow(user) {
+		w.Header().Set("Retry-After", strconv.Itoa(userRateLimiter.retryAfter()))
+		http.Error(w, errRateLimited.Error(), http.StatusTooManyRequests)
+		return
+	}
+	result, err := uploadObject(ctx, user, name, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, errMaxLimitExceeded), errors.Is(err, errUserBlocked):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// dayUsage represents the usage of a user on a day
+type dayUsage struct {
+	Date     string `json:"date"`
+	Objects  int    `json:"objects"`
+	Bytes    int64  `json:"bytes"`
+	Rejected int    `json:"rejected,omitempty"`
+}
+
+// quotaUsage represents the usage of a user, broken down by day
+type quotaUsage struct {
+	User     string     `json:"user"`
+	Site     string     `json:"site,omitempty"`
+	Objects  int        `json:"objects"`
+	Bytes    int64      `json:"bytes"`
+	Limit    int        `json:"limit"`
+	Rejected int        `json:"rejected,omitempty"`
+	Reserved int        `json:"reserved,omitempty"`
+	Days     []dayUsage `json:"days"`
+}
+
+// Usage sums the objects, the bytes and the rejected updates of the quota per day, sorted by date
+func (quota *UserQuota) Usage() (objects int, bytes int64, days []dayUsage) {
+	usage := map[time.Time]*dayUsage{}
+	for object, entry := range quota.Objects {
+		pathDate, err := time.Parse(dateFormat, strings.Split(object, "/")[0])
+		if err != nil {
+			continue
+		}
+		date := entry.date(pathDate)
+		day, ok := usage[date]
+		if !ok {
+			day = &dayUsage{Date: date.Format(dateFormat)}
+			usage[date] = day
+		}
+		day.Objects++
+		day.Bytes += entry.Size
+		objects++
+		bytes += entry.Size
+	}
+	for value, count := range quota.Rejections {
+		date, err := time.Parse(dateFormat, value)
+		if err != nil {
+			continue
+		}
+		day, ok := usage[date]
+		if !ok {
+			day = &dayUsage{Date: value}
+			usage[date] = day
+		}
+		day.Rejected += count
+	}
+	dates := make([]time.Time, 0, len(usage))
+	for date := range usage {
+		dates = append(dates, date)
+	}
+	sort.Slice(dates, func(i, j int) bool {
+		return dates[i].Before(dates[j])
+	})
+	days = make([]dayUsage, 0, len(dates))
+	for _, date := range dates {
+		days = append(days, *usage[date])
+	}
+	return
+}
+
+// readUsage reads the usage of the user from one site picked by the read preference,
+// falling back to the other sites if it fails
+func readUsage(ctx context.Context, user string) (usage *quotaUsage, err error) {
+	for _, site := range readOrder() {
+		usage, err = readSiteUsage(ctx, site, user)
+		if err == nil {
+			return usage, nil
+		}
+		logf(ctx, "WARNING", site.name, "unable to read usage for user '%v'; trying the next site; %v", user, err)
+	}
+	return nil, err
+}
+
+// readSiteUsage reads the usage of the user on the provided site
+func readSiteUsage(ctx context.Context, site *site, user string) (*quotaUsage, error) {
+	if site.Client() == nil {
+		return nil, errors.New("s3Client is nil")
+	}
+	userQuota, _, err := readUserQuota(ctx, site.Client(), user)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			return nil, fmt.Errorf("unable to GET user quota; %v", err)
+		}
+		// new user
+		userQuota = NewUserQuota()
+	}
+	rejections.merge(site.name, user, userQuota)
+	userQuota.Refresh()
+	usage := &quotaUsage{
+		User:     user,
+		Site:     site.name,
+		Limit:    effectiveLimit(ctx, user, userQuota),
+		Reserved: userQuota.held(),
+	}
+	usage.Objects, usage.Bytes, usage.Days = userQuota.Usage()
+	for _, day := range usage.Days {
+		usage.Rejected += day.Rejected
+	}
+	return usage, nil
+}
+
+// usedPercent returns the percent of the limit used by the user
+func (usage *quotaUsage) usedPercent() float64 {
+	if usage.Limit <= 0 {
+		if usage.Objects == 0 {
+			return 0
+		}
+		return 100
+	}
+	return float64(usage.Objects) * 100 / float64(usage.Limit)
+}
+
+// listUsage reads the usage of all the users from one site picked by the read preference,
+// falling back to the other sites if it fails
+func listUsage(ctx context.Context) (usages []*quotaUsage, err error) {
+	for _, site := range readOrder() {
+		usages, err = listSiteUsage(ctx, site)
+		if err == nil {
+			return usages, nil
+		}
+		logf(ctx, "WARNING", site.name, "unable to list usage; trying the next site; %v", err)
+	}
+	return nil, err
+}
+
+// listSiteUsage reads the usage of all the users having a quota on the provided site
+func listSiteUsage(ctx context.Context, site *site) ([]*quotaUsage, error) {
+	if site.Client() == nil {
+		return nil, errors.New("s3Client is nil")
+	}
+	var usages []*quotaUsage
+	for object := range site.Client().ListObjects(ctx, quotaBucket, minio.ListObjectsOptions{}) {
+		if object.Err != nil {
+			logf(ctx, "ERROR", site.name, "unable to list objects from '%v' bucket; %v", quotaBucket, object.Err)
+			return nil, fmt.Errorf("unable to list objects; %v", object.Err)
+		}
+		if !strings.HasSuffix(object.Key, quotaExt) {
+			continue
+		}
+		usage, err := readSiteUsage(ctx, site, strings.TrimSuffix(object.Key, quotaExt))
+		if err != nil {
+			return nil, err
+		}
+		usages = append(usages, usage)
+	}
+	return usages, nil
+}
+
+// usageBucket represents the number of users whose usage falls in the range of the percent of their limit
+type usageBucket struct {
+	Range string `json:"range"`
+	Users int    `json:"users"`
+}
+
+// usageStats represents the distribution of the users by the percent of their limit used
+type usageStats struct {
+	Users     int           `json:"users"`
+	Objects   int           `json:"objects"`
+	Bytes     int64         `json:"bytes"`
+	Histogram []usageBucket `json:"histogram"`
+}
+
+// getUsageStats buckets the users by the percent of their limit used
+func getUsageStats(usages []*quotaUsage) usageStats {
+	stats := usageStats{
+		Users: len(usages),
+		Histogram: []usageBucket{
+			{Range: "0-25"},
+			{Range: "25-50"},
+			{Range: "50-75"},
+			{Range: "75-100"},
+			{Range: ">100"},
+		},
+	}
+	for _, usage := range usages {
+		stats.Objects += usage.Objects
+		stats.Bytes += usage.Bytes
+		switch percent := usage.usedPercent(); {
+		case percent < 25:
+			stats.Histogram[0].Users++
+		case percent < 50:
+			stats.Histogram[1].Users++
+		case percent < 75:
+			stats.Histogram[2].Users++
+		case percent <= 100:
+			stats.Histogram[3].Users++
+		default:
+			stats.Histogram[4].Users++
+		}
+	}
+	return stats
+}
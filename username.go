@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/pkg/env"
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	// userNamePattern is the regular expression the whole user name must match; any if nil
+	userNamePattern *regexp.Regexp
+	// userNameMaxLength is the max length of a user name in bytes
+	userNameMaxLength = 255
+	// userNameDenyChars are the characters a user name must not contain
+	userNameDenyChars = ""
+
+	// userNameCaseInsensitive lowercases the user names, so that Alice and alice share a quota
+	userNameCaseInsensitive = env.Get("USER_NAME_CASE_INSENSITIVE", "off") == "on"
+	// userNameNormalization is the unicode normal form of the user names; kept as is if nil
+	userNameNormalization *norm.Form
+
+	errInvalidUser = errors.New("invalid user")
+)
+
+// loadUserNameRules reads the USER_NAME_PATTERN, USER_NAME_MAX_LENGTH and USER_NAME_DENY_CHARS envs
+func loadUserNameRules() (err error) {
+	if pattern := env.Get("USER_NAME_PATTERN", ""); pattern != "" {
+		if userNamePattern, err = regexp.Compile("^(?:" + pattern + ")$"); err != nil {
+			return fmt.Errorf("invalid USER_NAME_PATTERN %v; %v", pattern, err)
+		}
+	}
+	if userNameMaxLength, err = env.GetInt("USER_NAME_MAX_LENGTH", userNameMaxLength); err != nil {
+		return fmt.Errorf("unable to read USER_NAME_MAX_LENGTH env; %v", err)
+	}
+	if userNameMaxLength <= 0 {
+		return errors.New("USER_NAME_MAX_LENGTH env must be greater than 0")
+	}
+	userNameDenyChars = env.Get("USER_NAME_DENY_CHARS", userNameDenyChars)
+	switch value := env.Get("USER_NAME_NORMALIZATION", ""); value {
+	case "":
+	case "NFC":
+		form := norm.NFC
+		userNameNormalization = &form
+	case "NFKC":
+		form := norm.NFKC
+		userNameNormalization = &form
+	default:
+		return fmt.Errorf("invalid USER_NAME_NORMALIZATION %v; must be NFC or NFKC", value)
+	}
+	return nil
+}
+
+// canonicalUsers returns true if the user names are canonicalized
+func canonicalUsers() bool {
+	return userNameCaseInsensitive || userNameNormalization != nil
+}
+
+// canonicalUser returns the canonical form of the user name the quota is kept under, normalized
+// by USER_NAME_NORMALIZATION and lowercased by USER_NAME_CASE_INSENSITIVE
+func canonicalUser(user string) string {
+	if userNameNormalization != nil {
+		user = userNameNormalization.String(user)
+	}
+	if userNameCaseInsensitive {
+		user = strings.ToLower(user)
+	}
+	return user
+}
+
+// canonicalUserVars canonicalizes the user of the routes having one
+func canonicalUserVars(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if vars := mux.Vars(r); vars["user"] != "" {
+			vars["user"] = canonicalUser(vars["user"])
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// validateUserName validates the user component of an object path, so that the malformed paths
+// do not create the quotas of bogus users; "." and ".." are never valid
+func validateUserName(user string) error {
+	switch {
+	case user == "" || user == "." || user == "..":
+		return fmt.Errorf("%w '%v'", errInvalidUser, user)
+	case len(user) > userNameMaxLength:
+		return fmt.Errorf("%w '%.32v...'; longer than %v bytes", errInvalidUser, user, userNameMaxLength)
+	case userNameDenyChars != "" && strings.ContainsAny(user, userNameDenyChars):
+		return fmt.Errorf("%w '%v'; contains any of '%v'", errInvalidUser, user, userNameDenyChars)
+	case userNamePattern != nil && !userNamePattern.MatchString(user):
+		return fmt.Errorf("%w '%v'; does not match %v", errInvalidUser, user, userNamePattern)
+	}
+	return nil
+}
+
+// userNameMigration gates the merge of the non-canonical user quotas on startup, which removes them
+var userNameMigration = newFeatureFlag("user-name-migration", "Merge the user quotas kept under a non-canonical name into the quota of their canonical name on startup, removing them", true)
+
+// migrateUserNames merges the user quotas kept under a non-canonical name, written before the
+// user names were canonicalized, into the quota of their canonical name on every site, and
+// removes them; a quota failing to merge is left to the next start
+func migrateUserNames(ctx context.Context) {
+	if !canonicalUsers() || !userNameMigration.enabled() {
+		return
+	}
+	for _, site := range sites {
+		s3Client := site.Client()
+		if s3Client == nil {
+			continue
+		}
+		for object := range s3Client.ListObjects(ctx, quotaBucket, minio.ListObjectsOptions{}) {
+			if object.Err != nil {
+				logf(ctx, "WARNING", site.name, "unable to list the user quotas to canonicalize; %v", object.Err)
+				break
+			}
+			if !strings.HasSuffix(object.Key, quotaExt) {
+				continue
+			}
+			user := strings.TrimSuffix(object.Key, quotaExt)
+			canonical := canonicalUser(user)
+			if canonical == user {
+				continue
+			}
+			if err := defaultRetry.do(ctx, func() error {
+				return migrateUserName(ctx, s3Client, user, canonical)
+			}); err != nil {
+				logf(ctx, "WARNING", site.name, "unable to merge the quota of user '%v' into '%v'; %v", user, canonical, err)
+				continue
+			}
+			invalidateManifest(site, canonical)
+			logf(ctx, "LOG", site.name, "merged the quota of user '%v' into '%v'", user, canonical)
+		}
+	}
+}
+
+// migrateUserName merges the quota of the user into the quota of its canonical name, and removes it
+func migrateUserName(ctx context.Context, s3Client ObjectStore, user, canonical string) error {
+	userQuota, _, err := readUserQuota(ctx, s3Client, user)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			// already merged
+			return nil
+		}
+		return fmt.Errorf("unable to GET user quota; %v", err)
+	}
+	if len(userQuota.Objects) > 0 {
+		if err := adjustLatestUserQuota(ctx, s3Client, canonical, userQuota.Objects, nil); err != nil {
+			return err
+		}
+	}
+	return s3Client.RemoveObject(ctx, quotaBucket, user+quotaExt, minio.RemoveObjectOptions{})
+}
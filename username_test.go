@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestMigrateUserNames(t *testing.T) {
+	setupTestSites(t, 1)
+	ctx := context.Background()
+	for _, user := range []string{"Alice", "alice"} {
+		if err := processEvent(ctx, testEvent("s3:ObjectCreated:Put", user, "a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	userNameCaseInsensitive = true
+	t.Cleanup(func() { userNameCaseInsensitive = false })
+	s3Client := sites[0].Client()
+	userQuota, _, err := readUserQuota(ctx, s3Client, "Alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userQuota.Objects) != 1 {
+		t.Fatalf("expected the objects of 'Alice' to be kept when read by their own name, got %v", userQuota.Objects)
+	}
+
+	migrateUserNames(ctx)
+	if _, _, err := readUserQuota(ctx, s3Client, "Alice"); minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		t.Fatalf("expected the quota of 'Alice' to be removed, got %v", err)
+	}
+	userQuota, _, err = readUserQuota(ctx, s3Client, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userQuota.Objects) != 2 {
+		t.Fatalf("expected the objects of 'Alice' and 'alice' merged, got %v", userQuota.Objects)
+	}
+}